@@ -0,0 +1,306 @@
+// Package auth issues and verifies the JWTs that every motown HTTP service
+// accepts. Keys come from configuration and are named by kid, so a new key
+// can take over signing while the old one still verifies the tokens it
+// issued until they expire.
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	DefaultIssuer     = "motown"
+	DefaultAudience   = "motown-api"
+	DefaultTTL        = 15 * time.Minute
+	DefaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNoKeys       = errors.New("no signing keys configured")
+	ErrNoToken      = errors.New("no bearer token")
+	ErrInvalidToken = errors.New("invalid token")
+)
+
+// Claims are what a motown token says about its bearer
+type Claims struct {
+	jwt.StandardClaims
+	Role    string `json:"role,omitempty"`
+	Vehicle string `json:"vehicle,omitempty"`
+	Sacco   string `json:"sacco,omitempty"`
+	// Session is the sign in the token was issued for, so signing out ends
+	// it. Tokens issued by hand have none.
+	Session string `json:"sid,omitempty"`
+}
+
+// Identity is who a token is issued to
+type Identity struct {
+	Subject string
+	Role    string
+	Vehicle string // the vehicle a conductor works
+	Sacco   string // the SACCO a SACCO admin runs
+}
+
+func (who Identity) validate() error {
+	switch {
+	case who.Subject == "":
+		return fmt.Errorf("tokens need a subject")
+	case who.Role != RoleRider && who.Role != RoleConductor && who.Role != RoleSaccoAdmin && who.Role != RoleAdmin:
+		return fmt.Errorf("role %q is not one of %s, %s, %s or %s", who.Role, RoleRider, RoleConductor, RoleSaccoAdmin, RoleAdmin)
+	case who.Role == RoleConductor && who.Vehicle == "":
+		return fmt.Errorf("conductors need a vehicle")
+	case who.Role == RoleSaccoAdmin && who.Sacco == "":
+		return fmt.Errorf("SACCO admins need a SACCO")
+	}
+	return nil
+}
+
+// Config sets who tokens are issued by and for, and the keys they are
+// signed with
+type Config struct {
+	Issuer     string
+	Audience   string
+	TTL        time.Duration // lifetime of access tokens
+	RefreshTTL time.Duration // lifetime of refresh tokens
+	SigningKey string        // kid to sign with; the first key able to sign if empty
+	Keys       []*Key
+	// Refresh keeps refresh tokens; in memory, for one instance, if nil
+	Refresh RefreshStore
+	// Revocations are checked on every Verify; nothing is revoked if nil
+	Revocations *RevocationList
+}
+
+// LoadConfig reads the configuration from settings looked up by name:
+//
+//	AUTH_ISSUER       token issuer, "motown" if unset
+//	AUTH_AUDIENCE     token audience, "motown-api" if unset
+//	AUTH_TOKEN_TTL    lifetime of access tokens, 15m if unset
+//	AUTH_REFRESH_TTL  lifetime of refresh tokens, 720h if unset
+//	AUTH_KEYS         kid:ALG:path,... (see ParseKeys)
+//	AUTH_SIGNING_KEY  kid of the key to sign with
+//	JWT_SECRET        an HS256 secret, used as key "default" without AUTH_KEYS
+func LoadConfig(lookup func(string) string) (Config, error) {
+	config := Config{
+		Issuer:     lookup("AUTH_ISSUER"),
+		Audience:   lookup("AUTH_AUDIENCE"),
+		SigningKey: lookup("AUTH_SIGNING_KEY"),
+	}
+	if ttl := lookup("AUTH_TOKEN_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return config, fmt.Errorf("AUTH_TOKEN_TTL must be a positive duration, e.g. 1h")
+		}
+		config.TTL = d
+	}
+	if ttl := lookup("AUTH_REFRESH_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return config, fmt.Errorf("AUTH_REFRESH_TTL must be a positive duration, e.g. 720h")
+		}
+		config.RefreshTTL = d
+	}
+
+	keys, err := ParseKeys(lookup("AUTH_KEYS"))
+	if err != nil {
+		return config, err
+	}
+	if len(keys) == 0 {
+		if secret := lookup("JWT_SECRET"); secret != "" {
+			key, err := NewKey("default", HS256, []byte(secret))
+			if err != nil {
+				return config, fmt.Errorf("JWT_SECRET: %w", err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return config, fmt.Errorf("%w: set AUTH_KEYS or JWT_SECRET", ErrNoKeys)
+	}
+	config.Keys = keys
+	return config, nil
+}
+
+// Service issues and verifies tokens
+type Service struct {
+	config  Config
+	keys    map[string]*Key
+	signing *Key
+	mu      sync.RWMutex
+}
+
+func NewService(config Config) (*Service, error) {
+	if config.Issuer == "" {
+		config.Issuer = DefaultIssuer
+	}
+	if config.Audience == "" {
+		config.Audience = DefaultAudience
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultTTL
+	}
+	if config.RefreshTTL <= 0 {
+		config.RefreshTTL = DefaultRefreshTTL
+	}
+	if config.Refresh == nil {
+		config.Refresh = NewMemoryRefreshStore()
+	}
+
+	s := &Service{config: config, keys: make(map[string]*Key)}
+	for _, key := range config.Keys {
+		if _, exists := s.keys[key.ID]; exists {
+			return nil, fmt.Errorf("two keys have kid %q", key.ID)
+		}
+		s.keys[key.ID] = key
+		if s.signing == nil && config.SigningKey == "" && key.CanSign() {
+			s.signing = key
+		}
+	}
+	if config.SigningKey != "" {
+		s.signing = s.keys[config.SigningKey]
+		if s.signing == nil {
+			return nil, fmt.Errorf("signing key %q is not among the keys", config.SigningKey)
+		}
+		if !s.signing.CanSign() {
+			return nil, fmt.Errorf("signing key %q has no private half", config.SigningKey)
+		}
+	}
+	if s.signing == nil {
+		return nil, fmt.Errorf("%w: none of the keys can sign", ErrNoKeys)
+	}
+	return s, nil
+}
+
+// Issuer is who the service's tokens are issued by
+func (s *Service) Issuer() string {
+	return s.config.Issuer
+}
+
+// Audience is who the service's tokens are issued for
+func (s *Service) Audience() string {
+	return s.config.Audience
+}
+
+// Issue signs a token for who, lasting ttl or the configured TTL if ttl is
+// zero
+func (s *Service) Issue(who Identity, ttl time.Duration) (string, *Claims, error) {
+	if ttl <= 0 {
+		ttl = s.config.TTL
+	}
+	return s.issue(who, ttl, "")
+}
+
+func (s *Service) issue(who Identity, ttl time.Duration, session string) (string, *Claims, error) {
+	if err := who.validate(); err != nil {
+		return "", nil, err
+	}
+	id, err := tokenID()
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.mu.RLock()
+	key := s.signing
+	s.mu.RUnlock()
+
+	now := time.Now()
+	claims := &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			Subject:   who.Subject,
+			Issuer:    s.config.Issuer,
+			Audience:  s.config.Audience,
+			IssuedAt:  now.Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
+		Role:    who.Role,
+		Vehicle: who.Vehicle,
+		Sacco:   who.Sacco,
+		Session: session,
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.private)
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
+}
+
+// Verify checks an access token's signature against the key named by its
+// kid, its expiry, issuer and audience, and that it hasn't been revoked
+func (s *Service) Verify(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		s.mu.RLock()
+		key, exists := s.keys[kid]
+		s.mu.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+		// Never let the token pick the algorithm, or an RS256 public key
+		// could be passed off as an HS256 secret
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("key %s is for %s, not %v", kid, key.Algorithm, token.Header["alg"])
+		}
+		return key.public, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if !claims.VerifyIssuer(s.config.Issuer, true) {
+		return nil, fmt.Errorf("%w: issued by %q, not %q", ErrInvalidToken, claims.Issuer, s.config.Issuer)
+	}
+	if !claims.VerifyAudience(s.config.Audience, true) {
+		return nil, fmt.Errorf("%w: meant for %q, not %q", ErrInvalidToken, claims.Audience, s.config.Audience)
+	}
+	if claims.Subject == "" || claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("%w: no subject or expiry", ErrInvalidToken)
+	}
+	if s.config.Revocations != nil && s.config.Revocations.Revoked(claims) {
+		return nil, fmt.Errorf("%w: revoked", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// Rotate adds a key and signs with it from now on. Keys signed with before
+// still verify until retired.
+func (s *Service) Rotate(key *Key) error {
+	if !key.CanSign() {
+		return fmt.Errorf("key %s has no private half", key.ID)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.keys[key.ID]; exists {
+		return fmt.Errorf("kid %q is already in use", key.ID)
+	}
+	s.keys[key.ID] = key
+	s.signing = key
+	return nil
+}
+
+// Retire drops a key, so the tokens it signed no longer verify
+func (s *Service) Retire(kid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.signing.ID == kid {
+		return fmt.Errorf("key %s is signing; rotate to another first", kid)
+	}
+	delete(s.keys, kid)
+	return nil
+}
+
+func tokenID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
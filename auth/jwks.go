@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+)
+
+// JWKSPath is where services publish their JWKS
+const JWKSPath = "/.well-known/jwks.json"
+
+// JWK is a public key in JSON Web Key form
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"` // RSA modulus
+	E         string `json:"e,omitempty"` // RSA exponent
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at JWKSPath
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public keys tokens are verified with. HS256 secrets are
+// shared, not public, so they are never listed.
+func (s *Service) JWKS() JWKSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range s.keys {
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = encodeInt(public.N, 0)
+			jwk.E = encodeInt(big.NewInt(int64(public.E)), 0)
+		case *ecdsa.PublicKey:
+			size := (public.Curve.Params().BitSize + 7) / 8
+			jwk.KeyType = "EC"
+			jwk.Curve = public.Curve.Params().Name
+			jwk.X = encodeInt(public.X, size)
+			jwk.Y = encodeInt(public.Y, size)
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].KeyID < set.Keys[j].KeyID })
+	return set
+}
+
+// JWKSHandler serves the JWKS
+func (s *Service) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(s.JWKS())
+	})
+}
+
+// Key turns a JWK back into a key that verifies
+func (jwk JWK) Key() (*Key, error) {
+	key := &Key{ID: jwk.KeyID, Algorithm: jwk.Algorithm}
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: bad modulus: %w", jwk.KeyID, err)
+		}
+		e, err := decodeInt(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("key %s: bad exponent", jwk.KeyID)
+		}
+		if n.BitLen() < minRSABits {
+			return nil, fmt.Errorf("key %s: RSA keys need at least %d bits", jwk.KeyID, minRSABits)
+		}
+		key.public = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if key.Algorithm == "" {
+			key.Algorithm = RS256
+		}
+		if key.Algorithm != RS256 {
+			return nil, fmt.Errorf("key %s: RSA keys are for RS256, not %q", jwk.KeyID, key.Algorithm)
+		}
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return nil, fmt.Errorf("key %s: curve %q is not supported", jwk.KeyID, jwk.Curve)
+		}
+		x, errX := decodeInt(jwk.X)
+		y, errY := decodeInt(jwk.Y)
+		if errX != nil || errY != nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("key %s: not a point on P-256", jwk.KeyID)
+		}
+		key.public = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if key.Algorithm == "" {
+			key.Algorithm = ES256
+		}
+		if key.Algorithm != ES256 {
+			return nil, fmt.Errorf("key %s: P-256 keys are for ES256, not %q", jwk.KeyID, key.Algorithm)
+		}
+	default:
+		return nil, fmt.Errorf("key %s: key type %q is not supported", jwk.KeyID, jwk.KeyType)
+	}
+	return key, nil
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// encodeInt is base64url of a big-endian integer, left padded to size bytes
+func encodeInt(n *big.Int, size int) string {
+	raw := n.Bytes()
+	if len(raw) < size {
+		raw = append(make([]byte, size-len(raw)), raw...)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Signing algorithms
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	HS256 = "HS256"
+)
+
+const (
+	minRSABits       = 2048
+	minSecretBytes   = 32
+	generatedRSABits = 3072
+)
+
+// Key is a signing key named by its kid. RS256 and ES256 keys loaded from a
+// public key only verify tokens, which is how a key is kept on after
+// rotation until the tokens it signed have expired.
+type Key struct {
+	ID        string
+	Algorithm string
+	private   interface{} // *rsa.PrivateKey, *ecdsa.PrivateKey or the HS256 secret
+	public    interface{} // *rsa.PublicKey, *ecdsa.PublicKey or the HS256 secret
+}
+
+// NewKey makes a key from PEM encoded RSA or EC keys, private or public, or
+// from an HS256 shared secret
+func NewKey(id, algorithm string, material []byte) (*Key, error) {
+	if id == "" {
+		return nil, fmt.Errorf("key has no id")
+	}
+	key := &Key{ID: id, Algorithm: strings.ToUpper(algorithm)}
+
+	switch key.Algorithm {
+	case RS256:
+		if private, err := jwt.ParseRSAPrivateKeyFromPEM(material); err == nil {
+			key.private, key.public = private, &private.PublicKey
+		} else if public, err := jwt.ParseRSAPublicKeyFromPEM(material); err == nil {
+			key.public = public
+		} else {
+			return nil, fmt.Errorf("key %s: not a PEM encoded RSA key", id)
+		}
+		if bits := key.public.(*rsa.PublicKey).N.BitLen(); bits < minRSABits {
+			return nil, fmt.Errorf("key %s: RSA keys need at least %d bits, not %d", id, minRSABits, bits)
+		}
+
+	case ES256:
+		if private, err := jwt.ParseECPrivateKeyFromPEM(material); err == nil {
+			key.private, key.public = private, &private.PublicKey
+		} else if public, err := jwt.ParseECPublicKeyFromPEM(material); err == nil {
+			key.public = public
+		} else {
+			return nil, fmt.Errorf("key %s: not a PEM encoded EC key", id)
+		}
+		if curve := key.public.(*ecdsa.PublicKey).Curve; curve != elliptic.P256() {
+			return nil, fmt.Errorf("key %s: ES256 needs a P-256 key, not %s", id, curve.Params().Name)
+		}
+
+	case HS256:
+		secret := []byte(strings.TrimSpace(string(material)))
+		if len(secret) < minSecretBytes {
+			return nil, fmt.Errorf("key %s: HS256 secrets need at least %d bytes", id, minSecretBytes)
+		}
+		key.private, key.public = secret, secret
+
+	default:
+		return nil, fmt.Errorf("key %s: unsupported algorithm %q (use RS256, ES256 or HS256)", id, algorithm)
+	}
+	return key, nil
+}
+
+// GenerateKey makes a new key for signing
+func GenerateKey(id, algorithm string) (*Key, error) {
+	key := &Key{ID: id, Algorithm: strings.ToUpper(algorithm)}
+	switch key.Algorithm {
+	case RS256:
+		private, err := rsa.GenerateKey(rand.Reader, generatedRSABits)
+		if err != nil {
+			return nil, err
+		}
+		key.private, key.public = private, &private.PublicKey
+	case ES256:
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		key.private, key.public = private, &private.PublicKey
+	case HS256:
+		raw := make([]byte, minSecretBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		secret := []byte(base64.RawURLEncoding.EncodeToString(raw))
+		key.private, key.public = secret, secret
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q (use RS256, ES256 or HS256)", algorithm)
+	}
+	return key, nil
+}
+
+// CanSign reports whether the key holds its private half
+func (k *Key) CanSign() bool {
+	return k.private != nil
+}
+
+// PrivatePEM encodes the key the way NewKey reads it back: PEM for RS256
+// and ES256, the secret itself for HS256
+func (k *Key) PrivatePEM() ([]byte, error) {
+	switch private := k.private.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(private)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case []byte:
+		return append(private[:len(private):len(private)], '\n'), nil
+	default:
+		return nil, fmt.Errorf("key %s has no private half", k.ID)
+	}
+}
+
+// PublicPEM encodes the public half of an RS256 or ES256 key, for keeping
+// a rotated key on to verify with
+func (k *Key) PublicPEM() ([]byte, error) {
+	switch k.public.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(k.public)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), nil
+	default:
+		return nil, fmt.Errorf("key %s is a shared secret and has no public half", k.ID)
+	}
+}
+
+func (k *Key) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+// ParseKeys reads a key list of the form "kid:ALG:path,kid:ALG:path". Each
+// file holds a PEM encoded key, or an HS256 secret.
+func ParseKeys(list string) ([]*Key, error) {
+	var keys []*Key
+	for _, spec := range strings.Split(list, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("key %q should be kid:ALG:path", spec)
+		}
+		material, err := os.ReadFile(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", parts[0], err)
+		}
+		key, err := NewKey(parts[0], parts[1], material)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
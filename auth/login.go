@@ -0,0 +1,393 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	loginTimeout    = 10 * time.Minute
+	maxPendingLogin = 10000
+	loginCookie     = "motown_login"
+)
+
+var ErrLoginFailed = errors.New("login failed")
+
+// ExternalIdentity is who a provider says signed in
+type ExternalIdentity struct {
+	Provider      string `json:"provider"` // OIDC issuer, or an OAuth1 provider's name
+	Subject       string `json:"subject"`
+	Name          string `json:"name,omitempty"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	Phone         string `json:"phone,omitempty"`
+	PhoneVerified bool   `json:"phone_verified,omitempty"`
+}
+
+// Key names the identity uniquely across providers
+func (e *ExternalIdentity) Key() string {
+	return e.Provider + "|" + e.Subject
+}
+
+// PendingLogin is what a login remembers while the user is away at the
+// provider
+type PendingLogin struct {
+	State  string // comes back on the callback, to find the login again
+	Secret string // never leaves the server: a PKCE verifier, an OAuth1 request secret
+	Nonce  string
+}
+
+// Provider is somewhere users sign in
+type Provider interface {
+	// Begin starts a login, returning where to send the user
+	Begin(ctx context.Context) (string, PendingLogin, error)
+	// StateParam is the callback parameter carrying PendingLogin.State
+	StateParam() string
+	// Complete finishes a login from the provider's callback
+	Complete(ctx context.Context, pending PendingLogin, callback url.Values) (*ExternalIdentity, error)
+}
+
+// Linker finds or makes the account an external identity belongs to
+type Linker interface {
+	Link(ctx context.Context, identity *ExternalIdentity) (Identity, error)
+}
+
+// LinkerFunc lets a function be a Linker
+type LinkerFunc func(ctx context.Context, identity *ExternalIdentity) (Identity, error)
+
+func (f LinkerFunc) Link(ctx context.Context, identity *ExternalIdentity) (Identity, error) {
+	return f(ctx, identity)
+}
+
+type pendingLogin struct {
+	PendingLogin
+	binding string // the cookie that ties the login to the browser that began it
+	expires time.Time
+}
+
+// Login signs users in through external providers, or by a code sent to
+// their phone, and hands them our own session tokens. It serves:
+//
+//	GET  /login/{provider}            send the user to the provider
+//	GET  /login/{provider}/callback   where the provider sends them back
+//	POST /login/phone                 text a code to a phone
+//	POST /login/phone/verify          sign in with the code
+//	POST /token/refresh               trade a refresh token for a new session
+//	POST /logout                      end the bearer's session
+//	POST /logout/all                  end all the bearer's sessions, everywhere
+type Login struct {
+	service   *Service
+	linker    Linker
+	providers map[string]Provider
+	otp       *OTP                     // phone login is off if nil
+	pending   map[string]*pendingLogin // by provider and state
+	mu        sync.Mutex
+}
+
+func NewLogin(service *Service, linker Linker) *Login {
+	return &Login{
+		service:   service,
+		linker:    linker,
+		providers: make(map[string]Provider),
+		pending:   make(map[string]*pendingLogin),
+	}
+}
+
+// AddProvider offers a provider under name, e.g. /login/google
+func (l *Login) AddProvider(name string, provider Provider) {
+	l.providers[name] = provider
+}
+
+// EnablePhone lets users sign in with codes sent by otp. Phone logins are
+// linked as identities of PhoneProvider with a verified phone.
+func (l *Login) EnablePhone(otp *OTP) {
+	l.otp = otp
+}
+
+func (l *Login) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch parts := strings.Split(path, "/"); {
+	case path == "token/refresh":
+		if r.Method != http.MethodPost {
+			loginError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use POST")
+			return
+		}
+		l.refresh(w, r)
+	case path == "logout" || path == "logout/all":
+		if r.Method != http.MethodPost {
+			loginError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use POST")
+			return
+		}
+		l.logout(w, r, path == "logout/all")
+	case (path == "login/"+PhoneProvider || path == "login/"+PhoneProvider+"/verify") && l.otp != nil:
+		if r.Method != http.MethodPost {
+			loginError(w, http.StatusMethodNotAllowed, "method_not_allowed", "use POST")
+			return
+		}
+		if len(parts) == 2 {
+			l.requestCode(w, r)
+		} else {
+			l.verifyCode(w, r)
+		}
+	case len(parts) == 2 && parts[0] == "login" && r.Method == http.MethodGet:
+		l.begin(w, r, parts[1])
+	case len(parts) == 3 && parts[0] == "login" && parts[2] == "callback" && r.Method == http.MethodGet:
+		l.complete(w, r, parts[1])
+	default:
+		loginError(w, http.StatusNotFound, "not_found", "no such endpoint: "+r.URL.Path)
+	}
+}
+
+func (l *Login) begin(w http.ResponseWriter, r *http.Request, name string) {
+	provider, ok := l.providers[name]
+	if !ok {
+		loginError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no login provider %q", name))
+		return
+	}
+
+	redirect, pending, err := provider.Begin(r.Context())
+	if err != nil {
+		log.Printf("Login with %s: %v", name, err)
+		loginError(w, http.StatusBadGateway, "provider_unavailable", "the login provider can't be reached")
+		return
+	}
+	binding, err := randomString(16)
+	if err != nil {
+		loginError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+
+	l.mu.Lock()
+	l.sweep(time.Now())
+	full := len(l.pending) >= maxPendingLogin
+	if !full {
+		l.pending[name+"|"+pending.State] = &pendingLogin{
+			PendingLogin: pending,
+			binding:      binding,
+			expires:      time.Now().Add(loginTimeout),
+		}
+	}
+	l.mu.Unlock()
+	if full {
+		loginError(w, http.StatusServiceUnavailable, "busy", "too many logins in progress; try again shortly")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookie,
+		Value:    binding,
+		Path:     "/login/" + name,
+		MaxAge:   int(loginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (l *Login) complete(w http.ResponseWriter, r *http.Request, name string) {
+	provider, ok := l.providers[name]
+	if !ok {
+		loginError(w, http.StatusNotFound, "not_found", fmt.Sprintf("no login provider %q", name))
+		return
+	}
+	query := r.URL.Query()
+	if reason := query.Get("error"); reason != "" {
+		loginError(w, http.StatusUnauthorized, "login_failed", "the provider turned the login down: "+reason)
+		return
+	}
+
+	// Each login can be completed once, and only by the browser that began it
+	key := name + "|" + query.Get(provider.StateParam())
+	l.mu.Lock()
+	pending := l.pending[key]
+	delete(l.pending, key)
+	l.mu.Unlock()
+	cookie, _ := r.Cookie(loginCookie)
+	if pending == nil || time.Now().After(pending.expires) || cookie == nil || cookie.Value != pending.binding {
+		loginError(w, http.StatusBadRequest, "invalid_state", "this login has expired or was begun elsewhere; start again")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookie, Path: "/login/" + name, MaxAge: -1})
+
+	external, err := provider.Complete(r.Context(), pending.PendingLogin, query)
+	if err != nil {
+		log.Printf("Login with %s: %v", name, err)
+		loginError(w, http.StatusUnauthorized, "login_failed", "the provider couldn't confirm who you are")
+		return
+	}
+	l.link(w, r, external)
+}
+
+// link finds the account a confirmed identity belongs to and signs it in
+func (l *Login) link(w http.ResponseWriter, r *http.Request, external *ExternalIdentity) {
+	who, err := l.linker.Link(r.Context(), external)
+	if errors.Is(err, ErrForbidden) {
+		loginError(w, http.StatusForbidden, "forbidden", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Linking %s: %v", external.Key(), err)
+		loginError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	l.issue(w, r, who)
+}
+
+func (l *Login) requestCode(w http.ResponseWriter, r *http.Request) {
+	params := postParams(w, r)
+	if params["phone"] == "" {
+		loginError(w, http.StatusBadRequest, "invalid_request", "phone is required")
+		return
+	}
+
+	err := l.otp.Request(r.Context(), params["phone"])
+	var throttled *ThrottledError
+	switch {
+	case errors.Is(err, ErrInvalidPhone):
+		loginError(w, http.StatusBadRequest, "invalid_phone", err.Error())
+		return
+	case errors.As(err, &throttled):
+		w.Header().Set("Retry-After", fmt.Sprint(int(throttled.RetryAfter.Seconds()+0.5)))
+		loginError(w, http.StatusTooManyRequests, "throttled", err.Error())
+		return
+	case err != nil:
+		log.Printf("Sending a login code: %v", err)
+		loginError(w, http.StatusBadGateway, "sms_unavailable", "the code couldn't be sent; try again shortly")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"sent": true, "expires_in": int(l.otp.config.TTL.Seconds())})
+}
+
+func (l *Login) verifyCode(w http.ResponseWriter, r *http.Request) {
+	params := postParams(w, r)
+	if params["phone"] == "" || params["code"] == "" {
+		loginError(w, http.StatusBadRequest, "invalid_request", "phone and code are required")
+		return
+	}
+
+	phone, err := l.otp.Verify(params["phone"], params["code"])
+	if errors.Is(err, ErrInvalidPhone) {
+		loginError(w, http.StatusBadRequest, "invalid_phone", err.Error())
+		return
+	}
+	if err != nil {
+		loginError(w, http.StatusUnauthorized, "invalid_code", err.Error())
+		return
+	}
+	l.link(w, r, &ExternalIdentity{Provider: PhoneProvider, Subject: phone, Phone: phone, PhoneVerified: true})
+}
+
+func (l *Login) refresh(w http.ResponseWriter, r *http.Request) {
+	refreshToken := postParams(w, r)["refresh_token"]
+	if refreshToken == "" {
+		loginError(w, http.StatusBadRequest, "invalid_request", "refresh_token is required")
+		return
+	}
+
+	session, err := l.service.Refresh(r.Context(), refreshToken)
+	if errors.Is(err, ErrInvalidToken) {
+		loginError(w, http.StatusUnauthorized, "invalid_grant", err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("Refreshing a session: %v", err)
+		loginError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeSession(w, session)
+}
+
+func (l *Login) logout(w http.ResponseWriter, r *http.Request, everywhere bool) {
+	claims, err := l.service.Authenticate(r)
+	if err != nil {
+		Unauthorized(w, err)
+		return
+	}
+	if everywhere {
+		// The subject's revocation misses tokens issued in the second it
+		// is made in, so the bearer's own session is ended by itself too
+		if err = l.service.Logout(r.Context(), claims); err == nil {
+			err = l.service.LogoutAll(r.Context(), claims.Subject)
+		}
+	} else {
+		err = l.service.Logout(r.Context(), claims)
+	}
+	if err != nil {
+		log.Printf("Signing %s out: %v", claims.Subject, err)
+		loginError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (l *Login) issue(w http.ResponseWriter, r *http.Request, who Identity) {
+	session, err := l.service.IssueSession(r.Context(), who)
+	if err != nil {
+		log.Printf("Issuing a session for %s: %v", who.Subject, err)
+		loginError(w, http.StatusInternalServerError, "internal", "internal error")
+		return
+	}
+	writeSession(w, session)
+}
+
+// sweep drops logins that were never completed
+func (l *Login) sweep(now time.Time) {
+	for key, pending := range l.pending {
+		if now.After(pending.expires) {
+			delete(l.pending, key)
+		}
+	}
+}
+
+// postParams reads a POST body sent as JSON or as a form
+func postParams(w http.ResponseWriter, r *http.Request) map[string]string {
+	r.Body = http.MaxBytesReader(w, r.Body, 8<<10)
+	params := make(map[string]string)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		json.NewDecoder(r.Body).Decode(&params)
+		return params
+	}
+	r.ParseForm()
+	for name := range r.PostForm {
+		params[name] = r.PostForm.Get(name)
+	}
+	return params
+}
+
+func writeSession(w http.ResponseWriter, session *Session) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(session)
+}
+
+func loginError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": code, "message": message},
+	})
+}
+
+func randomString(bytes int) (string, error) {
+	raw := make([]byte, bytes)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type claimsKey struct{}
+
+// WithClaims returns a context carrying a token's claims
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// ClaimsFrom returns the claims of the token a request was authenticated
+// with
+func ClaimsFrom(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// Authenticate verifies the bearer token of a request. Browsers can't set
+// headers on WebSocket or EventSource requests, so those may pass the
+// token in the access_token query parameter instead.
+func (s *Service) Authenticate(r *http.Request) (*Claims, error) {
+	var token string
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, value, _ := strings.Cut(header, " ")
+		if !strings.EqualFold(scheme, "Bearer") {
+			return nil, errors.New("authorization must be a bearer token")
+		}
+		token = strings.TrimSpace(value)
+	} else if streaming(r) {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	return s.Verify(token)
+}
+
+func streaming(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// Middleware lets through requests with a valid token, putting its claims
+// in the request context, and turns the rest away with 401
+func (s *Service) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := s.Authenticate(r)
+		if err != nil {
+			Unauthorized(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
+
+// Unauthorized answers a request that failed authentication, in the error
+// format of the motown APIs
+func Unauthorized(w http.ResponseWriter, err error) {
+	challenge := `Bearer realm="motown"`
+	message := "a bearer token is required"
+	if !errors.Is(err, ErrNoToken) {
+		challenge += `, error="invalid_token"`
+		message = err.Error()
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": "unauthorized", "message": message},
+	})
+}
@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// MockUser is who the mock IdP signs everyone in as
+type MockUser struct {
+	Subject       string
+	Name          string
+	Email         string
+	EmailVerified bool
+	Phone         string
+	PhoneVerified bool
+}
+
+// MockIdP is a local OpenID Connect provider for trying and testing logins
+// without a real one. It serves discovery, JWKS, an authorization endpoint
+// that approves at once as the current MockUser, and a token endpoint that
+// checks the code, client, redirect URI and PKCE verifier the way a real
+// provider does.
+type MockIdP struct {
+	server       *httptest.Server
+	key          *Key
+	clientID     string
+	clientSecret string
+	mu           sync.Mutex
+	user         MockUser
+	codes        map[string]*mockGrant
+}
+
+type mockGrant struct {
+	clientID    string
+	redirectURI string
+	challenge   string
+	nonce       string
+	expires     time.Time
+}
+
+// NewMockIdP starts a mock provider that knows one client. An empty secret
+// makes it a public client.
+func NewMockIdP(clientID, clientSecret string) (*MockIdP, error) {
+	key, err := GenerateKey("mock-idp", RS256)
+	if err != nil {
+		return nil, err
+	}
+	m := &MockIdP{
+		key:          key,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		user:         MockUser{Subject: "mock-user", Name: "Mock User", Email: "mock.user@example.com", EmailVerified: true},
+		codes:        make(map[string]*mockGrant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, m.handleDiscovery)
+	mux.HandleFunc("/authorize", m.handleAuthorize)
+	mux.HandleFunc("/token", m.handleToken)
+	mux.Handle("/jwks", m.jwksHandler())
+	m.server = httptest.NewServer(mux)
+	return m, nil
+}
+
+// Issuer is the issuer URL to give OIDCConfig
+func (m *MockIdP) Issuer() string {
+	return m.server.URL
+}
+
+// SetUser changes who the mock signs in as
+func (m *MockIdP) SetUser(user MockUser) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.user = user
+}
+
+// Close shuts the mock down
+func (m *MockIdP) Close() {
+	m.server.Close()
+}
+
+func (m *MockIdP) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeMockJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                m.Issuer(),
+		"authorization_endpoint":                m.Issuer() + "/authorize",
+		"token_endpoint":                        m.Issuer() + "/token",
+		"jwks_uri":                              m.Issuer() + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{RS256},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (m *MockIdP) jwksHandler() http.Handler {
+	// A Service is the simplest way to publish the key
+	service, _ := NewService(Config{Keys: []*Key{m.key}})
+	return service.JWKSHandler()
+}
+
+// handleAuthorize approves the login and sends the user back with a code
+func (m *MockIdP) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("client_id") != m.clientID:
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	case query.Get("response_type") != "code":
+		http.Error(w, "only the code flow is supported", http.StatusBadRequest)
+		return
+	case query.Get("code_challenge") == "" || query.Get("code_challenge_method") != "S256":
+		http.Error(w, "an S256 code_challenge is required", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code, err := randomString(16)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.mu.Lock()
+	m.codes[code] = &mockGrant{
+		clientID:    m.clientID,
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		expires:     time.Now().Add(time.Minute),
+	}
+	m.mu.Unlock()
+
+	back := redirect.Query()
+	back.Set("code", code)
+	back.Set("state", query.Get("state"))
+	redirect.RawQuery = back.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+// handleToken trades a code for an ID token
+func (m *MockIdP) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		mockTokenError(w, "invalid_request", err.Error())
+		return
+	}
+	clientID, clientSecret, basic := r.BasicAuth()
+	if basic {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientID = r.PostForm.Get("client_id")
+	}
+	if clientID != m.clientID || clientSecret != m.clientSecret {
+		mockTokenError(w, "invalid_client", "unknown client or wrong secret")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		mockTokenError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+
+	// Codes are good once
+	code := r.PostForm.Get("code")
+	m.mu.Lock()
+	grant := m.codes[code]
+	delete(m.codes, code)
+	user := m.user
+	m.mu.Unlock()
+	switch {
+	case grant == nil || time.Now().After(grant.expires):
+		mockTokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	case grant.redirectURI != r.PostForm.Get("redirect_uri"):
+		mockTokenError(w, "invalid_grant", "redirect_uri does not match")
+		return
+	case pkceChallenge(r.PostForm.Get("code_verifier")) != grant.challenge:
+		mockTokenError(w, "invalid_grant", "code_verifier does not match the challenge")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":            m.Issuer(),
+		"sub":            user.Subject,
+		"aud":            grant.clientID,
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"name":           user.Name,
+		"email":          user.Email,
+		"email_verified": user.EmailVerified,
+	}
+	if grant.nonce != "" {
+		claims["nonce"] = grant.nonce
+	}
+	if user.Phone != "" {
+		claims["phone_number"] = user.Phone
+		claims["phone_number_verified"] = user.PhoneVerified
+	}
+	token := jwt.NewWithClaims(m.key.method(), claims)
+	token.Header["kid"] = m.key.ID
+	idToken, err := token.SignedString(m.key.private)
+	if err != nil {
+		mockTokenError(w, "server_error", err.Error())
+		return
+	}
+	accessToken, _ := randomString(16)
+	writeMockJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func mockTokenError(w http.ResponseWriter, code, description string) {
+	writeMockJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+func writeMockJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dghubble/oauth1"
+)
+
+// OAuth1Config names an OAuth 1.0a provider, for those that don't speak
+// OpenID Connect
+type OAuth1Config struct {
+	Name            string // identifies the provider in linked identities
+	ConsumerKey     string
+	ConsumerSecret  string
+	CallbackURL     string // our /login/{provider}/callback
+	RequestTokenURL string
+	AuthorizeURL    string
+	AccessTokenURL  string
+	// UserInfoURL answers, signed with the user's access token, a JSON
+	// object with their id (as "id" or "sub"), and optionally "name" and
+	// "email"
+	UserInfoURL string
+	HTTPClient  *http.Client
+}
+
+// LoadOAuth1Config reads an OAuth1 provider's configuration from settings
+// looked up by name, with prefix "OAUTH1" reading OAUTH1_NAME,
+// OAUTH1_CONSUMER_KEY, OAUTH1_CONSUMER_SECRET, OAUTH1_CALLBACK_URL,
+// OAUTH1_REQUEST_TOKEN_URL, OAUTH1_AUTHORIZE_URL, OAUTH1_ACCESS_TOKEN_URL
+// and OAUTH1_USERINFO_URL. It returns ok false if the consumer key is unset.
+func LoadOAuth1Config(prefix string, lookup func(string) string) (config OAuth1Config, ok bool, err error) {
+	config = OAuth1Config{
+		Name:            lookup(prefix + "_NAME"),
+		ConsumerKey:     lookup(prefix + "_CONSUMER_KEY"),
+		ConsumerSecret:  lookup(prefix + "_CONSUMER_SECRET"),
+		CallbackURL:     lookup(prefix + "_CALLBACK_URL"),
+		RequestTokenURL: lookup(prefix + "_REQUEST_TOKEN_URL"),
+		AuthorizeURL:    lookup(prefix + "_AUTHORIZE_URL"),
+		AccessTokenURL:  lookup(prefix + "_ACCESS_TOKEN_URL"),
+		UserInfoURL:     lookup(prefix + "_USERINFO_URL"),
+	}
+	if config.ConsumerKey == "" {
+		return config, false, nil
+	}
+	if config.Name == "" || config.ConsumerSecret == "" || config.CallbackURL == "" || config.RequestTokenURL == "" ||
+		config.AuthorizeURL == "" || config.AccessTokenURL == "" || config.UserInfoURL == "" {
+		return config, true, fmt.Errorf("%s_CONSUMER_KEY is set, so the rest of the %s_ settings must be too", prefix, prefix)
+	}
+	return config, true, nil
+}
+
+// OAuth1Provider signs users in through an OAuth 1.0a provider. OAuth1 has
+// no ID token, so who signed in is read from the provider's user info
+// endpoint with the access token the login earns.
+type OAuth1Provider struct {
+	name     string
+	config   *oauth1.Config
+	userInfo string
+}
+
+func NewOAuth1Provider(config OAuth1Config) (*OAuth1Provider, error) {
+	if config.Name == "" || config.UserInfoURL == "" {
+		return nil, fmt.Errorf("OAuth1 providers need a name and a user info URL")
+	}
+	return &OAuth1Provider{
+		name:     config.Name,
+		userInfo: config.UserInfoURL,
+		config: &oauth1.Config{
+			ConsumerKey:    config.ConsumerKey,
+			ConsumerSecret: config.ConsumerSecret,
+			CallbackURL:    config.CallbackURL,
+			Endpoint: oauth1.Endpoint{
+				RequestTokenURL: config.RequestTokenURL,
+				AuthorizeURL:    config.AuthorizeURL,
+				AccessTokenURL:  config.AccessTokenURL,
+			},
+			HTTPClient: config.HTTPClient,
+		},
+	}, nil
+}
+
+// StateParam is the request token, which the provider hands back on the
+// callback
+func (p *OAuth1Provider) StateParam() string {
+	return "oauth_token"
+}
+
+// Begin gets a request token and sends the user to authorize it
+func (p *OAuth1Provider) Begin(ctx context.Context) (string, PendingLogin, error) {
+	requestToken, requestSecret, err := p.config.RequestToken()
+	if err != nil {
+		return "", PendingLogin{}, err
+	}
+	authorize, err := p.config.AuthorizationURL(requestToken)
+	if err != nil {
+		return "", PendingLogin{}, err
+	}
+	return authorize.String(), PendingLogin{State: requestToken, Secret: requestSecret}, nil
+}
+
+// Complete trades the verified request token for an access token and asks
+// the provider who it belongs to
+func (p *OAuth1Provider) Complete(ctx context.Context, pending PendingLogin, callback url.Values) (*ExternalIdentity, error) {
+	verifier := callback.Get("oauth_verifier")
+	if verifier == "" {
+		return nil, fmt.Errorf("%w: the callback has no oauth_verifier", ErrLoginFailed)
+	}
+	accessToken, accessSecret, err := p.config.AccessToken(pending.State, pending.Secret, verifier)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLoginFailed, err)
+	}
+
+	if p.config.HTTPClient != nil {
+		ctx = context.WithValue(ctx, oauth1.HTTPClient, p.config.HTTPClient)
+	}
+	client := p.config.Client(ctx, oauth1.NewToken(accessToken, accessSecret))
+	resp, err := client.Get(p.userInfo)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fetching user info: %v", ErrLoginFailed, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: fetching user info: %s", ErrLoginFailed, resp.Status)
+	}
+
+	var info map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxProviderBody)).Decode(&info); err != nil {
+		return nil, fmt.Errorf("%w: reading user info: %v", ErrLoginFailed, err)
+	}
+	identity := &ExternalIdentity{Provider: p.name}
+	for _, field := range []string{"id_str", "id", "sub", "user_id"} {
+		if identity.Subject = userInfoString(info[field]); identity.Subject != "" {
+			break
+		}
+	}
+	identity.Name = userInfoString(info["name"])
+	identity.Email = userInfoString(info["email"])
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: the user info has no id", ErrLoginFailed)
+	}
+	return identity, nil
+}
+
+// userInfoString reads a string or a numeric id. Ids past 2^53 lose
+// precision as JSON numbers, which is why providers send id_str as well.
+func userInfoString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return fmt.Sprintf("%.0f", v)
+	default:
+		return ""
+	}
+}
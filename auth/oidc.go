@@ -0,0 +1,295 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	discoveryPath   = "/.well-known/openid-configuration"
+	jwksRefetchWait = time.Minute // least time between JWKS fetches for unknown kids
+	maxProviderBody = 1 << 20
+)
+
+// OIDCConfig names an OpenID Connect provider and our client registered
+// with it
+type OIDCConfig struct {
+	Issuer       string // discovery starts at Issuer + /.well-known/openid-configuration
+	ClientID     string
+	ClientSecret string // empty for public clients, which rely on PKCE alone
+	RedirectURL  string // our /login/{provider}/callback, as registered
+	Scopes       []string
+	HTTPClient   *http.Client
+}
+
+// LoadOIDCConfig reads an OIDC provider's configuration from settings looked
+// up by name, with prefix "OIDC" reading:
+//
+//	OIDC_ISSUER         the provider's issuer URL
+//	OIDC_CLIENT_ID      our client id
+//	OIDC_CLIENT_SECRET  our client secret, unset for a public client
+//	OIDC_REDIRECT_URL   where the provider sends users back
+//	OIDC_SCOPES         space separated, "openid profile email" if unset
+//
+// It returns ok false if the issuer is unset.
+func LoadOIDCConfig(prefix string, lookup func(string) string) (config OIDCConfig, ok bool, err error) {
+	config = OIDCConfig{
+		Issuer:       lookup(prefix + "_ISSUER"),
+		ClientID:     lookup(prefix + "_CLIENT_ID"),
+		ClientSecret: lookup(prefix + "_CLIENT_SECRET"),
+		RedirectURL:  lookup(prefix + "_REDIRECT_URL"),
+		Scopes:       strings.Fields(lookup(prefix + "_SCOPES")),
+	}
+	if config.Issuer == "" {
+		return config, false, nil
+	}
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return config, true, fmt.Errorf("%s_ISSUER is set, so %s_CLIENT_ID and %s_REDIRECT_URL must be too", prefix, prefix, prefix)
+	}
+	return config, true, nil
+}
+
+// OIDCProvider signs users in with the authorization code flow and PKCE,
+// and trusts who they are from the ID token it gets back
+type OIDCProvider struct {
+	config   OIDCConfig
+	metadata oidcMetadata
+	client   *http.Client
+	keys     map[string]*Key
+	fetched  time.Time
+	mu       sync.Mutex
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewOIDCProvider discovers the provider's endpoints
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+	if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC needs an issuer, a client id and a redirect URL")
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	p := &OIDCProvider{config: config, client: config.HTTPClient, keys: make(map[string]*Key)}
+	if p.client == nil {
+		p.client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if err := p.getJSON(ctx, strings.TrimSuffix(config.Issuer, "/")+discoveryPath, &p.metadata); err != nil {
+		return nil, fmt.Errorf("discovering %s: %w", config.Issuer, err)
+	}
+	// A provider can only speak for its own issuer, or one could mint
+	// identities for another
+	if p.metadata.Issuer != config.Issuer {
+		return nil, fmt.Errorf("discovering %s: the provider says it is %q", config.Issuer, p.metadata.Issuer)
+	}
+	if p.metadata.AuthorizationEndpoint == "" || p.metadata.TokenEndpoint == "" || p.metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("discovering %s: the provider's metadata is missing endpoints", config.Issuer)
+	}
+	return p, nil
+}
+
+func (p *OIDCProvider) StateParam() string {
+	return "state"
+}
+
+// Begin sends the user to the provider's authorization endpoint with a PKCE
+// challenge, keeping the verifier
+func (p *OIDCProvider) Begin(ctx context.Context) (string, PendingLogin, error) {
+	var pending PendingLogin
+	var err error
+	if pending.State, err = randomString(24); err != nil {
+		return "", pending, err
+	}
+	if pending.Nonce, err = randomString(24); err != nil {
+		return "", pending, err
+	}
+	if pending.Secret, err = randomString(32); err != nil {
+		return "", pending, err
+	}
+
+	authorize, err := url.Parse(p.metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", pending, err
+	}
+	query := authorize.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", pending.State)
+	query.Set("nonce", pending.Nonce)
+	query.Set("code_challenge", pkceChallenge(pending.Secret))
+	query.Set("code_challenge_method", "S256")
+	authorize.RawQuery = query.Encode()
+	return authorize.String(), pending, nil
+}
+
+// Complete trades the code for tokens and verifies the ID token
+func (p *OIDCProvider) Complete(ctx context.Context, pending PendingLogin, callback url.Values) (*ExternalIdentity, error) {
+	code := callback.Get("code")
+	if code == "" {
+		return nil, fmt.Errorf("%w: the callback has no code", ErrLoginFailed)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {pending.Secret},
+	}
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+		Detail  string `json:"error_description"`
+	}
+	if err := p.doJSON(req, &tokens); err != nil {
+		return nil, fmt.Errorf("%w: exchanging the code: %v", ErrLoginFailed, err)
+	}
+	if tokens.Error != "" {
+		return nil, fmt.Errorf("%w: exchanging the code: %s %s", ErrLoginFailed, tokens.Error, tokens.Detail)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: the provider sent no ID token", ErrLoginFailed)
+	}
+	return p.verifyIDToken(ctx, tokens.IDToken, pending.Nonce)
+}
+
+// verifyIDToken checks the ID token was signed by the provider for us, for
+// this login
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, idToken, nonce string) (*ExternalIdentity, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("key %s is for %s, not %v", kid, key.Algorithm, token.Header["alg"])
+		}
+		return key.public, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: ID token: %v", ErrLoginFailed, err)
+	}
+
+	switch {
+	case !claims.VerifyIssuer(p.config.Issuer, true):
+		return nil, fmt.Errorf("%w: ID token issued by %v", ErrLoginFailed, claims["iss"])
+	case !claims.VerifyAudience(p.config.ClientID, true):
+		return nil, fmt.Errorf("%w: ID token meant for %v", ErrLoginFailed, claims["aud"])
+	case !claims.VerifyExpiresAt(time.Now().Unix(), true):
+		return nil, fmt.Errorf("%w: ID token has no expiry or has expired", ErrLoginFailed)
+	case claims["nonce"] != nonce:
+		return nil, fmt.Errorf("%w: ID token is for another login", ErrLoginFailed)
+	}
+	// With several audiences, azp must say the token was issued to us
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientID {
+		return nil, fmt.Errorf("%w: ID token issued to %q", ErrLoginFailed, azp)
+	}
+
+	identity := &ExternalIdentity{Provider: p.config.Issuer}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Name, _ = claims["name"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.Phone, _ = claims["phone_number"].(string)
+	identity.PhoneVerified, _ = claims["phone_number_verified"].(bool)
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("%w: ID token has no subject", ErrLoginFailed)
+	}
+	return identity, nil
+}
+
+// key finds a provider key by kid, fetching the JWKS again when the
+// provider has rotated to a key we haven't seen
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*Key, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.fetched) < jwksRefetchWait {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var set JWKSet
+	if err := p.getJSON(ctx, p.metadata.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching the provider's keys: %w", err)
+	}
+	p.fetched = time.Now()
+	p.keys = make(map[string]*Key)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		// Skip keys we can't use rather than fail on them; a token signed
+		// with one is refused as an unknown key
+		if key, err := jwk.Key(); err == nil {
+			p.keys[key.ID] = key
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, into interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return p.doJSON(req, into)
+}
+
+// doJSON decodes the provider's answer. Token endpoints answer errors with
+// a JSON body too, so 400s are decoded rather than failed.
+func (p *OIDCProvider) doJSON(req *http.Request, into interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxProviderBody)).Decode(into)
+}
+
+// pkceChallenge is the S256 code challenge for a verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// authorizeAt follows a login to the mock IdP, which approves at once, and
+// returns the callback it sends the user back with
+func authorizeAt(t *testing.T, authorizeURL string) url.Values {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authorizeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize answered %s", resp.Status)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back.Query()
+}
+
+func newMockProvider(t *testing.T, clientSecret string) (*MockIdP, *OIDCProvider) {
+	t.Helper()
+	idp, err := NewMockIdP("motown-login", "idp-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:       idp.Issuer(),
+		ClientID:     "motown-login",
+		ClientSecret: clientSecret,
+		RedirectURL:  "http://motown.test/login/mock/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idp, provider
+}
+
+func TestOIDCBegin(t *testing.T) {
+	_, provider := newMockProvider(t, "idp-secret")
+	authorizeURL, pending, err := provider.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _ := url.Parse(authorizeURL)
+	params := query.Query()
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "motown-login",
+		"state":                 pending.State,
+		"nonce":                 pending.Nonce,
+		"code_challenge":        pkceChallenge(pending.Secret),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if params.Get(name) != value {
+			t.Errorf("%s = %q, want %q", name, params.Get(name), value)
+		}
+	}
+	if params.Get("code_verifier") != "" || params.Get("state") == params.Get("nonce") {
+		t.Errorf("authorize URL gives away the login's secrets: %s", authorizeURL)
+	}
+
+	_, again, _ := provider.Begin(context.Background())
+	if again.State == pending.State || again.Nonce == pending.Nonce || again.Secret == pending.Secret {
+		t.Error("two logins share state, nonce or verifier")
+	}
+}
+
+func TestOIDCComplete(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientSecret string
+		tamper       func(pending *PendingLogin, callback url.Values)
+		wantErr      bool
+	}{
+		{name: "signs in"},
+		{name: "wrong PKCE verifier", tamper: func(p *PendingLogin, _ url.Values) { p.Secret += "x" }, wantErr: true},
+		{name: "ID token for another login", tamper: func(p *PendingLogin, _ url.Values) { p.Nonce = "another-login" }, wantErr: true},
+		{name: "forged code", tamper: func(_ *PendingLogin, c url.Values) { c.Set("code", "forged") }, wantErr: true},
+		{name: "no code", tamper: func(_ *PendingLogin, c url.Values) { c.Del("code") }, wantErr: true},
+		{name: "wrong client secret", clientSecret: "guessed", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSecret := tt.clientSecret
+			if clientSecret == "" {
+				clientSecret = "idp-secret"
+			}
+			idp, provider := newMockProvider(t, clientSecret)
+			idp.SetUser(MockUser{Subject: "user-42", Name: "Wanjiku", Email: "wanjiku@example.com", EmailVerified: true, Phone: "+254712345678", PhoneVerified: true})
+
+			authorizeURL, pending, err := provider.Begin(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			callback := authorizeAt(t, authorizeURL)
+			if callback.Get("state") != pending.State {
+				t.Fatalf("state came back as %q, want %q", callback.Get("state"), pending.State)
+			}
+			if tt.tamper != nil {
+				tt.tamper(&pending, callback)
+			}
+
+			identity, err := provider.Complete(context.Background(), pending, callback)
+			if tt.wantErr {
+				if !errors.Is(err, ErrLoginFailed) {
+					t.Fatalf("Complete() error = %v, want ErrLoginFailed", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Complete() error = %v", err)
+			}
+			want := ExternalIdentity{Provider: idp.Issuer(), Subject: "user-42", Name: "Wanjiku", Email: "wanjiku@example.com", EmailVerified: true, Phone: "+254712345678", PhoneVerified: true}
+			if *identity != want {
+				t.Errorf("Complete() = %+v, want %+v", *identity, want)
+			}
+
+			// Codes are good once
+			if _, err := provider.Complete(context.Background(), pending, callback); !errors.Is(err, ErrLoginFailed) {
+				t.Errorf("second Complete() error = %v, want ErrLoginFailed", err)
+			}
+		})
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp, err := NewMockIdP("motown-login", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+	// The mock says it is idp.Issuer(), not this
+	_, err = NewOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:      idp.Issuer() + "/",
+		ClientID:    "motown-login",
+		RedirectURL: "http://motown.test/login/mock/callback",
+	})
+	if err == nil {
+		t.Error("NewOIDCProvider trusted a provider speaking for another issuer")
+	}
+}
+
+// TestLoginWithMockIdP runs the browser's side of a login through Login
+func TestLoginWithMockIdP(t *testing.T) {
+	key, err := GenerateKey("test", HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewService(Config{Keys: []*Key{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var linked []*ExternalIdentity
+	login := NewLogin(service, LinkerFunc(func(ctx context.Context, identity *ExternalIdentity) (Identity, error) {
+		linked = append(linked, identity)
+		return Identity{Subject: "person-1", Role: RoleRider}, nil
+	}))
+	server := httptest.NewServer(login)
+	defer server.Close()
+
+	idp, err := NewMockIdP("motown-login", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Issuer:      idp.Issuer(),
+		ClientID:    "motown-login",
+		RedirectURL: server.URL + "/login/mock/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login.AddProvider("mock", provider)
+
+	// begin starts a login in a browser of its own, stopping at the
+	// callback so it can be tampered with
+	begin := func() (*http.Client, *url.URL) {
+		jar, _ := cookiejar.New(nil)
+		browser := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Host == server.Listener.Addr().String() {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}}
+		resp, err := browser.Get(server.URL + "/login/mock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil || callback.Path != "/login/mock/callback" {
+			t.Fatalf("login did not come back to the callback: %s", resp.Header.Get("Location"))
+		}
+		return browser, callback
+	}
+	finish := func(browser *http.Client, callback *url.URL) (int, string) {
+		resp, err := browser.Get(callback.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			AccessToken string `json:"access_token"`
+			Error       struct {
+				Code string `json:"code"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body.AccessToken != "" {
+			claims, err := service.Verify(body.AccessToken)
+			if err != nil || claims.Subject != "person-1" {
+				t.Errorf("login issued %v, %v", claims, err)
+			}
+		}
+		return resp.StatusCode, body.Error.Code
+	}
+	withState := func(callback *url.URL, state string) *url.URL {
+		tampered := *callback
+		query := tampered.Query()
+		query.Set("state", state)
+		tampered.RawQuery = query.Encode()
+		return &tampered
+	}
+
+	t.Run("signs in", func(t *testing.T) {
+		browser, callback := begin()
+		if status, code := finish(browser, callback); status != http.StatusOK {
+			t.Fatalf("callback answered %d %s", status, code)
+		}
+		if len(linked) != 1 || linked[0].Subject != "mock-user" {
+			t.Errorf("linked %+v", linked)
+		}
+		// Each login completes once
+		if status, code := finish(browser, callback); status != http.StatusBadRequest || code != "invalid_state" {
+			t.Errorf("replayed callback answered %d %s", status, code)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		callback func(browser *http.Client, callback *url.URL) (*http.Client, *url.URL)
+		status   int
+		code     string
+	}{
+		{
+			name: "unknown state",
+			callback: func(browser *http.Client, callback *url.URL) (*http.Client, *url.URL) {
+				return browser, withState(callback, "forged")
+			},
+			status: http.StatusBadRequest, code: "invalid_state",
+		},
+		{
+			name: "another browser's callback",
+			callback: func(_ *http.Client, callback *url.URL) (*http.Client, *url.URL) {
+				return &http.Client{}, callback
+			},
+			status: http.StatusBadRequest, code: "invalid_state",
+		},
+		{
+			name: "another login's state",
+			callback: func(browser *http.Client, callback *url.URL) (*http.Client, *url.URL) {
+				_, other := begin()
+				return browser, withState(callback, other.Query().Get("state"))
+			},
+			status: http.StatusBadRequest, code: "invalid_state",
+		},
+		{
+			name: "turned down by the provider",
+			callback: func(browser *http.Client, callback *url.URL) (*http.Client, *url.URL) {
+				denied := *callback
+				denied.RawQuery = url.Values{"error": {"access_denied"}, "state": {callback.Query().Get("state")}}.Encode()
+				return browser, &denied
+			},
+			status: http.StatusUnauthorized, code: "login_failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			linked = nil
+			browser, callback := tt.callback(begin())
+			if status, code := finish(browser, callback); status != tt.status || code != tt.code {
+				t.Errorf("callback answered %d %s, want %d %s", status, code, tt.status, tt.code)
+			}
+			if len(linked) != 0 {
+				t.Errorf("linked %+v", linked)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PhoneProvider names phone logins in linked identities
+const PhoneProvider = "phone"
+
+const (
+	DefaultOTPLength      = 6
+	DefaultOTPTTL         = 5 * time.Minute
+	DefaultOTPAttempts    = 5
+	DefaultOTPResendAfter = time.Minute
+	DefaultOTPHourlySends = 5
+
+	maxOTPPhones = 100000
+)
+
+var (
+	ErrInvalidPhone = errors.New("not a Kenyan mobile number")
+	ErrOTPInvalid   = errors.New("wrong or expired code")
+	ErrOTPThrottled = errors.New("too many codes requested")
+)
+
+// ThrottledError says when another code may be requested
+type ThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("%v; try again in %s", ErrOTPThrottled, e.RetryAfter.Round(time.Second))
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrOTPThrottled
+}
+
+// OTPConfig sets how one-time codes are made and how hard they are to
+// guess or abuse
+type OTPConfig struct {
+	Length      int           // digits in a code
+	TTL         time.Duration // how long a code stays good
+	MaxAttempts int           // wrong guesses before a code is thrown away
+	ResendAfter time.Duration // least time between codes to one phone
+	HourlySends int           // most codes sent to one phone in an hour
+}
+
+// OTP sends one-time codes by SMS and checks them. Codes are kept only as
+// HMACs under a key made at start up, so a leaked store can't be turned
+// back into codes, and nothing outlives a restart.
+type OTP struct {
+	config OTPConfig
+	sender SMSSender
+	key    []byte
+	now    func() time.Time
+	mu     sync.Mutex
+	phones map[string]*otpState
+}
+
+type otpState struct {
+	hash     []byte // HMAC of the current code, nil once used up
+	expires  time.Time
+	attempts int
+	sends    []time.Time // in the last hour
+}
+
+func NewOTP(config OTPConfig, sender SMSSender) (*OTP, error) {
+	if config.Length <= 0 {
+		config.Length = DefaultOTPLength
+	}
+	if config.TTL <= 0 {
+		config.TTL = DefaultOTPTTL
+	}
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = DefaultOTPAttempts
+	}
+	if config.ResendAfter <= 0 {
+		config.ResendAfter = DefaultOTPResendAfter
+	}
+	if config.HourlySends <= 0 {
+		config.HourlySends = DefaultOTPHourlySends
+	}
+	if config.Length < 4 || config.Length > 10 {
+		return nil, fmt.Errorf("OTP codes should have 4 to 10 digits, not %d", config.Length)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &OTP{config: config, sender: sender, key: key, now: time.Now, phones: make(map[string]*otpState)}, nil
+}
+
+// Request sends a new code to a phone, replacing any code sent before
+func (o *OTP) Request(ctx context.Context, phone string) error {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return err
+	}
+	code, err := o.generate()
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	now := o.now()
+	o.sweep(now)
+	state := o.phones[phone]
+	if state == nil && len(o.phones) >= maxOTPPhones {
+		o.mu.Unlock()
+		return &ThrottledError{RetryAfter: o.config.ResendAfter}
+	}
+	if state == nil {
+		state = &otpState{}
+		o.phones[phone] = state
+	}
+	if wait := o.wait(state, now); wait > 0 {
+		o.mu.Unlock()
+		return &ThrottledError{RetryAfter: wait}
+	}
+	state.hash = o.hash(phone, code)
+	state.expires = now.Add(o.config.TTL)
+	state.attempts = 0
+	state.sends = append(state.sends, now)
+	o.mu.Unlock()
+
+	message := fmt.Sprintf("Your motown code is %s. It expires in %d minutes. Don't share it with anyone.",
+		code, int(o.config.TTL.Minutes()))
+	if err := o.sender.Send(ctx, phone, message); err != nil {
+		// The send still counts towards the limits, or a failing gateway
+		// could be made to retry without end
+		o.mu.Lock()
+		state.hash = nil
+		o.mu.Unlock()
+		return fmt.Errorf("sending the code: %w", err)
+	}
+	return nil
+}
+
+// Verify checks a code sent to a phone, and returns the phone in the form
+// codes were sent to. A code is good for one successful check.
+func (o *OTP) Verify(phone, code string) (string, error) {
+	phone, err := NormalizePhone(phone)
+	if err != nil {
+		return "", err
+	}
+	code = strings.TrimSpace(code)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	state := o.phones[phone]
+	if state == nil || state.hash == nil || o.now().After(state.expires) {
+		return "", ErrOTPInvalid
+	}
+	if !hmac.Equal(state.hash, o.hash(phone, code)) {
+		state.attempts++
+		if state.attempts >= o.config.MaxAttempts {
+			state.hash = nil
+		}
+		return "", ErrOTPInvalid
+	}
+	state.hash = nil
+	return phone, nil
+}
+
+// wait is how long until the phone may be sent another code
+func (o *OTP) wait(state *otpState, now time.Time) time.Duration {
+	if len(state.sends) == 0 {
+		return 0
+	}
+	wait := state.sends[len(state.sends)-1].Add(o.config.ResendAfter).Sub(now)
+	if len(state.sends) >= o.config.HourlySends {
+		if hourly := state.sends[0].Add(time.Hour).Sub(now); hourly > wait {
+			wait = hourly
+		}
+	}
+	return wait
+}
+
+// sweep forgets sends more than an hour old, and phones with nothing left
+// to remember
+func (o *OTP) sweep(now time.Time) {
+	for phone, state := range o.phones {
+		recent := state.sends[:0]
+		for _, sent := range state.sends {
+			if now.Sub(sent) < time.Hour {
+				recent = append(recent, sent)
+			}
+		}
+		state.sends = recent
+		if now.After(state.expires) {
+			state.hash = nil
+		}
+		if state.hash == nil && len(state.sends) == 0 {
+			delete(o.phones, phone)
+		}
+	}
+}
+
+func (o *OTP) generate() (string, error) {
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(o.config.Length)), nil)
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", o.config.Length, n), nil
+}
+
+func (o *OTP) hash(phone, code string) []byte {
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write([]byte(phone + "|" + code))
+	return mac.Sum(nil)
+}
+
+// NormalizePhone turns a Kenyan mobile number into +2547XXXXXXXX form, the
+// form Person phone numbers are stored in
+func NormalizePhone(phone string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == ' ' || r == '-' || r == '+' || r == '(' || r == ')':
+			return -1
+		default:
+			return 'x'
+		}
+	}, phone)
+
+	switch {
+	case len(digits) == 12 && strings.HasPrefix(digits, "254"):
+	case len(digits) == 10 && strings.HasPrefix(digits, "0"):
+		digits = "254" + digits[1:]
+	case len(digits) == 9:
+		digits = "254" + digits
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidPhone, phone)
+	}
+	if strings.ContainsRune(digits, 'x') || (digits[3] != '7' && digits[3] != '1') {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPhone, phone)
+	}
+	return "+" + digits, nil
+}
@@ -0,0 +1,352 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// outbox keeps the codes it is asked to send, by phone
+type outbox struct {
+	mu    sync.Mutex
+	codes map[string]string
+	err   error
+}
+
+var codePattern = regexp.MustCompile(`code is (\d+)\.`)
+
+func (o *outbox) Send(ctx context.Context, phone, message string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return o.err
+	}
+	if o.codes == nil {
+		o.codes = make(map[string]string)
+	}
+	o.codes[phone] = codePattern.FindStringSubmatch(message)[1]
+	return nil
+}
+
+func (o *outbox) code(phone string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.codes[phone]
+}
+
+// testClock is a clock tests move by hand
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestOTP(t *testing.T, config OTPConfig) (*OTP, *outbox, *testClock) {
+	t.Helper()
+	sender := &outbox{}
+	otp, err := NewOTP(config, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)}
+	otp.now = clock.Now
+	return otp, sender, clock
+}
+
+func TestOTPVerify(t *testing.T) {
+	const phone = "+254712345678"
+	tests := []struct {
+		name    string
+		verify  func(otp *OTP, code string, clock *testClock) (string, error)
+		wantErr error
+	}{
+		{
+			name:   "right code",
+			verify: func(otp *OTP, code string, _ *testClock) (string, error) { return otp.Verify(phone, code) },
+		},
+		{
+			name: "phone written another way",
+			verify: func(otp *OTP, code string, _ *testClock) (string, error) {
+				return otp.Verify("0712 345 678", " "+code+" ")
+			},
+		},
+		{
+			name:    "wrong code",
+			verify:  func(otp *OTP, code string, _ *testClock) (string, error) { return otp.Verify(phone, "x"+code) },
+			wantErr: ErrOTPInvalid,
+		},
+		{
+			name:    "another phone",
+			verify:  func(otp *OTP, code string, _ *testClock) (string, error) { return otp.Verify("+254712345679", code) },
+			wantErr: ErrOTPInvalid,
+		},
+		{
+			name:    "not a phone",
+			verify:  func(otp *OTP, code string, _ *testClock) (string, error) { return otp.Verify("not-a-phone", code) },
+			wantErr: ErrInvalidPhone,
+		},
+		{
+			name: "just in time",
+			verify: func(otp *OTP, code string, clock *testClock) (string, error) {
+				clock.Advance(5 * time.Minute)
+				return otp.Verify(phone, code)
+			},
+		},
+		{
+			name: "expired",
+			verify: func(otp *OTP, code string, clock *testClock) (string, error) {
+				clock.Advance(5*time.Minute + time.Second)
+				return otp.Verify(phone, code)
+			},
+			wantErr: ErrOTPInvalid,
+		},
+		{
+			name: "used already",
+			verify: func(otp *OTP, code string, _ *testClock) (string, error) {
+				if _, err := otp.Verify(phone, code); err != nil {
+					return "", err
+				}
+				return otp.Verify(phone, code)
+			},
+			wantErr: ErrOTPInvalid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otp, sender, clock := newTestOTP(t, OTPConfig{TTL: 5 * time.Minute})
+			if err := otp.Request(context.Background(), "0712345678"); err != nil {
+				t.Fatal(err)
+			}
+			code := sender.code(phone)
+			if len(code) != DefaultOTPLength {
+				t.Fatalf("sent code %q", code)
+			}
+
+			got, err := tt.verify(otp, code, clock)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Verify() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != phone {
+				t.Fatalf("Verify() = %q, %v, want %q", got, err, phone)
+			}
+		})
+	}
+}
+
+func TestOTPAttempts(t *testing.T) {
+	const phone = "+254712345678"
+	tests := []struct {
+		name    string
+		wrong   int
+		wantErr bool
+	}{
+		{name: "right first time"},
+		{name: "right on the last attempt", wrong: 2},
+		{name: "out of attempts", wrong: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otp, sender, _ := newTestOTP(t, OTPConfig{MaxAttempts: 3})
+			if err := otp.Request(context.Background(), phone); err != nil {
+				t.Fatal(err)
+			}
+			code := sender.code(phone)
+			wrong := "0000"
+			if strings.HasPrefix(code, wrong) {
+				wrong = "1111"
+			}
+			for i := 0; i < tt.wrong; i++ {
+				if _, err := otp.Verify(phone, wrong); !errors.Is(err, ErrOTPInvalid) {
+					t.Fatalf("wrong guess %d: error = %v", i+1, err)
+				}
+			}
+			_, err := otp.Verify(phone, code)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Verify() of the right code error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOTPThrottling(t *testing.T) {
+	const phone = "+254712345678"
+	otp, sender, clock := newTestOTP(t, OTPConfig{ResendAfter: time.Minute, HourlySends: 3})
+	ctx := context.Background()
+
+	steps := []struct {
+		after     time.Duration // since the last step
+		wantRetry time.Duration // 0 if the code is sent
+	}{
+		{},
+		{after: 10 * time.Second, wantRetry: 50 * time.Second},
+		{after: 50 * time.Second},
+		{after: time.Minute},
+		{after: time.Minute, wantRetry: 57 * time.Minute}, // the hour's three are used
+		{after: 57 * time.Minute},
+	}
+	var lastCode string
+	for i, step := range steps {
+		clock.Advance(step.after)
+		err := otp.Request(ctx, phone)
+
+		var throttled *ThrottledError
+		if step.wantRetry > 0 {
+			if !errors.As(err, &throttled) || !errors.Is(err, ErrOTPThrottled) {
+				t.Fatalf("step %d: Request() error = %v, want throttled", i, err)
+			}
+			if throttled.RetryAfter != step.wantRetry {
+				t.Errorf("step %d: RetryAfter = %s, want %s", i, throttled.RetryAfter, step.wantRetry)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %d: Request() error = %v", i, err)
+		}
+		// A new code replaces the one before
+		if lastCode != "" && lastCode != sender.code(phone) {
+			if _, err := otp.Verify(phone, lastCode); !errors.Is(err, ErrOTPInvalid) {
+				t.Errorf("step %d: the code before still works", i)
+			}
+		}
+		lastCode = sender.code(phone)
+	}
+
+	// Other phones have limits of their own
+	if err := otp.Request(ctx, "+254798765432"); err != nil {
+		t.Errorf("Request() for another phone error = %v", err)
+	}
+}
+
+func TestOTPSendFails(t *testing.T) {
+	const phone = "+254712345678"
+	otp, sender, clock := newTestOTP(t, OTPConfig{})
+	sender.err = errors.New("gateway down")
+
+	if err := otp.Request(context.Background(), phone); err == nil {
+		t.Fatal("Request() succeeded without sending")
+	}
+	// A failed send counts, or a broken gateway could be hammered
+	sender.err = nil
+	var throttled *ThrottledError
+	if err := otp.Request(context.Background(), phone); !errors.As(err, &throttled) {
+		t.Fatalf("Request() straight after error = %v, want throttled", err)
+	}
+	clock.Advance(DefaultOTPResendAfter)
+	if err := otp.Request(context.Background(), phone); err != nil {
+		t.Fatalf("Request() error = %v", err)
+	}
+	if _, err := otp.Verify(phone, sender.code(phone)); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone   string
+		want    string
+		wantErr bool
+	}{
+		{phone: "+254712345678", want: "+254712345678"},
+		{phone: "254712345678", want: "+254712345678"},
+		{phone: "0712345678", want: "+254712345678"},
+		{phone: "712345678", want: "+254712345678"},
+		{phone: "+254 (712) 345-678", want: "+254712345678"},
+		{phone: "0110 123 456", want: "+254110123456"},
+		{phone: "0201234567", wantErr: true}, // a Nairobi landline
+		{phone: "+447700900123", wantErr: true},
+		{phone: "07123456789", wantErr: true},
+		{phone: "07l2345678", wantErr: true},
+		{phone: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phone, func(t *testing.T) {
+			got, err := NormalizePhone(tt.phone)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidPhone) {
+					t.Errorf("NormalizePhone() = %q, %v, want ErrInvalidPhone", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("NormalizePhone() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// TestLoginByPhone signs in through Login's phone endpoints
+func TestLoginByPhone(t *testing.T) {
+	key, err := GenerateKey("test", HS256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, err := NewService(Config{Keys: []*Key{key}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := NewLogin(service, LinkerFunc(func(ctx context.Context, identity *ExternalIdentity) (Identity, error) {
+		if identity.Provider != PhoneProvider || !identity.PhoneVerified {
+			t.Errorf("linked %+v", identity)
+		}
+		return Identity{Subject: "person-1", Role: RoleRider}, nil
+	}))
+	otp, sender, _ := newTestOTP(t, OTPConfig{})
+	login.EnablePhone(otp)
+
+	post := func(path string, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		login.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post("/login/phone", url.Values{"phone": {"0712345678"}}); w.Code != http.StatusAccepted {
+		t.Fatalf("requesting a code answered %d: %s", w.Code, w.Body)
+	}
+	w := post("/login/phone", url.Values{"phone": {"0712345678"}})
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("requesting again answered %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := post("/login/phone", url.Values{"phone": {"12345"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("requesting for a bad phone answered %d", w.Code)
+	}
+
+	if w := post("/login/phone/verify", url.Values{"phone": {"0712345678"}, "code": {"wrong"}}); w.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong code answered %d", w.Code)
+	}
+	w = post("/login/phone/verify", url.Values{"phone": {"0712345678"}, "code": {sender.code("+254712345678")}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("verifying answered %d: %s", w.Code, w.Body)
+	}
+	var session Session
+	if err := json.NewDecoder(w.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	claims, err := service.Verify(session.AccessToken)
+	if err != nil || claims.Subject != "person-1" || claims.Role != RoleRider {
+		t.Errorf("signed in as %+v, %v", claims, err)
+	}
+}
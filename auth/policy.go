@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Roles a token can carry
+const (
+	RoleRider      = "rider"
+	RoleConductor  = "conductor"
+	RoleSaccoAdmin = "sacco_admin"
+	RoleAdmin      = "admin"
+)
+
+// AnyAction in a rule allows every action
+const AnyAction = "*"
+
+var ErrForbidden = errors.New("forbidden")
+
+// Resource describes what an action is taken on, by the attributes rules
+// check
+type Resource struct {
+	Owner   string // subject it belongs to, e.g. the rider of a booking
+	Vehicle string // vehicle it belongs to
+	Sacco   string // SACCO that runs it
+}
+
+// Condition is a check on the bearer's and the resource's attributes
+type Condition func(claims *Claims, resource Resource) bool
+
+// Rule allows a role some actions, when its condition holds
+type Rule struct {
+	Role    string
+	Actions []string
+	When    Condition // always holds if nil
+}
+
+// Policy decides what each role may do from a table of rules. Anything no
+// rule allows is denied.
+type Policy struct {
+	rules map[string][]Rule // by role
+}
+
+func NewPolicy(rules []Rule) *Policy {
+	p := &Policy{rules: make(map[string][]Rule)}
+	for _, rule := range rules {
+		p.rules[rule.Role] = append(p.rules[rule.Role], rule)
+	}
+	return p
+}
+
+// Permits reports whether some rule lets the role take the action on at
+// least some resources. Middleware checks it before the resource is known.
+func (p *Policy) Permits(role, action string) bool {
+	for _, rule := range p.rules[role] {
+		if rule.allows(action) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed reports whether the bearer of claims may take the action on the
+// resource
+func (p *Policy) Allowed(claims *Claims, action string, resource Resource) bool {
+	for _, rule := range p.rules[claims.Role] {
+		if rule.allows(action) && (rule.When == nil || rule.When(claims, resource)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks the action against the claims in ctx. Without claims
+// nothing is allowed; an API that runs without authentication doesn't ask.
+func (p *Policy) Authorize(ctx context.Context, action string, resource Resource) error {
+	claims, ok := ClaimsFrom(ctx)
+	if !ok {
+		return fmt.Errorf("%w: no credentials to %s", ErrForbidden, action)
+	}
+	if !p.Allowed(claims, action, resource) {
+		return forbidden(claims, action)
+	}
+	return nil
+}
+
+// Middleware turns away requests whose role may never take the action.
+// Handlers check the resource itself once they have loaded it, with
+// Authorize.
+func (p *Policy) Middleware(action string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFrom(r.Context())
+		if !ok {
+			Unauthorized(w, ErrNoToken)
+			return
+		}
+		if !p.Permits(claims.Role, action) {
+			Forbidden(w, forbidden(claims, action))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (r Rule) allows(action string) bool {
+	for _, allowed := range r.Actions {
+		if allowed == action || allowed == AnyAction {
+			return true
+		}
+	}
+	return false
+}
+
+func forbidden(claims *Claims, action string) error {
+	role := claims.Role
+	if role == "" {
+		role = "no role"
+	}
+	return fmt.Errorf("%w: %s may not %s", ErrForbidden, role, action)
+}
+
+// Forbidden answers a request the policy denied, in the error format of
+// the motown APIs
+func Forbidden(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]string{"code": "forbidden", "message": err.Error()},
+	})
+}
+
+// OwnResource holds when the resource belongs to the bearer
+func OwnResource(claims *Claims, resource Resource) bool {
+	return resource.Owner != "" && resource.Owner == claims.Subject
+}
+
+// OwnVehicle holds when the resource belongs to the bearer's vehicle
+func OwnVehicle(claims *Claims, resource Resource) bool {
+	return resource.Vehicle != "" && resource.Vehicle == claims.Vehicle
+}
+
+// OwnSacco holds when the resource is run by the bearer's SACCO
+func OwnSacco(claims *Claims, resource Resource) bool {
+	return resource.Sacco != "" && resource.Sacco == claims.Sacco
+}
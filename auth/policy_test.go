@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt"
+)
+
+var testRules = []Rule{
+	{Role: RoleRider, Actions: []string{"routes:read"}},
+	{Role: RoleRider, Actions: []string{"bookings:read"}, When: OwnResource},
+	{Role: RoleConductor, Actions: []string{"vehicles:report"}, When: OwnVehicle},
+	{Role: RoleSaccoAdmin, Actions: []string{"routes:timetable"}, When: OwnSacco},
+	{Role: RoleAdmin, Actions: []string{AnyAction}},
+}
+
+func claimsFor(subject, role string) *Claims {
+	return &Claims{StandardClaims: jwt.StandardClaims{Subject: subject}, Role: role, Vehicle: "KBX 123A", Sacco: "sacco-1"}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	policy := NewPolicy(testRules)
+	tests := []struct {
+		name     string
+		claims   *Claims
+		action   string
+		resource Resource
+		want     bool
+	}{
+		{name: "rider reads routes", claims: claimsFor("rider-1", RoleRider), action: "routes:read", want: true},
+		{name: "rider reads own booking", claims: claimsFor("rider-1", RoleRider), action: "bookings:read", resource: Resource{Owner: "rider-1"}, want: true},
+		{name: "rider reads another's booking", claims: claimsFor("rider-1", RoleRider), action: "bookings:read", resource: Resource{Owner: "rider-2"}},
+		{name: "rider reads unowned booking", claims: claimsFor("rider-1", RoleRider), action: "bookings:read"},
+		{name: "rider reports a position", claims: claimsFor("rider-1", RoleRider), action: "vehicles:report", resource: Resource{Vehicle: "KBX 123A"}},
+		{name: "conductor reports for own vehicle", claims: claimsFor("crew-1", RoleConductor), action: "vehicles:report", resource: Resource{Vehicle: "KBX 123A"}, want: true},
+		{name: "conductor reports for another vehicle", claims: claimsFor("crew-1", RoleConductor), action: "vehicles:report", resource: Resource{Vehicle: "KCA 999Z"}},
+		{name: "sacco admin edits own route", claims: claimsFor("sacco-admin", RoleSaccoAdmin), action: "routes:timetable", resource: Resource{Sacco: "sacco-1"}, want: true},
+		{name: "sacco admin edits another sacco's route", claims: claimsFor("sacco-admin", RoleSaccoAdmin), action: "routes:timetable", resource: Resource{Sacco: "sacco-2"}},
+		{name: "admin does anything", claims: claimsFor("root", RoleAdmin), action: "payments:refund", want: true},
+		{name: "unknown role", claims: claimsFor("someone", "driver"), action: "routes:read"},
+		{name: "no role", claims: claimsFor("someone", ""), action: "routes:read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Allowed(tt.claims, tt.action, tt.resource); got != tt.want {
+				t.Errorf("Allowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyPermits(t *testing.T) {
+	policy := NewPolicy(testRules)
+	// Conditional rules count, since the middleware runs before the
+	// resource is known
+	if !policy.Permits(RoleConductor, "vehicles:report") {
+		t.Error("conductor may never report")
+	}
+	if policy.Permits(RoleConductor, "routes:timetable") {
+		t.Error("conductor may edit timetables")
+	}
+	if !policy.Permits(RoleAdmin, "anything:at-all") {
+		t.Error("admin may not take every action")
+	}
+}
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy := NewPolicy(testRules)
+	rider := WithClaims(context.Background(), claimsFor("rider-1", RoleRider))
+
+	if err := policy.Authorize(context.Background(), "routes:read", Resource{}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Authorize() without claims = %v, want ErrForbidden", err)
+	}
+	if err := policy.Authorize(rider, "bookings:read", Resource{Owner: "rider-1"}); err != nil {
+		t.Errorf("Authorize() = %v, want nil", err)
+	}
+	if err := policy.Authorize(rider, "bookings:read", Resource{Owner: "rider-2"}); !errors.Is(err, ErrForbidden) {
+		t.Errorf("Authorize() = %v, want ErrForbidden", err)
+	}
+}
+
+func TestPolicyMiddleware(t *testing.T) {
+	policy := NewPolicy(testRules)
+	tests := []struct {
+		name   string
+		claims *Claims
+		want   int
+	}{
+		{name: "no token", want: http.StatusUnauthorized},
+		{name: "role without the action", claims: claimsFor("rider-1", RoleRider), want: http.StatusForbidden},
+		{name: "role with a conditional rule", claims: claimsFor("crew-1", RoleConductor), want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := policy.Middleware("vehicles:report", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodPost, "/v1/vehicles/KBX/positions", nil)
+			if tt.claims != nil {
+				r = r.WithContext(WithClaims(r.Context(), tt.claims))
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package auth
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// syncOverlap is how far back each sync looks again, for revocations stamped
+// by instances whose clocks run behind ours
+const syncOverlap = time.Minute
+
+// Revocation withdraws access tokens before they expire: one token, every
+// token of a session, or every token issued to a subject up to At
+type Revocation struct {
+	TokenID string
+	Session string
+	Subject string
+	At      time.Time
+	Until   time.Time // when every token it covers has expired anyway
+}
+
+// RevocationStore shares revocations between instances
+type RevocationStore interface {
+	AddRevocation(ctx context.Context, revocation Revocation) error
+	// Revocations lists those made since a time that are still in force
+	Revocations(ctx context.Context, since time.Time) ([]Revocation, error)
+}
+
+// RevocationList is the in-memory copy of the revocations that Verify
+// checks every token against, so checking costs no round trip. Sync keeps
+// it up to date with revocations other instances make.
+type RevocationList struct {
+	store    RevocationStore
+	mu       sync.RWMutex
+	tokens   map[string]time.Time // until, by jti
+	sessions map[string]time.Time // until, by session
+	subjects map[string]Revocation
+	synced   time.Time
+}
+
+// NewRevocationList makes a list shared through store, or local to this
+// instance if store is nil
+func NewRevocationList(store RevocationStore) *RevocationList {
+	return &RevocationList{
+		store:    store,
+		tokens:   make(map[string]time.Time),
+		sessions: make(map[string]time.Time),
+		subjects: make(map[string]Revocation),
+	}
+}
+
+// Add revokes tokens here and, through the store, everywhere else
+func (l *RevocationList) Add(ctx context.Context, revocation Revocation) error {
+	if l.store != nil {
+		if err := l.store.AddRevocation(ctx, revocation); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.apply(revocation)
+	return nil
+}
+
+// Revoked reports whether a token's claims have been revoked
+func (l *RevocationList) Revoked(claims *Claims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.tokens[claims.Id]; ok && claims.Id != "" {
+		return true
+	}
+	if _, ok := l.sessions[claims.Session]; ok && claims.Session != "" {
+		return true
+	}
+	// Tokens carry their issue time in whole seconds, so a subject's
+	// revocation covers those issued before the second it was made in. A
+	// token from signing in again straight after signing out everywhere
+	// must still work.
+	if revocation, ok := l.subjects[claims.Subject]; ok && claims.IssuedAt < revocation.At.Unix() {
+		return true
+	}
+	return false
+}
+
+// Sync fetches revocations made since the last sync, and forgets those
+// whose tokens have all expired
+func (l *RevocationList) Sync(ctx context.Context) error {
+	started := time.Now()
+	if l.store != nil {
+		since := l.synced
+		if !since.IsZero() {
+			since = since.Add(-syncOverlap)
+		}
+		revocations, err := l.store.Revocations(ctx, since)
+		if err != nil {
+			return err
+		}
+		l.mu.Lock()
+		for _, revocation := range revocations {
+			l.apply(revocation)
+		}
+		l.mu.Unlock()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, until := range l.tokens {
+		if started.After(until) {
+			delete(l.tokens, id)
+		}
+	}
+	for session, until := range l.sessions {
+		if started.After(until) {
+			delete(l.sessions, session)
+		}
+	}
+	for subject, revocation := range l.subjects {
+		if started.After(revocation.Until) {
+			delete(l.subjects, subject)
+		}
+	}
+	l.synced = started
+	return nil
+}
+
+// Run syncs every interval until ctx is done
+func (l *RevocationList) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Sync(ctx); err != nil {
+				log.Println("Syncing token revocations:", err)
+			}
+		}
+	}
+}
+
+func (l *RevocationList) apply(revocation Revocation) {
+	if revocation.TokenID != "" && revocation.Until.After(l.tokens[revocation.TokenID]) {
+		l.tokens[revocation.TokenID] = revocation.Until
+	}
+	if revocation.Session != "" && revocation.Until.After(l.sessions[revocation.Session]) {
+		l.sessions[revocation.Session] = revocation.Until
+	}
+	if revocation.Subject != "" {
+		// A later revocation covers everything an earlier one did
+		if current, ok := l.subjects[revocation.Subject]; !ok || revocation.At.After(current.At) {
+			l.subjects[revocation.Subject] = revocation
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestRevokedSubject(t *testing.T) {
+	at := time.Date(2024, 3, 1, 7, 0, 0, 600*int(time.Millisecond), time.UTC)
+	list := NewRevocationList(nil)
+	if err := list.Add(context.Background(), Revocation{Subject: "rider-1", At: at, Until: at.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		subject  string
+		issuedAt time.Time
+		want     bool
+	}{
+		{name: "issued the second before", subject: "rider-1", issuedAt: at.Add(-time.Second), want: true},
+		{name: "issued long before", subject: "rider-1", issuedAt: at.Add(-time.Hour), want: true},
+		{name: "issued the same second, after", subject: "rider-1", issuedAt: at.Add(200 * time.Millisecond)},
+		{name: "issued the second after", subject: "rider-1", issuedAt: at.Add(time.Second)},
+		{name: "another subject", subject: "rider-2", issuedAt: at.Add(-time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &Claims{StandardClaims: jwt.StandardClaims{Subject: tt.subject, IssuedAt: tt.issuedAt.Unix()}}
+			if got := list.Revoked(claims); got != tt.want {
+				t.Errorf("Revoked() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const refreshSweepInterval = time.Minute
+
+// Session is what a client gets on signing in: a short lived access token
+// and a refresh token to get the next one with
+type Session struct {
+	AccessToken  string    `json:"access_token"`
+	TokenType    string    `json:"token_type"`
+	ExpiresIn    int64     `json:"expires_in"` // seconds
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+}
+
+// RefreshToken is a refresh token as stored. Only its hash is kept, so the
+// store can't be used to sign in.
+type RefreshToken struct {
+	Hash      string
+	Family    string // the session; every token a refresh leads to shares it
+	Identity  Identity
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
+
+// RefreshStore keeps refresh tokens server side, by hash
+type RefreshStore interface {
+	Save(ctx context.Context, token *RefreshToken) error
+	// Use marks a token used, returning it as it was and whether this was
+	// its first use. It returns nil for tokens it doesn't have.
+	Use(ctx context.Context, hash string) (*RefreshToken, bool, error)
+	RevokeFamily(ctx context.Context, family string) error
+	RevokeSubject(ctx context.Context, subject string) error
+}
+
+// IssueSession signs an access token for who and starts a family of
+// refresh tokens for it
+func (s *Service) IssueSession(ctx context.Context, who Identity) (*Session, error) {
+	family, err := tokenID()
+	if err != nil {
+		return nil, err
+	}
+	return s.session(ctx, who, family)
+}
+
+// Refresh trades a refresh token for a new session. Refresh tokens rotate:
+// each is good once, for the next access token and the next refresh token.
+func (s *Service) Refresh(ctx context.Context, refreshToken string) (*Session, error) {
+	token, first, err := s.config.Refresh.Use(ctx, hashRefreshToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case token == nil:
+		return nil, fmt.Errorf("%w: unknown refresh token", ErrInvalidToken)
+	case token.Revoked:
+		return nil, fmt.Errorf("%w: the session has ended", ErrInvalidToken)
+	case time.Now().After(token.ExpiresAt):
+		return nil, fmt.Errorf("%w: the refresh token has expired", ErrInvalidToken)
+	case !first:
+		// Seeing a refresh token twice means it was copied. There's no
+		// telling which copy is the thief's, so the session ends for both.
+		if err := s.endSession(ctx, token.Family); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: the refresh token was used twice; the session has been ended", ErrInvalidToken)
+	}
+	return s.session(ctx, token.Identity, token.Family)
+}
+
+// Logout ends the session the claims were issued for. Tokens issued
+// without a session are revoked on their own.
+func (s *Service) Logout(ctx context.Context, claims *Claims) error {
+	if claims.Session != "" {
+		return s.endSession(ctx, claims.Session)
+	}
+	return s.revoke(ctx, Revocation{TokenID: claims.Id})
+}
+
+// LogoutAll ends every session of a subject, on all their devices
+func (s *Service) LogoutAll(ctx context.Context, subject string) error {
+	if err := s.config.Refresh.RevokeSubject(ctx, subject); err != nil {
+		return err
+	}
+	return s.revoke(ctx, Revocation{Subject: subject})
+}
+
+func (s *Service) session(ctx context.Context, who Identity, family string) (*Session, error) {
+	access, claims, err := s.issue(who, s.config.TTL, family)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := randomString(32)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	err = s.config.Refresh.Save(ctx, &RefreshToken{
+		Hash:      hashRefreshToken(raw),
+		Family:    family,
+		Identity:  who,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(s.config.RefreshTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	return &Session{
+		AccessToken:  access,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(time.Until(expiresAt).Seconds()),
+		ExpiresAt:    expiresAt,
+		RefreshToken: raw,
+	}, nil
+}
+
+// endSession revokes a family's refresh tokens, and the access tokens
+// issued with them
+func (s *Service) endSession(ctx context.Context, family string) error {
+	if err := s.config.Refresh.RevokeFamily(ctx, family); err != nil {
+		return err
+	}
+	return s.revoke(ctx, Revocation{Session: family})
+}
+
+// revoke lists a revocation until every access token it covers has
+// expired. Without a revocation list, access tokens run out their short
+// lives. Tokens issued by hand to last longer than the configured TTL
+// outlive their revocation; retire the key that signed them instead.
+func (s *Service) revoke(ctx context.Context, revocation Revocation) error {
+	if s.config.Revocations == nil {
+		return nil
+	}
+	revocation.At = time.Now()
+	revocation.Until = revocation.At.Add(s.config.TTL)
+	return s.config.Revocations.Add(ctx, revocation)
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// MemoryRefreshStore keeps refresh tokens in memory, for a single instance
+// or for tests. Sessions end when the process does.
+type MemoryRefreshStore struct {
+	mu     sync.Mutex
+	tokens map[string]*RefreshToken
+	swept  time.Time
+}
+
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{tokens: make(map[string]*RefreshToken)}
+}
+
+func (m *MemoryRefreshStore) Save(ctx context.Context, token *RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now := time.Now(); now.Sub(m.swept) > refreshSweepInterval {
+		for hash, old := range m.tokens {
+			if now.After(old.ExpiresAt) {
+				delete(m.tokens, hash)
+			}
+		}
+		m.swept = now
+	}
+	saved := *token
+	m.tokens[token.Hash] = &saved
+	return nil
+}
+
+func (m *MemoryRefreshStore) Use(ctx context.Context, hash string) (*RefreshToken, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	token, ok := m.tokens[hash]
+	if !ok {
+		return nil, false, nil
+	}
+	was := *token
+	token.Used = true
+	return &was, !was.Used, nil
+}
+
+func (m *MemoryRefreshStore) RevokeFamily(ctx context.Context, family string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.tokens {
+		if token.Family == family {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
+
+func (m *MemoryRefreshStore) RevokeSubject(ctx context.Context, subject string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.tokens {
+		if token.Identity.Subject == subject {
+			token.Revoked = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SMSSender delivers text messages to phones
+type SMSSender interface {
+	Send(ctx context.Context, phone, message string) error
+}
+
+// LoadSMSSender picks the sender named by SMS_SENDER, looked up by name:
+//
+//	SMS_SENDER  "console" to print messages, "file" to append them to
+//	            SMS_OUTBOX
+//
+// It returns ok false if SMS_SENDER is unset. Gateways plug in as
+// SMSSenders of their own.
+func LoadSMSSender(lookup func(string) string) (sender SMSSender, ok bool, err error) {
+	switch name := lookup("SMS_SENDER"); name {
+	case "":
+		return nil, false, nil
+	case "console":
+		return NewConsoleSender(), true, nil
+	case "file":
+		outbox := lookup("SMS_OUTBOX")
+		if outbox == "" {
+			return nil, true, fmt.Errorf("SMS_SENDER is file, so SMS_OUTBOX must be set")
+		}
+		return NewFileSender(outbox), true, nil
+	default:
+		return nil, true, fmt.Errorf("SMS_SENDER %q is not console or file", name)
+	}
+}
+
+// WriterSender writes messages to a writer instead of sending them, for
+// running locally
+type WriterSender struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+// NewConsoleSender prints messages on stderr
+func NewConsoleSender() *WriterSender {
+	return &WriterSender{w: os.Stderr}
+}
+
+// NewWriterSender writes messages to w
+func NewWriterSender(w io.Writer) *WriterSender {
+	return &WriterSender{w: w}
+}
+
+func (s *WriterSender) Send(ctx context.Context, phone, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := fmt.Fprintf(s.w, "%s  SMS to %s: %s\n", time.Now().Format(time.RFC3339), phone, message)
+	return err
+}
+
+// FileSender appends messages to a file, an outbox tests and scripts can
+// read codes from
+type FileSender struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileSender(path string) *FileSender {
+	return &FileSender{path: path}
+}
+
+func (s *FileSender) Send(ctx context.Context, phone, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s  SMS to %s: %s\n", time.Now().Format(time.RFC3339), phone, message)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Exit codes
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitInvalid     = 4 // input failed validation or a token didn't verify
+	exitUnavailable = 5 // Dgraph isn't configured or can't be reached
+)
+
+var (
+	ErrInvalidInput  = errors.New("invalid input")
+	ErrNotConfigured = errors.New("not configured")
+)
+
+// usageError is a mistake in how a command was called
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+// exitCode picks the exit code for an error
+func exitCode(err error) int {
+	var usage usageError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usage):
+		return exitUsage
+	case errors.Is(err, ErrPersonNotFound), errors.Is(err, ErrRouteNotFound):
+		return exitNotFound
+	case errors.Is(err, ErrInvalidInput), errors.Is(err, ErrPhoneTaken), errors.Is(err, ErrInvalidToken):
+		return exitInvalid
+	case errors.Is(err, ErrNotConfigured):
+		return exitUnavailable
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return exitUnavailable
+	}
+	return exitFailure
+}
+
+// output writes command results as text or, with --json, as JSON
+type output struct {
+	json   bool
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// emit writes v as JSON or text as plain text
+func (o *output) emit(v interface{}, text string) error {
+	if o.json {
+		encoder := json.NewEncoder(o.stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+	_, err := io.WriteString(o.stdout, text)
+	return err
+}
+
+// fail reports an error on stderr
+func (o *output) fail(err error) {
+	if o.json {
+		json.NewEncoder(o.stderr).Encode(map[string]interface{}{
+			"error": err.Error(),
+			"code":  exitCode(err),
+		})
+		return
+	}
+	fmt.Fprintln(o.stderr, "Error:", err)
+}
+
+// command is one CLI subcommand
+type command struct {
+	usage string
+	run   func(ctx context.Context, out *output, args []string) error
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"routes": {
+			usage: "routes import|search|show|update [flags]          manage matatu routes",
+			run:   runRoutesCommand,
+		},
+		"person": {
+			usage: "person add|find|update|delete [flags]             manage riders and crew",
+			run:   runPersonCLI,
+		},
+		"token": {
+			usage: "token issue|verify|keygen [flags]                 issue and check JWTs",
+			run:   runTokenCommand,
+		},
+		"gps": {
+			usage: "gps track [--port dev] [--file path]              print fixes from a GPS receiver",
+			run:   runGPSCommand,
+		},
+		"schema": {
+			usage: "schema apply [--dry-run]                          apply the Dgraph schema",
+			run:   runSchemaCommand,
+		},
+		"interactive": {
+			usage: "interactive                                       the person and Dgraph menus",
+			run:   runInteractive,
+		},
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: motown [--json] [--config file] <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(w, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "motown doesn't serve anything itself. The REST API is served by the engine,")
+	fmt.Fprintln(w, "go run ./src [-addr host:port], on LISTEN_ADDR or :8080 without the flag, and")
+	fmt.Fprintln(w, "sign in by go run ./src login. See the doc comment of src/main.go for")
+	fmt.Fprintln(w, "the engine's settings.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Settings come from flags, then environment variables, then the config file")
+	fmt.Fprintln(w, "(.env by default): GPS_PORT, GPS_BAUD, and AUTH_KEYS,")
+	fmt.Fprintln(w, "AUTH_SIGNING_KEY, AUTH_ISSUER, AUTH_AUDIENCE and AUTH_TOKEN_TTL (or JWT_SECRET)")
+	fmt.Fprintln(w, "for tokens. Dgraph is DGRAPH_ENDPOINT and DGRAPH_API_TOKEN for Dgraph Cloud, or")
+	fmt.Fprintln(w, "DGRAPH_ALPHAS (host:port,...) for your own, with DGRAPH_TLS, DGRAPH_TLS_CA,")
+	fmt.Fprintln(w, "DGRAPH_TLS_CERT, DGRAPH_TLS_KEY, DGRAPH_TLS_SERVER_NAME, DGRAPH_USER and")
+	fmt.Fprintln(w, "DGRAPH_PASSWORD; DGRAPH_RETRIES caps retries of aborted transactions.")
+}
+
+// newFlagSet makes a subcommand's flag set; --json is accepted after the
+// subcommand as well as before it
+func newFlagSet(name string, out *output) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out.stderr)
+	flags.BoolVar(&out.json, "json", out.json, "write JSON output")
+	return flags
+}
+
+// parseFlags parses a subcommand's flags, turning parse failures into
+// usage errors
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return usageError{msg: err.Error()}
+	}
+	return nil
+}
+
+// runCLI runs the command line and returns the exit code
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	out := &output{stdout: stdout, stderr: stderr}
+
+	global := flag.NewFlagSet("motown", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.BoolVar(&out.json, "json", false, "write JSON output")
+	configFile := global.String("config", "", "config file (default .env)")
+	global.Usage = func() { printUsage(stderr) }
+	if err := global.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	rest := global.Args()
+	if len(rest) == 0 || rest[0] == "help" {
+		printUsage(stderr)
+		if len(rest) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+
+	cmd, exists := commands[rest[0]]
+	if !exists {
+		out.fail(usagef("unknown command %q", rest[0]))
+		printUsage(stderr)
+		return exitUsage
+	}
+
+	if err := initConfig(*configFile); err != nil {
+		out.fail(err)
+		return exitUsage
+	}
+
+	// Ctrl-C and systemd's SIGTERM cancel the command's context
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.run(ctx, out, rest[1:])
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		out.fail(err)
+		var usage usageError
+		if errors.As(err, &usage) {
+			fmt.Fprintln(stderr, "Usage: motown "+strings.TrimSpace(strings.SplitN(cmd.usage, "  ", 2)[0]))
+		}
+	}
+	return exitCode(err)
+}
+
+func runPersonCLI(ctx context.Context, out *output, args []string) error {
+	dgraphClient, closeClient, err := createDgraphClient()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	return runPersonCommand(ctx, out, NewPersonStore(dgraphClient), args)
+}
+
+func runInteractive(ctx context.Context, out *output, args []string) error {
+	flags := newFlagSet("interactive", out)
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	showPersonMenu()
+	showDgraphMenu()
+	return nil
+}
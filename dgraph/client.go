@@ -0,0 +1,172 @@
+package dgraph
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/dgo/v210"
+	"github.com/dgraph-io/dgo/v210/protos/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ErrUnavailable is returned by Health when no alpha answers
+var ErrUnavailable = errors.New("Dgraph is unavailable")
+
+// Client is a Dgraph client over connections to every configured alpha,
+// which dgo picks between at random for each request
+type Client struct {
+	*dgo.Dgraph
+	config Config
+	alphas []alpha
+	once   sync.Once
+}
+
+type alpha struct {
+	addr   string
+	conn   *grpc.ClientConn
+	client api.DgraphClient
+}
+
+// AlphaHealth is how one alpha answered a health check
+type AlphaHealth struct {
+	Addr    string        `json:"addr"`
+	Healthy bool          `json:"healthy"`
+	Version string        `json:"version,omitempty"`
+	Latency time.Duration `json:"latency_ns"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// Open connects to the Dgraph in config. Connections are made in the
+// background, so an alpha that is down now is used once it comes up; use
+// Health to find out which are up. Close the client once done with it.
+func Open(ctx context.Context, config Config) (*Client, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.DialTimeout <= 0 {
+		config.DialTimeout = DefaultDialTimeout
+	}
+	if config.Retries <= 0 {
+		config.Retries = DefaultRetries
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = DefaultRetryBackoff
+	}
+
+	c := &Client{config: config}
+	if config.Cloud() {
+		conn, err := dgo.DialCloud(config.Endpoint, config.APIKey)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to Dgraph Cloud: %w", err)
+		}
+		c.alphas = append(c.alphas, alpha{addr: config.Endpoint, conn: conn, client: api.NewDgraphClient(conn)})
+	} else {
+		creds, err := config.credentials()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range config.Alphas {
+			conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+			if err != nil {
+				c.Close()
+				return nil, fmt.Errorf("connecting to Dgraph alpha %s: %w", addr, err)
+			}
+			c.alphas = append(c.alphas, alpha{addr: addr, conn: conn, client: api.NewDgraphClient(conn)})
+		}
+	}
+
+	clients := make([]api.DgraphClient, len(c.alphas))
+	for i, a := range c.alphas {
+		clients[i] = a.client
+	}
+	c.Dgraph = dgo.NewDgraphClient(clients...)
+
+	if config.User != "" {
+		loginCtx, cancel := context.WithTimeout(ctx, config.DialTimeout)
+		defer cancel()
+		// dgo logs in again by itself when the access token expires
+		if err := c.Login(loginCtx, config.User, config.Password); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("logging in to Dgraph as %s: %w", config.User, err)
+		}
+	}
+	return c, nil
+}
+
+// credentials are the transport credentials for self-hosted alphas
+func (c Config) credentials() (credentials.TransportCredentials, error) {
+	if !c.secure() {
+		return insecure.NewCredentials(), nil
+	}
+	tlsConfig := &tls.Config{ServerName: c.ServerName, MinVersion: tls.VersionTLS12}
+	if c.CACert != "" {
+		pem, err := os.ReadFile(c.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("reading DGRAPH_TLS_CA: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("DGRAPH_TLS_CA %s has no PEM certificates", c.CACert)
+		}
+	}
+	if c.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading the Dgraph client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(tlsConfig), nil
+}
+
+// Health asks every alpha for its version. It returns ErrUnavailable if
+// none answer; requests still work while any one does.
+func (c *Client) Health(ctx context.Context) ([]AlphaHealth, error) {
+	health := make([]AlphaHealth, len(c.alphas))
+	var wg sync.WaitGroup
+	for i, a := range c.alphas {
+		wg.Add(1)
+		go func(i int, a alpha) {
+			defer wg.Done()
+			started := time.Now()
+			version, err := a.client.CheckVersion(ctx, &api.Check{})
+			health[i] = AlphaHealth{Addr: a.addr, Latency: time.Since(started)}
+			if err != nil {
+				health[i].Error = err.Error()
+				return
+			}
+			health[i].Healthy = true
+			health[i].Version = version.GetTag()
+		}(i, a)
+	}
+	wg.Wait()
+
+	for _, h := range health {
+		if h.Healthy {
+			return health, nil
+		}
+	}
+	return health, ErrUnavailable
+}
+
+// Close closes the connections to every alpha. Requests still in flight
+// fail, so stop serving before closing. Closing more than once is harmless.
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		for _, a := range c.alphas {
+			if closeErr := a.conn.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
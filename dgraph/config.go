@@ -0,0 +1,122 @@
+// Package dgraph connects motown to Dgraph, either Dgraph Cloud or
+// self-hosted alphas, and runs transactions that retry when aborted
+package dgraph
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultDialTimeout  = 10 * time.Second
+	DefaultRetries      = 5
+	DefaultRetryBackoff = 20 * time.Millisecond
+
+	maxRetryBackoff = time.Second
+)
+
+// ErrNotConfigured is returned when there is no Dgraph to connect to
+var ErrNotConfigured = errors.New("Dgraph is not configured")
+
+// Config says which Dgraph to connect to and how. Set either Endpoint, for
+// Dgraph Cloud, or Alphas, for a self-hosted cluster.
+type Config struct {
+	Endpoint string // Dgraph Cloud GraphQL endpoint
+	APIKey   string // Dgraph Cloud API key
+
+	// Alphas are self-hosted alphas as host:port. Requests are spread
+	// across all of them.
+	Alphas     []string
+	TLS        bool   // use TLS to the alphas, on with any of the below
+	CACert     string // PEM file of the CA the alphas' certificates chain to; system roots if empty
+	ClientCert string // PEM files of a client certificate and its key, for mutual TLS
+	ClientKey  string
+	ServerName string // name the alphas' certificates are for, if not their host names
+	User       string // ACL login, if the alphas have ACLs on
+	Password   string
+
+	DialTimeout  time.Duration // how long Open waits for the login, DefaultDialTimeout if zero
+	Retries      int           // attempts at a transaction that keeps being aborted
+	RetryBackoff time.Duration // wait before the first retry; it doubles each time
+}
+
+// LoadConfig reads the Dgraph settings, looked up by name:
+//
+//	DGRAPH_ENDPOINT         Dgraph Cloud GraphQL endpoint
+//	DGRAPH_API_TOKEN        Dgraph Cloud API key
+//	DGRAPH_ALPHAS           self-hosted alphas, comma separated host:port
+//	DGRAPH_TLS              "true" for TLS to the alphas
+//	DGRAPH_TLS_CA           CA certificate to trust, instead of the system's
+//	DGRAPH_TLS_CERT         client certificate, for mutual TLS
+//	DGRAPH_TLS_KEY          client certificate key
+//	DGRAPH_TLS_SERVER_NAME  name the alphas' certificates are for
+//	DGRAPH_USER             ACL user
+//	DGRAPH_PASSWORD         ACL password
+//	DGRAPH_RETRIES          attempts at an aborted transaction, 5 if unset
+//
+// It returns ErrNotConfigured if neither DGRAPH_ENDPOINT nor DGRAPH_ALPHAS
+// is set.
+func LoadConfig(lookup func(string) string) (Config, error) {
+	config := Config{
+		Endpoint:   lookup("DGRAPH_ENDPOINT"),
+		APIKey:     lookup("DGRAPH_API_TOKEN"),
+		CACert:     lookup("DGRAPH_TLS_CA"),
+		ClientCert: lookup("DGRAPH_TLS_CERT"),
+		ClientKey:  lookup("DGRAPH_TLS_KEY"),
+		ServerName: lookup("DGRAPH_TLS_SERVER_NAME"),
+		User:       lookup("DGRAPH_USER"),
+		Password:   lookup("DGRAPH_PASSWORD"),
+	}
+	for _, alpha := range strings.Split(lookup("DGRAPH_ALPHAS"), ",") {
+		if alpha = strings.TrimSpace(alpha); alpha != "" {
+			config.Alphas = append(config.Alphas, alpha)
+		}
+	}
+	if value := lookup("DGRAPH_TLS"); value != "" {
+		on, err := strconv.ParseBool(value)
+		if err != nil {
+			return Config{}, fmt.Errorf("DGRAPH_TLS %q is not true or false", value)
+		}
+		config.TLS = on
+	}
+	if value := lookup("DGRAPH_RETRIES"); value != "" {
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 1 {
+			return Config{}, fmt.Errorf("DGRAPH_RETRIES %q is not a positive number", value)
+		}
+		config.Retries = retries
+	}
+	if err := config.validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// Cloud reports whether the config is for Dgraph Cloud
+func (c Config) Cloud() bool {
+	return c.Endpoint != ""
+}
+
+// secure reports whether connections to self-hosted alphas use TLS
+func (c Config) secure() bool {
+	return c.TLS || c.CACert != "" || c.ClientCert != "" || c.ServerName != ""
+}
+
+func (c Config) validate() error {
+	switch {
+	case c.Endpoint == "" && len(c.Alphas) == 0:
+		return fmt.Errorf("%w: set DGRAPH_ENDPOINT for Dgraph Cloud or DGRAPH_ALPHAS for your own", ErrNotConfigured)
+	case c.Endpoint != "" && len(c.Alphas) > 0:
+		return errors.New("set DGRAPH_ENDPOINT or DGRAPH_ALPHAS, not both")
+	case c.Endpoint != "" && c.secure():
+		return errors.New("Dgraph Cloud always uses TLS; the DGRAPH_TLS settings are for DGRAPH_ALPHAS")
+	case (c.ClientCert == "") != (c.ClientKey == ""):
+		return errors.New("DGRAPH_TLS_CERT and DGRAPH_TLS_KEY go together")
+	case (c.User == "") != (c.Password == ""):
+		return errors.New("DGRAPH_USER and DGRAPH_PASSWORD go together")
+	}
+	return nil
+}
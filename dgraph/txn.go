@@ -0,0 +1,56 @@
+package dgraph
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/dgraph-io/dgo/v210"
+)
+
+// ErrContention is returned when a transaction is aborted every time it is
+// tried
+var ErrContention = errors.New("transaction kept conflicting with other updates")
+
+// RetryTxn runs fn in a transaction and commits it. When Dgraph aborts the
+// commit because another transaction wrote the same nodes, fn runs again in
+// a new transaction, after a backoff that doubles each time.
+func (c *Client) RetryTxn(ctx context.Context, fn func(txn *dgo.Txn) error) error {
+	return retryTxn(ctx, c.Dgraph, c.config.Retries, c.config.RetryBackoff, fn)
+}
+
+func retryTxn(ctx context.Context, dg *dgo.Dgraph, retries int, backoff time.Duration, fn func(txn *dgo.Txn) error) error {
+	for attempt := 0; attempt < retries; attempt++ {
+		txn := dg.NewTxn()
+		err := fn(txn)
+		if err == nil {
+			err = txn.Commit(ctx)
+		}
+		txn.Discard(ctx)
+
+		if !errors.Is(err, dgo.ErrAborted) {
+			return err
+		}
+		if attempt == retries-1 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+	return ErrContention
+}
+
+// jitter spreads a backoff over its upper half, so transactions that
+// conflicted once don't retry in step and conflict again
+func jitter(backoff time.Duration) time.Duration {
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
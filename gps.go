@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/go-serial/serial"
+	"github.com/spf13/viper"
+)
+
+const (
+	defaultGPSPort = "/dev/ttyACM0"
+	defaultGPSBaud = 9600
+	knotsToKmh     = 1.852
+)
+
+var ErrUnsupportedSentence = errors.New("unsupported NMEA sentence")
+
+// GPSFix is a position reported by a GPS receiver
+type GPSFix struct {
+	Time       time.Time `json:"time"`
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	Quality    int       `json:"quality,omitempty"` // 1 GPS, 2 DGPS, 0 for RMC-only receivers
+	Satellites int       `json:"satellites,omitempty"`
+	HDOP       float64   `json:"hdop,omitempty"`
+	Altitude   float64   `json:"altitude_m,omitempty"`
+	SpeedKmh   float64   `json:"speed_kmh"`
+	Course     float64   `json:"course,omitempty"`
+}
+
+// nmeaSentence is one checked NMEA line split into fields, without the
+// talker ID, e.g. "GGA"
+type nmeaSentence struct {
+	kind   string
+	fields []string
+}
+
+// parseNMEA checks a sentence's checksum and splits it up
+func parseNMEA(line string) (nmeaSentence, error) {
+	line = strings.TrimSpace(line)
+	if len(line) < 7 || line[0] != '$' {
+		return nmeaSentence{}, fmt.Errorf("%w: %q", ErrInvalidInput, line)
+	}
+
+	body := line[1:]
+	if star := strings.LastIndexByte(body, '*'); star >= 0 {
+		want, err := strconv.ParseUint(body[star+1:], 16, 8)
+		if err != nil {
+			return nmeaSentence{}, fmt.Errorf("%w: bad checksum in %q", ErrInvalidInput, line)
+		}
+		body = body[:star]
+
+		var sum byte
+		for i := 0; i < len(body); i++ {
+			sum ^= body[i]
+		}
+		if sum != byte(want) {
+			return nmeaSentence{}, fmt.Errorf("%w: checksum mismatch in %q", ErrInvalidInput, line)
+		}
+	}
+
+	fields := strings.Split(body, ",")
+	if len(fields[0]) != 5 {
+		return nmeaSentence{}, fmt.Errorf("%w: %q", ErrUnsupportedSentence, fields[0])
+	}
+	return nmeaSentence{kind: fields[0][2:], fields: fields[1:]}, nil
+}
+
+// parseDegrees turns NMEA's ddmm.mmmm and a hemisphere into signed decimal
+// degrees
+func parseDegrees(value, direction string) (float64, error) {
+	if value == "" || direction == "" {
+		return 0, fmt.Errorf("%w: missing coordinate", ErrInvalidInput)
+	}
+	raw, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: coordinate %q", ErrInvalidInput, value)
+	}
+
+	degrees := math.Floor(raw / 100)
+	decimal := degrees + (raw-degrees*100)/60
+	if direction == "S" || direction == "W" {
+		decimal = -decimal
+	}
+	return decimal, nil
+}
+
+// parseNMEATime reads hhmmss.ss on a date, in UTC
+func parseNMEATime(value string, date time.Time) (time.Time, error) {
+	if len(value) < 6 {
+		return time.Time{}, fmt.Errorf("%w: time %q", ErrInvalidInput, value)
+	}
+	hour, err1 := strconv.Atoi(value[0:2])
+	minute, err2 := strconv.Atoi(value[2:4])
+	seconds, err3 := strconv.ParseFloat(value[4:], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return time.Time{}, fmt.Errorf("%w: time %q", ErrInvalidInput, value)
+	}
+
+	whole := int(seconds)
+	nanos := int((seconds - float64(whole)) * 1e9)
+	year, month, day := date.Date()
+	return time.Date(year, month, day, hour, minute, whole, nanos, time.UTC), nil
+}
+
+func atoiOrZero(value string) int {
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+func atofOrZero(value string) float64 {
+	f, _ := strconv.ParseFloat(value, 64)
+	return f
+}
+
+// fixFromGGA reads a GGA sentence; ok is false when the receiver has no fix
+func fixFromGGA(s nmeaSentence, date time.Time) (fix GPSFix, ok bool, err error) {
+	if len(s.fields) < 9 {
+		return GPSFix{}, false, fmt.Errorf("%w: short GGA sentence", ErrInvalidInput)
+	}
+	fix.Quality = atoiOrZero(s.fields[5])
+	if fix.Quality == 0 {
+		return GPSFix{}, false, nil
+	}
+
+	if fix.Time, err = parseNMEATime(s.fields[0], date); err != nil {
+		return GPSFix{}, false, err
+	}
+	if fix.Lat, err = parseDegrees(s.fields[1], s.fields[2]); err != nil {
+		return GPSFix{}, false, err
+	}
+	if fix.Lng, err = parseDegrees(s.fields[3], s.fields[4]); err != nil {
+		return GPSFix{}, false, err
+	}
+	fix.Satellites = atoiOrZero(s.fields[6])
+	fix.HDOP = atofOrZero(s.fields[7])
+	fix.Altitude = atofOrZero(s.fields[8])
+	return fix, true, nil
+}
+
+// fixFromRMC reads an RMC sentence; ok is false when it is marked void
+func fixFromRMC(s nmeaSentence) (fix GPSFix, ok bool, err error) {
+	if len(s.fields) < 9 {
+		return GPSFix{}, false, fmt.Errorf("%w: short RMC sentence", ErrInvalidInput)
+	}
+	if s.fields[1] != "A" {
+		return GPSFix{}, false, nil
+	}
+
+	date, err := time.Parse("020106", s.fields[8])
+	if err != nil {
+		return GPSFix{}, false, fmt.Errorf("%w: date %q", ErrInvalidInput, s.fields[8])
+	}
+	if fix.Time, err = parseNMEATime(s.fields[0], date); err != nil {
+		return GPSFix{}, false, err
+	}
+	if fix.Lat, err = parseDegrees(s.fields[2], s.fields[3]); err != nil {
+		return GPSFix{}, false, err
+	}
+	if fix.Lng, err = parseDegrees(s.fields[4], s.fields[5]); err != nil {
+		return GPSFix{}, false, err
+	}
+	fix.SpeedKmh = atofOrZero(s.fields[6]) * knotsToKmh
+	fix.Course = atofOrZero(s.fields[7])
+	return fix, true, nil
+}
+
+// trackFixes reads NMEA from r and calls emit for each fix. GGA sentences
+// carry the fix, topped up with speed and date from the latest RMC;
+// receivers that only send RMC have those reported instead.
+func trackFixes(r io.Reader, emit func(GPSFix) error) error {
+	scanner := bufio.NewScanner(r)
+	var lastRMC *GPSFix
+	seenGGA := false
+
+	for scanner.Scan() {
+		sentence, err := parseNMEA(scanner.Text())
+		if err != nil {
+			continue // receivers start mid-sentence and send other talkers' data
+		}
+
+		switch sentence.kind {
+		case "RMC":
+			fix, ok, err := fixFromRMC(sentence)
+			if err != nil || !ok {
+				continue
+			}
+			lastRMC = &fix
+			if !seenGGA {
+				if err := emit(fix); err != nil {
+					return err
+				}
+			}
+
+		case "GGA":
+			date := time.Now().UTC()
+			if lastRMC != nil {
+				date = lastRMC.Time
+			}
+			fix, ok, err := fixFromGGA(sentence, date)
+			if err != nil || !ok {
+				continue
+			}
+			seenGGA = true
+			if lastRMC != nil {
+				fix.SpeedKmh = lastRMC.SpeedKmh
+				fix.Course = lastRMC.Course
+			}
+			if err := emit(fix); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// errEnoughFixes stops tracking once --count fixes have been printed
+var errEnoughFixes = errors.New("enough fixes")
+
+// runGPSCommand prints fixes from a GPS receiver or a file of NMEA:
+//
+//	motown gps track [--port /dev/ttyACM0] [--baud 9600] [--count n]
+//	motown gps track --file capture.nmea   (- for stdin)
+func runGPSCommand(ctx context.Context, out *output, args []string) error {
+	if len(args) == 0 || args[0] != "track" {
+		return usagef("gps needs track")
+	}
+
+	flags := newFlagSet("gps track", out)
+	port := flags.String("port", "", "serial port (GPS_PORT, default "+defaultGPSPort+")")
+	baud := flags.Uint("baud", 0, "baud rate (GPS_BAUD, default 9600)")
+	file := flags.String("file", "", "read NMEA from a file instead, - for stdin")
+	count := flags.Int("count", 0, "stop after this many fixes")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+
+	var source io.ReadCloser
+	switch {
+	case *file == "-":
+		source = os.Stdin
+	case *file != "":
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		source = f
+	default:
+		if *port == "" {
+			*port = viper.GetString("GPS_PORT")
+		}
+		if *port == "" {
+			*port = defaultGPSPort
+		}
+		if *baud == 0 {
+			*baud = uint(viper.GetInt("GPS_BAUD"))
+		}
+		if *baud == 0 {
+			*baud = defaultGPSBaud
+		}
+
+		serialPort, err := serial.Open(serial.OpenOptions{
+			PortName:        *port,
+			BaudRate:        *baud,
+			DataBits:        8,
+			StopBits:        1,
+			MinimumReadSize: 4,
+		})
+		if err != nil {
+			return fmt.Errorf("opening %s: %w", *port, err)
+		}
+		source = serialPort
+	}
+
+	// Closing the source is what unblocks a read when we're told to stop
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		source.Close()
+	}()
+
+	// Fixes are a stream, so JSON output is one object per line
+	encoder := json.NewEncoder(out.stdout)
+	printed := 0
+	err := trackFixes(source, func(fix GPSFix) error {
+		if out.json {
+			if err := encoder.Encode(fix); err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(out.stdout, "%s %.6f,%.6f %.1f km/h\n",
+				fix.Time.Format(time.RFC3339), fix.Lat, fix.Lng, fix.SpeedKmh)
+		}
+
+		printed++
+		if *count > 0 && printed >= *count {
+			return errEnoughFixes
+		}
+		return nil
+	})
+
+	if errors.Is(err, errEnoughFixes) || ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
@@ -2,59 +2,67 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/golang-jwt/jwt"
 	"log"
 	"math"
-	"net/http"
-	"time"
+	"os"
 
-	"github.com/dgraph-io/dgo/v210"
-	"github.com/dgraph-io/dgo/v210/protos/api"
 	"github.com/dixonwille/wmenu/v5"
 	"github.com/spf13/viper"
-)
 
-// Dgraph server address (modify if necessary)
-const dgraphServer = "localhost:9080"
+	"motown/dgraph"
+)
 
-// Function to initialize Viper and read from .env file
-func initConfig() {
-    // Set the name of the .env file without the extension
-    viper.SetConfigName(".env")
+// Function to initialize Viper from a config file, .env in the current
+// directory by default. Environment variables take precedence over it.
+func initConfig(configFile string) error {
     viper.SetConfigType("env") // Set the config type to ENV
-    viper.AddConfigPath(".")   // Look for the .env file in the current directory
+    if configFile != "" {
+        viper.SetConfigFile(configFile)
+    } else {
+        // Set the name of the .env file without the extension
+        viper.SetConfigName(".env")
+        viper.AddConfigPath(".") // Look for the .env file in the current directory
+    }
+    viper.AutomaticEnv()
 
     // Read the configuration from the .env file
     if err := viper.ReadInConfig(); err != nil {
+        if configFile != "" {
+            return fmt.Errorf("reading config %s: %w", configFile, err)
+        }
         log.Println("No .env file found, using environment variables instead")
     }
+    return nil
 }
 
-// Function to create a Dgraph client for Dgraph Cloud
-func createDgraphClient() *dgo.Dgraph {
-    // Initialize Viper to read from .env file
-    initConfig()
-
-    endpoint := viper.GetString("DGRAPH_ENDPOINT") // Load the endpoint from the .env file
-    apiToken := viper.GetString("DGRAPH_API_TOKEN") // Load the API token from the .env file
-
-    // Create a connection to Dgraph Cloud
-    conn, err := dgo.DialCloud(endpoint, apiToken)
+// Function to create a Dgraph client for Dgraph Cloud or self-hosted
+// alphas, as configured. The returned function closes the connections once
+// the caller is done with the client.
+func createDgraphClient() (*dgraph.Client, func(), error) {
+    config, err := dgraph.LoadConfig(viper.GetString) // Load the settings from the .env file
+    if errors.Is(err, dgraph.ErrNotConfigured) {
+        return nil, nil, fmt.Errorf("%w: %v", ErrNotConfigured, err)
+    }
     if err != nil {
-        log.Fatal("Unable to connect to Dgraph Cloud:", err)
+        return nil, nil, err
     }
 
-    // Ensure that the connection is closed when done
-    defer conn.Close()
-
-    dgraphClient := dgo.NewDgraphClient(api.NewDgraphClient(conn))
-    return dgraphClient
+    client, err := dgraph.Open(context.Background(), config)
+    if err != nil {
+        return nil, nil, fmt.Errorf("unable to connect to Dgraph: %w", err)
+    }
+    return client, func() { client.Close() }, nil
 }
 
 // Client mode: Perform a simple Dgraph query
 func dgraphClientExample() {
-	dgraphClient := createDgraphClient()
+	dgraphClient, closeClient, err := createDgraphClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeClient()
 	ctx := context.Background()
 
 	// Create a query to fetch data from Dgraph
@@ -74,17 +82,6 @@ func dgraphClientExample() {
 	fmt.Printf("Query result: %s\n", response.Json)
 }
 
-// Server mode: Start a simple HTTP server to simulate a service (Dgraph is already running separately)
-func dgraphServerExample() {
-	// Create a simple HTTP server that could potentially serve Dgraph GraphQL queries
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Dgraph server is running...")
-	})
-
-	fmt.Println("Server is listening at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
-}
-
 // Function to calculate distance between two points
 func distance(lat1, lng1, lat2, lng2 float64, unit ...string) float64 {
 	const PI = 3.141592653589793
@@ -117,45 +114,52 @@ func speed(s, dist float64) float64 {
 	return dist / s
 }
 
-// Function to generate JWT token
-func GenerateToken() (string, error) {
-	secretKey := []byte("kadaddy")
-
-	claims := jwt.StandardClaims{
-		Issuer:    "my-app",
-		ExpiresAt: time.Now().Add(24 * time.Hour).Unix(),
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(secretKey)
-}
-
 // Function to handle person management menu
-func handlePersonFunc(opts []wmenu.Opt) {
+func handlePersonFunc(store *PersonStore, opts []wmenu.Opt) {
+    ctx, cancel := context.WithTimeout(context.Background(), personRequestTimeout)
+    defer cancel()
+
+    var err error
     switch opts[0].Value {
     case 0:
         fmt.Println("Add a new Person selected")
-        // Add logic to handle adding a person
+        err = promptAddPerson(ctx, store)
     case 1:
         fmt.Println("Find a Person selected")
-        // Add logic to handle finding a person
+        err = promptFindPerson(ctx, store)
     case 2:
         fmt.Println("Update a Person's information selected")
-        // Add logic to handle updating a person
+        err = promptUpdatePerson(ctx, store)
     case 3:
         fmt.Println("Delete a Person by ID selected")
-        // Add logic to handle deleting a person
+        err = promptDeletePerson(ctx, store)
     default:
         fmt.Println("Unknown option selected")
     }
+    if err != nil {
+        fmt.Println("Error:", err)
+    }
 }
 
 // Function to show the person management menu
 func showPersonMenu() {
+    dgraphClient, closeClient, err := createDgraphClient()
+    if err != nil {
+        log.Fatal(err)
+    }
+    defer closeClient()
+
+    store := NewPersonStore(dgraphClient)
+    ctx, cancel := context.WithTimeout(context.Background(), personRequestTimeout)
+    defer cancel()
+    if err := store.EnsureSchema(ctx); err != nil {
+        log.Fatal("Unable to apply the person schema:", err)
+    }
+
     // Create a command-line menu for person management
     personMenu := wmenu.NewMenu("What would you like to do with Persons?")
     personMenu.Action(func(opts []wmenu.Opt) error {
-        handlePersonFunc(opts) // Handle person management options
+        handlePersonFunc(store, opts) // Handle person management options
         return nil
     })
 
@@ -179,7 +183,7 @@ func handleDgraphMode(opts []wmenu.Opt) {
         dgraphClientExample()
     case 1: // Server mode
         fmt.Println("Selected: Dgraph Server Mode")
-        dgraphServerExample()
+        fmt.Println("The API is served by the engine: go run ./src [-addr host:port]")
     default:
         fmt.Println("Unknown option selected")
     }
@@ -206,16 +210,5 @@ func showDgraphMenu() {
 
 // Main function
 func main() {
-	// Generate the JWT token
-	tokenString, err := GenerateToken()
-	if err != nil {
-		log.Fatal("Error generating token:", err)
-	}
-	fmt.Printf("JWT Token: %s\n", tokenString)
-
-	// Display Dgraph mode menu
-	showPersonMenu()
-
-        // Show the Dgraph mode selection menu afterward
-        showDgraphMenu()
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
 }
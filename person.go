@@ -0,0 +1,548 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/v210"
+	"github.com/dgraph-io/dgo/v210/protos/api"
+
+	"motown/auth"
+	"motown/dgraph"
+)
+
+// Person roles are the roles of the tokens people sign in with. Drivers
+// and conductors are both the crew of a vehicle, in the conductor role.
+const (
+	RoleRider        = auth.RoleRider
+	RoleConductor    = auth.RoleConductor
+	RoleSaccoAdmin   = auth.RoleSaccoAdmin
+	RoleAdmin        = auth.RoleAdmin
+	maxPersonName    = 100
+	personQueryLimit = 50
+)
+
+// PersonRoles lists the valid roles in the order menus offer them
+var PersonRoles = []string{RoleRider, RoleConductor, RoleSaccoAdmin, RoleAdmin}
+
+var (
+	ErrPersonNotFound = errors.New("person not found")
+	ErrPhoneTaken     = errors.New("phone number already belongs to someone")
+	ErrRouteNotFound  = errors.New("route not found")
+
+	uidPattern = regexp.MustCompile(`^0x[0-9a-fA-F]+$`)
+)
+
+// Schema for people, applied alongside the route schema
+const personSchema = `
+    name: string @index(term, exact) .
+    phone: string @index(exact) @upsert .
+    role: string @index(exact) .
+    sacco: string @index(exact) .
+    crew_vehicle: string @index(exact) .
+    favourite_routes: [uid] @reverse .
+    identities: [string] @index(exact) @upsert .
+    created_at: datetime .
+    updated_at: datetime @index(hour) .
+
+    type Person {
+        name
+        phone
+        role
+        sacco
+        crew_vehicle
+        favourite_routes
+        identities
+        created_at
+        updated_at
+    }
+`
+
+// Person is a rider, crew member or SACCO administrator
+type Person struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	Phone           string    `json:"phone"`
+	Role            string    `json:"role"`
+	Sacco           string    `json:"sacco,omitempty"`            // the SACCO a SACCO admin runs
+	Vehicle         string    `json:"vehicle,omitempty"`          // the vehicle a conductor works
+	FavouriteRoutes []string  `json:"favourite_routes,omitempty"` // route numbers
+	Identities      []string  `json:"identities,omitempty"`       // provider|subject of linked logins
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// PersonUpdate holds the fields to change; nil fields are left alone
+type PersonUpdate struct {
+	Name            *string
+	Phone           *string
+	Role            *string
+	Sacco           *string
+	Vehicle         *string
+	FavouriteRoutes *[]string
+}
+
+// personNode is how a Person is stored in Dgraph
+type personNode struct {
+	Uid             string      `json:"uid,omitempty"`
+	DType           []string    `json:"dgraph.type,omitempty"`
+	Name            string      `json:"name,omitempty"`
+	Phone           string      `json:"phone,omitempty"`
+	Role            string      `json:"role,omitempty"`
+	Sacco           string      `json:"sacco,omitempty"`
+	Vehicle         string      `json:"crew_vehicle,omitempty"`
+	FavouriteRoutes []routeNode `json:"favourite_routes,omitempty"`
+	Identities      []string    `json:"identities,omitempty"`
+	CreatedAt       *time.Time  `json:"created_at,omitempty"`
+	UpdatedAt       *time.Time  `json:"updated_at,omitempty"`
+}
+
+type routeNode struct {
+	Uid         string `json:"uid"`
+	RouteNumber string `json:"route_number,omitempty"`
+}
+
+func (n personNode) toPerson() *Person {
+	p := &Person{
+		ID:         n.Uid,
+		Name:       n.Name,
+		Phone:      n.Phone,
+		Role:       n.Role,
+		Sacco:      n.Sacco,
+		Vehicle:    n.Vehicle,
+		Identities: n.Identities,
+	}
+	for _, route := range n.FavouriteRoutes {
+		p.FavouriteRoutes = append(p.FavouriteRoutes, route.RouteNumber)
+	}
+	if n.CreatedAt != nil {
+		p.CreatedAt = *n.CreatedAt
+	}
+	if n.UpdatedAt != nil {
+		p.UpdatedAt = *n.UpdatedAt
+	}
+	return p
+}
+
+const personFields = `
+        uid
+        name
+        phone
+        role
+        sacco
+        crew_vehicle
+        favourite_routes { uid route_number }
+        identities
+        created_at
+        updated_at`
+
+func validRole(role string) bool {
+	for _, r := range PersonRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks a person's fields and tidies them up
+func (p *Person) Validate() error {
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidInput)
+	}
+	if len(p.Name) > maxPersonName {
+		return fmt.Errorf("%w: name is longer than %d characters", ErrInvalidInput, maxPersonName)
+	}
+
+	phone, err := auth.NormalizePhone(p.Phone)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+	p.Phone = phone
+
+	p.Role = strings.ToLower(strings.TrimSpace(p.Role))
+	if p.Role == "" {
+		p.Role = RoleRider
+	}
+	if !validRole(p.Role) {
+		return fmt.Errorf("%w: role must be one of %s", ErrInvalidInput, strings.Join(PersonRoles, ", "))
+	}
+
+	// Tokens scope conductors to their vehicle and SACCO admins to their
+	// SACCO; nobody else has either
+	p.Sacco = strings.TrimSpace(p.Sacco)
+	p.Vehicle = strings.TrimSpace(p.Vehicle)
+	if p.Role != RoleSaccoAdmin {
+		p.Sacco = ""
+	}
+	if p.Role != RoleConductor {
+		p.Vehicle = ""
+	}
+	if p.Role == RoleSaccoAdmin && p.Sacco == "" {
+		return fmt.Errorf("%w: a SACCO admin needs the SACCO they run", ErrInvalidInput)
+	}
+	if p.Role == RoleConductor && p.Vehicle == "" {
+		return fmt.Errorf("%w: a conductor needs the vehicle they work", ErrInvalidInput)
+	}
+
+	seen := make(map[string]bool)
+	routes := p.FavouriteRoutes[:0]
+	for _, route := range p.FavouriteRoutes {
+		route = strings.TrimSpace(route)
+		if route != "" && !seen[route] {
+			seen[route] = true
+			routes = append(routes, route)
+		}
+	}
+	p.FavouriteRoutes = routes
+	return nil
+}
+
+// PersonStore keeps people in Dgraph
+type PersonStore struct {
+	dg *dgraph.Client
+}
+
+func NewPersonStore(dg *dgraph.Client) *PersonStore {
+	return &PersonStore{dg: dg}
+}
+
+// EnsureSchema applies the person schema
+func (s *PersonStore) EnsureSchema(ctx context.Context) error {
+	return s.dg.Alter(ctx, &api.Operation{Schema: personSchema})
+}
+
+// inTxn runs fn in a transaction and commits it, running it again if a
+// conflicting transaction gets Dgraph to abort it
+func (s *PersonStore) inTxn(ctx context.Context, fn func(txn *dgo.Txn) error) error {
+	return s.dg.RetryTxn(ctx, fn)
+}
+
+// phoneOwner returns the uid of whoever has a phone number, if anyone
+func phoneOwner(ctx context.Context, txn *dgo.Txn, phone string) (string, error) {
+	resp, err := txn.QueryWithVars(ctx, `
+    query Owner($phone: string) {
+        people(func: eq(phone, $phone)) @filter(type(Person)) { uid }
+    }`, map[string]string{"$phone": phone})
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		People []personNode `json:"people"`
+	}
+	if err := json.Unmarshal(resp.Json, &result); err != nil {
+		return "", err
+	}
+	if len(result.People) == 0 {
+		return "", nil
+	}
+	return result.People[0].Uid, nil
+}
+
+// resolveRoutes looks up the Route nodes for route numbers
+func resolveRoutes(ctx context.Context, txn *dgo.Txn, routeNumbers []string) ([]routeNode, error) {
+	routes := make([]routeNode, 0, len(routeNumbers))
+	for _, number := range routeNumbers {
+		resp, err := txn.QueryWithVars(ctx, `
+        query Route($number: string) {
+            routes(func: eq(route_number, $number), first: 1) @filter(type(Route)) { uid }
+        }`, map[string]string{"$number": number})
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Routes []routeNode `json:"routes"`
+		}
+		if err := json.Unmarshal(resp.Json, &result); err != nil {
+			return nil, err
+		}
+		if len(result.Routes) == 0 {
+			return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, number)
+		}
+		routes = append(routes, routeNode{Uid: result.Routes[0].Uid})
+	}
+	return routes, nil
+}
+
+// Add stores a new person. Phone numbers are unique.
+func (s *PersonStore) Add(ctx context.Context, p Person) (*Person, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	var uid string
+	err := s.inTxn(ctx, func(txn *dgo.Txn) error {
+		owner, err := phoneOwner(ctx, txn, p.Phone)
+		if err != nil {
+			return err
+		}
+		if owner != "" {
+			return fmt.Errorf("%w: %s", ErrPhoneTaken, p.Phone)
+		}
+		routes, err := resolveRoutes(ctx, txn, p.FavouriteRoutes)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		setJSON, err := json.Marshal(personNode{
+			Uid:             "_:person",
+			DType:           []string{"Person"},
+			Name:            p.Name,
+			Phone:           p.Phone,
+			Role:            p.Role,
+			Sacco:           p.Sacco,
+			Vehicle:         p.Vehicle,
+			FavouriteRoutes: routes,
+			CreatedAt:       &now,
+			UpdatedAt:       &now,
+		})
+		if err != nil {
+			return err
+		}
+
+		resp, err := txn.Mutate(ctx, &api.Mutation{SetJson: setJSON})
+		if err != nil {
+			return err
+		}
+		uid = resp.Uids["person"]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, uid)
+}
+
+func (s *PersonStore) queryPeople(ctx context.Context, query string, vars map[string]string) ([]*Person, error) {
+	txn := s.dg.NewReadOnlyTxn()
+	defer txn.Discard(ctx)
+
+	resp, err := txn.QueryWithVars(ctx, query, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		People []personNode `json:"people"`
+	}
+	if err := json.Unmarshal(resp.Json, &result); err != nil {
+		return nil, err
+	}
+
+	people := make([]*Person, 0, len(result.People))
+	for _, node := range result.People {
+		people = append(people, node.toPerson())
+	}
+	return people, nil
+}
+
+// Get returns the person with a Dgraph uid
+func (s *PersonStore) Get(ctx context.Context, id string) (*Person, error) {
+	if !uidPattern.MatchString(id) {
+		return nil, fmt.Errorf("%w: %q is not a person ID; IDs look like 0x1a2b", ErrInvalidInput, id)
+	}
+
+	people, err := s.queryPeople(ctx, `
+    query Person($id: string) {
+        people(func: uid($id)) @filter(type(Person)) {`+personFields+`
+        }
+    }`, map[string]string{"$id": id})
+	if err != nil {
+		return nil, err
+	}
+	if len(people) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPersonNotFound, id)
+	}
+	return people[0], nil
+}
+
+// FindByPhone returns the person with a phone number
+func (s *PersonStore) FindByPhone(ctx context.Context, phone string) (*Person, error) {
+	normalized, err := auth.NormalizePhone(phone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidInput, err)
+	}
+
+	people, err := s.queryPeople(ctx, `
+    query Person($phone: string) {
+        people(func: eq(phone, $phone)) @filter(type(Person)) {`+personFields+`
+        }
+    }`, map[string]string{"$phone": normalized})
+	if err != nil {
+		return nil, err
+	}
+	if len(people) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrPersonNotFound, normalized)
+	}
+	return people[0], nil
+}
+
+// FindByName returns people whose names share a word with name, optionally
+// only those with a role
+func (s *PersonStore) FindByName(ctx context.Context, name, role string) ([]*Person, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, fmt.Errorf("%w: a name to search for is required", ErrInvalidInput)
+	}
+
+	params := "$name: string"
+	filter := "type(Person)"
+	vars := map[string]string{"$name": name}
+	if role != "" {
+		if !validRole(role) {
+			return nil, fmt.Errorf("%w: role must be one of %s", ErrInvalidInput, strings.Join(PersonRoles, ", "))
+		}
+		params += ", $role: string"
+		filter += " AND eq(role, $role)"
+		vars["$role"] = role
+	}
+
+	return s.queryPeople(ctx, fmt.Sprintf(`
+    query People(%s) {
+        people(func: anyofterms(name, $name), orderasc: name, first: %d) @filter(%s) {`+personFields+`
+        }
+    }`, params, personQueryLimit, filter), vars)
+}
+
+// Update changes the given fields of a person
+func (s *PersonStore) Update(ctx context.Context, id string, update PersonUpdate) (*Person, error) {
+	current, err := s.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *current
+	if update.Name != nil {
+		updated.Name = *update.Name
+	}
+	if update.Phone != nil {
+		updated.Phone = *update.Phone
+	}
+	if update.Role != nil {
+		updated.Role = *update.Role
+	}
+	if update.Sacco != nil {
+		updated.Sacco = *update.Sacco
+	}
+	if update.Vehicle != nil {
+		updated.Vehicle = *update.Vehicle
+	}
+	if update.FavouriteRoutes != nil {
+		updated.FavouriteRoutes = append([]string(nil), (*update.FavouriteRoutes)...)
+	}
+	if err := updated.Validate(); err != nil {
+		return nil, err
+	}
+
+	err = s.inTxn(ctx, func(txn *dgo.Txn) error {
+		if updated.Phone != current.Phone {
+			owner, err := phoneOwner(ctx, txn, updated.Phone)
+			if err != nil {
+				return err
+			}
+			if owner != "" && owner != id {
+				return fmt.Errorf("%w: %s", ErrPhoneTaken, updated.Phone)
+			}
+		}
+
+		now := time.Now()
+		node := personNode{
+			Uid:       id,
+			Name:      updated.Name,
+			Phone:     updated.Phone,
+			Role:      updated.Role,
+			Sacco:     updated.Sacco,
+			Vehicle:   updated.Vehicle,
+			UpdatedAt: &now,
+		}
+
+		// A SACCO or vehicle the new role doesn't have goes
+		mu := &api.Mutation{}
+		if updated.Sacco == "" && current.Sacco != "" {
+			dgo.DeleteEdges(mu, id, "sacco")
+		}
+		if updated.Vehicle == "" && current.Vehicle != "" {
+			dgo.DeleteEdges(mu, id, "crew_vehicle")
+		}
+		if len(mu.Del) > 0 {
+			if _, err := txn.Mutate(ctx, mu); err != nil {
+				return err
+			}
+		}
+
+		if update.FavouriteRoutes != nil {
+			routes, err := resolveRoutes(ctx, txn, updated.FavouriteRoutes)
+			if err != nil {
+				return err
+			}
+			node.FavouriteRoutes = routes
+
+			// Favourites are replaced, not added to
+			mu := &api.Mutation{}
+			dgo.DeleteEdges(mu, id, "favourite_routes")
+			if _, err := txn.Mutate(ctx, mu); err != nil {
+				return err
+			}
+		}
+
+		setJSON, err := json.Marshal(node)
+		if err != nil {
+			return err
+		}
+		_, err = txn.Mutate(ctx, &api.Mutation{SetJson: setJSON})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(ctx, id)
+}
+
+// Delete removes a person
+func (s *PersonStore) Delete(ctx context.Context, id string) error {
+	if _, err := s.Get(ctx, id); err != nil {
+		return err
+	}
+
+	return s.inTxn(ctx, func(txn *dgo.Txn) error {
+		deleteJSON, err := json.Marshal(map[string]string{"uid": id})
+		if err != nil {
+			return err
+		}
+		_, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: deleteJSON})
+		return err
+	})
+}
+
+// String formats a person for the terminal
+func (p *Person) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %s\n", p.ID, p.Name)
+	fmt.Fprintf(&b, "  Phone: %s\n", p.Phone)
+	fmt.Fprintf(&b, "  Role:  %s\n", p.Role)
+	if p.Sacco != "" {
+		fmt.Fprintf(&b, "  SACCO: %s\n", p.Sacco)
+	}
+	if p.Vehicle != "" {
+		fmt.Fprintf(&b, "  Vehicle: %s\n", p.Vehicle)
+	}
+	if len(p.FavouriteRoutes) > 0 {
+		fmt.Fprintf(&b, "  Favourite routes: %s\n", strings.Join(p.FavouriteRoutes, ", "))
+	}
+	if len(p.Identities) > 0 {
+		fmt.Fprintf(&b, "  Signs in with: %s\n", strings.Join(p.Identities, ", "))
+	}
+	if !p.CreatedAt.IsZero() {
+		fmt.Fprintf(&b, "  Added: %s\n", p.CreatedAt.Format(time.RFC1123))
+	}
+	return b.String()
+}
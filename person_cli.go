@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dixonwille/wmenu/v5"
+
+	"motown/auth"
+)
+
+const personRequestTimeout = 30 * time.Second
+
+var stdin = bufio.NewReader(os.Stdin)
+
+// prompt asks for a line of input, returning def if the answer is blank
+func prompt(label, def string) (string, error) {
+	if def != "" {
+		fmt.Printf("%s [%s]: ", label, def)
+	} else {
+		fmt.Printf("%s: ", label)
+	}
+
+	answer, err := stdin.ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && answer != "") {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return def, nil
+	}
+	return answer, nil
+}
+
+// promptRequired keeps asking until it gets an answer that passes check
+func promptRequired(label, def string, check func(string) error) (string, error) {
+	for {
+		answer, err := prompt(label, def)
+		if err != nil {
+			return "", err
+		}
+		if answer == "" {
+			fmt.Println("  This field is required.")
+			continue
+		}
+		if check != nil {
+			if err := check(answer); err != nil {
+				fmt.Printf("  %v\n", err)
+				continue
+			}
+		}
+		return answer, nil
+	}
+}
+
+// promptRole offers the person roles as a menu
+func promptRole(current string) (string, error) {
+	var chosen string
+	roleMenu := wmenu.NewMenu("Role:")
+	roleMenu.Action(func(opts []wmenu.Opt) error {
+		chosen = opts[0].Value.(string)
+		return nil
+	})
+
+	if current == "" {
+		current = RoleRider
+	}
+	for _, role := range PersonRoles {
+		roleMenu.Option(role, role, role == current, nil)
+	}
+
+	if err := roleMenu.Run(); err != nil {
+		return "", err
+	}
+	return chosen, nil
+}
+
+// promptScope asks a conductor for their vehicle and a SACCO admin for
+// their SACCO, which their tokens are scoped to
+func promptScope(role string, current *Person) (sacco, vehicle string, err error) {
+	switch role {
+	case RoleSaccoAdmin:
+		sacco, err = promptRequired("SACCO", current.Sacco, nil)
+	case RoleConductor:
+		vehicle, err = promptRequired("Vehicle", current.Vehicle, nil)
+	}
+	return sacco, vehicle, err
+}
+
+// splitRoutes reads a comma separated list of route numbers
+func splitRoutes(list string) []string {
+	var routes []string
+	for _, route := range strings.Split(list, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func checkPhone(phone string) error {
+	_, err := auth.NormalizePhone(phone)
+	return err
+}
+
+func promptAddPerson(ctx context.Context, store *PersonStore) error {
+	name, err := promptRequired("Name", "", nil)
+	if err != nil {
+		return err
+	}
+	phone, err := promptRequired("Phone", "", checkPhone)
+	if err != nil {
+		return err
+	}
+	role, err := promptRole("")
+	if err != nil {
+		return err
+	}
+	sacco, vehicle, err := promptScope(role, &Person{})
+	if err != nil {
+		return err
+	}
+	routes, err := prompt("Favourite routes (comma separated, optional)", "")
+	if err != nil {
+		return err
+	}
+
+	person, err := store.Add(ctx, Person{
+		Name:            name,
+		Phone:           phone,
+		Role:            role,
+		Sacco:           sacco,
+		Vehicle:         vehicle,
+		FavouriteRoutes: splitRoutes(routes),
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added:\n%s", person)
+	return nil
+}
+
+func promptFindPerson(ctx context.Context, store *PersonStore) error {
+	query, err := promptRequired("ID, phone number or name", "", nil)
+	if err != nil {
+		return err
+	}
+
+	people, err := findPeople(ctx, store, query)
+	if err != nil {
+		return err
+	}
+	if len(people) == 0 {
+		fmt.Println("Nobody found.")
+		return nil
+	}
+	for _, person := range people {
+		fmt.Print(person)
+	}
+	return nil
+}
+
+// findPeople looks a person up by ID or phone, falling back to a name
+// search
+func findPeople(ctx context.Context, store *PersonStore, query string) ([]*Person, error) {
+	if uidPattern.MatchString(query) {
+		person, err := store.Get(ctx, query)
+		if err != nil {
+			return nil, err
+		}
+		return []*Person{person}, nil
+	}
+	if checkPhone(query) == nil {
+		person, err := store.FindByPhone(ctx, query)
+		if errors.Is(err, ErrPersonNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []*Person{person}, nil
+	}
+	return store.FindByName(ctx, query, "")
+}
+
+func promptUpdatePerson(ctx context.Context, store *PersonStore) error {
+	id, err := promptRequired("Person ID", "", nil)
+	if err != nil {
+		return err
+	}
+	current, err := store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	fmt.Print(current)
+	fmt.Println("Press enter to keep a value.")
+
+	name, err := prompt("Name", current.Name)
+	if err != nil {
+		return err
+	}
+	phone, err := promptRequired("Phone", current.Phone, checkPhone)
+	if err != nil {
+		return err
+	}
+	role, err := promptRole(current.Role)
+	if err != nil {
+		return err
+	}
+	sacco, vehicle, err := promptScope(role, current)
+	if err != nil {
+		return err
+	}
+	routeList, err := prompt("Favourite routes (comma separated, - to clear)", strings.Join(current.FavouriteRoutes, ","))
+	if err != nil {
+		return err
+	}
+	routes := splitRoutes(routeList)
+	if routeList == "-" {
+		routes = []string{}
+	}
+
+	person, err := store.Update(ctx, id, PersonUpdate{
+		Name:            &name,
+		Phone:           &phone,
+		Role:            &role,
+		Sacco:           &sacco,
+		Vehicle:         &vehicle,
+		FavouriteRoutes: &routes,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Updated:\n%s", person)
+	return nil
+}
+
+func promptDeletePerson(ctx context.Context, store *PersonStore) error {
+	id, err := promptRequired("Person ID", "", nil)
+	if err != nil {
+		return err
+	}
+	person, err := store.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	fmt.Print(person)
+
+	confirmed := false
+	confirmMenu := wmenu.NewMenu(fmt.Sprintf("Delete %s?", person.Name))
+	confirmMenu.IsYesNo(wmenu.DefN)
+	confirmMenu.Action(func(opts []wmenu.Opt) error {
+		confirmed = opts[0].Value.(string) == "yes"
+		return nil
+	})
+	if err := confirmMenu.Run(); err != nil {
+		return err
+	}
+	if !confirmed {
+		fmt.Println("Left as is.")
+		return nil
+	}
+
+	if err := store.Delete(ctx, id); err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %s.\n", person.Name)
+	return nil
+}
+
+// runPersonCommand is the non-interactive form of the person menu:
+//
+//	motown person add --name "Wanjiku" --phone 0712345678 --role rider --routes 46,111
+//	motown person add --name "Otieno" --phone 0722345678 --role conductor --vehicle "KBX 123A"
+//	motown person find --id 0x1a | --phone 0712345678 | --name Wanjiku [--role conductor]
+//	motown person update --id 0x1a [--name ..] [--phone ..] [--role ..] [--sacco ..] [--vehicle ..] [--routes ..]
+//	motown person delete --id 0x1a
+func runPersonCommand(ctx context.Context, out *output, store *PersonStore, args []string) error {
+	if len(args) == 0 {
+		return usagef("person needs add, find, update or delete")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, personRequestTimeout)
+	defer cancel()
+
+	flags := newFlagSet("person "+args[0], out)
+	id := flags.String("id", "", "person ID")
+	name := flags.String("name", "", "full name")
+	phone := flags.String("phone", "", "mobile number")
+	role := flags.String("role", "", "one of "+strings.Join(PersonRoles, ", "))
+	sacco := flags.String("sacco", "", "the SACCO a SACCO admin runs")
+	vehicle := flags.String("vehicle", "", "the vehicle a conductor works")
+	routes := flags.String("routes", "", "comma separated favourite route numbers")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	switch args[0] {
+	case "add":
+		person, err := store.Add(ctx, Person{
+			Name:            *name,
+			Phone:           *phone,
+			Role:            *role,
+			Sacco:           *sacco,
+			Vehicle:         *vehicle,
+			FavouriteRoutes: splitRoutes(*routes),
+		})
+		if err != nil {
+			return err
+		}
+		return out.emit(person, person.String())
+
+	case "find":
+		var people []*Person
+		switch {
+		case *id != "":
+			person, err := store.Get(ctx, *id)
+			if err != nil {
+				return err
+			}
+			people = append(people, person)
+		case *phone != "":
+			person, err := store.FindByPhone(ctx, *phone)
+			if err != nil {
+				return err
+			}
+			people = append(people, person)
+		case *name != "":
+			found, err := store.FindByName(ctx, *name, *role)
+			if err != nil {
+				return err
+			}
+			people = found
+		default:
+			return usagef("find needs --id, --phone or --name")
+		}
+		if len(people) == 0 {
+			return ErrPersonNotFound
+		}
+
+		var text strings.Builder
+		for _, person := range people {
+			text.WriteString(person.String())
+		}
+		return out.emit(people, text.String())
+
+	case "update":
+		if *id == "" {
+			return usagef("update needs --id")
+		}
+		var update PersonUpdate
+		if set["name"] {
+			update.Name = name
+		}
+		if set["phone"] {
+			update.Phone = phone
+		}
+		if set["role"] {
+			update.Role = role
+		}
+		if set["sacco"] {
+			update.Sacco = sacco
+		}
+		if set["vehicle"] {
+			update.Vehicle = vehicle
+		}
+		if set["routes"] {
+			list := splitRoutes(*routes)
+			update.FavouriteRoutes = &list
+		}
+		person, err := store.Update(ctx, *id, update)
+		if err != nil {
+			return err
+		}
+		return out.emit(person, person.String())
+
+	case "delete":
+		if *id == "" {
+			return usagef("delete needs --id")
+		}
+		if err := store.Delete(ctx, *id); err != nil {
+			return err
+		}
+		return out.emit(map[string]string{"deleted": *id}, fmt.Sprintf("Deleted %s\n", *id))
+
+	default:
+		return usagef("unknown person command %q; use add, find, update or delete", args[0])
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/dgo/v210"
+	"github.com/dgraph-io/dgo/v210/protos/api"
+	"github.com/uber/h3-go/v4"
+)
+
+const (
+	routeH3Resolution   = 9
+	h3CellSpacingMeters = 300 // roughly between neighbouring resolution 9 cells
+	maxSearchRings      = 20
+	defaultSearchRadius = 1000
+	defaultSearchLimit  = 20
+	yesBanaRouteNumber  = "Route Number"
+	yesBanaPickupPoint  = "Bus pickup point in Nairobi"
+	yesBanaDestinations = "Destination/ Bus-Stops"
+)
+
+// Route is a matatu route, in the same shape the engine stores it
+type Route struct {
+	Uid           string          `json:"uid,omitempty"`
+	RouteNumber   string          `json:"route_number"`
+	PickupPoint   string          `json:"pickup_point,omitempty"`
+	Destinations  []string        `json:"destinations,omitempty"`
+	PickupH3Index string          `json:"pickup_h3_index,omitempty"`
+	DestH3Index   string          `json:"dest_h3_index,omitempty"`
+	PickupLat     float64         `json:"pickup_lat,omitempty"`
+	PickupLng     float64         `json:"pickup_lng,omitempty"`
+	DestLat       float64         `json:"dest_lat,omitempty"`
+	DestLng       float64         `json:"dest_lng,omitempty"`
+	Schedule      []RouteSchedule `json:"schedule,omitempty"`
+	Fare          *RouteFare      `json:"fare,omitempty"`
+	ActiveDays    []string        `json:"active_days,omitempty"`
+	LastUpdated   *time.Time      `json:"last_updated,omitempty"`
+}
+
+type RouteSchedule struct {
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	Frequency int    `json:"frequency_minutes"`
+}
+
+type RouteFare struct {
+	Regular float64 `json:"regular_fare"`
+	Peak    float64 `json:"peak_fare,omitempty"`
+	OffPeak float64 `json:"off_peak_fare,omitempty"`
+}
+
+const routeFields = `
+            uid
+            route_number
+            pickup_point
+            destinations
+            pickup_h3_index
+            dest_h3_index
+            pickup_lat
+            pickup_lng
+            dest_lat
+            dest_lng
+            schedule { start_time end_time frequency_minutes }
+            fare { regular_fare peak_fare off_peak_fare }
+            active_days
+            last_updated`
+
+// Validate checks a route's fields and tidies them up
+func (r *Route) Validate() error {
+	r.RouteNumber = strings.TrimSpace(r.RouteNumber)
+	if r.RouteNumber == "" {
+		return fmt.Errorf("%w: route number is required", ErrInvalidInput)
+	}
+	r.PickupPoint = strings.TrimSpace(r.PickupPoint)
+	r.Destinations = splitList(strings.Join(r.Destinations, ","))
+	r.ActiveDays = splitList(strings.Join(r.ActiveDays, ","))
+
+	for _, point := range [][2]float64{{r.PickupLat, r.PickupLng}, {r.DestLat, r.DestLng}} {
+		if math.Abs(point[0]) > 90 || math.Abs(point[1]) > 180 {
+			return fmt.Errorf("%w: %v is not a valid position", ErrInvalidInput, point)
+		}
+	}
+	if r.Fare != nil && (r.Fare.Regular < 0 || r.Fare.Peak < 0 || r.Fare.OffPeak < 0) {
+		return fmt.Errorf("%w: fares can't be negative", ErrInvalidInput)
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping blanks
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseLatLng reads "lat,lng"
+func parseLatLng(value string) (float64, float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%w: %q is not lat,lng", ErrInvalidInput, value)
+	}
+	lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || math.Abs(lat) > 90 || math.Abs(lng) > 180 {
+		return 0, 0, fmt.Errorf("%w: %q is not lat,lng", ErrInvalidInput, value)
+	}
+	return lat, lng, nil
+}
+
+func h3Cell(lat, lng float64) string {
+	return h3.LatLngToCell(h3.LatLng{Lat: lat, Lng: lng}, routeH3Resolution).String()
+}
+
+// RouteStore reads and writes routes in Dgraph
+type RouteStore struct {
+	dg *dgo.Dgraph
+}
+
+func NewRouteStore(dg *dgo.Dgraph) *RouteStore {
+	return &RouteStore{dg: dg}
+}
+
+func (s *RouteStore) queryRoutes(ctx context.Context, query string, vars map[string]string) ([]*Route, error) {
+	txn := s.dg.NewReadOnlyTxn()
+	defer txn.Discard(ctx)
+
+	resp, err := txn.QueryWithVars(ctx, query, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Routes []*Route `json:"routes"`
+	}
+	if err := json.Unmarshal(resp.Json, &result); err != nil {
+		return nil, err
+	}
+	return result.Routes, nil
+}
+
+// Show returns the route with a route number
+func (s *RouteStore) Show(ctx context.Context, number string) (*Route, error) {
+	routes, err := s.queryRoutes(ctx, `
+    query Route($number: string) {
+        routes(func: eq(route_number, $number), first: 1) @filter(type(Route)) {`+routeFields+`
+        }
+    }`, map[string]string{"$number": number})
+	if err != nil {
+		return nil, err
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, number)
+	}
+	return routes[0], nil
+}
+
+// Upsert writes a route, replacing the one with the same route number if
+// there is one
+func (s *RouteStore) Upsert(ctx context.Context, route Route) error {
+	if err := route.Validate(); err != nil {
+		return err
+	}
+
+	node := map[string]interface{}{
+		"uid":          "uid(route)",
+		"dgraph.type":  "Route",
+		"route_number": route.RouteNumber,
+		"pickup_point": route.PickupPoint,
+		"last_updated": time.Now(),
+	}
+	if len(route.Destinations) > 0 {
+		node["destinations"] = route.Destinations
+	}
+	if len(route.ActiveDays) > 0 {
+		node["active_days"] = route.ActiveDays
+	}
+	if route.PickupLat != 0 || route.PickupLng != 0 {
+		node["pickup_lat"] = route.PickupLat
+		node["pickup_lng"] = route.PickupLng
+		node["pickup_h3_index"] = h3Cell(route.PickupLat, route.PickupLng)
+	}
+	if route.DestLat != 0 || route.DestLng != 0 {
+		node["dest_lat"] = route.DestLat
+		node["dest_lng"] = route.DestLng
+		node["dest_h3_index"] = h3Cell(route.DestLat, route.DestLng)
+	}
+	if route.Fare != nil {
+		node["fare"] = map[string]interface{}{
+			"uid":           "uid(fare)",
+			"dgraph.type":   "FareInfo",
+			"regular_fare":  route.Fare.Regular,
+			"peak_fare":     route.Fare.Peak,
+			"off_peak_fare": route.Fare.OffPeak,
+		}
+	}
+
+	// Lists are replaced rather than added to
+	deletes := []string{
+		"uid(route) <destinations> * .",
+		"uid(route) <active_days> * .",
+	}
+	if route.Schedule != nil {
+		deletes = append(deletes, "uid(route) <schedule> * .")
+		schedule := make([]map[string]interface{}, len(route.Schedule))
+		for i, entry := range route.Schedule {
+			schedule[i] = map[string]interface{}{
+				"dgraph.type":       "Schedule",
+				"start_time":        entry.StartTime,
+				"end_time":          entry.EndTime,
+				"frequency_minutes": entry.Frequency,
+			}
+		}
+		node["schedule"] = schedule
+	}
+
+	setJSON, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.dg.NewTxn().Do(ctx, &api.Request{
+		Query: `
+        query Route($number: string) {
+            route as var(func: eq(route_number, $number)) @filter(type(Route)) {
+                fare as fare
+            }
+        }`,
+		Vars: map[string]string{"$number": route.RouteNumber},
+		Mutations: []*api.Mutation{{
+			DelNquads: []byte(strings.Join(deletes, "\n")),
+			SetJson:   setJSON,
+		}},
+		CommitNow: true,
+	})
+	return err
+}
+
+// RouteSearch narrows a route search; empty fields match everything
+type RouteSearch struct {
+	Near        *[2]float64 // lat, lng of the pickup
+	MaxDistance float64     // metres from Near
+	Destination string
+	Day         string
+	MaxFare     float64
+	Limit       int
+}
+
+// Search finds routes picking up near a point, serving a destination, and
+// running on a day within a fare
+func (s *RouteStore) Search(ctx context.Context, search RouteSearch) ([]*Route, error) {
+	var params, conditions []string
+	vars := make(map[string]string)
+
+	if search.Near != nil {
+		if search.MaxDistance <= 0 {
+			search.MaxDistance = defaultSearchRadius
+		}
+		rings := int(math.Ceil(search.MaxDistance / h3CellSpacingMeters))
+		if rings > maxSearchRings {
+			rings = maxSearchRings
+		}
+
+		origin := h3.LatLngToCell(h3.LatLng{Lat: search.Near[0], Lng: search.Near[1]}, routeH3Resolution)
+		var cells []string
+		for _, cell := range h3.GridDisk(origin, rings) {
+			cells = append(cells, strconv.Quote(cell.String()))
+		}
+		conditions = append(conditions, "eq(pickup_h3_index, ["+strings.Join(cells, ", ")+"])")
+	}
+	if search.Destination != "" {
+		params = append(params, "$destination: string")
+		conditions = append(conditions, "anyofterms(destinations, $destination)")
+		vars["$destination"] = search.Destination
+	}
+	if search.Day != "" {
+		params = append(params, "$day: string")
+		conditions = append(conditions, "anyofterms(active_days, $day)")
+		vars["$day"] = search.Day
+	}
+
+	filter := "type(Route)"
+	if len(conditions) > 0 {
+		filter += " AND " + strings.Join(conditions, " AND ")
+	}
+	routes, err := s.queryRoutes(ctx, fmt.Sprintf(`
+    query Search(%s) {
+        routes(func: type(Route), orderasc: route_number) @filter(%s) {`+routeFields+`
+        }
+    }`, strings.Join(params, ", "), filter), vars)
+	if err != nil {
+		return nil, err
+	}
+
+	// The cell rings overshoot the radius, and fares live on another node,
+	// so both are checked here
+	matched := routes[:0]
+	for _, route := range routes {
+		if search.Near != nil &&
+			distance(search.Near[0], search.Near[1], route.PickupLat, route.PickupLng, "K")*1000 > search.MaxDistance {
+			continue
+		}
+		if search.MaxFare > 0 && (route.Fare == nil || route.Fare.Regular > search.MaxFare) {
+			continue
+		}
+		matched = append(matched, route)
+	}
+
+	if search.Limit <= 0 {
+		search.Limit = defaultSearchLimit
+	}
+	if len(matched) > search.Limit {
+		matched = matched[:search.Limit]
+	}
+	return matched, nil
+}
+
+// parseRouteFile reads routes from JSON, either in the engine's route
+// shape or the YesBana listing in 58/YesBana.json. Entries without a route
+// number are returned as skipped.
+func parseRouteFile(r io.Reader) ([]Route, []string, error) {
+	var raw []map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, nil, fmt.Errorf("%w: route file must be a JSON array: %v", ErrInvalidInput, err)
+	}
+
+	var routes []Route
+	var skipped []string
+	for i, entry := range raw {
+		var route Route
+		if _, yesBana := entry[yesBanaRouteNumber]; yesBana {
+			route.RouteNumber = fmt.Sprint(entry[yesBanaRouteNumber])
+			route.PickupPoint, _ = entry[yesBanaPickupPoint].(string)
+			destinations, _ := entry[yesBanaDestinations].(string)
+			route.Destinations = splitList(destinations)
+		} else {
+			encoded, err := json.Marshal(entry)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := json.Unmarshal(encoded, &route); err != nil {
+				return nil, nil, fmt.Errorf("%w: entry %d: %v", ErrInvalidInput, i+1, err)
+			}
+		}
+
+		if err := route.Validate(); err != nil {
+			skipped = append(skipped, fmt.Sprintf("entry %d: %v", i+1, err))
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes, skipped, nil
+}
+
+func (r *Route) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Route %s: %s -> %s\n", r.RouteNumber, r.PickupPoint, strings.Join(r.Destinations, ", "))
+	if r.PickupLat != 0 || r.PickupLng != 0 {
+		fmt.Fprintf(&b, "  Pickup at: %.6f,%.6f\n", r.PickupLat, r.PickupLng)
+	}
+	if r.Fare != nil {
+		fmt.Fprintf(&b, "  Fare: %.0f (peak %.0f, off-peak %.0f)\n", r.Fare.Regular, r.Fare.Peak, r.Fare.OffPeak)
+	}
+	if len(r.ActiveDays) > 0 {
+		fmt.Fprintf(&b, "  Days: %s\n", strings.Join(r.ActiveDays, ", "))
+	}
+	for _, entry := range r.Schedule {
+		fmt.Fprintf(&b, "  %s-%s every %d min\n", entry.StartTime, entry.EndTime, entry.Frequency)
+	}
+	return b.String()
+}
+
+// RouteImport reports what routes import did
+type RouteImport struct {
+	Imported []string `json:"imported"`
+	Skipped  []string `json:"skipped,omitempty"`
+	DryRun   bool     `json:"dry_run"`
+}
+
+// runRoutesCommand manages routes:
+//
+//	motown routes import --file 58/YesBana.json [--dry-run]
+//	motown routes search [--near lat,lng] [--within m] [--destination ..] [--day ..] [--max-fare n] [--limit n]
+//	motown routes show <route number>
+//	motown routes update --number n [--pickup ..] [--destinations a,b] [--pickup-at lat,lng]
+//	                     [--dest-at lat,lng] [--fare n] [--peak-fare n] [--off-peak-fare n] [--days ..]
+func runRoutesCommand(ctx context.Context, out *output, args []string) error {
+	if len(args) == 0 {
+		return usagef("routes needs import, search, show or update")
+	}
+	flags := newFlagSet("routes "+args[0], out)
+
+	switch args[0] {
+	case "import":
+		file := flags.String("file", "", "JSON file of routes, - for stdin")
+		dryRun := flags.Bool("dry-run", false, "check the file without writing anything")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if *file == "" {
+			return usagef("import needs --file")
+		}
+
+		var source io.Reader = os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			source = f
+		}
+		routes, skipped, err := parseRouteFile(source)
+		if err != nil {
+			return err
+		}
+
+		result := RouteImport{Skipped: skipped, DryRun: *dryRun}
+		if !*dryRun {
+			store, closeStore, err := openRouteStore()
+			if err != nil {
+				return err
+			}
+			defer closeStore()
+
+			for _, route := range routes {
+				if err := store.Upsert(ctx, route); err != nil {
+					return fmt.Errorf("importing route %s: %w", route.RouteNumber, err)
+				}
+				result.Imported = append(result.Imported, route.RouteNumber)
+			}
+		} else {
+			for _, route := range routes {
+				result.Imported = append(result.Imported, route.RouteNumber)
+			}
+		}
+
+		verb := "Imported"
+		if *dryRun {
+			verb = "Would import"
+		}
+		text := fmt.Sprintf("%s %d routes\n", verb, len(result.Imported))
+		for _, reason := range skipped {
+			text += "  skipped " + reason + "\n"
+		}
+		return out.emit(result, text)
+
+	case "search":
+		near := flags.String("near", "", "pickup near lat,lng")
+		within := flags.Float64("within", defaultSearchRadius, "metres from --near")
+		destination := flags.String("destination", "", "a stop the route serves")
+		day := flags.String("day", "", "day the route runs, e.g. Monday")
+		maxFare := flags.Float64("max-fare", 0, "highest regular fare")
+		limit := flags.Int("limit", defaultSearchLimit, "most routes to list")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+
+		search := RouteSearch{
+			MaxDistance: *within,
+			Destination: *destination,
+			Day:         *day,
+			MaxFare:     *maxFare,
+			Limit:       *limit,
+		}
+		if *near != "" {
+			lat, lng, err := parseLatLng(*near)
+			if err != nil {
+				return err
+			}
+			search.Near = &[2]float64{lat, lng}
+		}
+
+		store, closeStore, err := openRouteStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+
+		routes, err := store.Search(ctx, search)
+		if err != nil {
+			return err
+		}
+		var text strings.Builder
+		for _, route := range routes {
+			text.WriteString(route.String())
+		}
+		if len(routes) == 0 {
+			text.WriteString("No routes found\n")
+		}
+		return out.emit(routes, text.String())
+
+	case "show":
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return usagef("show needs a route number")
+		}
+
+		store, closeStore, err := openRouteStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+
+		route, err := store.Show(ctx, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		return out.emit(route, route.String())
+
+	case "update":
+		number := flags.String("number", "", "route number")
+		pickup := flags.String("pickup", "", "pickup point")
+		destinations := flags.String("destinations", "", "comma separated stops")
+		pickupAt := flags.String("pickup-at", "", "pickup lat,lng")
+		destAt := flags.String("dest-at", "", "destination lat,lng")
+		fare := flags.Float64("fare", 0, "regular fare")
+		peakFare := flags.Float64("peak-fare", 0, "peak hours fare")
+		offPeakFare := flags.Float64("off-peak-fare", 0, "off-peak fare")
+		days := flags.String("days", "", "comma separated days the route runs")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		if *number == "" {
+			return usagef("update needs --number")
+		}
+		set := make(map[string]bool)
+		flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+		store, closeStore, err := openRouteStore()
+		if err != nil {
+			return err
+		}
+		defer closeStore()
+
+		route, err := store.Show(ctx, *number)
+		if err != nil {
+			return err
+		}
+		if set["pickup"] {
+			route.PickupPoint = *pickup
+		}
+		if set["destinations"] {
+			route.Destinations = splitList(*destinations)
+		}
+		if set["days"] {
+			route.ActiveDays = splitList(*days)
+		}
+		if set["pickup-at"] {
+			if route.PickupLat, route.PickupLng, err = parseLatLng(*pickupAt); err != nil {
+				return err
+			}
+		}
+		if set["dest-at"] {
+			if route.DestLat, route.DestLng, err = parseLatLng(*destAt); err != nil {
+				return err
+			}
+		}
+		if set["fare"] || set["peak-fare"] || set["off-peak-fare"] {
+			if route.Fare == nil {
+				route.Fare = &RouteFare{}
+			}
+			if set["fare"] {
+				route.Fare.Regular = *fare
+			}
+			if set["peak-fare"] {
+				route.Fare.Peak = *peakFare
+			}
+			if set["off-peak-fare"] {
+				route.Fare.OffPeak = *offPeakFare
+			}
+		}
+		route.Schedule = nil // leave the schedule as it is
+
+		if err := store.Upsert(ctx, *route); err != nil {
+			return err
+		}
+		updated, err := store.Show(ctx, *number)
+		if err != nil {
+			return err
+		}
+		return out.emit(updated, updated.String())
+
+	default:
+		return usagef("unknown routes command %q; use import, search, show or update", args[0])
+	}
+}
+
+func openRouteStore() (*RouteStore, func(), error) {
+	dgraphClient, closeClient, err := createDgraphClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewRouteStore(dgraphClient.Dgraph), closeClient, nil
+}
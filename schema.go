@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/dgo/v210/protos/api"
+)
+
+// routeSchema is the engine's schema for routes, route sets, incidents,
+// bookings and payments
+//
+//go:embed src/schema.dql
+var routeSchema string
+
+// schemaParts are applied in order by schema apply
+var schemaParts = []struct {
+	name   string
+	schema string
+}{
+	{"routes", routeSchema},
+	{"people", personSchema},
+}
+
+// SchemaResult reports what schema apply did
+type SchemaResult struct {
+	Applied []string `json:"applied"`
+	DryRun  bool     `json:"dry_run"`
+	Schema  string   `json:"schema,omitempty"`
+}
+
+// runSchemaCommand applies the Dgraph schema:
+//
+//	motown schema apply [--dry-run]
+func runSchemaCommand(ctx context.Context, out *output, args []string) error {
+	if len(args) == 0 || args[0] != "apply" {
+		return usagef("schema needs apply")
+	}
+
+	flags := newFlagSet("schema apply", out)
+	dryRun := flags.Bool("dry-run", false, "print the schema without applying it")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+
+	result := SchemaResult{DryRun: *dryRun}
+	if *dryRun {
+		var b strings.Builder
+		for _, part := range schemaParts {
+			fmt.Fprintf(&b, "# %s\n%s\n", part.name, strings.TrimSpace(part.schema))
+			result.Applied = append(result.Applied, part.name)
+		}
+		result.Schema = b.String()
+		return out.emit(result, result.Schema)
+	}
+
+	dgraphClient, closeClient, err := createDgraphClient()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+
+	// The parts share a few predicates, so each goes in its own alter
+	for _, part := range schemaParts {
+		if err := dgraphClient.Alter(ctx, &api.Operation{Schema: part.schema}); err != nil {
+			return fmt.Errorf("applying %s schema: %w", part.name, err)
+		}
+		result.Applied = append(result.Applied, part.name)
+	}
+	return out.emit(result, fmt.Sprintf("Applied the %s schema\n", strings.Join(result.Applied, " and ")))
+}
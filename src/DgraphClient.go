@@ -1,19 +1,36 @@
 package main
 
-// Function to create a Dgraph client
-func createDgraphClient() *dgo.Dgraph {
-    conn, err := grpc.Dial(dgraphServer, grpc.WithInsecure())
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+
+    "motown/auth"
+    "motown/dgraph"
+)
+
+// Function to create a Dgraph client from the DGRAPH_* settings, for Dgraph
+// Cloud or self-hosted alphas. Close it once done with it.
+func createDgraphClient() *dgraph.Client {
+    config, err := dgraph.LoadConfig(os.Getenv)
     if err != nil {
-        log.Fatal("Unable to connect to Dgraph server:", err)
+        log.Fatal(err)
     }
-
-    dgraphClient := dgo.NewDgraphClient(api.NewDgraphClient(conn))
-    return dgraphClient
+    client, err := dgraph.Open(context.Background(), config)
+    if err != nil {
+        log.Fatal("Unable to connect to Dgraph:", err)
+    }
+    return client
 }
 
 // Client mode: Perform a simple Dgraph query
 func dgraphClientExample() {
     dgraphClient := createDgraphClient()
+    defer dgraphClient.Close()
     ctx := context.Background()
 
     // Create a query to fetch data from Dgraph
@@ -33,13 +50,77 @@ func dgraphClientExample() {
     fmt.Printf("Query result: %s\n", response.Json)
 }
 
-// Server mode: Start a simple HTTP server
-func dgraphServerExample() {
-    http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-        fmt.Fprintf(w, "Dgraph server is running...")
-    })
+// serveAPI serves the REST API on addr (":8080" if empty) until
+// interrupted, letting requests in flight finish before closing the
+// connections to Dgraph
+func serveAPI(addr string) {
+    client := createDgraphClient()
+    defer client.Close()
+    dgraphClient := client.Dgraph
+    planner := NewRoutePlanner(dgraphClient, NewRouteCache(15*time.Minute))
+    rtm := NewRealTimeManager(client, planner)
+    defer rtm.Close()
 
-    fmt.Println("Server is listening at http://localhost:8080")
-    log.Fatal(http.ListenAndServe(":8080", nil))
-}
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
 
+    // Real-time state survives restarts when it is journalled; the log is
+    // replayed before anything new comes in
+    if dir := os.Getenv("EVENT_LOG_DIR"); dir != "" {
+        if err := rtm.OpenEventLog(dir, EventLogOptions{}); err != nil {
+            log.Fatal("Opening event log:", err)
+        }
+    }
+
+    // Unhealthy routes are reported to the configured sinks
+    alertConfig, err := LoadAlertConfig(os.Getenv)
+    if err != nil {
+        log.Fatal("Alerts:", err)
+    }
+    if err := rtm.Alerts().Configure(alertConfig); err != nil {
+        log.Fatal("Alerts:", err)
+    }
+
+    // Incidents still active before a restart keep alerting their routes
+    if err := rtm.RestoreIncidents(ctx); err != nil {
+        log.Fatal("Restoring incidents:", err)
+    }
+    // Every stored route is health checked; the API schedules the routes
+    // it saves from here on
+    if err := rtm.MonitorAllRoutes(ctx); err != nil {
+        log.Fatal("Scheduling route health checks:", err)
+    }
+
+    authConfig, err := auth.LoadConfig(os.Getenv)
+    if err != nil {
+        log.Fatal("API authentication:", err)
+    }
+    // Tokens signed out on the login server stop working here too
+    authConfig.Revocations = auth.NewRevocationList(NewSessionStore(client))
+    if err := authConfig.Revocations.Sync(ctx); err != nil {
+        log.Fatal("Loading token revocations:", err)
+    }
+    go authConfig.Revocations.Run(ctx, revocationSyncInterval)
+    tokens, err := auth.NewService(authConfig)
+    if err != nil {
+        log.Fatal("API authentication:", err)
+    }
+
+    // Fares are taken with M-Pesa when it is configured
+    darajaConfig, ok, err := LoadDarajaConfig(os.Getenv)
+    if err != nil {
+        log.Fatal("M-Pesa payments:", err)
+    }
+    if ok {
+        provider, err := NewDarajaProvider(darajaConfig)
+        if err != nil {
+            log.Fatal("M-Pesa payments:", err)
+        }
+        rtm.Payments().AddProvider(provider)
+    }
+
+    server := NewAPIServer(APIConfig{Addr: addr, Auth: tokens, Health: client.Health}, planner, rtm)
+    if err := server.ListenAndServe(ctx); err != nil {
+        log.Println("API server stopped:", err)
+    }
+}
@@ -1,3 +1,5 @@
+//go:build ignore
+
 // find strings in a dir. can be a list of strings
 
 package main
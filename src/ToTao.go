@@ -1,7 +1,10 @@
+//go:build ignore
+
 //get current location
 package main
 
 import ("bytes"
+      "context"
       "encoding/json"
       "fmt"
       "os/exec"
@@ -28,9 +31,9 @@ func checkRouteNo(file,Address) string{
 	
 
 }
-func requestMat(location){
+func requestMat(ctx context.Context, rtm *RealTimeManager, location, destination Location) (*RideOffer, error) {
   /*Find the nearest matatu
-  Do a blockchain lookup from location specified
+  heading our way, ranked by when it reaches location
   */
-  //Query matatu's going to town only
+  return rtm.RequestRide(ctx, RideRequest{Pickup: location, Destination: destination})
 }
@@ -0,0 +1,630 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/smtp"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "motown/auth"
+)
+
+const (
+    defaultAlertCooldown  = 30 * time.Minute
+    notificationQueueSize = 100
+    notificationTimeout   = 10 * time.Second
+)
+
+// Notification states
+const (
+    AlertFiring   = "firing"
+    AlertResolved = "resolved"
+)
+
+// AlertRule fires when a route's health score stays below a threshold for
+// a while. It applies to the listed routes, the routes of a route set, or
+// every route if neither is given.
+type AlertRule struct {
+    ID         string        `json:"id"`
+    Name       string        `json:"name"`
+    RouteIDs   []string      `json:"route_ids,omitempty"`
+    RouteSetID string        `json:"route_set_id,omitempty"`
+    MaxScore   float64       `json:"max_score"` // fire below this score
+    For        time.Duration `json:"for"`       // how long the score must stay low
+    Cooldown   time.Duration `json:"cooldown"`  // quiet period after an alert resolves
+    Severity   string        `json:"severity"`
+    Sinks      []string      `json:"sinks,omitempty"` // empty for every sink
+}
+
+// Notification is what sinks deliver to operators
+type Notification struct {
+    RuleID   string     `json:"rule_id"`
+    RuleName string     `json:"rule_name"`
+    RouteID  string     `json:"route_id"`
+    Status   string     `json:"status"`
+    Severity string     `json:"severity"`
+    Score    float64    `json:"health_score"`
+    State    string     `json:"state"`
+    Issues   []string   `json:"issues,omitempty"`
+    StartsAt time.Time  `json:"starts_at"`
+    EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+// Summary is a one-line description for subjects and SMS
+func (n Notification) Summary() string {
+    return fmt.Sprintf("[%s] %s: route %s is %s (score %.2f)",
+        strings.ToUpper(n.Status), n.RuleName, n.RouteID, n.State, n.Score)
+}
+
+// Body is the full text of a notification
+func (n Notification) Body() string {
+    var b strings.Builder
+    b.WriteString(n.Summary())
+    b.WriteString("\n\nSince: " + n.StartsAt.Local().Format(time.RFC1123))
+    if n.EndsAt != nil {
+        b.WriteString("\nResolved: " + n.EndsAt.Local().Format(time.RFC1123))
+    }
+    for _, issue := range n.Issues {
+        b.WriteString("\n- " + issue)
+    }
+    return b.String()
+}
+
+// NotificationSink delivers notifications somewhere operators will see them
+type NotificationSink interface {
+    Name() string
+    Send(ctx context.Context, n Notification) error
+}
+
+// alertState tracks one rule against one route
+type alertState struct {
+    breachedAt time.Time // zero while the score is fine
+    firing     *Notification
+    quietUntil time.Time
+}
+
+// AlertManager turns route health into notifications, once per incident of
+// bad health rather than on every check
+type AlertManager struct {
+    rtm    *RealTimeManager
+    rules  map[string]AlertRule
+    sinks  map[string]NotificationSink
+    states map[string]*alertState // rule + route -> state
+    queue  chan Notification
+    sent   chan struct{}
+    now    func() time.Time
+    closed bool
+    mu     sync.Mutex
+}
+
+func NewAlertManager(rtm *RealTimeManager) *AlertManager {
+    am := &AlertManager{
+        rtm:    rtm,
+        rules:  make(map[string]AlertRule),
+        sinks:  make(map[string]NotificationSink),
+        states: make(map[string]*alertState),
+        queue:  make(chan Notification, notificationQueueSize),
+        sent:   make(chan struct{}),
+        now:    time.Now,
+    }
+    go am.dispatch()
+    return am
+}
+
+// AddSink registers a sink under its name
+func (am *AlertManager) AddSink(sink NotificationSink) {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    am.sinks[sink.Name()] = sink
+}
+
+// AddRule adds or replaces a rule
+func (am *AlertManager) AddRule(rule AlertRule) (AlertRule, error) {
+    if rule.MaxScore <= 0 || rule.MaxScore > 1 {
+        return rule, fmt.Errorf("alert rule threshold must be in (0, 1], got %.2f", rule.MaxScore)
+    }
+    if rule.For < 0 || rule.Cooldown < 0 {
+        return rule, fmt.Errorf("alert rule durations can't be negative")
+    }
+    if rule.ID == "" {
+        rule.ID = generateUUID()
+    }
+    if rule.Name == "" {
+        rule.Name = fmt.Sprintf("Health below %.2f", rule.MaxScore)
+    }
+    if rule.Cooldown == 0 {
+        rule.Cooldown = defaultAlertCooldown
+    }
+    if rule.Severity == "" {
+        rule.Severity = SeverityMedium
+    }
+
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    for _, name := range rule.Sinks {
+        if _, exists := am.sinks[name]; !exists {
+            return rule, fmt.Errorf("alert rule uses unknown sink %q", name)
+        }
+    }
+    am.rules[rule.ID] = rule
+    return rule, nil
+}
+
+// RemoveRule deletes a rule and forgets its alerts
+func (am *AlertManager) RemoveRule(ruleID string) {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+
+    delete(am.rules, ruleID)
+    for key := range am.states {
+        if strings.HasPrefix(key, ruleID+"/") {
+            delete(am.states, key)
+        }
+    }
+}
+
+// Rules lists the rules by name
+func (am *AlertManager) Rules() []AlertRule {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+
+    rules := make([]AlertRule, 0, len(am.rules))
+    for _, rule := range am.rules {
+        rules = append(rules, rule)
+    }
+    sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+    return rules
+}
+
+// Configure registers the sinks and then the rules of a loaded config
+func (am *AlertManager) Configure(config AlertConfig) error {
+    for _, sink := range config.Sinks {
+        am.AddSink(sink)
+    }
+    for _, rule := range config.Rules {
+        if _, err := am.AddRule(rule); err != nil {
+            return fmt.Errorf("alert rule %q: %w", rule.Name, err)
+        }
+    }
+    return nil
+}
+
+// appliesTo reports whether a rule covers a route
+func (am *AlertManager) appliesTo(ctx context.Context, rule AlertRule, routeID string) bool {
+    if len(rule.RouteIDs) == 0 && rule.RouteSetID == "" {
+        return true
+    }
+    for _, id := range rule.RouteIDs {
+        if id == routeID {
+            return true
+        }
+    }
+    if rule.RouteSetID == "" || am.rtm.planner == nil {
+        return false
+    }
+
+    routeSet, err := am.rtm.planner.getRouteSet(ctx, rule.RouteSetID)
+    if err != nil {
+        log.Printf("Alert rule %s: %v", rule.Name, err)
+        return false
+    }
+    for _, id := range routeSet.Routes {
+        if id == routeID {
+            return true
+        }
+    }
+    return false
+}
+
+// Observe feeds a health check result through every rule
+func (am *AlertManager) Observe(ctx context.Context, health HealthMetrics) {
+    am.mu.Lock()
+    rules := make([]AlertRule, 0, len(am.rules))
+    for _, rule := range am.rules {
+        rules = append(rules, rule)
+    }
+    am.mu.Unlock()
+
+    for _, rule := range rules {
+        if !am.appliesTo(ctx, rule, health.RouteID) {
+            continue
+        }
+        if n := am.evaluate(rule, health); n != nil {
+            am.enqueue(*n)
+        }
+    }
+}
+
+// evaluate advances one rule for one route, returning a notification to
+// send if there is something new to say
+func (am *AlertManager) evaluate(rule AlertRule, health HealthMetrics) *Notification {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+
+    key := rule.ID + "/" + health.RouteID
+    state, exists := am.states[key]
+    if !exists {
+        state = &alertState{}
+        am.states[key] = state
+    }
+    now := am.now()
+
+    if health.Score >= rule.MaxScore {
+        state.breachedAt = time.Time{}
+        if state.firing == nil {
+            return nil
+        }
+
+        resolved := *state.firing
+        resolved.Status = AlertResolved
+        resolved.Score = health.Score
+        resolved.State = health.State
+        resolved.Issues = health.Issues
+        resolved.EndsAt = &now
+        state.firing = nil
+        state.quietUntil = now.Add(rule.Cooldown)
+        return &resolved
+    }
+
+    if state.breachedAt.IsZero() {
+        state.breachedAt = health.LastChecked
+    }
+    if state.firing != nil {
+        // Already told; keep the details current for Firing
+        state.firing.Score = health.Score
+        state.firing.State = health.State
+        state.firing.Issues = health.Issues
+        return nil
+    }
+    if health.LastChecked.Sub(state.breachedAt) < rule.For || now.Before(state.quietUntil) {
+        return nil
+    }
+
+    state.firing = &Notification{
+        RuleID:   rule.ID,
+        RuleName: rule.Name,
+        RouteID:  health.RouteID,
+        Status:   AlertFiring,
+        Severity: rule.Severity,
+        Score:    health.Score,
+        State:    health.State,
+        Issues:   health.Issues,
+        StartsAt: state.breachedAt,
+    }
+    firing := *state.firing
+    return &firing
+}
+
+// Firing lists the alerts currently firing
+func (am *AlertManager) Firing() []Notification {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+
+    var firing []Notification
+    for _, state := range am.states {
+        if state.firing != nil {
+            firing = append(firing, *state.firing)
+        }
+    }
+    sort.Slice(firing, func(i, j int) bool { return firing[i].StartsAt.Before(firing[j].StartsAt) })
+    return firing
+}
+
+func (am *AlertManager) enqueue(n Notification) {
+    am.mu.Lock()
+    defer am.mu.Unlock()
+    if am.closed {
+        return
+    }
+
+    select {
+    case am.queue <- n:
+    default:
+        log.Printf("Notification queue full, dropping: %s", n.Summary())
+    }
+}
+
+// dispatch sends queued notifications to their sinks
+func (am *AlertManager) dispatch() {
+    defer close(am.sent)
+
+    for n := range am.queue {
+        am.mu.Lock()
+        rule := am.rules[n.RuleID]
+        var sinks []NotificationSink
+        if len(rule.Sinks) == 0 {
+            for _, sink := range am.sinks {
+                sinks = append(sinks, sink)
+            }
+        } else {
+            for _, name := range rule.Sinks {
+                if sink, exists := am.sinks[name]; exists {
+                    sinks = append(sinks, sink)
+                }
+            }
+        }
+        am.mu.Unlock()
+
+        for _, sink := range sinks {
+            ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+            if err := sink.Send(ctx, n); err != nil {
+                log.Printf("Sending alert via %s: %v", sink.Name(), err)
+            }
+            cancel()
+        }
+    }
+}
+
+// Close sends what is queued and stops
+func (am *AlertManager) Close() {
+    am.mu.Lock()
+    if am.closed {
+        am.mu.Unlock()
+        return
+    }
+    am.closed = true
+    close(am.queue)
+    am.mu.Unlock()
+
+    <-am.sent
+}
+
+// WebhookSink posts notifications as JSON. With a secret set, the body is
+// signed with HMAC-SHA256 in the X-Signature-256 header.
+type WebhookSink struct {
+    URL    string
+    Secret string
+    Client *http.Client
+}
+
+func (s WebhookSink) Name() string { return "webhook" }
+
+func (s WebhookSink) Send(ctx context.Context, n Notification) error {
+    body, err := json.Marshal(n)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if s.Secret != "" {
+        mac := hmac.New(sha256.New, []byte(s.Secret))
+        mac.Write(body)
+        req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+
+    return doNotify(s.Client, req)
+}
+
+// SMTPSink emails notifications. Addr can point at a local stand-in such
+// as MailHog for testing.
+type SMTPSink struct {
+    Addr string // host:port
+    From string
+    To   []string
+    Auth smtp.Auth // nil for servers that don't authenticate
+}
+
+func (s SMTPSink) Name() string { return "smtp" }
+
+func (s SMTPSink) Send(ctx context.Context, n Notification) error {
+    var msg strings.Builder
+    msg.WriteString("From: " + s.From + "\r\n")
+    msg.WriteString("To: " + strings.Join(s.To, ", ") + "\r\n")
+    msg.WriteString("Subject: " + n.Summary() + "\r\n")
+    msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+    msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+    msg.WriteString(strings.ReplaceAll(n.Body(), "\n", "\r\n"))
+    msg.WriteString("\r\n")
+
+    // net/smtp has no context support; run it aside so we can give up
+    errc := make(chan error, 1)
+    go func() {
+        errc <- smtp.SendMail(s.Addr, s.Auth, s.From, s.To, []byte(msg.String()))
+    }()
+    select {
+    case err := <-errc:
+        return err
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// SMSSink sends notifications through an HTTP SMS gateway that takes a
+// form post of recipients, message and sender ID, authenticated by an API
+// key header
+type SMSSink struct {
+    GatewayURL string
+    APIKey     string
+    Username   string
+    SenderID   string
+    To         []string
+    Client     *http.Client
+}
+
+func (s SMSSink) Name() string { return "sms" }
+
+func (s SMSSink) Send(ctx context.Context, n Notification) error {
+    form := url.Values{}
+    form.Set("username", s.Username)
+    form.Set("to", strings.Join(s.To, ","))
+    form.Set("message", n.Summary())
+    if s.SenderID != "" {
+        form.Set("from", s.SenderID)
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.GatewayURL, strings.NewReader(form.Encode()))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.Header.Set("Accept", "application/json")
+    req.Header.Set("apiKey", s.APIKey)
+
+    return doNotify(s.Client, req)
+}
+
+func doNotify(client *http.Client, req *http.Request) error {
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+        return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+    }
+    return nil
+}
+
+// LogSink writes notifications to the log; handy as a fallback and in
+// development
+type LogSink struct{}
+
+func (LogSink) Name() string { return "log" }
+
+func (LogSink) Send(ctx context.Context, n Notification) error {
+    log.Print(n.Summary())
+    return nil
+}
+
+// AlertConfig is the sinks and rules alerting starts with
+type AlertConfig struct {
+    Sinks []NotificationSink
+    Rules []AlertRule
+}
+
+// alertRuleEntry is an AlertRule as written in a rules file, with durations
+// such as "10m"
+type alertRuleEntry struct {
+    AlertRule
+    For      string `json:"for"`
+    Cooldown string `json:"cooldown"`
+}
+
+// LoadAlertConfig reads the alert sinks and rules from settings:
+//
+//	ALERT_WEBHOOK_URL     where to post notifications as JSON
+//	ALERT_WEBHOOK_SECRET  signs the webhook bodies, if set
+//	ALERT_SMTP_ADDR       mail server host:port to email notifications through
+//	ALERT_SMTP_FROM       sender address
+//	ALERT_SMTP_TO         comma separated recipients
+//	ALERT_SMTP_USERNAME   with ALERT_SMTP_PASSWORD, if the server authenticates
+//	ALERT_SMS_URL         SMS gateway to text notifications through
+//	ALERT_SMS_API_KEY     gateway API key
+//	ALERT_SMS_USERNAME    gateway account
+//	ALERT_SMS_SENDER_ID   sender ID, the gateway's default if unset
+//	ALERT_SMS_TO          comma separated phone numbers
+//	ALERT_RULES_FILE      JSON array of alert rules
+//
+// Notifications are logged whatever else is configured.
+func LoadAlertConfig(lookup func(string) string) (AlertConfig, error) {
+    config := AlertConfig{Sinks: []NotificationSink{LogSink{}}}
+
+    if webhookURL := lookup("ALERT_WEBHOOK_URL"); webhookURL != "" {
+        config.Sinks = append(config.Sinks, WebhookSink{URL: webhookURL, Secret: lookup("ALERT_WEBHOOK_SECRET")})
+    }
+
+    if addr := lookup("ALERT_SMTP_ADDR"); addr != "" {
+        sink := SMTPSink{Addr: addr, From: lookup("ALERT_SMTP_FROM"), To: commaList(lookup("ALERT_SMTP_TO"))}
+        if sink.From == "" || len(sink.To) == 0 {
+            return AlertConfig{}, fmt.Errorf("ALERT_SMTP_ADDR is set, so ALERT_SMTP_FROM and ALERT_SMTP_TO must be too")
+        }
+        if username := lookup("ALERT_SMTP_USERNAME"); username != "" {
+            host, _, err := net.SplitHostPort(addr)
+            if err != nil {
+                return AlertConfig{}, fmt.Errorf("ALERT_SMTP_ADDR %q is not host:port", addr)
+            }
+            sink.Auth = smtp.PlainAuth("", username, lookup("ALERT_SMTP_PASSWORD"), host)
+        }
+        config.Sinks = append(config.Sinks, sink)
+    }
+
+    if gateway := lookup("ALERT_SMS_URL"); gateway != "" {
+        sink := SMSSink{
+            GatewayURL: gateway,
+            APIKey:     lookup("ALERT_SMS_API_KEY"),
+            Username:   lookup("ALERT_SMS_USERNAME"),
+            SenderID:   lookup("ALERT_SMS_SENDER_ID"),
+        }
+        for _, phone := range commaList(lookup("ALERT_SMS_TO")) {
+            normalized, err := auth.NormalizePhone(phone)
+            if err != nil {
+                return AlertConfig{}, fmt.Errorf("ALERT_SMS_TO: %w", err)
+            }
+            sink.To = append(sink.To, normalized)
+        }
+        if sink.APIKey == "" || sink.Username == "" || len(sink.To) == 0 {
+            return AlertConfig{}, fmt.Errorf("ALERT_SMS_URL is set, so ALERT_SMS_API_KEY, ALERT_SMS_USERNAME and ALERT_SMS_TO must be too")
+        }
+        config.Sinks = append(config.Sinks, sink)
+    }
+
+    if path := lookup("ALERT_RULES_FILE"); path != "" {
+        rules, err := readAlertRules(path)
+        if err != nil {
+            return AlertConfig{}, fmt.Errorf("ALERT_RULES_FILE: %w", err)
+        }
+        config.Rules = rules
+    }
+    return config, nil
+}
+
+// readAlertRules reads a JSON array of alert rules
+func readAlertRules(path string) ([]AlertRule, error) {
+    data, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var entries []alertRuleEntry
+    if err := json.Unmarshal(data, &entries); err != nil {
+        return nil, fmt.Errorf("reading %s: %w", path, err)
+    }
+
+    rules := make([]AlertRule, len(entries))
+    for i, entry := range entries {
+        rule := entry.AlertRule
+        if entry.For != "" {
+            if rule.For, err = time.ParseDuration(entry.For); err != nil {
+                return nil, fmt.Errorf("rule %d: for %q is not a duration", i+1, entry.For)
+            }
+        }
+        if entry.Cooldown != "" {
+            if rule.Cooldown, err = time.ParseDuration(entry.Cooldown); err != nil {
+                return nil, fmt.Errorf("rule %d: cooldown %q is not a duration", i+1, entry.Cooldown)
+            }
+        }
+        rules[i] = rule
+    }
+    return rules, nil
+}
+
+// commaList splits a comma separated setting, dropping empty entries
+func commaList(value string) []string {
+    var values []string
+    for _, v := range strings.Split(value, ",") {
+        if v = strings.TrimSpace(v); v != "" {
+            values = append(values, v)
+        }
+    }
+    return values
+}
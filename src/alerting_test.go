@@ -0,0 +1,473 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+var testNotification = Notification{
+    RuleID:   "rule-1",
+    RuleName: "Route down",
+    RouteID:  "route-1",
+    Status:   AlertFiring,
+    Severity: SeverityHigh,
+    Score:    0.2,
+    State:    HealthDown,
+    Issues:   []string{"no vehicles seen for 20m"},
+    StartsAt: time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC),
+}
+
+func TestWebhookSink(t *testing.T) {
+    tests := []struct {
+        name    string
+        secret  string
+        status  int
+        wantErr bool
+    }{
+        {name: "unsigned", status: http.StatusOK},
+        {name: "signed", secret: "s3cret", status: http.StatusNoContent},
+        {name: "rejected", status: http.StatusInternalServerError, wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var body []byte
+            var signature string
+            server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                body, _ = io.ReadAll(r.Body)
+                signature = r.Header.Get("X-Signature-256")
+                w.WriteHeader(tt.status)
+            }))
+            defer server.Close()
+
+            err := WebhookSink{URL: server.URL, Secret: tt.secret}.Send(context.Background(), testNotification)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Send() error = %v, want error %v", err, tt.wantErr)
+            }
+
+            var got Notification
+            if err := json.Unmarshal(body, &got); err != nil {
+                t.Fatalf("webhook body is not a notification: %v", err)
+            }
+            if got.RouteID != testNotification.RouteID || got.Status != AlertFiring {
+                t.Errorf("webhook got %+v", got)
+            }
+
+            want := ""
+            if tt.secret != "" {
+                mac := hmac.New(sha256.New, []byte(tt.secret))
+                mac.Write(body)
+                want = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+            }
+            if signature != want {
+                t.Errorf("X-Signature-256 = %q, want %q", signature, want)
+            }
+        })
+    }
+}
+
+func TestSMSSink(t *testing.T) {
+    tests := []struct {
+        name     string
+        senderID string
+        status   int
+        wantErr  bool
+    }{
+        {name: "sent", senderID: "MOTOWN", status: http.StatusCreated},
+        {name: "no sender ID", status: http.StatusOK},
+        {name: "gateway down", status: http.StatusBadGateway, wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var form map[string]string
+            var apiKey string
+            server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                r.ParseForm()
+                form = map[string]string{
+                    "username": r.PostForm.Get("username"),
+                    "to":       r.PostForm.Get("to"),
+                    "message":  r.PostForm.Get("message"),
+                    "from":     r.PostForm.Get("from"),
+                }
+                apiKey = r.Header.Get("apiKey")
+                w.WriteHeader(tt.status)
+            }))
+            defer server.Close()
+
+            sink := SMSSink{
+                GatewayURL: server.URL,
+                APIKey:     "key",
+                Username:   "sandbox",
+                SenderID:   tt.senderID,
+                To:         []string{"+254712345678", "+254798765432"},
+            }
+            err := sink.Send(context.Background(), testNotification)
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("Send() error = %v, want error %v", err, tt.wantErr)
+            }
+
+            if apiKey != "key" {
+                t.Errorf("apiKey header = %q", apiKey)
+            }
+            want := map[string]string{
+                "username": "sandbox",
+                "to":       "+254712345678,+254798765432",
+                "message":  testNotification.Summary(),
+                "from":     tt.senderID,
+            }
+            for field, value := range want {
+                if form[field] != value {
+                    t.Errorf("form %s = %q, want %q", field, form[field], value)
+                }
+            }
+        })
+    }
+}
+
+// smtpStandIn accepts one connection at a time and speaks just enough SMTP
+// for net/smtp to deliver a message, which it keeps
+type smtpStandIn struct {
+    listener net.Listener
+    mu       sync.Mutex
+    messages []string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &smtpStandIn{listener: listener}
+    go s.serve()
+    t.Cleanup(func() { listener.Close() })
+    return s
+}
+
+func (s *smtpStandIn) serve() {
+    for {
+        conn, err := s.listener.Accept()
+        if err != nil {
+            return
+        }
+        s.session(conn)
+    }
+}
+
+func (s *smtpStandIn) session(conn net.Conn) {
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+    reply("220 localhost ready")
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return
+        }
+        command := strings.ToUpper(strings.TrimSpace(line))
+        switch {
+        case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+            reply("250 localhost")
+        case strings.HasPrefix(command, "DATA"):
+            reply("354 end with .")
+            var message strings.Builder
+            for {
+                line, err := reader.ReadString('\n')
+                if err != nil {
+                    return
+                }
+                if line == ".\r\n" {
+                    break
+                }
+                message.WriteString(line)
+            }
+            s.mu.Lock()
+            s.messages = append(s.messages, message.String())
+            s.mu.Unlock()
+            reply("250 queued")
+        case strings.HasPrefix(command, "QUIT"):
+            reply("221 bye")
+            return
+        default:
+            reply("250 ok")
+        }
+    }
+}
+
+func (s *smtpStandIn) received() []string {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return append([]string(nil), s.messages...)
+}
+
+func TestSMTPSink(t *testing.T) {
+    server := newSMTPStandIn(t)
+    sink := SMTPSink{
+        Addr: server.listener.Addr().String(),
+        From: "alerts@motown.test",
+        To:   []string{"ops@motown.test", "sacco@motown.test"},
+    }
+    if err := sink.Send(context.Background(), testNotification); err != nil {
+        t.Fatalf("Send() error = %v", err)
+    }
+
+    messages := server.received()
+    if len(messages) != 1 {
+        t.Fatalf("stand-in got %d messages, want 1", len(messages))
+    }
+    for _, want := range []string{
+        "From: alerts@motown.test\r\n",
+        "To: ops@motown.test, sacco@motown.test\r\n",
+        "Subject: " + testNotification.Summary() + "\r\n",
+        "- no vehicles seen for 20m",
+    } {
+        if !strings.Contains(messages[0], want) {
+            t.Errorf("message is missing %q:\n%s", want, messages[0])
+        }
+    }
+}
+
+func TestSMTPSinkGivesUp(t *testing.T) {
+    // A server that accepts but never greets holds net/smtp until the
+    // context runs out
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer listener.Close()
+    go func() {
+        conn, err := listener.Accept()
+        if err == nil {
+            defer conn.Close()
+            io.Copy(io.Discard, conn)
+        }
+    }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+    sink := SMTPSink{Addr: listener.Addr().String(), From: "alerts@motown.test", To: []string{"ops@motown.test"}}
+    if err := sink.Send(ctx, testNotification); err != context.DeadlineExceeded {
+        t.Fatalf("Send() error = %v, want %v", err, context.DeadlineExceeded)
+    }
+}
+
+// recordingSink keeps what it is sent
+type recordingSink struct {
+    name string
+    mu   sync.Mutex
+    sent []Notification
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Send(ctx context.Context, n Notification) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.sent = append(s.sent, n)
+    return nil
+}
+
+func TestAlertManagerDeduplicatesAndCoolsDown(t *testing.T) {
+    start := time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+    type check struct {
+        after time.Duration // since start
+        score float64
+    }
+    tests := []struct {
+        name   string
+        checks []check
+        want   []string // statuses sent, in order
+    }{
+        {
+            name:   "healthy route says nothing",
+            checks: []check{{0, 0.9}, {time.Minute, 0.8}},
+        },
+        {
+            name:   "brief dip is not long enough",
+            checks: []check{{0, 0.3}, {2 * time.Minute, 0.3}, {3 * time.Minute, 0.9}},
+        },
+        {
+            name:   "fires once however long it stays down",
+            checks: []check{{0, 0.3}, {5 * time.Minute, 0.3}, {6 * time.Minute, 0.2}, {7 * time.Minute, 0.1}},
+            want:   []string{AlertFiring},
+        },
+        {
+            name:   "resolves when the score recovers",
+            checks: []check{{0, 0.3}, {5 * time.Minute, 0.3}, {6 * time.Minute, 0.9}, {7 * time.Minute, 0.9}},
+            want:   []string{AlertFiring, AlertResolved},
+        },
+        {
+            name: "stays quiet through the cool-down",
+            checks: []check{
+                {0, 0.3}, {5 * time.Minute, 0.3}, {6 * time.Minute, 0.9},
+                {7 * time.Minute, 0.3}, {13 * time.Minute, 0.3},
+            },
+            want: []string{AlertFiring, AlertResolved},
+        },
+        {
+            name: "fires again after the cool-down",
+            checks: []check{
+                {0, 0.3}, {5 * time.Minute, 0.3}, {6 * time.Minute, 0.9},
+                {20 * time.Minute, 0.3}, {25 * time.Minute, 0.3},
+            },
+            want: []string{AlertFiring, AlertResolved, AlertFiring},
+        },
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            am := NewAlertManager(&RealTimeManager{})
+            sink := &recordingSink{name: "recording"}
+            am.AddSink(sink)
+            if _, err := am.AddRule(AlertRule{ID: "rule-1", MaxScore: 0.5, For: 5 * time.Minute, Cooldown: 10 * time.Minute}); err != nil {
+                t.Fatal(err)
+            }
+
+            var now time.Time
+            am.now = func() time.Time { return now }
+            for _, c := range tt.checks {
+                now = start.Add(c.after)
+                am.Observe(context.Background(), HealthMetrics{RouteID: "route-1", Score: c.score, State: HealthDegraded, LastChecked: now})
+            }
+            am.Close()
+
+            var got []string
+            for _, n := range sink.sent {
+                got = append(got, n.Status)
+            }
+            if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+                t.Errorf("sent %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestAlertRuleSinks(t *testing.T) {
+    am := NewAlertManager(&RealTimeManager{})
+    webhook := &recordingSink{name: "webhook"}
+    sms := &recordingSink{name: "sms"}
+    am.AddSink(webhook)
+    am.AddSink(sms)
+
+    if _, err := am.AddRule(AlertRule{MaxScore: 0.5, Sinks: []string{"pager"}}); err == nil {
+        t.Error("AddRule accepted an unknown sink")
+    }
+    if _, err := am.AddRule(AlertRule{MaxScore: 1.5}); err == nil {
+        t.Error("AddRule accepted a threshold above 1")
+    }
+    if _, err := am.AddRule(AlertRule{ID: "sms-only", MaxScore: 0.5, Sinks: []string{"sms"}}); err != nil {
+        t.Fatal(err)
+    }
+
+    am.Observe(context.Background(), HealthMetrics{RouteID: "route-1", Score: 0.1, State: HealthDown, LastChecked: time.Now()})
+    am.Close()
+
+    if len(sms.sent) != 1 || len(webhook.sent) != 0 {
+        t.Errorf("sms got %d, webhook got %d; want 1 and 0", len(sms.sent), len(webhook.sent))
+    }
+}
+
+func TestLoadAlertConfig(t *testing.T) {
+    rulesFile := filepath.Join(t.TempDir(), "rules.json")
+    rules := `[{"name": "Route down", "route_ids": ["0x1"], "max_score": 0.3, "for": "10m", "severity": "high", "sinks": ["sms"]},
+        {"max_score": 0.6, "cooldown": "1h"}]`
+    if err := os.WriteFile(rulesFile, []byte(rules), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    badRulesFile := filepath.Join(t.TempDir(), "rules.json")
+    if err := os.WriteFile(badRulesFile, []byte(`[{"max_score": 0.5, "for": "soon"}]`), 0o644); err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name      string
+        settings  map[string]string
+        wantSinks []string
+        wantRules []AlertRule
+        wantErr   bool
+    }{
+        {name: "nothing configured", wantSinks: []string{"log"}},
+        {
+            name: "every sink",
+            settings: map[string]string{
+                "ALERT_WEBHOOK_URL":   "https://ops.example.com/hooks/motown",
+                "ALERT_SMTP_ADDR":     "localhost:1025",
+                "ALERT_SMTP_FROM":     "alerts@motown.example",
+                "ALERT_SMTP_TO":       "ops@motown.example, duty@motown.example",
+                "ALERT_SMTP_USERNAME": "alerts",
+                "ALERT_SMS_URL":       "https://sms.example.com/messaging",
+                "ALERT_SMS_API_KEY":   "key",
+                "ALERT_SMS_USERNAME":  "motown",
+                "ALERT_SMS_TO":        "0712 345678,+254 722 000000",
+            },
+            wantSinks: []string{"log", "webhook", "smtp", "sms"},
+        },
+        {
+            name:     "smtp without recipients",
+            settings: map[string]string{"ALERT_SMTP_ADDR": "localhost:1025", "ALERT_SMTP_FROM": "alerts@motown.example"},
+            wantErr:  true,
+        },
+        {
+            name:     "sms to a number that isn't one",
+            settings: map[string]string{"ALERT_SMS_URL": "https://sms.example.com", "ALERT_SMS_API_KEY": "key", "ALERT_SMS_USERNAME": "motown", "ALERT_SMS_TO": "12345"},
+            wantErr:  true,
+        },
+        {
+            name:      "rules file",
+            settings:  map[string]string{"ALERT_RULES_FILE": rulesFile},
+            wantSinks: []string{"log"},
+            wantRules: []AlertRule{
+                {Name: "Route down", RouteIDs: []string{"0x1"}, MaxScore: 0.3, For: 10 * time.Minute, Severity: SeverityHigh, Sinks: []string{"sms"}},
+                {MaxScore: 0.6, Cooldown: time.Hour},
+            },
+        },
+        {name: "rules with a bad duration", settings: map[string]string{"ALERT_RULES_FILE": badRulesFile}, wantErr: true},
+        {name: "missing rules file", settings: map[string]string{"ALERT_RULES_FILE": filepath.Join(t.TempDir(), "none.json")}, wantErr: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            config, err := LoadAlertConfig(func(key string) string { return tt.settings[key] })
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("LoadAlertConfig error = %v, want error %v", err, tt.wantErr)
+            }
+            if err != nil {
+                return
+            }
+
+            var sinks []string
+            for _, sink := range config.Sinks {
+                sinks = append(sinks, sink.Name())
+            }
+            if !reflect.DeepEqual(sinks, tt.wantSinks) {
+                t.Errorf("sinks = %v, want %v", sinks, tt.wantSinks)
+            }
+            if !reflect.DeepEqual(config.Rules, tt.wantRules) {
+                t.Errorf("rules = %+v, want %+v", config.Rules, tt.wantRules)
+            }
+            for _, sink := range config.Sinks {
+                if sms, ok := sink.(SMSSink); ok {
+                    if want := []string{"+254712345678", "+254722000000"}; !reflect.DeepEqual(sms.To, want) {
+                        t.Errorf("SMS recipients = %v, want %v", sms.To, want)
+                    }
+                }
+                if mail, ok := sink.(SMTPSink); ok && (len(mail.To) != 2 || mail.Auth == nil) {
+                    t.Errorf("SMTP sink = %+v, want two recipients and auth", mail)
+                }
+            }
+        })
+    }
+}
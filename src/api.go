@@ -0,0 +1,1582 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "net/http"
+    "net/url"
+    "reflect"
+    "regexp"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "motown/auth"
+    "motown/dgraph"
+)
+
+const (
+    defaultAPIAddr        = ":8080"
+    defaultShutdownWait   = 10 * time.Second
+    defaultPageLimit      = 50
+    maxPageLimit          = 500
+    maxRequestBody        = 1 << 20
+    maxSearchDistance     = 20000 // meters
+    defaultPositionMaxAge = 5 * time.Minute
+    dgraphHealthTimeout   = 2 * time.Second
+)
+
+var (
+    ErrInvalidRequest = errors.New("invalid request")
+
+    uidPattern   = regexp.MustCompile(`^0x[0-9a-f]+$`)
+    clockPattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+)
+
+// APIConfig configures the REST API server
+type APIConfig struct {
+    Addr string // listen address, ":8080" if empty
+    // ShutdownWait is how long requests in flight get to finish once the
+    // server is told to stop
+    ShutdownWait time.Duration
+    Stream       StreamConfig
+    // Auth verifies the bearer token on every endpoint but the public ones.
+    // Without it the API is open to anyone who can reach it.
+    Auth *auth.Service
+    // Policy decides what each role may do, PolicyRules if nil
+    Policy *auth.Policy
+    // Health checks Dgraph for /health, which answers 503 while no alpha
+    // does. Without it /health only says the server is up.
+    Health func(ctx context.Context) ([]dgraph.AlphaHealth, error)
+}
+
+// FieldError is a request field that failed validation
+type FieldError struct {
+    Field   string `json:"field"`
+    Message string `json:"message"`
+}
+
+// ValidationError collects everything wrong with a request, so clients can
+// fix it in one go
+type ValidationError struct {
+    Fields []FieldError
+}
+
+func (e *ValidationError) Add(field, format string, args ...interface{}) {
+    e.Fields = append(e.Fields, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (e *ValidationError) Error() string {
+    problems := make([]string, len(e.Fields))
+    for i, f := range e.Fields {
+        problems[i] = f.Field + ": " + f.Message
+    }
+    return "invalid request: " + strings.Join(problems, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+    return ErrInvalidRequest
+}
+
+// Err returns the validation error, or nil if nothing was added
+func (e *ValidationError) Err() error {
+    if len(e.Fields) == 0 {
+        return nil
+    }
+    return e
+}
+
+// APIError is the body of every error response
+type APIError struct {
+    Code    string       `json:"code"`
+    Message string       `json:"message"`
+    Fields  []FieldError `json:"fields,omitempty"`
+}
+
+type errorEnvelope struct {
+    Error APIError `json:"error"`
+}
+
+// Page describes one page of a list response
+type Page struct {
+    Limit  int    `json:"limit"`
+    Offset int    `json:"offset"`
+    Total  int    `json:"total"`
+    Next   string `json:"next,omitempty"` // URL of the next page
+}
+
+type dataEnvelope struct {
+    Data interface{} `json:"data"`
+    Page *Page       `json:"page,omitempty"`
+}
+
+// pageOf is what list handlers return: one page of items
+type pageOf struct {
+    items interface{}
+    page  Page
+}
+
+// apiHandler returns the response data, or an error to be sent as an error
+// envelope
+type apiHandler func(r *http.Request) (interface{}, error)
+
+// queryParam documents a query parameter
+type queryParam struct {
+    Name        string
+    Type        string // OpenAPI type: string, number, integer
+    Description string
+    Required    bool
+}
+
+// endpoint is a route the server answers, described well enough to generate
+// the OpenAPI document from
+type endpoint struct {
+    Method   string
+    Path     string // path parameters in braces, e.g. /v1/routes/{id}
+    Summary  string
+    Tag      string
+    Query    []queryParam
+    Body     interface{} // a value of the request body type, if there is one
+    Response interface{} // a value of the response data type
+    Status   int         // on success; 200 if zero
+    Paged    bool
+    Produces string // response content type, JSON if empty
+    Public   bool   // answered without a token
+    Action   string // what the policy must allow the caller, unless Public
+    handle   apiHandler
+    serve    http.Handler // answers the request itself, without the envelope
+    segments []string
+}
+
+type pathParamsKey struct{}
+
+// pathParam returns a path parameter of the endpoint handling r
+func pathParam(r *http.Request, name string) string {
+    params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+    return params[name]
+}
+
+// APIServer serves the versioned REST API over the route planner and the
+// real-time manager
+type APIServer struct {
+    config    APIConfig
+    planner   *RoutePlanner
+    rtm       *RealTimeManager
+    endpoints []*endpoint
+    stopping  chan struct{} // closed once shutdown starts, ending live streams
+}
+
+func NewAPIServer(config APIConfig, planner *RoutePlanner, rtm *RealTimeManager) *APIServer {
+    if config.Addr == "" {
+        config.Addr = defaultAPIAddr
+    }
+    if config.ShutdownWait <= 0 {
+        config.ShutdownWait = defaultShutdownWait
+    }
+    if config.Stream.Heartbeat <= 0 {
+        config.Stream.Heartbeat = defaultStreamHeartbeat
+    }
+    if config.Stream.Rate <= 0 {
+        config.Stream.Rate = defaultStreamRate
+    }
+    if config.Stream.Burst <= 0 {
+        config.Stream.Burst = defaultStreamBurst
+    }
+    if config.Stream.MessageRate <= 0 {
+        config.Stream.MessageRate = defaultStreamMessageRate
+    }
+    if config.Stream.MessageBurst <= 0 {
+        config.Stream.MessageBurst = defaultStreamMessageBurst
+    }
+    if config.Policy == nil {
+        config.Policy = auth.NewPolicy(PolicyRules)
+    }
+
+    s := &APIServer{config: config, planner: planner, rtm: rtm, stopping: make(chan struct{})}
+    s.registerEndpoints()
+    return s
+}
+
+func (s *APIServer) handle(e endpoint) {
+    if !e.Public && e.Action == "" {
+        panic(fmt.Sprintf("%s %s is neither public nor guarded by an action", e.Method, e.Path))
+    }
+    e.segments = strings.Split(strings.Trim(e.Path, "/"), "/")
+    s.endpoints = append(s.endpoints, &e)
+}
+
+// match finds the endpoint for a path, returning the methods the path
+// allows when none matches the method
+func (s *APIServer) match(method, path string) (*endpoint, map[string]string, []string) {
+    segments := strings.Split(strings.Trim(path, "/"), "/")
+    var allowed []string
+
+    for _, e := range s.endpoints {
+        if len(e.segments) != len(segments) {
+            continue
+        }
+        params := make(map[string]string)
+        matched := true
+        for i, segment := range e.segments {
+            if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+                value, err := url.PathUnescape(segments[i])
+                if err != nil || value == "" {
+                    matched = false
+                    break
+                }
+                params[segment[1:len(segment)-1]] = value
+            } else if segment != segments[i] {
+                matched = false
+                break
+            }
+        }
+        if !matched {
+            continue
+        }
+        if e.Method == method {
+            return e, params, nil
+        }
+        allowed = append(allowed, e.Method)
+    }
+    return nil, nil, allowed
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    defer func() {
+        if recovered := recover(); recovered != nil {
+            log.Printf("API %s %s panicked: %v", r.Method, r.URL.Path, recovered)
+            writeError(w, http.StatusInternalServerError, APIError{Code: "internal", Message: "internal error"})
+        }
+    }()
+
+    e, params, allowed := s.match(r.Method, r.URL.Path)
+    if e == nil {
+        if len(allowed) > 0 {
+            w.Header().Set("Allow", strings.Join(allowed, ", "))
+            writeError(w, http.StatusMethodNotAllowed, APIError{
+                Code:    "method_not_allowed",
+                Message: fmt.Sprintf("%s is not allowed here; use %s", r.Method, strings.Join(allowed, " or ")),
+            })
+            return
+        }
+        writeError(w, http.StatusNotFound, APIError{Code: "not_found", Message: "no such endpoint: " + r.URL.Path})
+        return
+    }
+
+    r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+    if s.config.Auth != nil && !e.Public {
+        serve := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            s.serveEndpoint(w, r, e)
+        })
+        s.config.Auth.Middleware(s.config.Policy.Middleware(e.Action, serve)).ServeHTTP(w, r)
+        return
+    }
+    s.serveEndpoint(w, r, e)
+}
+
+// serveEndpoint answers a request matched to e
+func (s *APIServer) serveEndpoint(w http.ResponseWriter, r *http.Request, e *endpoint) {
+    if e.serve != nil {
+        e.serve.ServeHTTP(w, r)
+        return
+    }
+    data, err := e.handle(r)
+    if err != nil {
+        status, apiErr := errorResponse(err)
+        if status == http.StatusInternalServerError {
+            log.Printf("API %s %s: %v", r.Method, r.URL.Path, err)
+        }
+        writeError(w, status, apiErr)
+        return
+    }
+
+    status := e.Status
+    if status == 0 {
+        status = http.StatusOK
+    }
+    if status == http.StatusNoContent {
+        w.WriteHeader(status)
+        return
+    }
+
+    envelope := dataEnvelope{Data: data}
+    if page, ok := data.(pageOf); ok {
+        envelope.Data = page.items
+        envelope.Page = &page.page
+        if page.page.Offset+page.page.Limit < page.page.Total {
+            next := *r.URL
+            query := next.Query()
+            query.Set("offset", strconv.Itoa(page.page.Offset+page.page.Limit))
+            query.Set("limit", strconv.Itoa(page.page.Limit))
+            next.RawQuery = query.Encode()
+            envelope.Page.Next = next.RequestURI()
+        }
+    }
+    writeJSON(w, status, envelope)
+}
+
+// errorResponse maps an error onto a status and error body. Errors that
+// aren't the client's doing are not described, as they may leak internals.
+func errorResponse(err error) (int, APIError) {
+    var validation *ValidationError
+    switch {
+    case errors.As(err, &validation):
+        return http.StatusBadRequest, APIError{Code: "invalid_request", Message: "the request has invalid fields", Fields: validation.Fields}
+    case errors.Is(err, ErrInvalidRequest):
+        return http.StatusBadRequest, APIError{Code: "invalid_request", Message: err.Error()}
+    case errors.Is(err, auth.ErrForbidden):
+        return http.StatusForbidden, APIError{Code: "forbidden", Message: err.Error()}
+    case errors.Is(err, ErrUnknownProvider):
+        return http.StatusBadRequest, APIError{Code: "invalid_request", Message: err.Error()}
+    case errors.Is(err, ErrRouteNotFound), errors.Is(err, ErrRouteSetNotFound),
+        errors.Is(err, ErrTripNotFound), errors.Is(err, ErrBookingNotFound),
+        errors.Is(err, ErrPaymentNotFound), errors.Is(err, ErrRefundNotFound),
+        errors.Is(err, ErrIncidentNotFound), errors.Is(err, ErrRideRequestNotFound),
+        errors.Is(err, ErrSeatRequestNotFound):
+        return http.StatusNotFound, APIError{Code: "not_found", Message: err.Error()}
+    case errors.Is(err, ErrRouteSetConflict), errors.Is(err, ErrNoSeats),
+        errors.Is(err, ErrIdempotencyReuse), errors.Is(err, ErrPaymentNotRefundable),
+        errors.Is(err, ErrSeatRequestClosed), errors.Is(err, ErrSeatAlreadyRequested),
+        errors.Is(err, ErrBookingTransition):
+        return http.StatusConflict, APIError{Code: "conflict", Message: err.Error()}
+    case errors.Is(err, context.DeadlineExceeded):
+        return http.StatusGatewayTimeout, APIError{Code: "timeout", Message: "the request took too long"}
+    default:
+        return http.StatusInternalServerError, APIError{Code: "internal", Message: "internal error"}
+    }
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    if err := json.NewEncoder(w).Encode(body); err != nil {
+        log.Printf("Writing API response: %v", err)
+    }
+}
+
+func writeError(w http.ResponseWriter, status int, apiErr APIError) {
+    writeJSON(w, status, errorEnvelope{Error: apiErr})
+}
+
+// ListenAndServe serves the API until ctx is done, then gives requests in
+// flight ShutdownWait to finish
+func (s *APIServer) ListenAndServe(ctx context.Context) error {
+    server := &http.Server{
+        Addr:              s.config.Addr,
+        Handler:           s,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    // Shutdown doesn't wait for streams to end by themselves
+    server.RegisterOnShutdown(func() { close(s.stopping) })
+
+    served := make(chan error, 1)
+    go func() {
+        served <- server.ListenAndServe()
+    }()
+    log.Printf("API listening on %s", s.config.Addr)
+    if s.config.Auth == nil {
+        log.Printf("API authentication is off; anyone who can reach %s can use it", s.config.Addr)
+    }
+
+    select {
+    case err := <-served:
+        return err
+    case <-ctx.Done():
+    }
+
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownWait)
+    defer cancel()
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        return err
+    }
+    if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
+
+// decodeBody reads a JSON request body into v, refusing unknown fields
+func decodeBody(r *http.Request, v interface{}) error {
+    decoder := json.NewDecoder(io.LimitReader(r.Body, maxRequestBody))
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(v); err != nil {
+        verr := &ValidationError{}
+        verr.Add("body", "%v", err)
+        return verr
+    }
+    if decoder.More() {
+        verr := &ValidationError{}
+        verr.Add("body", "must be a single JSON value")
+        return verr
+    }
+    return nil
+}
+
+// paginate cuts one page out of a slice, as asked for by the limit and
+// offset query parameters
+func paginate(r *http.Request, items interface{}) (interface{}, error) {
+    verr := &ValidationError{}
+    query := r.URL.Query()
+    limit := queryInt(query, "limit", defaultPageLimit, verr)
+    offset := queryInt(query, "offset", 0, verr)
+    if limit < 1 || limit > maxPageLimit {
+        verr.Add("limit", "must be between 1 and %d", maxPageLimit)
+    }
+    if offset < 0 {
+        verr.Add("offset", "can't be negative")
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    all := reflect.ValueOf(items)
+    total := all.Len()
+    start, end := offset, offset+limit
+    if start > total {
+        start = total
+    }
+    if end > total {
+        end = total
+    }
+
+    // An empty page is [] rather than null
+    page := reflect.MakeSlice(all.Type(), 0, end-start)
+    page = reflect.AppendSlice(page, all.Slice(start, end))
+    return pageOf{
+        items: page.Interface(),
+        page:  Page{Limit: limit, Offset: offset, Total: total},
+    }, nil
+}
+
+func queryInt(query url.Values, name string, def int, verr *ValidationError) int {
+    value := query.Get(name)
+    if value == "" {
+        return def
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil {
+        verr.Add(name, "must be a whole number")
+    }
+    return n
+}
+
+func queryFloat(query url.Values, name string, verr *ValidationError) float64 {
+    value := query.Get(name)
+    if value == "" {
+        return 0
+    }
+    f, err := strconv.ParseFloat(value, 64)
+    if err != nil {
+        verr.Add(name, "must be a number")
+    }
+    return f
+}
+
+// queryLocation reads a "lat,lng" query parameter; it returns nil when the
+// parameter is absent
+func queryLocation(query url.Values, name string, verr *ValidationError) *Location {
+    value := query.Get(name)
+    if value == "" {
+        return nil
+    }
+    parts := strings.Split(value, ",")
+    if len(parts) != 2 {
+        verr.Add(name, "must be lat,lng")
+        return nil
+    }
+    lat, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+    lng, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+    if err1 != nil || err2 != nil {
+        verr.Add(name, "must be lat,lng")
+        return nil
+    }
+    location := &Location{Lat: lat, Lng: lng}
+    validateLocation(name, *location, verr)
+    return location
+}
+
+func validateLocation(field string, location Location, verr *ValidationError) {
+    if location.Lat < -90 || location.Lat > 90 || location.Lng < -180 || location.Lng > 180 {
+        verr.Add(field, "%v,%v is not a valid position", location.Lat, location.Lng)
+    }
+}
+
+func validateWeekday(field, day string, verr *ValidationError) {
+    for d := time.Sunday; d <= time.Saturday; d++ {
+        if strings.EqualFold(day, d.String()) {
+            return
+        }
+    }
+    verr.Add(field, "%q is not a day of the week", day)
+}
+
+func routeID(r *http.Request) (string, error) {
+    id := pathParam(r, "id")
+    if !uidPattern.MatchString(id) {
+        verr := &ValidationError{}
+        verr.Add("id", "%q is not a route ID; IDs look like 0x1a2b", id)
+        return "", verr
+    }
+    return id, nil
+}
+
+// validateSearch checks search criteria, whether from a query or a body
+func validateSearch(criteria SearchCriteria, verr *ValidationError) {
+    if criteria.NearLocation != nil {
+        validateLocation("near_location", *criteria.NearLocation, verr)
+    }
+    if criteria.MaxDistance < 0 || criteria.MaxDistance > maxSearchDistance {
+        verr.Add("max_distance", "must be between 0 and %d meters", maxSearchDistance)
+    }
+    if criteria.MaxDistance > 0 && criteria.NearLocation == nil {
+        verr.Add("max_distance", "needs near_location")
+    }
+    if criteria.DayOfWeek != "" {
+        validateWeekday("day_of_week", criteria.DayOfWeek, verr)
+    }
+    if criteria.MaxFare < 0 {
+        verr.Add("max_fare", "can't be negative")
+    }
+    if criteria.TimeOfDay != "" && !clockPattern.MatchString(criteria.TimeOfDay) {
+        verr.Add("time_of_day", "must be HH:MM")
+    }
+}
+
+// validateRoute checks a route from a request body
+func validateRoute(route *Route, verr *ValidationError) {
+    route.RouteNumber = strings.TrimSpace(route.RouteNumber)
+    if route.RouteNumber == "" {
+        verr.Add("route_number", "is required")
+    }
+    validateLocation("pickup", Location{Lat: route.PickupLat, Lng: route.PickupLng}, verr)
+    validateLocation("destination", Location{Lat: route.DestLat, Lng: route.DestLng}, verr)
+    if route.Fare.Regular < 0 || route.Fare.PeakHours < 0 || route.Fare.OffPeakHours < 0 {
+        verr.Add("fare", "can't be negative")
+    }
+    for i, s := range route.Schedule {
+        field := fmt.Sprintf("schedule[%d]", i)
+        if !clockPattern.MatchString(s.StartTime) || !clockPattern.MatchString(s.EndTime) {
+            verr.Add(field, "start_time and end_time must be HH:MM")
+        } else if s.StartTime >= s.EndTime {
+            verr.Add(field, "must start before it ends")
+        }
+        if s.Frequency <= 0 {
+            verr.Add(field, "frequency_minutes must be positive")
+        }
+    }
+    for i, day := range route.ActiveDays {
+        validateWeekday(fmt.Sprintf("active_days[%d]", i), day, verr)
+    }
+}
+
+// RouteSetRequest creates a route set from the routes matching a search
+type RouteSetRequest struct {
+    Name     string         `json:"name"`
+    Criteria SearchCriteria `json:"criteria"`
+}
+
+// RouteSetUpdate renames a route set or replaces its properties. Version
+// is the version being updated, to catch concurrent changes.
+type RouteSetUpdate struct {
+    Version    int                    `json:"version"`
+    Name       string                 `json:"name,omitempty"`
+    Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// OptimizeRequest gives the weights and constraints for optimising a set
+type OptimizeRequest struct {
+    Criteria    map[string]float64      `json:"criteria"`
+    Constraints OptimizationConstraints `json:"constraints"`
+}
+
+// RouteTimetable is the part of a route its SACCO keeps up to date
+type RouteTimetable struct {
+    Schedule   []Schedule `json:"schedule"`
+    Fare       FareInfo   `json:"fare"`
+    ActiveDays []string   `json:"active_days"`
+}
+
+// BookingRequest holds seats on a trip. RiderID is the caller if not given;
+// only admins book for someone else.
+type BookingRequest struct {
+    RiderID     string   `json:"rider_id,omitempty"`
+    Seats       int      `json:"seats"`
+    Pickup      Location `json:"pickup"`
+    Destination Location `json:"destination"`
+}
+
+// BookingCancellation releases a booking's seats
+type BookingCancellation struct {
+    Reason string `json:"reason,omitempty"`
+}
+
+// BookingPaymentRequest asks for a booking's fare to be paid. Retrying
+// with the same idempotency key never charges twice.
+type BookingPaymentRequest struct {
+    IdempotencyKey string `json:"idempotency_key"`
+    Provider       string `json:"provider,omitempty"` // "mpesa" if not given
+    Phone          string `json:"phone"`
+}
+
+// RefundRequest returns some or all of a payment
+type RefundRequest struct {
+    Amount float64 `json:"amount,omitempty"` // everything left if zero
+    Reason string  `json:"reason"`
+}
+
+// SeatHoldRequest asks the crew of one of a ride offer's vehicles to keep
+// seats for the rider
+type SeatHoldRequest struct {
+    VehicleID string `json:"vehicle_id"`
+}
+
+// SeatAcceptanceRequest accepts a seat request. With a trip, the seats are
+// booked on it too.
+type SeatAcceptanceRequest struct {
+    TripID string `json:"trip_id,omitempty"`
+}
+
+// SeatAcceptance is an accepted seat request and, if a trip was given, the
+// booking made for it
+type SeatAcceptance struct {
+    SeatRequest
+    Booking *Booking `json:"booking,omitempty"`
+}
+
+// IncidentRecord is an incident with its audit history, oldest first
+type IncidentRecord struct {
+    Incident
+    History []IncidentEvent `json:"history"`
+}
+
+// IncidentResolution closes an incident that has cleared
+type IncidentResolution struct {
+    Note string `json:"note,omitempty"`
+}
+
+// RouteAnalyticsReport gathers what is known about how a route is doing
+type RouteAnalyticsReport struct {
+    RouteID string                `json:"route_id"`
+    Usage   *RouteAnalytics       `json:"usage,omitempty"`
+    Health  HealthMetrics         `json:"health"`
+    Demand  map[string]Prediction `json:"demand"` // next 24 hours, keyed "15:00"
+}
+
+var searchParams = []queryParam{
+    {Name: "near_location", Type: "string", Description: "pickup near lat,lng"},
+    {Name: "max_distance", Type: "number", Description: "meters from near_location"},
+    {Name: "destination", Type: "string", Description: "a stop the route serves"},
+    {Name: "day_of_week", Type: "string", Description: "day the route runs, e.g. Monday"},
+    {Name: "max_fare", Type: "number", Description: "highest fare, at time_of_day if given"},
+    {Name: "time_of_day", Type: "string", Description: "HH:MM the route must be running at"},
+}
+
+var streamParams = []queryParam{
+    {Name: "routes", Type: "string", Description: "comma separated route numbers"},
+    {Name: "route_ids", Type: "string", Description: "comma separated route IDs"},
+    {Name: "vehicles", Type: "string", Description: "comma separated vehicle IDs"},
+    {Name: "areas", Type: "string", Description: "comma separated H3 cells, at any resolution"},
+    {Name: "types", Type: "string", Description: "comma separated event types: position, eta, service_alert"},
+    {Name: "stop", Type: "string", Description: "lat,lng to estimate arrivals at"},
+    {Name: "since", Type: "string", Description: "sequence to resume from; SSE clients may send Last-Event-ID instead"},
+    {Name: "access_token", Type: "string", Description: "bearer token, for clients that can't set the Authorization header"},
+}
+
+func (s *APIServer) registerEndpoints() {
+    s.handle(endpoint{Method: http.MethodGet, Path: "/health", Summary: "Check the server and Dgraph are up", Tag: "meta",
+        Response: HealthStatus{}, Public: true, serve: http.HandlerFunc(s.health)})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/openapi.json", Summary: "This API's OpenAPI document", Tag: "meta",
+        Response: map[string]interface{}{}, Public: true, handle: s.openAPI})
+    if s.config.Auth != nil {
+        s.handle(endpoint{Method: http.MethodGet, Path: auth.JWKSPath, Summary: "Public keys that verify this API's tokens", Tag: "meta",
+            Response: auth.JWKSet{}, Public: true, serve: s.config.Auth.JWKSHandler()})
+    }
+
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/routes", Summary: "Search routes", Tag: "routes",
+        Query: searchParams, Response: []Route{}, Paged: true, Action: ActionReadRoutes, handle: s.searchRoutes})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/routes", Summary: "Create a route", Tag: "routes",
+        Body: Route{}, Response: Route{}, Status: http.StatusCreated, Action: ActionWriteRoutes, handle: s.createRoute})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/routes/{id}", Summary: "Get a route", Tag: "routes",
+        Response: Route{}, Action: ActionReadRoutes, handle: s.getRoute})
+    s.handle(endpoint{Method: http.MethodPut, Path: "/v1/routes/{id}", Summary: "Replace a route", Tag: "routes",
+        Body: Route{}, Response: Route{}, Action: ActionWriteRoutes, handle: s.replaceRoute})
+    s.handle(endpoint{Method: http.MethodDelete, Path: "/v1/routes/{id}", Summary: "Delete a route", Tag: "routes",
+        Status: http.StatusNoContent, Action: ActionWriteRoutes, handle: s.deleteRoute})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/routes/{id}/analytics", Summary: "Usage, health and predicted demand of a route", Tag: "analytics",
+        Response: RouteAnalyticsReport{}, Action: ActionRouteAnalytics, handle: s.routeAnalytics})
+    s.handle(endpoint{Method: http.MethodPut, Path: "/v1/routes/{id}/timetable", Summary: "Replace a route's schedule, fare and active days", Tag: "routes",
+        Body: RouteTimetable{}, Response: Route{}, Action: ActionEditTimetable, handle: s.replaceTimetable})
+
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/route-sets", Summary: "List route sets, most recently updated first", Tag: "route sets",
+        Response: []*RouteSet{}, Paged: true, Action: ActionReadRouteSets, handle: s.listRouteSets})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/route-sets", Summary: "Create a route set from a search", Tag: "route sets",
+        Body: RouteSetRequest{}, Response: RouteSet{}, Status: http.StatusCreated, Action: ActionWriteRouteSets, handle: s.createRouteSet})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/route-sets/{id}", Summary: "Get a route set", Tag: "route sets",
+        Response: RouteSet{}, Action: ActionReadRouteSets, handle: s.getRouteSet})
+    s.handle(endpoint{Method: http.MethodPatch, Path: "/v1/route-sets/{id}", Summary: "Rename a route set or replace its properties", Tag: "route sets",
+        Body: RouteSetUpdate{}, Response: RouteSet{}, Action: ActionWriteRouteSets, handle: s.updateRouteSet})
+    s.handle(endpoint{Method: http.MethodDelete, Path: "/v1/route-sets/{id}", Summary: "Delete a route set and its history", Tag: "route sets",
+        Status: http.StatusNoContent, Action: ActionWriteRouteSets, handle: s.deleteRouteSet})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/route-sets/{id}/history", Summary: "Stored versions of a route set, newest first", Tag: "route sets",
+        Response: []RouteSetVersion{}, Paged: true, Action: ActionReadRouteSets, handle: s.routeSetHistory})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/route-sets/{id}/optimize", Summary: "Optimise a route set", Tag: "route sets",
+        Body: OptimizeRequest{}, Response: OptimizationResult{}, Action: ActionWriteRouteSets, handle: s.optimizeRouteSet})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/route-sets/{id}/analysis", Summary: "Analyse a route set", Tag: "analytics",
+        Response: RouteSetAnalysis{}, Action: ActionReadRouteSets, handle: s.analyzeRouteSet})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/route-sets/{id}/coverage", Summary: "Coverage of a route set as GeoJSON", Tag: "analytics",
+        Response: GeoJSONMultiPolygon{}, Action: ActionReadRouteSets, handle: s.routeSetCoverage})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/route-sets/{id}/compare/{other}", Summary: "Coverage overlap between two route sets", Tag: "analytics",
+        Response: CoverageOverlap{}, Action: ActionReadRouteSets, handle: s.compareRouteSets})
+
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/vehicles/positions", Summary: "Latest position of each vehicle", Tag: "vehicles",
+        Query: []queryParam{
+            {Name: "max_age", Type: "string", Description: "oldest fix to include, e.g. 5m"},
+            {Name: "route_id", Type: "string", Description: "only vehicles on this route"},
+        },
+        Response: []VehicleFix{}, Paged: true, Action: ActionReadVehicles, handle: s.vehiclePositions})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/vehicles/{id}/position", Summary: "Report where a vehicle is", Tag: "vehicles",
+        Body: VehicleFix{}, Response: VehicleFix{}, Status: http.StatusAccepted, Action: ActionReportPosition, handle: s.reportPosition})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/journeys", Summary: "Plan a journey between two points", Tag: "journeys",
+        Query: []queryParam{
+            {Name: "from", Type: "string", Description: "start at lat,lng", Required: true},
+            {Name: "to", Type: "string", Description: "end at lat,lng", Required: true},
+            {Name: "depart_at", Type: "string", Description: "RFC 3339 departure time, now if not given"},
+        },
+        Response: JourneyPlan{}, Action: ActionPlanJourney, handle: s.planJourney})
+
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/rides", Summary: "Find vehicles that can pick a rider up, best first", Tag: "rides",
+        Body: RideRequest{}, Response: RideOffer{}, Status: http.StatusCreated, Action: ActionRequestRide, handle: s.requestRide})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/rides/{id}/hold", Summary: "Ask an offered vehicle's crew to keep seats", Tag: "rides",
+        Body: SeatHoldRequest{}, Response: SeatRequest{}, Status: http.StatusCreated, Action: ActionRequestRide, handle: s.holdSeat})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/vehicles/{id}/seat-requests", Summary: "Seat requests a vehicle's crew has yet to answer, soonest pickup first", Tag: "rides",
+        Response: []SeatRequest{}, Paged: true, Action: ActionAnswerSeats, handle: s.pendingSeatRequests})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/vehicles/{id}/seat-requests/{sr}/accept", Summary: "Accept a seat request, booking it on a trip if given", Tag: "rides",
+        Body: SeatAcceptanceRequest{}, Response: SeatAcceptance{}, Action: ActionAnswerSeats, handle: s.acceptSeatRequest})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/vehicles/{id}/seat-requests/{sr}/decline", Summary: "Decline a seat request", Tag: "rides",
+        Response: SeatRequest{}, Action: ActionAnswerSeats, handle: s.declineSeatRequest})
+
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/incidents", Summary: "Active incidents, most recent first", Tag: "incidents",
+        Response: []Incident{}, Paged: true, Action: ActionReadIncidents, handle: s.listIncidents})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/incidents", Summary: "Report an incident, or update an active one with the same ID", Tag: "incidents",
+        Body: Incident{}, Response: Incident{}, Status: http.StatusCreated, Action: ActionReportIncident, handle: s.reportIncident})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/incidents/{id}", Summary: "Get an incident and its history", Tag: "incidents",
+        Response: IncidentRecord{}, Action: ActionReadIncidents, handle: s.getIncident})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/incidents/{id}/resolve", Summary: "Resolve an incident that has cleared", Tag: "incidents",
+        Body: IncidentResolution{}, Status: http.StatusNoContent, Action: ActionResolveIncident, handle: s.resolveIncident})
+
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/trips", Summary: "Open a vehicle's trip along a route for booking", Tag: "bookings",
+        Body: VehicleTrip{}, Response: VehicleTrip{}, Status: http.StatusCreated, Action: ActionCreateTrip, handle: s.createTrip})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/trips/{id}/bookings", Summary: "Hold seats on a trip", Tag: "bookings",
+        Body: BookingRequest{}, Response: Booking{}, Status: http.StatusCreated, Action: ActionBook, handle: s.createBooking})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/bookings", Summary: "A rider's bookings, newest first", Tag: "bookings",
+        Query: []queryParam{
+            {Name: "rider_id", Type: "string", Description: "whose bookings; the caller's if not given"},
+        },
+        Response: []*Booking{}, Paged: true, Action: ActionReadBookings, handle: s.listBookings})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/bookings/{id}", Summary: "Get a booking", Tag: "bookings",
+        Response: Booking{}, Action: ActionReadBookings, handle: s.getBooking})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/bookings/{id}/cancel", Summary: "Cancel a booking, releasing its seats", Tag: "bookings",
+        Body: BookingCancellation{}, Response: Booking{}, Action: ActionCancelBooking, handle: s.cancelBooking})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/bookings/{id}/board", Summary: "Record a rider getting on", Tag: "bookings",
+        Response: Booking{}, Action: ActionBoard, handle: s.boardBooking})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/bookings/{id}/no-show", Summary: "Record that a rider never turned up, releasing the seats", Tag: "bookings",
+        Response: Booking{}, Action: ActionBoard, handle: s.noShowBooking})
+
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/bookings/{id}/payments", Summary: "Pay a booking's fare", Tag: "payments",
+        Body: BookingPaymentRequest{}, Response: PaymentIntent{}, Status: http.StatusCreated, Action: ActionPay, handle: s.payBooking})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/payments/{id}", Summary: "Get a payment and its refunds", Tag: "payments",
+        Response: PaymentIntent{}, Action: ActionReadPayments, handle: s.getPayment})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/payments/{id}/refunds", Summary: "Refund some or all of a payment", Tag: "payments",
+        Body: RefundRequest{}, Response: Refund{}, Status: http.StatusCreated, Action: ActionRefund, handle: s.refundPayment})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/payments/callbacks/{provider}", Summary: "Where payment providers post results", Tag: "payments",
+        Public: true, serve: http.HandlerFunc(s.paymentCallback)})
+
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/stream", Summary: "Live positions, ETAs and service alerts as Server-Sent Events", Tag: "stream",
+        Query: streamParams, Response: StreamEvent{}, Produces: "text/event-stream", Action: ActionReadVehicles, serve: http.HandlerFunc(s.streamEvents)})
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/stream/ws", Summary: "Live positions, ETAs and service alerts over a WebSocket; send a StreamFilter to change the subscription", Tag: "stream",
+        Query: streamParams, Body: StreamFilter{}, Response: StreamEvent{}, Action: ActionReadVehicles, serve: http.HandlerFunc(s.streamWebSocket)})
+
+    graphQL := newGraphQLHandler(s)
+    s.handle(endpoint{Method: http.MethodGet, Path: "/v1/graphql", Summary: "GraphQL over WebSocket, for subscriptions", Tag: "graphql",
+        Response: GraphQLResponse{}, Action: ActionReadRoutes, serve: graphQL})
+    s.handle(endpoint{Method: http.MethodPost, Path: "/v1/graphql", Summary: "Run a GraphQL query or mutation", Tag: "graphql",
+        Body: GraphQLRequest{}, Response: GraphQLResponse{}, Action: ActionReadRoutes, serve: http.MaxBytesHandler(graphQL, maxRequestBody)})
+}
+
+// findRoutes searches routes, nearest pickup first when searching near a
+// place. The REST and GraphQL APIs both search through it.
+func (s *APIServer) findRoutes(ctx context.Context, criteria SearchCriteria) ([]Route, error) {
+    verr := &ValidationError{}
+    validateSearch(criteria, verr)
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    routes, err := SearchRoutes(ctx, s.planner.dgraph, criteria)
+    if err != nil {
+        return nil, err
+    }
+    if near := criteria.NearLocation; near != nil {
+        sort.SliceStable(routes, func(i, j int) bool {
+            return calculateDistance(near.Lat, near.Lng, routes[i].PickupLat, routes[i].PickupLng) <
+                calculateDistance(near.Lat, near.Lng, routes[j].PickupLat, routes[j].PickupLng)
+        })
+    }
+    return routes, nil
+}
+
+// saveRoute validates and stores a route, creating it if it has no UID,
+// and puts it on the health schedule
+func (s *APIServer) saveRoute(ctx context.Context, route *Route) error {
+    verr := &ValidationError{}
+    validateRoute(route, verr)
+    if err := verr.Err(); err != nil {
+        return err
+    }
+
+    if err := UpdateRoute(ctx, s.planner.dgraph, route); err != nil {
+        return err
+    }
+    s.planner.cache.Clear()
+    s.rtm.health.Watch(route.Uid)
+    return nil
+}
+
+// removeRoute deletes a route and takes it off the health schedule
+func (s *APIServer) removeRoute(ctx context.Context, id string) error {
+    if err := DeleteRoute(ctx, s.planner.dgraph, id); err != nil {
+        return err
+    }
+    s.planner.cache.Clear()
+    s.rtm.health.Unwatch(id)
+    return nil
+}
+
+// HealthStatus is what /health answers: "ok", "degraded" while some Dgraph
+// alphas are down, or "unavailable" while all are
+type HealthStatus struct {
+    Status string               `json:"status"`
+    Dgraph []dgraph.AlphaHealth `json:"dgraph,omitempty"`
+}
+
+func (s *APIServer) health(w http.ResponseWriter, r *http.Request) {
+    if s.config.Health == nil {
+        writeJSON(w, http.StatusOK, HealthStatus{Status: "ok"})
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.Context(), dgraphHealthTimeout)
+    defer cancel()
+    alphas, err := s.config.Health(ctx)
+    if err != nil {
+        writeJSON(w, http.StatusServiceUnavailable, HealthStatus{Status: "unavailable", Dgraph: alphas})
+        return
+    }
+    status := HealthStatus{Status: "ok", Dgraph: alphas}
+    for _, alpha := range alphas {
+        if !alpha.Healthy {
+            status.Status = "degraded"
+        }
+    }
+    writeJSON(w, http.StatusOK, status)
+}
+
+func (s *APIServer) openAPI(r *http.Request) (interface{}, error) {
+    return s.OpenAPI(), nil
+}
+
+func (s *APIServer) searchRoutes(r *http.Request) (interface{}, error) {
+    verr := &ValidationError{}
+    query := r.URL.Query()
+    criteria := SearchCriteria{
+        NearLocation: queryLocation(query, "near_location", verr),
+        Destination:  query.Get("destination"),
+        MaxDistance:  queryFloat(query, "max_distance", verr),
+        DayOfWeek:    query.Get("day_of_week"),
+        MaxFare:      queryFloat(query, "max_fare", verr),
+        TimeOfDay:    query.Get("time_of_day"),
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    routes, err := s.findRoutes(r.Context(), criteria)
+    if err != nil {
+        return nil, err
+    }
+    return paginate(r, routes)
+}
+
+func (s *APIServer) createRoute(r *http.Request) (interface{}, error) {
+    var route Route
+    if err := decodeBody(r, &route); err != nil {
+        return nil, err
+    }
+    if route.Uid != "" {
+        verr := &ValidationError{}
+        verr.Add("uid", "is assigned by the server")
+        return nil, verr
+    }
+
+    if err := s.saveRoute(r.Context(), &route); err != nil {
+        return nil, err
+    }
+    return route, nil
+}
+
+func (s *APIServer) getRoute(r *http.Request) (interface{}, error) {
+    id, err := routeID(r)
+    if err != nil {
+        return nil, err
+    }
+    return s.planner.getRoute(r.Context(), id)
+}
+
+func (s *APIServer) replaceRoute(r *http.Request) (interface{}, error) {
+    id, err := routeID(r)
+    if err != nil {
+        return nil, err
+    }
+    var route Route
+    if err := decodeBody(r, &route); err != nil {
+        return nil, err
+    }
+    if route.Uid != "" && route.Uid != id {
+        verr := &ValidationError{}
+        verr.Add("uid", "doesn't match the route being replaced")
+        return nil, verr
+    }
+
+    route.Uid = id
+    if err := s.saveRoute(r.Context(), &route); err != nil {
+        return nil, err
+    }
+    return route, nil
+}
+
+func (s *APIServer) deleteRoute(r *http.Request) (interface{}, error) {
+    id, err := routeID(r)
+    if err != nil {
+        return nil, err
+    }
+    return nil, s.removeRoute(r.Context(), id)
+}
+
+// replaceTimetable lets a route's SACCO change when it runs and what it
+// charges, leaving the rest of the route alone
+func (s *APIServer) replaceTimetable(r *http.Request) (interface{}, error) {
+    id, err := routeID(r)
+    if err != nil {
+        return nil, err
+    }
+    var timetable RouteTimetable
+    if err := decodeBody(r, &timetable); err != nil {
+        return nil, err
+    }
+
+    route, err := s.planner.getRoute(r.Context(), id)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionEditTimetable, auth.Resource{Sacco: route.Sacco}); err != nil {
+        return nil, err
+    }
+
+    updated := *route
+    updated.Schedule = timetable.Schedule
+    updated.Fare = timetable.Fare
+    updated.ActiveDays = timetable.ActiveDays
+    if err := s.saveRoute(r.Context(), &updated); err != nil {
+        return nil, err
+    }
+    return updated, nil
+}
+
+func (s *APIServer) routeAnalytics(r *http.Request) (interface{}, error) {
+    id, err := routeID(r)
+    if err != nil {
+        return nil, err
+    }
+    route, err := s.planner.getRoute(r.Context(), id)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionRouteAnalytics, auth.Resource{Sacco: route.Sacco}); err != nil {
+        return nil, err
+    }
+
+    report := RouteAnalyticsReport{RouteID: id}
+    if report.Usage, err = s.planner.getRouteAnalytics(r.Context(), id); err != nil {
+        return nil, err
+    }
+    if report.Health, err = s.rtm.RouteHealth(r.Context(), id); err != nil {
+        return nil, err
+    }
+    if report.Demand, err = s.rtm.PredictDemand(r.Context(), id); err != nil {
+        return nil, err
+    }
+    return report, nil
+}
+
+func (s *APIServer) listRouteSets(r *http.Request) (interface{}, error) {
+    routeSets, err := s.planner.ListRouteSets(r.Context())
+    if err != nil {
+        return nil, err
+    }
+    return paginate(r, routeSets)
+}
+
+func (s *APIServer) createRouteSet(r *http.Request) (interface{}, error) {
+    var req RouteSetRequest
+    if err := decodeBody(r, &req); err != nil {
+        return nil, err
+    }
+    verr := &ValidationError{}
+    req.Name = strings.TrimSpace(req.Name)
+    if req.Name == "" {
+        verr.Add("name", "is required")
+    }
+    validateSearch(req.Criteria, verr)
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    return s.planner.CreateRouteSet(r.Context(), req.Name, req.Criteria)
+}
+
+func (s *APIServer) getRouteSet(r *http.Request) (interface{}, error) {
+    return s.planner.GetRouteSet(r.Context(), pathParam(r, "id"))
+}
+
+func (s *APIServer) updateRouteSet(r *http.Request) (interface{}, error) {
+    var update RouteSetUpdate
+    if err := decodeBody(r, &update); err != nil {
+        return nil, err
+    }
+    verr := &ValidationError{}
+    if update.Version < 1 {
+        verr.Add("version", "is required, and must be the version being updated")
+    }
+    if update.Name == "" && update.Properties == nil {
+        verr.Add("body", "give a name, properties or both")
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    return s.planner.UpdateRouteSet(r.Context(), pathParam(r, "id"), update.Version, strings.TrimSpace(update.Name), update.Properties)
+}
+
+func (s *APIServer) deleteRouteSet(r *http.Request) (interface{}, error) {
+    return nil, s.planner.DeleteRouteSet(r.Context(), pathParam(r, "id"))
+}
+
+func (s *APIServer) routeSetHistory(r *http.Request) (interface{}, error) {
+    history, err := s.planner.RouteSetHistory(r.Context(), pathParam(r, "id"))
+    if err != nil {
+        return nil, err
+    }
+    return paginate(r, history)
+}
+
+func (s *APIServer) optimizeRouteSet(r *http.Request) (interface{}, error) {
+    var req OptimizeRequest
+    if err := decodeBody(r, &req); err != nil {
+        return nil, err
+    }
+    verr := &ValidationError{}
+    if _, err := validateCriteria(req.Criteria); err != nil {
+        verr.Add("criteria", "%v", err)
+    }
+    if req.Constraints.MaxRoutes < 0 {
+        verr.Add("constraints.max_routes", "can't be negative")
+    }
+    if req.Constraints.FleetSize < 0 {
+        verr.Add("constraints.fleet_size", "can't be negative")
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    return s.planner.OptimizeRouteSet(r.Context(), pathParam(r, "id"), req.Criteria, req.Constraints)
+}
+
+func (s *APIServer) analyzeRouteSet(r *http.Request) (interface{}, error) {
+    return s.planner.AnalyzeRouteSet(r.Context(), pathParam(r, "id"))
+}
+
+func (s *APIServer) routeSetCoverage(r *http.Request) (interface{}, error) {
+    return s.planner.RouteSetCoverageGeoJSON(r.Context(), pathParam(r, "id"))
+}
+
+func (s *APIServer) compareRouteSets(r *http.Request) (interface{}, error) {
+    return s.planner.CompareRouteSets(r.Context(), pathParam(r, "id"), pathParam(r, "other"))
+}
+
+func (s *APIServer) vehiclePositions(r *http.Request) (interface{}, error) {
+    verr := &ValidationError{}
+    query := r.URL.Query()
+    maxAge := defaultPositionMaxAge
+    if value := query.Get("max_age"); value != "" {
+        age, err := time.ParseDuration(value)
+        if err != nil || age <= 0 {
+            verr.Add("max_age", "must be a positive duration, e.g. 5m")
+        }
+        maxAge = age
+    }
+    routeFilter := query.Get("route_id")
+    if routeFilter != "" && !uidPattern.MatchString(routeFilter) {
+        verr.Add("route_id", "%q is not a route ID", routeFilter)
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    return paginate(r, s.positions(routeFilter, maxAge))
+}
+
+// reportPosition takes a GPS fix from a vehicle's crew
+func (s *APIServer) reportPosition(r *http.Request) (interface{}, error) {
+    vehicleID := pathParam(r, "id")
+    var fix VehicleFix
+    if err := decodeBody(r, &fix); err != nil {
+        return nil, err
+    }
+
+    verr := &ValidationError{}
+    if fix.VehicleID != "" && fix.VehicleID != vehicleID {
+        verr.Add("vehicle_id", "doesn't match the vehicle being reported")
+    }
+    if fix.RouteID != "" && !uidPattern.MatchString(fix.RouteID) {
+        verr.Add("route_id", "%q is not a route ID", fix.RouteID)
+    }
+    validateLocation("lat,lng", Location{Lat: fix.Lat, Lng: fix.Lng}, verr)
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionReportPosition, auth.Resource{Vehicle: vehicleID}); err != nil {
+        return nil, err
+    }
+
+    fix.VehicleID = vehicleID
+    if fix.Timestamp.IsZero() {
+        fix.Timestamp = time.Now()
+    }
+    if err := s.rtm.IngestFix(fix); err != nil {
+        return nil, fmt.Errorf("%w: %v", ErrInvalidRequest, err)
+    }
+    return fix, nil
+}
+
+// positions returns the latest fix of each vehicle seen within maxAge, on
+// one route if routeID isn't empty
+func (s *APIServer) positions(routeID string, maxAge time.Duration) []VehicleFix {
+    positions := s.rtm.probes.VehiclePositions(maxAge)
+    onRoute := make([]VehicleFix, 0, len(positions))
+    for _, fix := range positions {
+        if routeID == "" || fix.RouteID == routeID {
+            onRoute = append(onRoute, fix)
+        }
+    }
+    return onRoute
+}
+
+func (s *APIServer) planJourney(r *http.Request) (interface{}, error) {
+    verr := &ValidationError{}
+    query := r.URL.Query()
+    from := queryLocation(query, "from", verr)
+    to := queryLocation(query, "to", verr)
+    if query.Get("from") == "" {
+        verr.Add("from", "is required")
+    }
+    if query.Get("to") == "" {
+        verr.Add("to", "is required")
+    }
+    departAt := time.Now()
+    if value := query.Get("depart_at"); value != "" {
+        at, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            verr.Add("depart_at", "must be an RFC 3339 time")
+        }
+        departAt = at
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    return s.rtm.PlanJourney(r.Context(), *from, *to, departAt)
+}
+
+func (s *APIServer) requestRide(r *http.Request) (interface{}, error) {
+    var request RideRequest
+    if err := decodeBody(r, &request); err != nil {
+        return nil, err
+    }
+    if request.RiderID == "" {
+        request.RiderID = caller(r.Context())
+    }
+
+    verr := &ValidationError{}
+    if request.ID != "" {
+        verr.Add("id", "is assigned by the server")
+    }
+    if request.Seats < 0 || request.Seats > maxSeatsPerHold {
+        verr.Add("seats", "must be between 1 and %d", maxSeatsPerHold)
+    }
+    validateLocation("pickup", request.Pickup, verr)
+    validateLocation("destination", request.Destination, verr)
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionRequestRide, auth.Resource{Owner: request.RiderID}); err != nil {
+        return nil, err
+    }
+
+    return s.rtm.RequestRide(r.Context(), request)
+}
+
+func (s *APIServer) holdSeat(r *http.Request) (interface{}, error) {
+    var request SeatHoldRequest
+    if err := decodeBody(r, &request); err != nil {
+        return nil, err
+    }
+    if request.VehicleID == "" {
+        verr := &ValidationError{}
+        verr.Add("vehicle_id", "is required")
+        return nil, verr
+    }
+
+    rides := s.rtm.Rides()
+    offer, err := rides.Offer(pathParam(r, "id"))
+    if err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionRequestRide, auth.Resource{Owner: offer.Request.RiderID}); err != nil {
+        return nil, err
+    }
+    return rides.HoldSeat(offer.Request.ID, request.VehicleID)
+}
+
+func (s *APIServer) pendingSeatRequests(r *http.Request) (interface{}, error) {
+    vehicleID := pathParam(r, "id")
+    if err := s.authorize(r.Context(), ActionAnswerSeats, auth.Resource{Vehicle: vehicleID}); err != nil {
+        return nil, err
+    }
+    return paginate(r, s.rtm.Rides().PendingSeatRequests(vehicleID))
+}
+
+func (s *APIServer) acceptSeatRequest(r *http.Request) (interface{}, error) {
+    var request SeatAcceptanceRequest
+    if err := decodeBody(r, &request); err != nil {
+        return nil, err
+    }
+    vehicleID, seatRequestID := pathParam(r, "id"), pathParam(r, "sr")
+    if err := s.authorize(r.Context(), ActionAnswerSeats, auth.Resource{Vehicle: vehicleID}); err != nil {
+        return nil, err
+    }
+
+    if request.TripID == "" {
+        seatRequest, err := s.rtm.Rides().AcceptSeatRequest(seatRequestID, vehicleID)
+        if err != nil {
+            return nil, err
+        }
+        return SeatAcceptance{SeatRequest: *seatRequest}, nil
+    }
+    booking, err := s.rtm.AcceptSeatRequest(r.Context(), seatRequestID, vehicleID, request.TripID)
+    if err != nil {
+        return nil, err
+    }
+    seatRequest, err := s.rtm.Rides().SeatRequest(seatRequestID)
+    if err != nil {
+        return nil, err
+    }
+    return SeatAcceptance{SeatRequest: *seatRequest, Booking: booking}, nil
+}
+
+func (s *APIServer) declineSeatRequest(r *http.Request) (interface{}, error) {
+    vehicleID := pathParam(r, "id")
+    if err := s.authorize(r.Context(), ActionAnswerSeats, auth.Resource{Vehicle: vehicleID}); err != nil {
+        return nil, err
+    }
+    return s.rtm.Rides().DeclineSeatRequest(pathParam(r, "sr"), vehicleID)
+}
+
+func (s *APIServer) listIncidents(r *http.Request) (interface{}, error) {
+    return paginate(r, s.rtm.ActiveIncidents())
+}
+
+func (s *APIServer) reportIncident(r *http.Request) (interface{}, error) {
+    var incident Incident
+    if err := decodeBody(r, &incident); err != nil {
+        return nil, err
+    }
+    // Reports only ever open or update an incident; closing it is resolve's
+    incident.Status = ""
+    incident.ResolvedAt = nil
+    return s.rtm.ReportIncident(r.Context(), incident)
+}
+
+func (s *APIServer) getIncident(r *http.Request) (interface{}, error) {
+    incident, history, err := s.rtm.IncidentHistory(r.Context(), pathParam(r, "id"))
+    if err != nil {
+        return nil, err
+    }
+    if history == nil {
+        history = []IncidentEvent{}
+    }
+    return IncidentRecord{Incident: *incident, History: history}, nil
+}
+
+func (s *APIServer) resolveIncident(r *http.Request) (interface{}, error) {
+    var resolution IncidentResolution
+    if err := decodeBody(r, &resolution); err != nil {
+        return nil, err
+    }
+    return nil, s.rtm.ResolveIncident(r.Context(), pathParam(r, "id"), resolution.Note)
+}
+
+func (s *APIServer) createTrip(r *http.Request) (interface{}, error) {
+    var trip VehicleTrip
+    if err := decodeBody(r, &trip); err != nil {
+        return nil, err
+    }
+
+    verr := &ValidationError{}
+    if trip.ID != "" {
+        verr.Add("id", "is assigned by the server")
+    }
+    if trip.VehicleID == "" {
+        verr.Add("vehicle_id", "is required")
+    }
+    if !uidPattern.MatchString(trip.RouteID) {
+        verr.Add("route_id", "%q is not a route ID", trip.RouteID)
+    }
+    if trip.Capacity < 0 {
+        verr.Add("capacity", "can't be negative")
+    }
+    if trip.SeatsReserved != 0 {
+        verr.Add("seats_reserved", "starts at zero")
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionCreateTrip, auth.Resource{Vehicle: trip.VehicleID}); err != nil {
+        return nil, err
+    }
+
+    if _, err := s.planner.getRoute(r.Context(), trip.RouteID); err != nil {
+        return nil, err
+    }
+    return s.rtm.Bookings().CreateTrip(r.Context(), trip)
+}
+
+func (s *APIServer) createBooking(r *http.Request) (interface{}, error) {
+    tripID := pathParam(r, "id")
+    var request BookingRequest
+    if err := decodeBody(r, &request); err != nil {
+        return nil, err
+    }
+    if request.RiderID == "" {
+        request.RiderID = caller(r.Context())
+    }
+
+    verr := &ValidationError{}
+    if request.RiderID == "" {
+        verr.Add("rider_id", "is required")
+    }
+    if request.Seats < 1 || request.Seats > defaultVehicleCapacity {
+        verr.Add("seats", "must be between 1 and %d", defaultVehicleCapacity)
+    }
+    validateLocation("pickup", request.Pickup, verr)
+    validateLocation("destination", request.Destination, verr)
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionBook, auth.Resource{Owner: request.RiderID}); err != nil {
+        return nil, err
+    }
+
+    bookings := s.rtm.Bookings()
+    trip, err := bookings.GetTrip(r.Context(), tripID)
+    if err != nil {
+        return nil, err
+    }
+    route, err := s.planner.getRoute(r.Context(), trip.RouteID)
+    if err != nil {
+        return nil, err
+    }
+    fare := fareAt(*route, trip.DepartureAt) * float64(request.Seats)
+    return bookings.Book(r.Context(), tripID, request.RiderID, request.Seats, request.Pickup, request.Destination, fare)
+}
+
+func (s *APIServer) listBookings(r *http.Request) (interface{}, error) {
+    riderID := r.URL.Query().Get("rider_id")
+    if riderID == "" {
+        riderID = caller(r.Context())
+    }
+    if riderID == "" {
+        verr := &ValidationError{}
+        verr.Add("rider_id", "is required")
+        return nil, verr
+    }
+    if err := s.authorize(r.Context(), ActionReadBookings, auth.Resource{Owner: riderID}); err != nil {
+        return nil, err
+    }
+
+    bookings, err := s.rtm.Bookings().RiderBookings(r.Context(), riderID)
+    if err != nil {
+        return nil, err
+    }
+    return paginate(r, bookings)
+}
+
+func (s *APIServer) getBooking(r *http.Request) (interface{}, error) {
+    booking, err := s.rtm.Bookings().GetBooking(r.Context(), pathParam(r, "id"))
+    if err != nil {
+        return nil, err
+    }
+    resource := auth.Resource{Owner: booking.RiderID, Vehicle: booking.VehicleID}
+    if err := s.authorize(r.Context(), ActionReadBookings, resource); err != nil {
+        return nil, err
+    }
+    return booking, nil
+}
+
+func (s *APIServer) cancelBooking(r *http.Request) (interface{}, error) {
+    var cancellation BookingCancellation
+    if err := decodeBody(r, &cancellation); err != nil {
+        return nil, err
+    }
+    booking, err := s.authorizedBooking(r, ActionCancelBooking)
+    if err != nil {
+        return nil, err
+    }
+    return s.rtm.Bookings().Cancel(r.Context(), booking.ID, cancellation.Reason)
+}
+
+func (s *APIServer) boardBooking(r *http.Request) (interface{}, error) {
+    booking, err := s.authorizedBooking(r, ActionBoard)
+    if err != nil {
+        return nil, err
+    }
+    return s.rtm.Bookings().Board(r.Context(), booking.ID)
+}
+
+func (s *APIServer) noShowBooking(r *http.Request) (interface{}, error) {
+    booking, err := s.authorizedBooking(r, ActionBoard)
+    if err != nil {
+        return nil, err
+    }
+    return s.rtm.Bookings().NoShow(r.Context(), booking.ID)
+}
+
+// authorizedBooking loads the booking in the path and checks the caller
+// may take the action on it
+func (s *APIServer) authorizedBooking(r *http.Request, action string) (*Booking, error) {
+    booking, err := s.rtm.Bookings().GetBooking(r.Context(), pathParam(r, "id"))
+    if err != nil {
+        return nil, err
+    }
+    resource := auth.Resource{Owner: booking.RiderID, Vehicle: booking.VehicleID}
+    if err := s.authorize(r.Context(), action, resource); err != nil {
+        return nil, err
+    }
+    return booking, nil
+}
+
+func (s *APIServer) payBooking(r *http.Request) (interface{}, error) {
+    var request BookingPaymentRequest
+    if err := decodeBody(r, &request); err != nil {
+        return nil, err
+    }
+    if request.Provider == "" {
+        request.Provider = "mpesa"
+    }
+
+    verr := &ValidationError{}
+    if request.IdempotencyKey == "" {
+        verr.Add("idempotency_key", "is required")
+    }
+    phone, err := auth.NormalizePhone(request.Phone)
+    if err != nil {
+        verr.Add("phone", "must be a Kenyan mobile number")
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    booking, err := s.rtm.Bookings().GetBooking(r.Context(), pathParam(r, "id"))
+    if err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionPay, auth.Resource{Owner: booking.RiderID}); err != nil {
+        return nil, err
+    }
+    if booking.Status != BookingRequested && booking.Status != BookingConfirmed {
+        return nil, fmt.Errorf("%w: booking %s is %s", ErrInvalidRequest, booking.ID, booking.Status)
+    }
+
+    return s.rtm.Payments().Pay(r.Context(), PaymentRequest{
+        IdempotencyKey: request.IdempotencyKey,
+        Provider:       request.Provider,
+        BookingID:      booking.ID,
+        Phone:          phone,
+        Amount:         booking.Fare,
+        Description:    "Fare for booking " + booking.ID,
+    })
+}
+
+// paymentOwner is the rider a payment is for, if it is for a booking
+func (s *APIServer) paymentOwner(ctx context.Context, intent *PaymentIntent) (auth.Resource, error) {
+    if intent.BookingID == "" {
+        return auth.Resource{}, nil
+    }
+    booking, err := s.rtm.Bookings().GetBooking(ctx, intent.BookingID)
+    if err != nil {
+        return auth.Resource{}, err
+    }
+    return auth.Resource{Owner: booking.RiderID, Vehicle: booking.VehicleID}, nil
+}
+
+func (s *APIServer) getPayment(r *http.Request) (interface{}, error) {
+    intent, err := s.rtm.Payments().GetPayment(r.Context(), pathParam(r, "id"))
+    if err != nil {
+        return nil, err
+    }
+    resource, err := s.paymentOwner(r.Context(), intent)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.authorize(r.Context(), ActionReadPayments, resource); err != nil {
+        return nil, err
+    }
+    return intent, nil
+}
+
+func (s *APIServer) refundPayment(r *http.Request) (interface{}, error) {
+    var request RefundRequest
+    if err := decodeBody(r, &request); err != nil {
+        return nil, err
+    }
+    verr := &ValidationError{}
+    if request.Amount < 0 {
+        verr.Add("amount", "must not be negative")
+    }
+    if strings.TrimSpace(request.Reason) == "" {
+        verr.Add("reason", "is required")
+    }
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+    return s.rtm.Payments().Refund(r.Context(), pathParam(r, "id"), request.Amount, request.Reason)
+}
+
+// paymentCallback passes a provider's callback to the payment service,
+// which checks it came from the provider
+func (s *APIServer) paymentCallback(w http.ResponseWriter, r *http.Request) {
+    s.rtm.Payments().CallbackHandler(pathParam(r, "provider")).ServeHTTP(w, r)
+}
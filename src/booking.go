@@ -0,0 +1,654 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+    "github.com/dgraph-io/dgo/v210/protos/api"
+
+    "motown/dgraph"
+)
+
+const (
+    defaultVehicleCapacity = 14 // the usual matatu
+    bookingHoldTTL         = 10 * time.Minute
+    bookingSweepInterval   = 30 * time.Second
+)
+
+// Booking states
+const (
+    BookingRequested = "requested"
+    BookingConfirmed = "confirmed"
+    BookingBoarded   = "boarded"
+    BookingCancelled = "cancelled"
+    BookingNoShow    = "no_show"
+)
+
+// bookingTransitions lists the states each state may move to
+var bookingTransitions = map[string][]string{
+    BookingRequested: {BookingConfirmed, BookingCancelled},
+    BookingConfirmed: {BookingBoarded, BookingCancelled, BookingNoShow},
+}
+
+var (
+    ErrNoSeats           = errors.New("not enough seats left on this trip")
+    ErrTripNotFound      = errors.New("trip not found")
+    ErrBookingNotFound   = errors.New("booking not found")
+    ErrBookingTransition = errors.New("booking can't move to that state")
+    ErrTxnContention     = dgraph.ErrContention
+)
+
+// VehicleTrip is one run of a vehicle along a route, with its seats
+type VehicleTrip struct {
+    ID            string    `json:"id"`
+    VehicleID     string    `json:"vehicle_id"`
+    RouteID       string    `json:"route_id"`
+    DepartureAt   time.Time `json:"departure_at"`
+    Capacity      int       `json:"capacity"`
+    SeatsReserved int       `json:"seats_reserved"`
+}
+
+// SeatsLeft is how many seats can still be booked
+func (t VehicleTrip) SeatsLeft() int {
+    return t.Capacity - t.SeatsReserved
+}
+
+// Booking is a rider's reservation of seats on a trip
+type Booking struct {
+    ID            string     `json:"id"`
+    TripID        string     `json:"trip_id"`
+    RouteID       string     `json:"route_id"`
+    VehicleID     string     `json:"vehicle_id"`
+    RiderID       string     `json:"rider_id"`
+    Seats         int        `json:"seats"`
+    Fare          float64    `json:"fare"`
+    Pickup        Location   `json:"pickup"`
+    Destination   Location   `json:"destination"`
+    Status        string     `json:"status"`
+    HoldExpiresAt *time.Time `json:"hold_expires_at,omitempty"`
+    ConfirmedAt   *time.Time `json:"confirmed_at,omitempty"`
+    BoardedAt     *time.Time `json:"boarded_at,omitempty"`
+    CancelledAt   *time.Time `json:"cancelled_at,omitempty"`
+    CancelReason  string     `json:"cancel_reason,omitempty"`
+    CreatedAt     time.Time  `json:"created_at"`
+    UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+// BookingService allocates seats on vehicle trips. Seat counts live on the
+// trip node in Dgraph and every change to them goes through a transaction,
+// so two bookings racing for the last seat can't both win, even across
+// instances.
+type BookingService struct {
+    dgraph    *dgraph.Client
+    now       func() time.Time
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+func NewBookingService(client *dgraph.Client) *BookingService {
+    bs := &BookingService{
+        dgraph: client,
+        now:    time.Now,
+        done:   make(chan struct{}),
+    }
+    go bs.run()
+    return bs
+}
+
+// vehicleNode, tripNode and bookingNode are how the service's records are
+// stored in Dgraph
+type vehicleNode struct {
+    Uid       string   `json:"uid,omitempty"`
+    DType     []string `json:"dgraph.type,omitempty"`
+    VehicleID string   `json:"vehicle_id,omitempty"`
+    Capacity  int      `json:"vehicle_capacity,omitempty"`
+}
+
+type tripNode struct {
+    Uid           string       `json:"uid,omitempty"`
+    DType         []string     `json:"dgraph.type,omitempty"`
+    TripID        string       `json:"trip_id,omitempty"`
+    Route         *routeRef    `json:"trip_route,omitempty"`
+    Vehicle       *vehicleNode `json:"trip_vehicle,omitempty"`
+    DepartureAt   time.Time    `json:"departure_at"`
+    Capacity      int          `json:"trip_capacity"`
+    SeatsReserved int          `json:"seats_reserved"`
+}
+
+func (n tripNode) toTrip() *VehicleTrip {
+    trip := &VehicleTrip{
+        ID:            n.TripID,
+        DepartureAt:   n.DepartureAt,
+        Capacity:      n.Capacity,
+        SeatsReserved: n.SeatsReserved,
+    }
+    if n.Route != nil {
+        trip.RouteID = n.Route.Uid
+    }
+    if n.Vehicle != nil {
+        trip.VehicleID = n.Vehicle.VehicleID
+    }
+    return trip
+}
+
+type bookingNode struct {
+    Uid           string       `json:"uid,omitempty"`
+    DType         []string     `json:"dgraph.type,omitempty"`
+    BookingID     string       `json:"booking_id,omitempty"`
+    Trip          *tripNode    `json:"booking_trip,omitempty"`
+    Route         *routeRef    `json:"booking_route,omitempty"`
+    Vehicle       *vehicleNode `json:"booking_vehicle,omitempty"`
+    RiderID       string       `json:"booking_rider,omitempty"`
+    Seats         int          `json:"booking_seats,omitempty"`
+    Fare          float64      `json:"booking_fare"`
+    PickupLat     float64      `json:"booking_pickup_lat"`
+    PickupLng     float64      `json:"booking_pickup_lng"`
+    DestLat       float64      `json:"booking_dest_lat"`
+    DestLng       float64      `json:"booking_dest_lng"`
+    Status        string       `json:"booking_status,omitempty"`
+    HoldExpiresAt *time.Time   `json:"hold_expires_at,omitempty"`
+    ConfirmedAt   *time.Time   `json:"confirmed_at,omitempty"`
+    BoardedAt     *time.Time   `json:"boarded_at,omitempty"`
+    CancelledAt   *time.Time   `json:"cancelled_at,omitempty"`
+    CancelReason  string       `json:"cancel_reason,omitempty"`
+    CreatedAt     time.Time    `json:"created_at"`
+    UpdatedAt     time.Time    `json:"updated_at"`
+}
+
+func (n bookingNode) toBooking() *Booking {
+    booking := &Booking{
+        ID:            n.BookingID,
+        RiderID:       n.RiderID,
+        Seats:         n.Seats,
+        Fare:          n.Fare,
+        Pickup:        Location{Lat: n.PickupLat, Lng: n.PickupLng},
+        Destination:   Location{Lat: n.DestLat, Lng: n.DestLng},
+        Status:        n.Status,
+        HoldExpiresAt: n.HoldExpiresAt,
+        ConfirmedAt:   n.ConfirmedAt,
+        BoardedAt:     n.BoardedAt,
+        CancelledAt:   n.CancelledAt,
+        CancelReason:  n.CancelReason,
+        CreatedAt:     n.CreatedAt,
+        UpdatedAt:     n.UpdatedAt,
+    }
+    if n.Trip != nil {
+        booking.TripID = n.Trip.TripID
+    }
+    if n.Route != nil {
+        booking.RouteID = n.Route.Uid
+    }
+    if n.Vehicle != nil {
+        booking.VehicleID = n.Vehicle.VehicleID
+    }
+    return booking
+}
+
+const bookingFields = `
+    booking_id
+    booking_trip { trip_id }
+    booking_route { uid }
+    booking_vehicle { vehicle_id }
+    booking_rider
+    booking_seats
+    booking_fare
+    booking_pickup_lat
+    booking_pickup_lng
+    booking_dest_lat
+    booking_dest_lng
+    booking_status
+    hold_expires_at
+    confirmed_at
+    boarded_at
+    cancelled_at
+    cancel_reason
+    created_at
+    updated_at`
+
+func mutateJSON(ctx context.Context, txn *dgo.Txn, node interface{}) error {
+    setJSON, err := json.Marshal(node)
+    if err != nil {
+        return err
+    }
+    _, err = txn.Mutate(ctx, &api.Mutation{SetJson: setJSON})
+    return err
+}
+
+// CreateTrip opens a vehicle's trip for booking, registering the vehicle
+// if it hasn't been seen before
+func (bs *BookingService) CreateTrip(ctx context.Context, trip VehicleTrip) (*VehicleTrip, error) {
+    if trip.VehicleID == "" || trip.RouteID == "" {
+        return nil, fmt.Errorf("%w: a trip needs a vehicle and a route", ErrInvalidRequest)
+    }
+    if trip.ID == "" {
+        trip.ID = generateUUID()
+    }
+    if trip.DepartureAt.IsZero() {
+        trip.DepartureAt = bs.now()
+    }
+    trip.SeatsReserved = 0
+
+    err := bs.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        resp, err := txn.QueryWithVars(ctx, `
+            query Vehicle($id: string) {
+                vehicles(func: eq(vehicle_id, $id)) @filter(type(Vehicle)) {
+                    uid
+                    vehicle_capacity
+                }
+            }`, map[string]string{"$id": trip.VehicleID})
+        if err != nil {
+            return err
+        }
+
+        var existing struct {
+            Vehicles []vehicleNode `json:"vehicles"`
+        }
+        if err := json.Unmarshal(resp.Json, &existing); err != nil {
+            return err
+        }
+
+        vehicle := &vehicleNode{
+            Uid:       "_:vehicle",
+            DType:     []string{"Vehicle"},
+            VehicleID: trip.VehicleID,
+            Capacity:  trip.Capacity,
+        }
+        if len(existing.Vehicles) > 0 {
+            vehicle = &vehicleNode{Uid: existing.Vehicles[0].Uid}
+            if trip.Capacity == 0 {
+                trip.Capacity = existing.Vehicles[0].Capacity
+            }
+        }
+        if trip.Capacity <= 0 {
+            trip.Capacity = defaultVehicleCapacity
+            vehicle.Capacity = trip.Capacity
+        }
+
+        return mutateJSON(ctx, txn, tripNode{
+            Uid:         "_:trip",
+            DType:       []string{"Trip"},
+            TripID:      trip.ID,
+            Route:       &routeRef{Uid: trip.RouteID},
+            Vehicle:     vehicle,
+            DepartureAt: trip.DepartureAt,
+            Capacity:    trip.Capacity,
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+    return &trip, nil
+}
+
+// loadTrip reads a trip inside a transaction
+func loadTrip(ctx context.Context, txn *dgo.Txn, tripID string) (*tripNode, error) {
+    resp, err := txn.QueryWithVars(ctx, `
+        query Trip($id: string) {
+            trips(func: eq(trip_id, $id)) @filter(type(Trip)) {
+                uid
+                trip_id
+                trip_route { uid }
+                trip_vehicle { uid vehicle_id }
+                departure_at
+                trip_capacity
+                seats_reserved
+            }
+        }`, map[string]string{"$id": tripID})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Trips []tripNode `json:"trips"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Trips) == 0 {
+        return nil, fmt.Errorf("%w: %s", ErrTripNotFound, tripID)
+    }
+    return &result.Trips[0], nil
+}
+
+// GetTrip returns a trip with its current seat count
+func (bs *BookingService) GetTrip(ctx context.Context, tripID string) (*VehicleTrip, error) {
+    txn := bs.dgraph.NewReadOnlyTxn()
+    defer txn.Discard(ctx)
+
+    node, err := loadTrip(ctx, txn, tripID)
+    if err != nil {
+        return nil, err
+    }
+    return node.toTrip(), nil
+}
+
+// Book holds seats on a trip for a rider until the booking is confirmed or
+// the hold runs out
+func (bs *BookingService) Book(ctx context.Context, tripID, riderID string, seats int, pickup, destination Location, fare float64) (*Booking, error) {
+    return bs.book(ctx, tripID, "", riderID, seats, pickup, destination, fare, BookingRequested)
+}
+
+// BookSeatRequest books the seats a crew accepted through the ride
+// dispatcher, confirmed straight away, on a trip of the vehicle asked
+func (bs *BookingService) BookSeatRequest(ctx context.Context, seatRequest SeatRequest, tripID string) (*Booking, error) {
+    if seatRequest.Status != SeatRequestAccepted {
+        return nil, fmt.Errorf("seat request %s is %s, not accepted", seatRequest.ID, seatRequest.Status)
+    }
+    return bs.book(ctx, tripID, seatRequest.VehicleID, seatRequest.RiderID, seatRequest.Seats,
+        seatRequest.Pickup, seatRequest.Destination, seatRequest.Fare, BookingConfirmed)
+}
+
+// book reserves seats on a trip. A vehicleID other than "" must be the one
+// running the trip.
+func (bs *BookingService) book(ctx context.Context, tripID, vehicleID, riderID string, seats int, pickup, destination Location, fare float64, status string) (*Booking, error) {
+    if seats <= 0 {
+        return nil, fmt.Errorf("a booking needs at least one seat")
+    }
+
+    var booking *Booking
+    err := bs.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        trip, err := loadTrip(ctx, txn, tripID)
+        if err != nil {
+            return err
+        }
+        if trip.Vehicle == nil || trip.Route == nil {
+            return fmt.Errorf("trip %s has no vehicle or route", tripID)
+        }
+        if vehicleID != "" && trip.Vehicle.VehicleID != vehicleID {
+            return fmt.Errorf("%w: trip %s is run by vehicle %s, not %s", ErrInvalidRequest, tripID, trip.Vehicle.VehicleID, vehicleID)
+        }
+        if trip.SeatsReserved+seats > trip.Capacity {
+            return fmt.Errorf("%w: %d of %d left", ErrNoSeats, trip.Capacity-trip.SeatsReserved, trip.Capacity)
+        }
+
+        now := bs.now()
+        node := bookingNode{
+            Uid:       "_:booking",
+            DType:     []string{"Booking"},
+            BookingID: generateUUID(),
+            Trip:      &tripNode{Uid: trip.Uid},
+            Route:     trip.Route,
+            Vehicle:   &vehicleNode{Uid: trip.Vehicle.Uid},
+            RiderID:   riderID,
+            Seats:     seats,
+            Fare:      fare,
+            PickupLat: pickup.Lat,
+            PickupLng: pickup.Lng,
+            DestLat:   destination.Lat,
+            DestLng:   destination.Lng,
+            Status:    status,
+            CreatedAt: now,
+            UpdatedAt: now,
+        }
+        if status == BookingRequested {
+            expires := now.Add(bookingHoldTTL)
+            node.HoldExpiresAt = &expires
+        } else {
+            node.ConfirmedAt = &now
+        }
+
+        if err := mutateJSON(ctx, txn, node); err != nil {
+            return err
+        }
+        if err := mutateJSON(ctx, txn, map[string]interface{}{
+            "uid":            trip.Uid,
+            "seats_reserved": trip.SeatsReserved + seats,
+        }); err != nil {
+            return err
+        }
+
+        booking = node.toBooking()
+        booking.TripID = trip.TripID
+        booking.VehicleID = trip.Vehicle.VehicleID
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    return booking, nil
+}
+
+// Confirm firms up a held booking
+func (bs *BookingService) Confirm(ctx context.Context, bookingID string) (*Booking, error) {
+    return bs.transition(ctx, bookingID, BookingConfirmed, "")
+}
+
+// Board records the rider getting on
+func (bs *BookingService) Board(ctx context.Context, bookingID string) (*Booking, error) {
+    return bs.transition(ctx, bookingID, BookingBoarded, "")
+}
+
+// Cancel releases a booking's seats
+func (bs *BookingService) Cancel(ctx context.Context, bookingID, reason string) (*Booking, error) {
+    return bs.transition(ctx, bookingID, BookingCancelled, reason)
+}
+
+// NoShow records that a confirmed rider never turned up, releasing the seats
+func (bs *BookingService) NoShow(ctx context.Context, bookingID string) (*Booking, error) {
+    return bs.transition(ctx, bookingID, BookingNoShow, "")
+}
+
+// transition moves a booking to a new state, returning its seats to the
+// trip if it no longer needs them
+func (bs *BookingService) transition(ctx context.Context, bookingID, status, reason string) (*Booking, error) {
+    var booking *Booking
+    err := bs.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        resp, err := txn.QueryWithVars(ctx, `
+            query Booking($id: string) {
+                bookings(func: eq(booking_id, $id)) @filter(type(Booking)) {
+                    uid
+                    booking_status
+                    booking_seats
+                    hold_expires_at
+                    booking_trip { uid trip_id seats_reserved }
+                }
+            }`, map[string]string{"$id": bookingID})
+        if err != nil {
+            return err
+        }
+
+        var result struct {
+            Bookings []bookingNode `json:"bookings"`
+        }
+        if err := json.Unmarshal(resp.Json, &result); err != nil {
+            return err
+        }
+        if len(result.Bookings) == 0 {
+            return fmt.Errorf("%w: %s", ErrBookingNotFound, bookingID)
+        }
+        current := result.Bookings[0]
+        now := bs.now()
+
+        // A hold that has run out can't be confirmed, whether or not the
+        // sweep has got to it yet
+        if current.Status == BookingRequested && status == BookingConfirmed &&
+            current.HoldExpiresAt != nil && !now.Before(*current.HoldExpiresAt) {
+            return fmt.Errorf("%w: hold expired at %s", ErrBookingTransition, current.HoldExpiresAt.Format(time.RFC3339))
+        }
+
+        allowed := false
+        for _, next := range bookingTransitions[current.Status] {
+            if next == status {
+                allowed = true
+                break
+            }
+        }
+        if !allowed {
+            return fmt.Errorf("%w: %s to %s", ErrBookingTransition, current.Status, status)
+        }
+
+        update := map[string]interface{}{
+            "uid":            current.Uid,
+            "booking_status": status,
+            "updated_at":     now,
+        }
+        switch status {
+        case BookingConfirmed:
+            update["confirmed_at"] = now
+        case BookingBoarded:
+            update["boarded_at"] = now
+        case BookingCancelled, BookingNoShow:
+            update["cancelled_at"] = now
+            if reason != "" {
+                update["cancel_reason"] = reason
+            }
+            if current.Trip != nil {
+                remaining := current.Trip.SeatsReserved - current.Seats
+                if remaining < 0 {
+                    remaining = 0
+                }
+                if err := mutateJSON(ctx, txn, map[string]interface{}{
+                    "uid":            current.Trip.Uid,
+                    "seats_reserved": remaining,
+                }); err != nil {
+                    return err
+                }
+            }
+        }
+        return mutateJSON(ctx, txn, update)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    booking, err = bs.GetBooking(ctx, bookingID)
+    return booking, err
+}
+
+// GetBooking returns a booking
+func (bs *BookingService) GetBooking(ctx context.Context, bookingID string) (*Booking, error) {
+    bookings, err := bs.queryBookings(ctx, `
+        query Booking($id: string) {
+            bookings(func: eq(booking_id, $id)) @filter(type(Booking)) {`+bookingFields+`
+            }
+        }`, map[string]string{"$id": bookingID})
+    if err != nil {
+        return nil, err
+    }
+    if len(bookings) == 0 {
+        return nil, fmt.Errorf("%w: %s", ErrBookingNotFound, bookingID)
+    }
+    return bookings[0], nil
+}
+
+// TripBookings lists the bookings on a trip
+func (bs *BookingService) TripBookings(ctx context.Context, tripID string) ([]*Booking, error) {
+    return bs.queryBookings(ctx, `
+        query Bookings($id: string) {
+            var(func: eq(trip_id, $id)) @filter(type(Trip)) {
+                b as ~booking_trip
+            }
+            bookings(func: uid(b), orderasc: created_at) {`+bookingFields+`
+            }
+        }`, map[string]string{"$id": tripID})
+}
+
+// RiderBookings lists a rider's bookings, newest first
+func (bs *BookingService) RiderBookings(ctx context.Context, riderID string) ([]*Booking, error) {
+    return bs.queryBookings(ctx, `
+        query Bookings($rider: string) {
+            bookings(func: eq(booking_rider, $rider), orderdesc: created_at) @filter(type(Booking)) {`+bookingFields+`
+            }
+        }`, map[string]string{"$rider": riderID})
+}
+
+func (bs *BookingService) queryBookings(ctx context.Context, query string, vars map[string]string) ([]*Booking, error) {
+    resp, err := bs.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, query, vars)
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Bookings []bookingNode `json:"bookings"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+
+    bookings := make([]*Booking, 0, len(result.Bookings))
+    for _, node := range result.Bookings {
+        bookings = append(bookings, node.toBooking())
+    }
+    return bookings, nil
+}
+
+// ExpireHolds cancels held bookings that were never confirmed
+func (bs *BookingService) ExpireHolds(ctx context.Context) error {
+    resp, err := bs.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query Expired($status: string, $now: string) {
+            bookings(func: eq(booking_status, $status)) @filter(type(Booking) AND le(hold_expires_at, $now)) {
+                booking_id
+            }
+        }`, map[string]string{
+        "$status": BookingRequested,
+        "$now":    bs.now().Format(time.RFC3339),
+    })
+    if err != nil {
+        return err
+    }
+
+    var result struct {
+        Bookings []bookingNode `json:"bookings"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return err
+    }
+
+    for _, node := range result.Bookings {
+        _, err := bs.transition(ctx, node.BookingID, BookingCancelled, "hold expired")
+        if err != nil && !errors.Is(err, ErrBookingTransition) {
+            return err
+        }
+    }
+    return nil
+}
+
+func (bs *BookingService) run() {
+    ticker := time.NewTicker(bookingSweepInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-bs.done:
+            return
+        case <-ticker.C:
+            ctx, cancel := context.WithTimeout(context.Background(), bookingSweepInterval)
+            if err := bs.ExpireHolds(ctx); err != nil {
+                log.Printf("Expiring booking holds: %v", err)
+            }
+            cancel()
+        }
+    }
+}
+
+// Close stops expiring holds
+func (bs *BookingService) Close() {
+    bs.closeOnce.Do(func() { close(bs.done) })
+}
+
+// AcceptSeatRequest has a crew accept a rider's seat request and books the
+// seats on the vehicle's current trip. If the booking can't be made, e.g.
+// the trip has filled up in the meantime, the request goes back to pending.
+func (rtm *RealTimeManager) AcceptSeatRequest(ctx context.Context, seatRequestID, vehicleID, tripID string) (*Booking, error) {
+    seatRequest, err := rtm.rides.AcceptSeatRequest(seatRequestID, vehicleID)
+    if err != nil {
+        return nil, err
+    }
+    booking, err := rtm.bookings.BookSeatRequest(ctx, *seatRequest, tripID)
+    if err != nil {
+        rtm.rides.reopen(seatRequestID)
+        return nil, err
+    }
+    return booking, nil
+}
+
+// Bookings returns the seat booking service
+func (rtm *RealTimeManager) Bookings() *BookingService {
+    return rtm.bookings
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+    "bufio"
+    "encoding/csv"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+
+    "github.com/uber/h3-go/v4"
+)
+
+// maxPolygonCells bounds how many cells a coverage may expand to when
+// mixed resolutions have to be brought to a common resolution
+const maxPolygonCells = 500000
+
+// GeoJSONMultiPolygon is the GeoJSON geometry for a coverage union.
+// Coordinates are [lng, lat] pairs with closed rings, per RFC 7946.
+type GeoJSONMultiPolygon struct {
+    Type        string           `json:"type"`
+    Coordinates [][][][2]float64 `json:"coordinates"`
+}
+
+// CoverageOverlap compares the coverage of two route sets
+type CoverageOverlap struct {
+    SharedAreaKm2 float64  `json:"shared_area_km2"`
+    OnlyAAreaKm2  float64  `json:"only_a_area_km2"`
+    OnlyBAreaKm2  float64  `json:"only_b_area_km2"`
+    Jaccard       float64  `json:"jaccard"` // shared / union, 0-1
+    SharedRoutes  []string `json:"shared_route_ids"`
+}
+
+// PopulationCoverage is the share of a population grid inside a coverage
+type PopulationCoverage struct {
+    Covered float64 `json:"covered_population"`
+    Total   float64 `json:"total_population"`
+    Share   float64 `json:"share"` // 0-1
+}
+
+// Calculate coverage area from H3 indexes using the real area of each cell.
+// Cells may be at different resolutions; a cell already inside a coarser
+// cell of the coverage is only counted once.
+func calculateCoverageArea(h3Indexes []string) float64 {
+    var area float64
+    for _, cell := range normalizeCoverage(h3Indexes) {
+        area += h3.CellAreaKm2(cell)
+    }
+    return area
+}
+
+// normalizeCoverage parses H3 indexes, drops invalid and duplicate cells,
+// and drops cells whose ancestor is already part of the coverage
+func normalizeCoverage(h3Indexes []string) []h3.Cell {
+    var cells []h3.Cell
+    seen := make(map[h3.Cell]bool)
+    for _, idx := range h3Indexes {
+        cell := h3.Cell(h3.IndexFromString(idx))
+        if !cell.IsValid() || seen[cell] {
+            continue
+        }
+        seen[cell] = true
+        cells = append(cells, cell)
+    }
+
+    // Coarse cells first, so descendants can be checked against them
+    sort.Slice(cells, func(i, j int) bool {
+        return cells[i].Resolution() < cells[j].Resolution()
+    })
+
+    kept := make(map[h3.Cell]bool, len(cells))
+    resolutions := make(map[int]bool)
+    var result []h3.Cell
+    for _, cell := range cells {
+        covered := false
+        for res := range resolutions {
+            if res < cell.Resolution() && kept[cell.Parent(res)] {
+                covered = true
+                break
+            }
+        }
+        if covered {
+            continue
+        }
+        kept[cell] = true
+        resolutions[cell.Resolution()] = true
+        result = append(result, cell)
+    }
+
+    return result
+}
+
+// uncompactCoverage brings cells to a single resolution so they can be
+// compared or traced into polygons
+func uncompactCoverage(cells []h3.Cell, resolution int) ([]h3.Cell, error) {
+    total := 0
+    for _, cell := range cells {
+        total += pow7(resolution - cell.Resolution())
+        if total > maxPolygonCells {
+            return nil, fmt.Errorf("coverage expands to more than %d cells at resolution %d", maxPolygonCells, resolution)
+        }
+    }
+
+    result := make([]h3.Cell, 0, total)
+    for _, cell := range cells {
+        if cell.Resolution() == resolution {
+            result = append(result, cell)
+            continue
+        }
+        result = append(result, cell.Children(resolution)...)
+    }
+    return result, nil
+}
+
+func pow7(n int) int {
+    result := 1
+    for i := 0; i < n; i++ {
+        result *= 7
+    }
+    return result
+}
+
+func finestResolution(cells []h3.Cell) int {
+    finest := 0
+    for _, cell := range cells {
+        if cell.Resolution() > finest {
+            finest = cell.Resolution()
+        }
+    }
+    return finest
+}
+
+// CoverageGeoJSON returns the union of the coverage cells as a GeoJSON
+// MultiPolygon
+func CoverageGeoJSON(h3Indexes []string) (*GeoJSONMultiPolygon, error) {
+    geometry := &GeoJSONMultiPolygon{
+        Type:        "MultiPolygon",
+        Coordinates: [][][][2]float64{},
+    }
+
+    cells := normalizeCoverage(h3Indexes)
+    if len(cells) == 0 {
+        return geometry, nil
+    }
+
+    // h3 only traces outlines for cells of one resolution
+    cells, err := uncompactCoverage(cells, finestResolution(cells))
+    if err != nil {
+        return nil, err
+    }
+
+    for _, polygon := range h3.CellsToMultiPolygon(cells) {
+        rings := [][][2]float64{geoLoopToRing(polygon.GeoLoop)}
+        for _, hole := range polygon.Holes {
+            rings = append(rings, geoLoopToRing(hole))
+        }
+        geometry.Coordinates = append(geometry.Coordinates, rings)
+    }
+
+    return geometry, nil
+}
+
+func geoLoopToRing(loop h3.GeoLoop) [][2]float64 {
+    ring := make([][2]float64, 0, len(loop)+1)
+    for _, point := range loop {
+        ring = append(ring, [2]float64{point.Lng, point.Lat})
+    }
+    if len(loop) > 0 {
+        ring = append(ring, ring[0])
+    }
+    return ring
+}
+
+// CompareCoverage measures how much two route sets cover the same ground
+func CompareCoverage(a, b *RouteSet) (*CoverageOverlap, error) {
+    cellsA := normalizeCoverage(a.Coverage)
+    cellsB := normalizeCoverage(b.Coverage)
+
+    resolution := finestResolution(cellsA)
+    if res := finestResolution(cellsB); res > resolution {
+        resolution = res
+    }
+
+    cellsA, err := uncompactCoverage(cellsA, resolution)
+    if err != nil {
+        return nil, err
+    }
+    cellsB, err = uncompactCoverage(cellsB, resolution)
+    if err != nil {
+        return nil, err
+    }
+
+    inB := make(map[h3.Cell]bool, len(cellsB))
+    for _, cell := range cellsB {
+        inB[cell] = true
+    }
+
+    overlap := &CoverageOverlap{}
+    shared := make(map[h3.Cell]bool)
+    for _, cell := range cellsA {
+        if inB[cell] {
+            shared[cell] = true
+            overlap.SharedAreaKm2 += h3.CellAreaKm2(cell)
+        } else {
+            overlap.OnlyAAreaKm2 += h3.CellAreaKm2(cell)
+        }
+    }
+    for _, cell := range cellsB {
+        if !shared[cell] {
+            overlap.OnlyBAreaKm2 += h3.CellAreaKm2(cell)
+        }
+    }
+
+    union := overlap.SharedAreaKm2 + overlap.OnlyAAreaKm2 + overlap.OnlyBAreaKm2
+    if union > 0 {
+        overlap.Jaccard = overlap.SharedAreaKm2 / union
+    }
+
+    routesInB := make(map[string]bool, len(b.Routes))
+    for _, routeID := range b.Routes {
+        routesInB[routeID] = true
+    }
+    for _, routeID := range a.Routes {
+        if routesInB[routeID] {
+            overlap.SharedRoutes = append(overlap.SharedRoutes, routeID)
+        }
+    }
+
+    return overlap, nil
+}
+
+// PopulationGrid holds population counts at points, loaded from a local
+// CSV or ESRI ASCII raster
+type PopulationGrid struct {
+    points []populationPoint
+    total  float64
+}
+
+type populationPoint struct {
+    latLng     h3.LatLng
+    population float64
+}
+
+func (pg *PopulationGrid) add(lat, lng, population float64) {
+    if population <= 0 {
+        return
+    }
+    pg.points = append(pg.points, populationPoint{
+        latLng:     h3.NewLatLng(lat, lng),
+        population: population,
+    })
+    pg.total += population
+}
+
+// LoadPopulationCSV reads a CSV with a header row and either
+// "h3_index,population" or "lat,lng,population" columns
+func LoadPopulationCSV(path string) (*PopulationGrid, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    reader := csv.NewReader(file)
+    header, err := reader.Read()
+    if err != nil {
+        return nil, fmt.Errorf("reading population header: %w", err)
+    }
+
+    columns := make(map[string]int)
+    for i, name := range header {
+        columns[strings.ToLower(strings.TrimSpace(name))] = i
+    }
+    popCol, ok := columns["population"]
+    if !ok {
+        return nil, fmt.Errorf("population CSV has no population column")
+    }
+    h3Col, byCell := columns["h3_index"]
+    latCol, hasLat := columns["lat"]
+    lngCol, hasLng := columns["lng"]
+    if !byCell && !(hasLat && hasLng) {
+        return nil, fmt.Errorf("population CSV needs h3_index or lat,lng columns")
+    }
+
+    grid := &PopulationGrid{}
+    for line := 2; ; line++ {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %w", line, err)
+        }
+
+        population, err := strconv.ParseFloat(record[popCol], 64)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: invalid population %q", line, record[popCol])
+        }
+
+        if byCell {
+            cell := h3.Cell(h3.IndexFromString(record[h3Col]))
+            if !cell.IsValid() {
+                return nil, fmt.Errorf("line %d: invalid h3 index %q", line, record[h3Col])
+            }
+            center := cell.LatLng()
+            grid.add(center.Lat, center.Lng, population)
+            continue
+        }
+
+        lat, errLat := strconv.ParseFloat(record[latCol], 64)
+        lng, errLng := strconv.ParseFloat(record[lngCol], 64)
+        if errLat != nil || errLng != nil {
+            return nil, fmt.Errorf("line %d: invalid coordinates", line)
+        }
+        grid.add(lat, lng, population)
+    }
+
+    return grid, nil
+}
+
+// LoadPopulationRaster reads an ESRI ASCII grid (.asc) in WGS84 degrees,
+// taking each raster cell's centre as a population point
+func LoadPopulationRaster(path string) (*PopulationGrid, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+
+    // The header runs until the first row of values, as NODATA_value may
+    // be left out
+    header := make(map[string]float64)
+    var firstRow string
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 0 {
+            continue
+        }
+        if _, err := strconv.ParseFloat(fields[0], 64); err == nil {
+            firstRow = scanner.Text()
+            break
+        }
+        if len(fields) != 2 {
+            return nil, fmt.Errorf("invalid raster header line %q", scanner.Text())
+        }
+        value, err := strconv.ParseFloat(fields[1], 64)
+        if err != nil {
+            return nil, fmt.Errorf("invalid raster header value %q", fields[1])
+        }
+        header[strings.ToLower(fields[0])] = value
+    }
+    for _, key := range []string{"ncols", "nrows", "cellsize"} {
+        if _, ok := header[key]; !ok {
+            return nil, fmt.Errorf("raster header is missing %s", key)
+        }
+    }
+    ncols, nrows := int(header["ncols"]), int(header["nrows"])
+    cellSize := header["cellsize"]
+    noData, hasNoData := header["nodata_value"]
+    xllCorner, err := rasterCorner(header, "x", cellSize)
+    if err != nil {
+        return nil, err
+    }
+    yllCorner, err := rasterCorner(header, "y", cellSize)
+    if err != nil {
+        return nil, err
+    }
+
+    grid := &PopulationGrid{}
+    for row := 0; row < nrows; row++ {
+        line := firstRow
+        if row > 0 || line == "" {
+            if !scanner.Scan() {
+                return nil, fmt.Errorf("raster has %d of %d rows", row, nrows)
+            }
+            line = scanner.Text()
+        }
+        fields := strings.Fields(line)
+        if len(fields) != ncols {
+            return nil, fmt.Errorf("raster row %d has %d of %d columns", row, len(fields), ncols)
+        }
+
+        // Rows run north to south
+        lat := yllCorner + (float64(nrows-row)-0.5)*cellSize
+        for col, field := range fields {
+            value, err := strconv.ParseFloat(field, 64)
+            if err != nil {
+                return nil, fmt.Errorf("raster row %d col %d: invalid value %q", row, col, field)
+            }
+            if hasNoData && value == noData {
+                continue
+            }
+            lng := xllCorner + (float64(col)+0.5)*cellSize
+            grid.add(lat, lng, value)
+        }
+    }
+
+    return grid, scanner.Err()
+}
+
+// rasterCorner is the grid's lower left corner on one axis, from its
+// xllcorner header or, for grids registered by cell centre, xllcenter
+func rasterCorner(header map[string]float64, axis string, cellSize float64) (float64, error) {
+    if corner, ok := header[axis+"llcorner"]; ok {
+        return corner, nil
+    }
+    if center, ok := header[axis+"llcenter"]; ok {
+        return center - cellSize/2, nil
+    }
+    return 0, fmt.Errorf("raster header is missing %sllcorner or %sllcenter", axis, axis)
+}
+
+// Coverage returns how much of the grid's population falls inside the
+// coverage cells
+func (pg *PopulationGrid) Coverage(h3Indexes []string) PopulationCoverage {
+    cells := normalizeCoverage(h3Indexes)
+    covered := make(map[h3.Cell]bool, len(cells))
+    resolutions := make(map[int]bool)
+    for _, cell := range cells {
+        covered[cell] = true
+        resolutions[cell.Resolution()] = true
+    }
+
+    result := PopulationCoverage{Total: pg.total}
+    for _, point := range pg.points {
+        for res := range resolutions {
+            if covered[h3.LatLngToCell(point.latLng, res)] {
+                result.Covered += point.population
+                break
+            }
+        }
+    }
+
+    if result.Total > 0 {
+        result.Share = result.Covered / result.Total
+    }
+    return result
+}
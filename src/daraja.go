@@ -0,0 +1,474 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "time"
+
+    "motown/auth"
+)
+
+const (
+    DarajaSandboxURL    = "https://sandbox.safaricom.co.ke"
+    DarajaProductionURL = "https://api.safaricom.co.ke"
+
+    darajaTimestampLayout = "20060102150405"
+    darajaCallbackLimit   = 1 << 20
+    darajaStillProcessing = "500.001.1001"
+)
+
+// DarajaConfig holds the credentials and URLs for Safaricom's Daraja API
+type DarajaConfig struct {
+    BaseURL        string // DarajaSandboxURL, DarajaProductionURL or a mock
+    ConsumerKey    string
+    ConsumerSecret string
+    ShortCode      string // paybill or till number taking the payments
+    Passkey        string // Lipa na M-Pesa Online passkey
+    // CallbackURL is where Daraja posts results; it must reach
+    // PaymentService.CallbackHandler("mpesa"), which the API serves at
+    // /v1/payments/callbacks/mpesa
+    CallbackURL string
+    // CallbackSecret signs the callback URLs handed to Daraja. Daraja
+    // doesn't sign its callbacks, so a valid signature in the URL is what
+    // shows a callback is genuine.
+    CallbackSecret     string
+    Initiator          string // API operator allowed to reverse payments
+    SecurityCredential string // the initiator's encrypted password
+    HTTPClient         *http.Client
+}
+
+// LoadDarajaConfig reads the M-Pesa settings, looked up by name:
+//
+//	MPESA_CONSUMER_KEY         Daraja app consumer key
+//	MPESA_CONSUMER_SECRET      Daraja app consumer secret
+//	MPESA_SHORTCODE            paybill or till number
+//	MPESA_PASSKEY              Lipa na M-Pesa Online passkey
+//	MPESA_CALLBACK_URL         public URL of /v1/payments/callbacks/mpesa
+//	MPESA_CALLBACK_SECRET      secret signing the callback URLs
+//	MPESA_INITIATOR            API operator for reversals
+//	MPESA_SECURITY_CREDENTIAL  the initiator's encrypted password
+//	MPESA_BASE_URL             Daraja to call, the sandbox if unset
+//
+// It returns ok false if MPESA_CONSUMER_KEY is unset.
+func LoadDarajaConfig(lookup func(string) string) (config DarajaConfig, ok bool, err error) {
+    config = DarajaConfig{
+        BaseURL:            lookup("MPESA_BASE_URL"),
+        ConsumerKey:        lookup("MPESA_CONSUMER_KEY"),
+        ConsumerSecret:     lookup("MPESA_CONSUMER_SECRET"),
+        ShortCode:          lookup("MPESA_SHORTCODE"),
+        Passkey:            lookup("MPESA_PASSKEY"),
+        CallbackURL:        lookup("MPESA_CALLBACK_URL"),
+        CallbackSecret:     lookup("MPESA_CALLBACK_SECRET"),
+        Initiator:          lookup("MPESA_INITIATOR"),
+        SecurityCredential: lookup("MPESA_SECURITY_CREDENTIAL"),
+    }
+    if config.ConsumerKey == "" {
+        return config, false, nil
+    }
+    if config.ConsumerSecret == "" || config.ShortCode == "" || config.Passkey == "" ||
+        config.CallbackURL == "" || config.CallbackSecret == "" {
+        return config, true, fmt.Errorf("MPESA_CONSUMER_KEY is set, so MPESA_CONSUMER_SECRET, MPESA_SHORTCODE, MPESA_PASSKEY, MPESA_CALLBACK_URL and MPESA_CALLBACK_SECRET must be too")
+    }
+    return config, true, nil
+}
+
+// DarajaProvider collects fares with M-Pesa STK push and refunds them with
+// transaction reversals
+type DarajaProvider struct {
+    config      DarajaConfig
+    client      *http.Client
+    mu          sync.Mutex
+    token       string
+    tokenExpiry time.Time
+    now         func() time.Time
+}
+
+func NewDarajaProvider(config DarajaConfig) (*DarajaProvider, error) {
+    if config.ConsumerKey == "" || config.ConsumerSecret == "" || config.ShortCode == "" || config.Passkey == "" {
+        return nil, fmt.Errorf("daraja needs a consumer key and secret, short code and passkey")
+    }
+    if config.CallbackURL == "" || config.CallbackSecret == "" {
+        return nil, fmt.Errorf("daraja needs a callback URL and a secret to sign it with")
+    }
+    if config.BaseURL == "" {
+        config.BaseURL = DarajaSandboxURL
+    }
+    config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+
+    client := config.HTTPClient
+    if client == nil {
+        client = &http.Client{Timeout: providerRequestTimeout}
+    }
+    return &DarajaProvider{config: config, client: client, now: time.Now}, nil
+}
+
+func (dp *DarajaProvider) Name() string {
+    return "mpesa"
+}
+
+// accessToken returns a cached OAuth token, fetching a new one shortly
+// before the old one expires
+func (dp *DarajaProvider) accessToken(ctx context.Context) (string, error) {
+    dp.mu.Lock()
+    defer dp.mu.Unlock()
+
+    if dp.token != "" && dp.now().Before(dp.tokenExpiry) {
+        return dp.token, nil
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+        dp.config.BaseURL+"/oauth/v1/generate?grant_type=client_credentials", nil)
+    if err != nil {
+        return "", err
+    }
+    req.SetBasicAuth(dp.config.ConsumerKey, dp.config.ConsumerSecret)
+
+    resp, err := dp.client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("daraja token request returned %s", resp.Status)
+    }
+
+    var result struct {
+        AccessToken string `json:"access_token"`
+        ExpiresIn   string `json:"expires_in"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+        return "", err
+    }
+
+    lifetime := time.Hour
+    if seconds, err := time.ParseDuration(result.ExpiresIn + "s"); err == nil {
+        lifetime = seconds
+    }
+    dp.token = result.AccessToken
+    dp.tokenExpiry = dp.now().Add(lifetime - time.Minute)
+    return dp.token, nil
+}
+
+// call posts a request to Daraja and decodes the reply. Daraja reports
+// some outcomes, such as a push still being processed, with error
+// statuses, so the body is decoded whatever the status and left to the
+// caller to judge.
+func (dp *DarajaProvider) call(ctx context.Context, path string, body, result interface{}) error {
+    token, err := dp.accessToken(ctx)
+    if err != nil {
+        return err
+    }
+    payload, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, dp.config.BaseURL+path, bytes.NewReader(payload))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("Content-Type", "application/json")
+
+    resp, err := dp.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode == http.StatusUnauthorized {
+        dp.mu.Lock()
+        dp.token = ""
+        dp.mu.Unlock()
+    }
+    if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+        return fmt.Errorf("daraja %s returned %s: %w", path, resp.Status, err)
+    }
+    return nil
+}
+
+// darajaError is the shape of Daraja's error replies
+type darajaError struct {
+    RequestID    string `json:"requestId"`
+    ErrorCode    string `json:"errorCode"`
+    ErrorMessage string `json:"errorMessage"`
+}
+
+// password is the STK push password for a timestamp
+func (dp *DarajaProvider) password(timestamp string) string {
+    return base64.StdEncoding.EncodeToString([]byte(dp.config.ShortCode + dp.config.Passkey + timestamp))
+}
+
+// signature is the HMAC that ties a callback URL to one payment or refund
+func (dp *DarajaProvider) signature(kind, paymentID, refundID string) string {
+    mac := hmac.New(sha256.New, []byte(dp.config.CallbackSecret))
+    mac.Write([]byte(kind + ":" + paymentID + ":" + refundID))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (dp *DarajaProvider) callbackURL(kind, paymentID, refundID string) string {
+    query := url.Values{}
+    query.Set("kind", kind)
+    query.Set("payment", paymentID)
+    if refundID != "" {
+        query.Set("refund", refundID)
+    }
+    query.Set("sig", dp.signature(kind, paymentID, refundID))
+
+    separator := "?"
+    if strings.Contains(dp.config.CallbackURL, "?") {
+        separator = "&"
+    }
+    return dp.config.CallbackURL + separator + query.Encode()
+}
+
+// Charge sends an STK push asking the payer to enter their M-Pesa PIN
+func (dp *DarajaProvider) Charge(ctx context.Context, intent PaymentIntent) (string, error) {
+    // Daraja wants the number without the +
+    phone, err := auth.NormalizePhone(intent.Phone)
+    if err != nil {
+        return "", err
+    }
+    phone = strings.TrimPrefix(phone, "+")
+    timestamp := dp.now().Format(darajaTimestampLayout)
+
+    reference := intent.BookingID
+    if reference == "" {
+        reference = intent.TripID
+    }
+    if len(reference) > 12 {
+        reference = reference[:12]
+    }
+    description := intent.Description
+    if description == "" {
+        description = "Fare"
+    }
+    if len(description) > 13 {
+        description = description[:13]
+    }
+
+    var result struct {
+        darajaError
+        MerchantRequestID   string `json:"MerchantRequestID"`
+        CheckoutRequestID   string `json:"CheckoutRequestID"`
+        ResponseCode        string `json:"ResponseCode"`
+        ResponseDescription string `json:"ResponseDescription"`
+    }
+    err = dp.call(ctx, "/mpesa/stkpush/v1/processrequest", map[string]interface{}{
+        "BusinessShortCode": dp.config.ShortCode,
+        "Password":          dp.password(timestamp),
+        "Timestamp":         timestamp,
+        "TransactionType":   "CustomerPayBillOnline",
+        "Amount":            int(math.Ceil(intent.Amount)),
+        "PartyA":            phone,
+        "PartyB":            dp.config.ShortCode,
+        "PhoneNumber":       phone,
+        "CallBackURL":       dp.callbackURL(EventPayment, intent.ID, ""),
+        "AccountReference":  reference,
+        "TransactionDesc":   description,
+    }, &result)
+    if err != nil {
+        return "", err
+    }
+    if result.ResponseCode != "0" {
+        return "", fmt.Errorf("stk push rejected: %s%s", result.ResponseDescription, result.ErrorMessage)
+    }
+    return result.CheckoutRequestID, nil
+}
+
+// Status queries how an STK push ended
+func (dp *DarajaProvider) Status(ctx context.Context, intent PaymentIntent) (ProviderEvent, error) {
+    timestamp := dp.now().Format(darajaTimestampLayout)
+
+    var result struct {
+        darajaError
+        ResponseCode      string `json:"ResponseCode"`
+        CheckoutRequestID string `json:"CheckoutRequestID"`
+        ResultCode        string `json:"ResultCode"`
+        ResultDesc        string `json:"ResultDesc"`
+    }
+    err := dp.call(ctx, "/mpesa/stkpushquery/v1/query", map[string]interface{}{
+        "BusinessShortCode": dp.config.ShortCode,
+        "Password":          dp.password(timestamp),
+        "Timestamp":         timestamp,
+        "CheckoutRequestID": intent.Reference,
+    }, &result)
+    if err != nil {
+        return ProviderEvent{}, err
+    }
+
+    event := ProviderEvent{Kind: EventPayment, PaymentID: intent.ID, Reference: intent.Reference}
+    switch {
+    case result.ErrorCode == darajaStillProcessing:
+        event.Status = PaymentPending
+    case result.ErrorCode != "":
+        return ProviderEvent{}, fmt.Errorf("stk query failed: %s", result.ErrorMessage)
+    case result.ResultCode == "0":
+        // The query doesn't carry the receipt number; the callback does,
+        // so a payment settled here has none
+        event.Status = PaymentSucceeded
+    default:
+        event.Status = PaymentFailed
+        event.Reason = result.ResultDesc
+    }
+    return event, nil
+}
+
+// Refund reverses the payer's M-Pesa transaction. The reversal is settled
+// later by a callback to the result URL.
+func (dp *DarajaProvider) Refund(ctx context.Context, intent PaymentIntent, refund Refund) (string, error) {
+    if dp.config.Initiator == "" || dp.config.SecurityCredential == "" {
+        return "", fmt.Errorf("daraja refunds need an initiator and security credential")
+    }
+    if intent.Receipt == "" {
+        return "", fmt.Errorf("payment %s has no M-Pesa receipt to reverse", intent.ID)
+    }
+
+    resultURL := dp.callbackURL(EventRefund, intent.ID, refund.ID)
+    var result struct {
+        darajaError
+        OriginatorConversationID string `json:"OriginatorConversationID"`
+        ConversationID           string `json:"ConversationID"`
+        ResponseCode             string `json:"ResponseCode"`
+        ResponseDescription      string `json:"ResponseDescription"`
+    }
+    err := dp.call(ctx, "/mpesa/reversal/v1/request", map[string]interface{}{
+        "Initiator":              dp.config.Initiator,
+        "SecurityCredential":     dp.config.SecurityCredential,
+        "CommandID":              "TransactionReversal",
+        "TransactionID":          intent.Receipt,
+        "Amount":                 int(math.Ceil(refund.Amount)),
+        "ReceiverParty":          dp.config.ShortCode,
+        "RecieverIdentifierType": "11",
+        "ResultURL":              resultURL,
+        "QueueTimeOutURL":        resultURL + "&timeout=1",
+        "Remarks":                "Fare refund",
+        "Occasion":               refund.Reason,
+    }, &result)
+    if err != nil {
+        return "", err
+    }
+    if result.ResponseCode != "0" {
+        return "", fmt.Errorf("reversal rejected: %s%s", result.ResponseDescription, result.ErrorMessage)
+    }
+    return result.ConversationID, nil
+}
+
+// darajaSTKCallback is what Daraja posts when an STK push ends
+type darajaSTKCallback struct {
+    Body struct {
+        StkCallback struct {
+            MerchantRequestID string `json:"MerchantRequestID"`
+            CheckoutRequestID string `json:"CheckoutRequestID"`
+            ResultCode        int    `json:"ResultCode"`
+            ResultDesc        string `json:"ResultDesc"`
+            CallbackMetadata  struct {
+                Item []struct {
+                    Name  string      `json:"Name"`
+                    Value interface{} `json:"Value"`
+                } `json:"Item"`
+            } `json:"CallbackMetadata"`
+        } `json:"stkCallback"`
+    } `json:"Body"`
+}
+
+// darajaResultCallback is what Daraja posts when a reversal ends
+type darajaResultCallback struct {
+    Result struct {
+        ResultType               int    `json:"ResultType"`
+        ResultCode               int    `json:"ResultCode"`
+        ResultDesc               string `json:"ResultDesc"`
+        OriginatorConversationID string `json:"OriginatorConversationID"`
+        ConversationID           string `json:"ConversationID"`
+        TransactionID            string `json:"TransactionID"`
+    } `json:"Result"`
+}
+
+// ParseCallback checks the callback URL's signature and reads an STK push
+// or reversal result
+func (dp *DarajaProvider) ParseCallback(r *http.Request) (ProviderEvent, error) {
+    if r.Method != http.MethodPost {
+        return ProviderEvent{}, fmt.Errorf("%w: method %s", ErrBadCallback, r.Method)
+    }
+
+    query := r.URL.Query()
+    kind, paymentID, refundID := query.Get("kind"), query.Get("payment"), query.Get("refund")
+    expected := dp.signature(kind, paymentID, refundID)
+    if paymentID == "" || !hmac.Equal([]byte(query.Get("sig")), []byte(expected)) {
+        return ProviderEvent{}, fmt.Errorf("%w: bad signature", ErrBadCallback)
+    }
+
+    body, err := io.ReadAll(io.LimitReader(r.Body, darajaCallbackLimit))
+    if err != nil {
+        return ProviderEvent{}, err
+    }
+    event := ProviderEvent{Kind: kind, PaymentID: paymentID, RefundID: refundID}
+
+    switch kind {
+    case EventPayment:
+        var callback darajaSTKCallback
+        if err := json.Unmarshal(body, &callback); err != nil {
+            return ProviderEvent{}, fmt.Errorf("%w: %v", ErrBadCallback, err)
+        }
+        result := callback.Body.StkCallback
+        if result.CheckoutRequestID == "" {
+            return ProviderEvent{}, fmt.Errorf("%w: no checkout request id", ErrBadCallback)
+        }
+        event.Reference = result.CheckoutRequestID
+
+        if result.ResultCode != 0 {
+            event.Status = PaymentFailed
+            event.Reason = result.ResultDesc
+            return event, nil
+        }
+        event.Status = PaymentSucceeded
+        for _, item := range result.CallbackMetadata.Item {
+            switch item.Name {
+            case "MpesaReceiptNumber":
+                event.Receipt = fmt.Sprint(item.Value)
+            case "Amount":
+                if amount, ok := item.Value.(float64); ok {
+                    event.Amount = amount
+                }
+            }
+        }
+
+    case EventRefund:
+        if refundID == "" {
+            return ProviderEvent{}, fmt.Errorf("%w: no refund id", ErrBadCallback)
+        }
+        if query.Get("timeout") != "" {
+            event.Status = RefundFailed
+            event.Reason = "reversal timed out in Daraja's queue"
+            return event, nil
+        }
+
+        var callback darajaResultCallback
+        if err := json.Unmarshal(body, &callback); err != nil {
+            return ProviderEvent{}, fmt.Errorf("%w: %v", ErrBadCallback, err)
+        }
+        event.Reference = callback.Result.ConversationID
+        if callback.Result.ResultCode == 0 {
+            event.Status = RefundSucceeded
+        } else {
+            event.Status = RefundFailed
+            event.Reason = callback.Result.ResultDesc
+        }
+
+    default:
+        return ProviderEvent{}, fmt.Errorf("%w: unknown kind %q", ErrBadCallback, kind)
+    }
+    return event, nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+    "bytes"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "time"
+)
+
+// STK push result codes the mock can be told to answer with
+const (
+    DarajaResultSuccess      = 0
+    DarajaResultInsufficient = 1
+    DarajaResultCancelled    = 1032
+    DarajaResultTimeout      = 1037
+)
+
+// MockDaraja is a local stand-in for the Daraja API. It answers token, STK
+// push, STK query and reversal requests the way Daraja does and posts the
+// results back to the callback URLs it was given, so the whole payment
+// flow can run without Safaricom's sandbox.
+type MockDaraja struct {
+    server         *httptest.Server
+    consumerKey    string
+    consumerSecret string
+    passkey        string
+    token          string
+    // CallbackDelay is how long the mock waits before posting a result,
+    // standing in for the payer entering their PIN
+    CallbackDelay time.Duration
+    mu            sync.Mutex
+    results       map[string]int // phone -> result code, success if unset
+    pushes        map[string]*mockPush
+    reversals     int
+    sequence      int
+}
+
+type mockPush struct {
+    CheckoutRequestID string
+    Phone             string
+    Amount            float64
+    ResultCode        int
+    Receipt           string
+    Done              bool
+}
+
+func NewMockDaraja(consumerKey, consumerSecret, passkey string) *MockDaraja {
+    md := &MockDaraja{
+        consumerKey:    consumerKey,
+        consumerSecret: consumerSecret,
+        passkey:        passkey,
+        token:          "mock-token",
+        CallbackDelay:  100 * time.Millisecond,
+        results:        make(map[string]int),
+        pushes:         make(map[string]*mockPush),
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/oauth/v1/generate", md.handleToken)
+    mux.HandleFunc("/mpesa/stkpush/v1/processrequest", md.authorized(md.handleSTKPush))
+    mux.HandleFunc("/mpesa/stkpushquery/v1/query", md.authorized(md.handleSTKQuery))
+    mux.HandleFunc("/mpesa/reversal/v1/request", md.authorized(md.handleReversal))
+    md.server = httptest.NewServer(mux)
+    return md
+}
+
+// URL is the base URL to give DarajaConfig
+func (md *MockDaraja) URL() string {
+    return md.server.URL
+}
+
+// Close shuts the mock down
+func (md *MockDaraja) Close() {
+    md.server.Close()
+}
+
+// SetResult makes STK pushes to a phone end with the given result code
+func (md *MockDaraja) SetResult(phone string, resultCode int) {
+    md.mu.Lock()
+    defer md.mu.Unlock()
+    md.results[phone] = resultCode
+}
+
+// Pushes is how many STK pushes the mock has been sent
+func (md *MockDaraja) Pushes() int {
+    md.mu.Lock()
+    defer md.mu.Unlock()
+    return len(md.pushes)
+}
+
+// Reversals is how many reversals the mock has been sent
+func (md *MockDaraja) Reversals() int {
+    md.mu.Lock()
+    defer md.mu.Unlock()
+    return md.reversals
+}
+
+func (md *MockDaraja) handleToken(w http.ResponseWriter, r *http.Request) {
+    key, secret, ok := r.BasicAuth()
+    if !ok || key != md.consumerKey || secret != md.consumerSecret {
+        mockDarajaError(w, http.StatusBadRequest, "400.008.01", "Invalid Authentication passed")
+        return
+    }
+    writeMockJSON(w, http.StatusOK, map[string]string{
+        "access_token": md.token,
+        "expires_in":   "3599",
+    })
+}
+
+func (md *MockDaraja) authorized(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Authorization") != "Bearer "+md.token {
+            mockDarajaError(w, http.StatusUnauthorized, "404.001.03", "Invalid Access Token")
+            return
+        }
+        next(w, r)
+    }
+}
+
+func (md *MockDaraja) checkPassword(shortCode, password, timestamp string) bool {
+    expected := base64.StdEncoding.EncodeToString([]byte(shortCode + md.passkey + timestamp))
+    return password == expected
+}
+
+func (md *MockDaraja) handleSTKPush(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        BusinessShortCode string  `json:"BusinessShortCode"`
+        Password          string  `json:"Password"`
+        Timestamp         string  `json:"Timestamp"`
+        Amount            float64 `json:"Amount"`
+        PhoneNumber       string  `json:"PhoneNumber"`
+        CallBackURL       string  `json:"CallBackURL"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        mockDarajaError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Body")
+        return
+    }
+    if !md.checkPassword(req.BusinessShortCode, req.Password, req.Timestamp) {
+        mockDarajaError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Password")
+        return
+    }
+    if req.Amount < 1 || req.CallBackURL == "" || !strings.HasPrefix(req.PhoneNumber, "254") {
+        mockDarajaError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Request")
+        return
+    }
+
+    md.mu.Lock()
+    md.sequence++
+    merchantRequestID := fmt.Sprintf("mock-%d", md.sequence)
+    push := &mockPush{
+        CheckoutRequestID: fmt.Sprintf("ws_CO_%s_%d", time.Now().Format(darajaTimestampLayout), md.sequence),
+        Phone:             req.PhoneNumber,
+        Amount:            req.Amount,
+        ResultCode:        md.results[req.PhoneNumber],
+        Receipt:           fmt.Sprintf("MOCK%06d", md.sequence),
+    }
+    md.pushes[push.CheckoutRequestID] = push
+    md.mu.Unlock()
+
+    go md.completePush(push, req.CallBackURL)
+
+    writeMockJSON(w, http.StatusOK, map[string]string{
+        "MerchantRequestID":   merchantRequestID,
+        "CheckoutRequestID":   push.CheckoutRequestID,
+        "ResponseCode":        "0",
+        "ResponseDescription": "Success. Request accepted for processing",
+        "CustomerMessage":     "Success. Request accepted for processing",
+    })
+}
+
+// completePush posts the push's result to its callback URL once the
+// simulated payer has responded
+func (md *MockDaraja) completePush(push *mockPush, callbackURL string) {
+    time.Sleep(md.CallbackDelay)
+
+    md.mu.Lock()
+    push.Done = true
+    md.mu.Unlock()
+
+    callback := map[string]interface{}{
+        "MerchantRequestID": "mock",
+        "CheckoutRequestID": push.CheckoutRequestID,
+        "ResultCode":        push.ResultCode,
+        "ResultDesc":        mockResultDesc(push.ResultCode),
+    }
+    if push.ResultCode == DarajaResultSuccess {
+        callback["CallbackMetadata"] = map[string]interface{}{
+            "Item": []map[string]interface{}{
+                {"Name": "Amount", "Value": push.Amount},
+                {"Name": "MpesaReceiptNumber", "Value": push.Receipt},
+                {"Name": "TransactionDate", "Value": time.Now().Format(darajaTimestampLayout)},
+                {"Name": "PhoneNumber", "Value": push.Phone},
+            },
+        }
+    }
+    postMockCallback(callbackURL, map[string]interface{}{
+        "Body": map[string]interface{}{"stkCallback": callback},
+    })
+}
+
+func (md *MockDaraja) handleSTKQuery(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        BusinessShortCode string `json:"BusinessShortCode"`
+        Password          string `json:"Password"`
+        Timestamp         string `json:"Timestamp"`
+        CheckoutRequestID string `json:"CheckoutRequestID"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+        !md.checkPassword(req.BusinessShortCode, req.Password, req.Timestamp) {
+        mockDarajaError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Body")
+        return
+    }
+
+    md.mu.Lock()
+    push, exists := md.pushes[req.CheckoutRequestID]
+    done := exists && push.Done
+    md.mu.Unlock()
+
+    switch {
+    case !exists:
+        mockDarajaError(w, http.StatusNotFound, "404.001.01", "Invalid CheckoutRequestID")
+    case !done:
+        mockDarajaError(w, http.StatusInternalServerError, darajaStillProcessing, "The transaction is being processed")
+    default:
+        writeMockJSON(w, http.StatusOK, map[string]string{
+            "ResponseCode":        "0",
+            "ResponseDescription": "The service request has been accepted successfully",
+            "CheckoutRequestID":   push.CheckoutRequestID,
+            "ResultCode":          fmt.Sprint(push.ResultCode),
+            "ResultDesc":          mockResultDesc(push.ResultCode),
+        })
+    }
+}
+
+func (md *MockDaraja) handleReversal(w http.ResponseWriter, r *http.Request) {
+    var req struct {
+        TransactionID string  `json:"TransactionID"`
+        Amount        float64 `json:"Amount"`
+        ResultURL     string  `json:"ResultURL"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ResultURL == "" {
+        mockDarajaError(w, http.StatusBadRequest, "400.002.02", "Bad Request - Invalid Body")
+        return
+    }
+
+    md.mu.Lock()
+    md.reversals++
+    md.sequence++
+    conversationID := fmt.Sprintf("AG_%s_%d", time.Now().Format(darajaTimestampLayout), md.sequence)
+    known := false
+    for _, push := range md.pushes {
+        if push.Receipt == req.TransactionID && push.ResultCode == DarajaResultSuccess {
+            known = req.Amount <= push.Amount
+            break
+        }
+    }
+    md.mu.Unlock()
+
+    go func() {
+        time.Sleep(md.CallbackDelay)
+        result := map[string]interface{}{
+            "ResultType":               0,
+            "ResultCode":               0,
+            "ResultDesc":               "The service request is processed successfully.",
+            "OriginatorConversationID": "mock",
+            "ConversationID":           conversationID,
+            "TransactionID":            req.TransactionID,
+        }
+        if !known {
+            result["ResultCode"] = 2001
+            result["ResultDesc"] = "The initiator information is invalid."
+        }
+        postMockCallback(req.ResultURL, map[string]interface{}{"Result": result})
+    }()
+
+    writeMockJSON(w, http.StatusOK, map[string]string{
+        "OriginatorConversationID": "mock",
+        "ConversationID":           conversationID,
+        "ResponseCode":             "0",
+        "ResponseDescription":      "Accept the service request successfully.",
+    })
+}
+
+func mockResultDesc(code int) string {
+    switch code {
+    case DarajaResultSuccess:
+        return "The service request is processed successfully."
+    case DarajaResultInsufficient:
+        return "The balance is insufficient for the transaction."
+    case DarajaResultCancelled:
+        return "Request cancelled by user"
+    case DarajaResultTimeout:
+        return "DS timeout user cannot be reached"
+    default:
+        return "The transaction failed"
+    }
+}
+
+func postMockCallback(callbackURL string, body interface{}) {
+    payload, err := json.Marshal(body)
+    if err != nil {
+        return
+    }
+    resp, err := http.Post(callbackURL, "application/json", bytes.NewReader(payload))
+    if err != nil {
+        return
+    }
+    resp.Body.Close()
+}
+
+func mockDarajaError(w http.ResponseWriter, status int, code, message string) {
+    writeMockJSON(w, status, darajaError{
+        RequestID:    "mock",
+        ErrorCode:    code,
+        ErrorMessage: message,
+    })
+}
+
+func writeMockJSON(w http.ResponseWriter, status int, body interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
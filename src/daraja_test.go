@@ -0,0 +1,278 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+// darajaHarness runs a DarajaProvider against MockDaraja, with callbacks
+// parsed by the provider as PaymentService.CallbackHandler would
+type darajaHarness struct {
+    mock     *MockDaraja
+    provider *DarajaProvider
+    events   chan ProviderEvent
+    rejected chan error
+}
+
+func newDarajaHarness(t *testing.T) *darajaHarness {
+    h := &darajaHarness{
+        mock:     NewMockDaraja("key", "secret", "passkey"),
+        events:   make(chan ProviderEvent, 10),
+        rejected: make(chan error, 10),
+    }
+    h.mock.CallbackDelay = 50 * time.Millisecond
+    t.Cleanup(h.mock.Close)
+
+    callbacks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        event, err := h.provider.ParseCallback(r)
+        if err != nil {
+            h.rejected <- err
+            http.Error(w, "invalid callback", http.StatusUnauthorized)
+            return
+        }
+        h.events <- event
+    }))
+    t.Cleanup(callbacks.Close)
+
+    provider, err := NewDarajaProvider(DarajaConfig{
+        BaseURL:            h.mock.URL(),
+        ConsumerKey:        "key",
+        ConsumerSecret:     "secret",
+        ShortCode:          "174379",
+        Passkey:            "passkey",
+        CallbackURL:        callbacks.URL + "/v1/payments/callbacks/mpesa",
+        CallbackSecret:     "callback-secret",
+        Initiator:          "testapi",
+        SecurityCredential: "credential",
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    h.provider = provider
+    return h
+}
+
+func (h *darajaHarness) callback(t *testing.T) ProviderEvent {
+    t.Helper()
+    select {
+    case event := <-h.events:
+        return event
+    case err := <-h.rejected:
+        t.Fatalf("callback rejected: %v", err)
+    case <-time.After(5 * time.Second):
+        t.Fatal("no callback from the mock")
+    }
+    return ProviderEvent{}
+}
+
+func TestDarajaPaymentFlow(t *testing.T) {
+    tests := []struct {
+        name       string
+        phone      string
+        msisdn     string
+        result     int
+        wantStatus string
+        wantReason string
+    }{
+        {name: "paid", phone: "0712345678", msisdn: "254712345678", result: DarajaResultSuccess, wantStatus: PaymentSucceeded},
+        {name: "cancelled", phone: "+254 722 000 111", msisdn: "254722000111", result: DarajaResultCancelled, wantStatus: PaymentFailed, wantReason: "Request cancelled by user"},
+        {name: "insufficient funds", phone: "733000222", msisdn: "254733000222", result: DarajaResultInsufficient, wantStatus: PaymentFailed, wantReason: "The balance is insufficient for the transaction."},
+        {name: "payer unreachable", phone: "254110000333", msisdn: "254110000333", result: DarajaResultTimeout, wantStatus: PaymentFailed, wantReason: "DS timeout user cannot be reached"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            h := newDarajaHarness(t)
+            h.mock.SetResult(tt.msisdn, tt.result)
+
+            ctx := context.Background()
+            intent := PaymentIntent{ID: "pay-1", BookingID: "booking-1", Phone: tt.phone, Amount: 99.5, Currency: "KES"}
+            reference, err := h.provider.Charge(ctx, intent)
+            if err != nil {
+                t.Fatalf("Charge() error = %v", err)
+            }
+            intent.Reference = reference
+
+            // Until the payer answers, a status query says it is pending
+            event, err := h.provider.Status(ctx, intent)
+            if err != nil {
+                t.Fatalf("Status() error = %v", err)
+            }
+            if event.Status != PaymentPending {
+                t.Errorf("Status() before the callback = %s, want pending", event.Status)
+            }
+
+            event = h.callback(t)
+            if event.Kind != EventPayment || event.PaymentID != intent.ID || event.Reference != reference {
+                t.Errorf("callback event = %+v", event)
+            }
+            if event.Status != tt.wantStatus || event.Reason != tt.wantReason {
+                t.Errorf("callback status = %s (%q), want %s (%q)", event.Status, event.Reason, tt.wantStatus, tt.wantReason)
+            }
+            if tt.wantStatus == PaymentSucceeded {
+                if !strings.HasPrefix(event.Receipt, "MOCK") {
+                    t.Errorf("callback receipt = %q", event.Receipt)
+                }
+                // Fares are charged in whole shillings
+                if event.Amount != 100 {
+                    t.Errorf("callback amount = %v, want 100", event.Amount)
+                }
+            }
+
+            // Reconciling asks again once the callback is due, and gets
+            // the same answer without the receipt
+            event, err = h.provider.Status(ctx, intent)
+            if err != nil {
+                t.Fatalf("Status() error = %v", err)
+            }
+            if event.Status != tt.wantStatus || event.Receipt != "" {
+                t.Errorf("Status() after the callback = %+v, want %s without a receipt", event, tt.wantStatus)
+            }
+        })
+    }
+}
+
+func TestDarajaRefund(t *testing.T) {
+    h := newDarajaHarness(t)
+    ctx := context.Background()
+
+    intent := PaymentIntent{ID: "pay-1", TripID: "trip-1", Phone: "0712345678", Amount: 100}
+    reference, err := h.provider.Charge(ctx, intent)
+    if err != nil {
+        t.Fatal(err)
+    }
+    paid := h.callback(t)
+    intent.Reference = reference
+    intent.Receipt = paid.Receipt
+
+    tests := []struct {
+        name       string
+        receipt    string
+        amount     float64
+        wantStatus string
+    }{
+        {name: "part of the fare", receipt: paid.Receipt, amount: 40, wantStatus: RefundSucceeded},
+        {name: "more than was paid", receipt: paid.Receipt, amount: 150, wantStatus: RefundFailed},
+        {name: "unknown receipt", receipt: "NOSUCH0001", amount: 10, wantStatus: RefundFailed},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            intent := intent
+            intent.Receipt = tt.receipt
+            refund := Refund{ID: "refund-" + strings.ReplaceAll(tt.name, " ", "-"), Amount: tt.amount}
+
+            conversation, err := h.provider.Refund(ctx, intent, refund)
+            if err != nil {
+                t.Fatalf("Refund() error = %v", err)
+            }
+            event := h.callback(t)
+            if event.Kind != EventRefund || event.PaymentID != intent.ID || event.RefundID != refund.ID {
+                t.Errorf("callback event = %+v", event)
+            }
+            if event.Reference != conversation || event.Status != tt.wantStatus {
+                t.Errorf("callback = %s %s, want %s %s", event.Reference, event.Status, conversation, tt.wantStatus)
+            }
+        })
+    }
+
+    intent.Receipt = ""
+    if _, err := h.provider.Refund(ctx, intent, Refund{ID: "refund-x", Amount: 10}); err == nil {
+        t.Error("Refund() of a payment without a receipt succeeded")
+    }
+}
+
+func TestDarajaChargeRejected(t *testing.T) {
+    tests := []struct {
+        name   string
+        config func(*DarajaConfig)
+        phone  string
+    }{
+        {name: "bad consumer secret", config: func(c *DarajaConfig) { c.ConsumerSecret = "wrong" }, phone: "0712345678"},
+        {name: "bad passkey", config: func(c *DarajaConfig) { c.Passkey = "wrong" }, phone: "0712345678"},
+        {name: "not a Kenyan mobile", phone: "+44 7700 900123"},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            mock := NewMockDaraja("key", "secret", "passkey")
+            defer mock.Close()
+            config := DarajaConfig{
+                BaseURL:        mock.URL(),
+                ConsumerKey:    "key",
+                ConsumerSecret: "secret",
+                ShortCode:      "174379",
+                Passkey:        "passkey",
+                CallbackURL:    "http://127.0.0.1:1/callback",
+                CallbackSecret: "callback-secret",
+            }
+            if tt.config != nil {
+                tt.config(&config)
+            }
+            provider, err := NewDarajaProvider(config)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            intent := PaymentIntent{ID: "pay-1", BookingID: "booking-1", Phone: tt.phone, Amount: 50}
+            if _, err := provider.Charge(context.Background(), intent); err == nil {
+                t.Error("Charge() succeeded")
+            }
+            if mock.Pushes() != 0 {
+                t.Errorf("mock took %d pushes", mock.Pushes())
+            }
+        })
+    }
+}
+
+func TestDarajaParseCallback(t *testing.T) {
+    h := newDarajaHarness(t)
+    valid := h.provider.callbackURL(EventPayment, "pay-1", "")
+    refund := h.provider.callbackURL(EventRefund, "pay-1", "refund-1")
+    stkBody := `{"Body":{"stkCallback":{"CheckoutRequestID":"ws_CO_1","ResultCode":0,"CallbackMetadata":{"Item":[{"Name":"MpesaReceiptNumber","Value":"QWE123"},{"Name":"Amount","Value":50}]}}}}`
+
+    tests := []struct {
+        name        string
+        method      string
+        url         string
+        body        string
+        wantErr     bool
+        wantStatus  string
+        wantReceipt string
+    }{
+        {name: "paid", url: valid, body: stkBody, wantStatus: PaymentSucceeded, wantReceipt: "QWE123"},
+        {name: "not a post", method: http.MethodGet, url: valid, body: stkBody, wantErr: true},
+        {name: "no signature", url: strings.Split(valid, "&sig=")[0], body: stkBody, wantErr: true},
+        {name: "signature for another payment", url: strings.Replace(valid, "payment=pay-1", "payment=pay-2", 1), body: stkBody, wantErr: true},
+        {name: "payment signature used for a refund", url: strings.Replace(valid, "kind=payment", "kind=refund", 1) + "&refund=refund-1", body: stkBody, wantErr: true},
+        {name: "no checkout request", url: valid, body: `{"Body":{"stkCallback":{"ResultCode":0}}}`, wantErr: true},
+        {name: "not JSON", url: valid, body: "<xml/>", wantErr: true},
+        {name: "refund queue timeout", url: refund + "&timeout=1", body: `{}`, wantStatus: RefundFailed},
+        {name: "refund done", url: refund, body: `{"Result":{"ResultCode":0,"ConversationID":"AG_1"}}`, wantStatus: RefundSucceeded},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            method := tt.method
+            if method == "" {
+                method = http.MethodPost
+            }
+            r := httptest.NewRequest(method, tt.url, strings.NewReader(tt.body))
+
+            event, err := h.provider.ParseCallback(r)
+            if tt.wantErr {
+                if !errors.Is(err, ErrBadCallback) {
+                    t.Fatalf("ParseCallback() error = %v, want ErrBadCallback", err)
+                }
+                return
+            }
+            if err != nil {
+                t.Fatalf("ParseCallback() error = %v", err)
+            }
+            if event.Status != tt.wantStatus || event.Receipt != tt.wantReceipt {
+                t.Errorf("ParseCallback() = %+v, want %s with receipt %q", event, tt.wantStatus, tt.wantReceipt)
+            }
+        })
+    }
+}
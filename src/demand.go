@@ -0,0 +1,359 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "sort"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+    "github.com/dgraph-io/dgo/v210/protos/api"
+)
+
+const (
+    hoursPerWeek       = 7 * 24
+    demandHistoryWeeks = 8
+    demandSmoothing    = 0.3 // weight of the newest observation in a slot
+    backtestWindow     = 7 * 24 * time.Hour
+)
+
+// RidershipSample is one ridership observation for a route
+type RidershipSample struct {
+    RouteID    string    `json:"route_id"`
+    ObservedAt time.Time `json:"observed_at"`
+    Boardings  float64   `json:"boardings"`
+    TravelTime float64   `json:"travel_time_minutes,omitempty"` // 0 when not measured
+}
+
+// hourlyObservation is ridership aggregated over one clock hour
+type hourlyObservation struct {
+    start         time.Time
+    boardings     float64
+    travelTime    float64 // mean over the samples that measured it
+    travelSamples int
+}
+
+// hourOfWeek numbers the hours of the week from Sunday 00:00 (0) to
+// Saturday 23:00 (167), in local time
+func hourOfWeek(t time.Time) int {
+    t = t.Local()
+    return int(t.Weekday())*24 + t.Hour()
+}
+
+// hourOfWeekKey is the key a model stores an hour-of-week prediction under,
+// e.g. "Mon 08:00"
+func hourOfWeekKey(slot int) string {
+    return fmt.Sprintf("%s %02d:00", time.Weekday(slot / 24).String()[:3], slot%24)
+}
+
+// RecordRidership stores a ridership observation for a route
+func (rtm *RealTimeManager) RecordRidership(ctx context.Context, sample RidershipSample) error {
+    node := map[string]interface{}{
+        "dgraph.type":     "Ridership",
+        "ridership_route": map[string]string{"uid": sample.RouteID},
+        "observed_at":     sample.ObservedAt,
+        "boardings":       sample.Boardings,
+    }
+    if sample.TravelTime > 0 {
+        node["travel_time_minutes"] = sample.TravelTime
+    }
+
+    setJSON, err := json.Marshal(node)
+    if err != nil {
+        return err
+    }
+
+    _, err = rtm.dgraph.NewTxn().Mutate(ctx, &api.Mutation{
+        SetJson:   setJSON,
+        CommitNow: true,
+    })
+    return err
+}
+
+// handleDemandUpdate stores ridership published on the bus
+func (rtm *RealTimeManager) handleDemandUpdate(update RouteUpdate) {
+    sample := *update.Ridership
+    if sample.RouteID == "" {
+        sample.RouteID = update.RouteID
+    }
+    if sample.ObservedAt.IsZero() {
+        sample.ObservedAt = update.Timestamp
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+    if err := rtm.RecordRidership(ctx, sample); err != nil {
+        log.Printf("Recording ridership for route %s: %v", sample.RouteID, err)
+    }
+}
+
+// getHistoricalData fetches the recent ridership of a route, oldest first
+func (rtm *RealTimeManager) getHistoricalData(ctx context.Context, routeID string) ([]RidershipSample, error) {
+    since := time.Now().Add(-demandHistoryWeeks * 7 * 24 * time.Hour)
+
+    resp, err := rtm.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query History($route: string, $since: string) {
+            route(func: uid($route)) {
+                ~ridership_route(orderasc: observed_at) @filter(ge(observed_at, $since)) {
+                    observed_at
+                    boardings
+                    travel_time_minutes
+                }
+            }
+        }`, map[string]string{
+        "$route": routeID,
+        "$since": since.Format(time.RFC3339),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Route []struct {
+            Samples []RidershipSample `json:"~ridership_route"`
+        } `json:"route"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Route) == 0 {
+        return nil, nil
+    }
+
+    samples := result.Route[0].Samples
+    for i := range samples {
+        samples[i].RouteID = routeID
+    }
+    return samples, nil
+}
+
+// hourlySeries groups samples into clock hours, oldest first
+func hourlySeries(samples []RidershipSample) []hourlyObservation {
+    byHour := make(map[time.Time]*hourlyObservation)
+    for _, sample := range samples {
+        start := sample.ObservedAt.Truncate(time.Hour)
+        obs, exists := byHour[start]
+        if !exists {
+            obs = &hourlyObservation{start: start}
+            byHour[start] = obs
+        }
+
+        obs.boardings += sample.Boardings
+        if sample.TravelTime > 0 {
+            obs.travelSamples++
+            obs.travelTime += (sample.TravelTime - obs.travelTime) / float64(obs.travelSamples)
+        }
+    }
+
+    series := make([]hourlyObservation, 0, len(byHour))
+    for _, obs := range byHour {
+        series = append(series, *obs)
+    }
+    sort.Slice(series, func(i, j int) bool {
+        return series[i].start.Before(series[j].start)
+    })
+    return series
+}
+
+// smoothSlot runs simple exponential smoothing over the observations of
+// one hour-of-week slot. It returns the smoothed demand and travel time
+// and the mean absolute one-step-ahead demand error.
+func smoothSlot(series []hourlyObservation, slot int) (demand, travelTime, meanError float64, n int) {
+    var travelSeen bool
+    var totalError float64
+    for _, obs := range series {
+        if hourOfWeek(obs.start) != slot {
+            continue
+        }
+
+        if n == 0 {
+            demand = obs.boardings
+        } else {
+            totalError += math.Abs(obs.boardings - demand)
+            demand = demandSmoothing*obs.boardings + (1-demandSmoothing)*demand
+        }
+        n++
+
+        if obs.travelSamples > 0 {
+            if !travelSeen {
+                travelTime = obs.travelTime
+                travelSeen = true
+            } else {
+                travelTime = demandSmoothing*obs.travelTime + (1-demandSmoothing)*travelTime
+            }
+        }
+    }
+
+    if n > 1 {
+        meanError = totalError / float64(n-1)
+    }
+    return demand, travelTime, meanError, n
+}
+
+// calculatePrediction predicts one hour-of-week slot from the history
+func (rtm *RealTimeManager) calculatePrediction(series []hourlyObservation, slot int) Prediction {
+    demand, travelTime, meanError, n := smoothSlot(series, slot)
+    if n == 0 {
+        return Prediction{}
+    }
+
+    // A slot whose demand swings a lot from week to week is less reliable
+    reliability := 1.0
+    if demand > 0 {
+        reliability = math.Max(0, 1-meanError/demand)
+    } else if meanError > 0 {
+        reliability = 0
+    }
+    if n == 1 {
+        reliability *= 0.5
+    }
+
+    return Prediction{
+        Demand:      demand,
+        TravelTime:  travelTime,
+        Reliability: reliability,
+    }
+}
+
+// calculateModelAccuracy backtests the model: it trains on everything but
+// the last week and scores the predictions for that week as 1 - WMAPE
+func (rtm *RealTimeManager) calculateModelAccuracy(series []hourlyObservation) float64 {
+    if len(series) == 0 {
+        return 0
+    }
+
+    cutoff := series[len(series)-1].start.Add(-backtestWindow)
+    split := sort.Search(len(series), func(i int) bool {
+        return series[i].start.After(cutoff)
+    })
+    train, test := series[:split], series[split:]
+    if len(train) == 0 || len(test) == 0 {
+        return 0
+    }
+
+    predicted := make(map[int]float64)
+    var totalError, totalActual float64
+    for _, obs := range test {
+        slot := hourOfWeek(obs.start)
+        demand, seen := predicted[slot]
+        if !seen {
+            demand, _, _, _ = smoothSlot(train, slot)
+            predicted[slot] = demand
+        }
+        totalError += math.Abs(obs.boardings - demand)
+        totalActual += obs.boardings
+    }
+
+    if totalActual == 0 {
+        if totalError == 0 {
+            return 1
+        }
+        return 0
+    }
+    return math.Max(0, 1-totalError/totalActual)
+}
+
+// demandModelNode is how a PredictiveModel is stored in Dgraph
+type demandModelNode struct {
+    Uid         string    `json:"uid,omitempty"`
+    DType       []string  `json:"dgraph.type,omitempty"`
+    Route       *routeRef `json:"model_route,omitempty"`
+    Predictions string    `json:"model_predictions"`
+    Accuracy    float64   `json:"accuracy_score"`
+    LastTrained time.Time `json:"last_trained"`
+}
+
+// saveModel stores a model, replacing the route's previous one
+func saveModel(ctx context.Context, dgraphClient *dgo.Dgraph, model *PredictiveModel) error {
+    txn := dgraphClient.NewTxn()
+    defer txn.Discard(ctx)
+
+    resp, err := txn.QueryWithVars(ctx, `
+        query Model($route: string) {
+            route(func: uid($route)) {
+                ~model_route { uid }
+            }
+        }`, map[string]string{"$route": model.RouteID})
+    if err != nil {
+        return err
+    }
+
+    var existing struct {
+        Route []struct {
+            Models []routeRef `json:"~model_route"`
+        } `json:"route"`
+    }
+    if err := json.Unmarshal(resp.Json, &existing); err != nil {
+        return err
+    }
+
+    predictions, err := json.Marshal(model.Predictions)
+    if err != nil {
+        return err
+    }
+
+    node := demandModelNode{
+        Uid:         "_:model",
+        DType:       []string{"DemandModel"},
+        Route:       &routeRef{Uid: model.RouteID},
+        Predictions: string(predictions),
+        Accuracy:    model.Accuracy,
+        LastTrained: model.LastTrained,
+    }
+    if len(existing.Route) > 0 && len(existing.Route[0].Models) > 0 {
+        node.Uid = existing.Route[0].Models[0].Uid
+    }
+
+    setJSON, err := json.Marshal(node)
+    if err != nil {
+        return err
+    }
+    if _, err := txn.Mutate(ctx, &api.Mutation{SetJson: setJSON}); err != nil {
+        return err
+    }
+    return txn.Commit(ctx)
+}
+
+// loadModel reads the stored model for a route, or nil if there is none
+func loadModel(ctx context.Context, dgraphClient *dgo.Dgraph, routeID string) (*PredictiveModel, error) {
+    resp, err := dgraphClient.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query Model($route: string) {
+            route(func: uid($route)) {
+                ~model_route {
+                    model_predictions
+                    accuracy_score
+                    last_trained
+                }
+            }
+        }`, map[string]string{"$route": routeID})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Route []struct {
+            Models []demandModelNode `json:"~model_route"`
+        } `json:"route"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Route) == 0 || len(result.Route[0].Models) == 0 {
+        return nil, nil
+    }
+
+    node := result.Route[0].Models[0]
+    model := &PredictiveModel{
+        RouteID:     routeID,
+        Predictions: make(map[string]Prediction),
+        Accuracy:    node.Accuracy,
+        LastTrained: node.LastTrained,
+    }
+    if err := json.Unmarshal([]byte(node.Predictions), &model.Predictions); err != nil {
+        return nil, fmt.Errorf("decoding model for route %s: %w", routeID, err)
+    }
+    return model, nil
+}
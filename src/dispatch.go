@@ -0,0 +1,524 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "math"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/uber/h3-go/v4"
+)
+
+const (
+    maxRideOptions  = 5
+    maxOffRouteKm   = 0.5 // a vehicle further than this from its route is off it
+    seatRequestTTL  = 2 * time.Minute
+    rideRequestTTL  = 15 * time.Minute
+    defaultSeats    = 1
+    maxSeatsPerHold = 4
+)
+
+// Peak fare windows, local time on weekdays
+var peakFareHours = [][2]int{{6, 9}, {16, 20}}
+
+// Seat request states
+const (
+    SeatRequestPending   = "pending"
+    SeatRequestAccepted  = "accepted"
+    SeatRequestDeclined  = "declined"
+    SeatRequestExpired   = "expired"
+    SeatRequestCancelled = "cancelled"
+)
+
+var (
+    ErrRideRequestNotFound  = errors.New("ride request not found or expired")
+    ErrSeatRequestNotFound  = errors.New("seat request not found")
+    ErrSeatRequestClosed    = errors.New("seat request is no longer pending")
+    ErrSeatAlreadyRequested = errors.New("ride request already has a pending seat request")
+)
+
+// RideRequest is a rider asking for a matatu from a pickup to a destination
+type RideRequest struct {
+    ID          string    `json:"id"`
+    RiderID     string    `json:"rider_id,omitempty"`
+    Pickup      Location  `json:"pickup"`
+    Destination Location  `json:"destination"`
+    Seats       int       `json:"seats"`
+    RequestedAt time.Time `json:"requested_at"`
+}
+
+// RideOption is one vehicle that can take the rider
+type RideOption struct {
+    Rank        int           `json:"rank"`
+    VehicleID   string        `json:"vehicle_id"`
+    RouteID     string        `json:"route_id"`
+    RouteNumber string        `json:"route_number"`
+    WalkToKm    float64       `json:"walk_to_pickup_km"`
+    WalkFromKm  float64       `json:"walk_from_drop_off_km"`
+    ETA         time.Duration `json:"eta"`
+    ETALower    time.Duration `json:"eta_lower"`
+    ETAUpper    time.Duration `json:"eta_upper"`
+    ArriveAt    time.Time     `json:"arrive_at"`
+    Fare        float64       `json:"fare"`
+    LastSeen    time.Time     `json:"last_seen"`
+}
+
+// RideOffer is the answer to a ride request, best option first
+type RideOffer struct {
+    Request RideRequest  `json:"request"`
+    Options []RideOption `json:"options"`
+}
+
+// VehicleETA is when a vehicle is expected at a stop
+type VehicleETA struct {
+    VehicleID   string        `json:"vehicle_id"`
+    RouteID     string        `json:"route_id"`
+    RouteNumber string        `json:"route_number"`
+    Stop        Location      `json:"stop"`
+    ETA         time.Duration `json:"eta"`
+    ETALower    time.Duration `json:"eta_lower"`
+    ETAUpper    time.Duration `json:"eta_upper"`
+    ArriveAt    time.Time     `json:"arrive_at"`
+    LastSeen    time.Time     `json:"last_seen"`
+}
+
+// SeatRequest asks a vehicle's crew to keep seats for a rider
+type SeatRequest struct {
+    ID          string     `json:"id"`
+    RequestID   string     `json:"request_id"`
+    RiderID     string     `json:"rider_id,omitempty"`
+    VehicleID   string     `json:"vehicle_id"`
+    RouteID     string     `json:"route_id"`
+    Pickup      Location   `json:"pickup"`
+    Destination Location   `json:"destination"`
+    Seats       int        `json:"seats"`
+    Fare        float64    `json:"fare"`
+    ETA         time.Time  `json:"eta"`
+    Status      string     `json:"status"`
+    CreatedAt   time.Time  `json:"created_at"`
+    ExpiresAt   time.Time  `json:"expires_at"`
+    RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
+
+// RideDispatcher matches riders with approaching vehicles and relays seat
+// requests to crews
+type RideDispatcher struct {
+    rtm          *RealTimeManager
+    offers       map[string]*RideOffer
+    seatRequests map[string]*SeatRequest
+    now          func() time.Time
+    mu           sync.Mutex
+}
+
+func NewRideDispatcher(rtm *RealTimeManager) *RideDispatcher {
+    return &RideDispatcher{
+        rtm:          rtm,
+        offers:       make(map[string]*RideOffer),
+        seatRequests: make(map[string]*SeatRequest),
+        now:          time.Now,
+    }
+}
+
+// nearestCell finds the cell of a path closest to a location
+func nearestCell(cells []string, loc Location) (index int, km float64) {
+    index, km = -1, math.Inf(1)
+    point := h3.NewLatLng(loc.Lat, loc.Lng)
+    for i, id := range cells {
+        cell := h3.Cell(h3.IndexFromString(id))
+        if !cell.IsValid() {
+            continue
+        }
+        if d := h3.GreatCircleDistanceKm(point, cell.LatLng()); d < km {
+            index, km = i, d
+        }
+    }
+    return index, km
+}
+
+// fareAt is a route's fare at a time of day
+func fareAt(route Route, at time.Time) float64 {
+    at = at.Local()
+    weekday := at.Weekday() != time.Saturday && at.Weekday() != time.Sunday
+    peak := false
+    for _, window := range peakFareHours {
+        if weekday && at.Hour() >= window[0] && at.Hour() < window[1] {
+            peak = true
+        }
+    }
+
+    switch {
+    case peak && route.Fare.PeakHours > 0:
+        return route.Fare.PeakHours
+    case !peak && route.Fare.OffPeakHours > 0:
+        return route.Fare.OffPeakHours
+    default:
+        return route.Fare.Regular
+    }
+}
+
+// Request finds vehicles on routes serving the journey that have yet to
+// pass the pickup, and ranks them by estimated arrival
+func (rd *RideDispatcher) Request(ctx context.Context, req RideRequest) (*RideOffer, error) {
+    for _, loc := range []Location{req.Pickup, req.Destination} {
+        if loc.Lat < -90 || loc.Lat > 90 || loc.Lng < -180 || loc.Lng > 180 || (loc.Lat == 0 && loc.Lng == 0) {
+            return nil, fmt.Errorf("%w: invalid location %f,%f", ErrInvalidRequest, loc.Lat, loc.Lng)
+        }
+    }
+    if req.Seats <= 0 {
+        req.Seats = defaultSeats
+    }
+    if req.Seats > maxSeatsPerHold {
+        return nil, fmt.Errorf("%w: at most %d seats can be requested at once", ErrInvalidRequest, maxSeatsPerHold)
+    }
+    if req.ID == "" {
+        req.ID = generateUUID()
+    }
+    now := rd.now()
+    req.RequestedAt = now
+
+    routes, err := rd.rtm.planner.listRoutes(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    offer := &RideOffer{Request: req, Options: []RideOption{}}
+    for _, route := range routes {
+        offer.Options = append(offer.Options, rd.matchRoute(route, req, now)...)
+    }
+
+    sort.Slice(offer.Options, func(i, j int) bool {
+        a, b := offer.Options[i], offer.Options[j]
+        if a.ETA+walkTime(a.WalkToKm) != b.ETA+walkTime(b.WalkToKm) {
+            return a.ETA+walkTime(a.WalkToKm) < b.ETA+walkTime(b.WalkToKm)
+        }
+        return a.WalkFromKm < b.WalkFromKm
+    })
+    if len(offer.Options) > maxRideOptions {
+        offer.Options = offer.Options[:maxRideOptions]
+    }
+    for i := range offer.Options {
+        offer.Options[i].Rank = i + 1
+    }
+
+    rd.mu.Lock()
+    rd.expire(now)
+    rd.offers[req.ID] = offer
+    rd.mu.Unlock()
+
+    return offer, nil
+}
+
+func walkTime(km float64) time.Duration {
+    return time.Duration(km / walkingSpeedKmh * float64(time.Hour))
+}
+
+// matchRoute returns an option for every vehicle on a route that will
+// reach the pickup on its way to the destination
+func (rd *RideDispatcher) matchRoute(route Route, req RideRequest, now time.Time) []RideOption {
+    cells := routeCells(route)
+    if len(cells) < 2 {
+        return nil
+    }
+
+    pickup, walkTo := nearestCell(cells, req.Pickup)
+    dropOff, walkFrom := nearestCell(cells, req.Destination)
+    if walkTo > maxWalkKm || walkFrom > maxWalkKm || pickup == dropOff {
+        return nil
+    }
+    // Routes run out and back; the rider travels whichever way takes them
+    // from pickup to drop-off
+    direction := 1
+    if dropOff < pickup {
+        direction = -1
+    }
+
+    var options []RideOption
+    for _, fix := range routeVehicles(rd.rtm, route.Uid) {
+        eta, ok := rd.rtm.approach(cells, fix, pickup, direction, now)
+        if !ok {
+            continue
+        }
+        options = append(options, RideOption{
+            VehicleID:   fix.VehicleID,
+            RouteID:     route.Uid,
+            RouteNumber: route.RouteNumber,
+            WalkToKm:    walkTo,
+            WalkFromKm:  walkFrom,
+            ETA:         eta.ETA,
+            ETALower:    eta.Lower,
+            ETAUpper:    eta.Upper,
+            ArriveAt:    now.Add(eta.ETA),
+            Fare:        fareAt(route, now) * float64(req.Seats),
+            LastSeen:    fix.Timestamp,
+        })
+    }
+    return options
+}
+
+// arrival is how long until a vehicle reaches a point, with the spread of
+// the estimate
+type arrival struct {
+    ETA   time.Duration
+    Lower time.Duration
+    Upper time.Duration
+}
+
+// approach estimates when a vehicle reaches the cell of a route's path at
+// target, travelling along the path in direction: 1 or -1, or 0 for
+// whichever way leads to the target. It is false for a vehicle off the
+// route, already past the target or seen moving the other way.
+func (rtm *RealTimeManager) approach(cells []string, fix VehicleFix, target, direction int, now time.Time) (arrival, bool) {
+    at, offKm := nearestCell(cells, Location{Lat: fix.Lat, Lng: fix.Lng})
+    if at < 0 || offKm > maxOffRouteKm {
+        return arrival{}, false
+    }
+    if direction == 0 {
+        direction = 1
+        if target < at {
+            direction = -1
+        }
+    }
+    if (target-at)*direction < 0 {
+        return arrival{}, false
+    }
+
+    // A vehicle seen moving the other way is on the opposite leg
+    previous, _, hasPrevious := rtm.probes.VehicleTrack(fix.VehicleID)
+    if hasPrevious {
+        before, _ := nearestCell(cells, Location{Lat: previous.Lat, Lng: previous.Lng})
+        if before >= 0 && (at-before)*direction < 0 {
+            return arrival{}, false
+        }
+    }
+
+    path := make([]string, 0, (target-at)*direction+1)
+    for i := at; i != target+direction; i += direction {
+        path = append(path, cells[i])
+    }
+
+    // The fix is already some seconds old; the vehicle has moved on
+    estimate := rtm.estimator.EstimateCells(path, fix.Timestamp)
+    eta := time.Duration(math.Max(0, float64(estimate.Arrival().Sub(now))))
+    shift := eta - estimate.Duration
+    return arrival{
+        ETA:   eta,
+        Lower: time.Duration(math.Max(0, float64(estimate.Lower+shift))),
+        Upper: time.Duration(math.Max(0, float64(estimate.Upper+shift))),
+    }, true
+}
+
+// EstimateArrival estimates when a vehicle on a route reaches the point of
+// the route nearest a stop. It is false when the stop is off the route or
+// the vehicle isn't heading for it.
+func (rtm *RealTimeManager) EstimateArrival(route Route, fix VehicleFix, stop Location, now time.Time) (*VehicleETA, bool) {
+    cells := routeCells(route)
+    if len(cells) < 2 {
+        return nil, false
+    }
+    target, walkKm := nearestCell(cells, stop)
+    if target < 0 || walkKm > maxWalkKm {
+        return nil, false
+    }
+
+    eta, ok := rtm.approach(cells, fix, target, 0, now)
+    if !ok {
+        return nil, false
+    }
+    return &VehicleETA{
+        VehicleID:   fix.VehicleID,
+        RouteID:     route.Uid,
+        RouteNumber: route.RouteNumber,
+        Stop:        stop,
+        ETA:         eta.ETA,
+        ETALower:    eta.Lower,
+        ETAUpper:    eta.Upper,
+        ArriveAt:    now.Add(eta.ETA),
+        LastSeen:    fix.Timestamp,
+    }, true
+}
+
+// Offer returns the offer made for a ride request, while it lasts
+func (rd *RideDispatcher) Offer(requestID string) (*RideOffer, error) {
+    rd.mu.Lock()
+    defer rd.mu.Unlock()
+    rd.expire(rd.now())
+
+    offer, exists := rd.offers[requestID]
+    if !exists {
+        return nil, ErrRideRequestNotFound
+    }
+    copied := *offer
+    copied.Options = append([]RideOption(nil), offer.Options...)
+    return &copied, nil
+}
+
+// HoldSeat asks the crew of a vehicle from an offer to keep seats for the
+// rider. The request lapses unless the crew accepts it in time.
+func (rd *RideDispatcher) HoldSeat(requestID, vehicleID string) (*SeatRequest, error) {
+    rd.mu.Lock()
+    defer rd.mu.Unlock()
+
+    now := rd.now()
+    rd.expire(now)
+
+    offer, exists := rd.offers[requestID]
+    if !exists {
+        return nil, ErrRideRequestNotFound
+    }
+
+    var option *RideOption
+    for i := range offer.Options {
+        if offer.Options[i].VehicleID == vehicleID {
+            option = &offer.Options[i]
+            break
+        }
+    }
+    if option == nil {
+        return nil, fmt.Errorf("%w: vehicle %s was not offered for ride request %s", ErrInvalidRequest, vehicleID, requestID)
+    }
+
+    for _, existing := range rd.seatRequests {
+        if existing.RequestID == requestID && existing.Status == SeatRequestPending {
+            return nil, fmt.Errorf("%w: %s", ErrSeatAlreadyRequested, requestID)
+        }
+    }
+
+    seatRequest := &SeatRequest{
+        ID:          generateUUID(),
+        RequestID:   requestID,
+        RiderID:     offer.Request.RiderID,
+        VehicleID:   vehicleID,
+        RouteID:     option.RouteID,
+        Pickup:      offer.Request.Pickup,
+        Destination: offer.Request.Destination,
+        Seats:       offer.Request.Seats,
+        Fare:        option.Fare,
+        ETA:         option.ArriveAt,
+        Status:      SeatRequestPending,
+        CreatedAt:   now,
+        ExpiresAt:   now.Add(seatRequestTTL),
+    }
+    rd.seatRequests[seatRequest.ID] = seatRequest
+
+    copied := *seatRequest
+    return &copied, nil
+}
+
+// PendingSeatRequests lists what a vehicle's crew has yet to answer,
+// soonest pickup first
+func (rd *RideDispatcher) PendingSeatRequests(vehicleID string) []SeatRequest {
+    rd.mu.Lock()
+    defer rd.mu.Unlock()
+    rd.expire(rd.now())
+
+    var pending []SeatRequest
+    for _, seatRequest := range rd.seatRequests {
+        if seatRequest.VehicleID == vehicleID && seatRequest.Status == SeatRequestPending {
+            pending = append(pending, *seatRequest)
+        }
+    }
+    sort.Slice(pending, func(i, j int) bool { return pending[i].ETA.Before(pending[j].ETA) })
+    return pending
+}
+
+// SeatRequest returns a seat request by ID
+func (rd *RideDispatcher) SeatRequest(seatRequestID string) (*SeatRequest, error) {
+    rd.mu.Lock()
+    defer rd.mu.Unlock()
+    rd.expire(rd.now())
+
+    seatRequest, exists := rd.seatRequests[seatRequestID]
+    if !exists {
+        return nil, ErrSeatRequestNotFound
+    }
+    copied := *seatRequest
+    return &copied, nil
+}
+
+// AcceptSeatRequest is the crew agreeing to pick the rider up
+func (rd *RideDispatcher) AcceptSeatRequest(seatRequestID, vehicleID string) (*SeatRequest, error) {
+    return rd.respond(seatRequestID, vehicleID, SeatRequestAccepted)
+}
+
+// DeclineSeatRequest is the crew turning the rider down
+func (rd *RideDispatcher) DeclineSeatRequest(seatRequestID, vehicleID string) (*SeatRequest, error) {
+    return rd.respond(seatRequestID, vehicleID, SeatRequestDeclined)
+}
+
+// CancelSeatRequest is the rider withdrawing a request
+func (rd *RideDispatcher) CancelSeatRequest(seatRequestID string) (*SeatRequest, error) {
+    return rd.respond(seatRequestID, "", SeatRequestCancelled)
+}
+
+// respond moves a pending seat request to its answer. Only the crew of the
+// vehicle asked may accept or decline.
+func (rd *RideDispatcher) respond(seatRequestID, vehicleID, status string) (*SeatRequest, error) {
+    rd.mu.Lock()
+    defer rd.mu.Unlock()
+
+    now := rd.now()
+    rd.expire(now)
+
+    seatRequest, exists := rd.seatRequests[seatRequestID]
+    if !exists {
+        return nil, ErrSeatRequestNotFound
+    }
+    if vehicleID != "" && seatRequest.VehicleID != vehicleID {
+        return nil, fmt.Errorf("%w: seat request %s is for vehicle %s", ErrInvalidRequest, seatRequestID, seatRequest.VehicleID)
+    }
+    if seatRequest.Status != SeatRequestPending {
+        return nil, fmt.Errorf("%w: %s", ErrSeatRequestClosed, seatRequest.Status)
+    }
+
+    seatRequest.Status = status
+    seatRequest.RespondedAt = &now
+
+    copied := *seatRequest
+    return &copied, nil
+}
+
+// reopen puts an accepted seat request back to pending, for when its
+// booking could not be made. It lapses as usual if not answered again.
+func (rd *RideDispatcher) reopen(seatRequestID string) {
+    rd.mu.Lock()
+    defer rd.mu.Unlock()
+
+    seatRequest, exists := rd.seatRequests[seatRequestID]
+    if !exists || seatRequest.Status != SeatRequestAccepted {
+        return
+    }
+    seatRequest.Status = SeatRequestPending
+    seatRequest.RespondedAt = nil
+    rd.expire(rd.now())
+}
+
+// expire lapses pending seat requests nobody answered and forgets old
+// offers. Callers must hold rd.mu.
+func (rd *RideDispatcher) expire(now time.Time) {
+    for id, seatRequest := range rd.seatRequests {
+        switch {
+        case seatRequest.Status == SeatRequestPending && !now.Before(seatRequest.ExpiresAt):
+            seatRequest.Status = SeatRequestExpired
+        case seatRequest.Status != SeatRequestPending && now.Sub(seatRequest.CreatedAt) > rideRequestTTL:
+            delete(rd.seatRequests, id)
+        }
+    }
+    for id, offer := range rd.offers {
+        if now.Sub(offer.Request.RequestedAt) > rideRequestTTL {
+            delete(rd.offers, id)
+        }
+    }
+}
+
+// RequestRide finds the vehicles that can pick a rider up, best first
+func (rtm *RealTimeManager) RequestRide(ctx context.Context, req RideRequest) (*RideOffer, error) {
+    return rtm.rides.Request(ctx, req)
+}
+
+// Rides returns the dispatcher for seat requests
+func (rtm *RealTimeManager) Rides() *RideDispatcher {
+    return rtm.rides
+}
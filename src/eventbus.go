@@ -0,0 +1,431 @@
+package main
+
+import (
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Topics a RouteUpdate can be published on
+const (
+    TopicTraffic     = "traffic"
+    TopicDemand      = "demand"
+    TopicIncident    = "incident"
+    TopicHealth      = "health_issue"
+    TopicHealthState = "health_state"
+    TopicAlert       = "service_alert"
+    TopicPosition    = "position"
+)
+
+var validTopics = []string{
+    TopicTraffic,
+    TopicDemand,
+    TopicIncident,
+    TopicHealth,
+    TopicHealthState,
+    TopicAlert,
+    TopicPosition,
+}
+
+const (
+    defaultSubscriberBuffer = 256
+
+    // blockTimeout is how long publishers wait on a full Block subscriber
+    // before dropping the update, so one that is stuck can't hold up
+    // publishing for good
+    blockTimeout = 10 * time.Second
+)
+
+var (
+    ErrBusClosed    = errors.New("event bus is closed")
+    ErrUnknownTopic = errors.New("unknown update topic")
+)
+
+// HealthIssue is a problem found on a route by health monitoring
+type HealthIssue struct {
+    Score float64 `json:"health_score"`
+    Issue string  `json:"issue"`
+}
+
+// RouteUpdate is an event published on the bus. Exactly one payload is set,
+// the one matching UpdateType.
+type RouteUpdate struct {
+    Sequence   uint64            `json:"sequence"`
+    RouteID    string            `json:"route_id,omitempty"`
+    UpdateType string            `json:"type"`
+    Timestamp  time.Time         `json:"timestamp"`
+    Traffic    *TrafficData      `json:"traffic,omitempty"`
+    Ridership  *RidershipSample  `json:"ridership,omitempty"`
+    Incident   *Incident         `json:"incident,omitempty"`
+    Health     *HealthIssue      `json:"health,omitempty"`
+    Transition *HealthTransition `json:"transition,omitempty"`
+    Alert      *ServiceAlert     `json:"alert,omitempty"`
+    Position   *VehicleFix       `json:"position,omitempty"`
+}
+
+func isValidTopic(topic string) bool {
+    for _, valid := range validTopics {
+        if topic == valid {
+            return true
+        }
+    }
+    return false
+}
+
+// validate checks an update is on a known topic and carries its payload
+func (u RouteUpdate) validate() error {
+    var present bool
+    switch u.UpdateType {
+    case TopicTraffic:
+        present = u.Traffic != nil
+    case TopicDemand:
+        present = u.Ridership != nil
+    case TopicIncident:
+        present = u.Incident != nil
+    case TopicHealth:
+        present = u.Health != nil
+    case TopicHealthState:
+        present = u.Transition != nil
+    case TopicAlert:
+        present = u.Alert != nil
+    case TopicPosition:
+        present = u.Position != nil
+    default:
+        return fmt.Errorf("%w %q (valid topics: %s)", ErrUnknownTopic, u.UpdateType, strings.Join(validTopics, ", "))
+    }
+    if !present {
+        return fmt.Errorf("%s update has no %s payload", u.UpdateType, u.UpdateType)
+    }
+    return nil
+}
+
+// OverflowPolicy decides what happens when a subscriber's buffer is full
+type OverflowPolicy int
+
+const (
+    // DropNewest discards the update being published
+    DropNewest OverflowPolicy = iota
+    // DropOldest discards the oldest buffered update to make room
+    DropOldest
+    // Block makes the publisher wait for room, up to BlockTimeout if set.
+    // Delivery is in order, so a full Block subscriber holds up every
+    // publisher until it catches up. Its reader must not publish inline,
+    // nor wait on anything a publisher may hold, or both wait forever; use
+    // a Relay to publish from it.
+    Block
+)
+
+// SubscribeOptions filters what a subscriber receives and how it is buffered
+type SubscribeOptions struct {
+    Topics       []string // empty for every topic
+    RouteIDs     []string // empty for every route
+    Buffer       int
+    Policy       OverflowPolicy
+    BlockTimeout time.Duration // 0 waits until the subscriber or bus closes
+}
+
+// Subscription receives the updates matching its filters on C. C is closed
+// once the subscription or the bus is closed and buffered updates are read.
+type Subscription struct {
+    C <-chan RouteUpdate
+
+    ch      chan RouteUpdate
+    topics  map[string]bool
+    routes  map[string]bool
+    policy  OverflowPolicy
+    timeout time.Duration
+    dropped uint64
+    done    chan struct{}
+    once    sync.Once
+    mu      sync.Mutex // held while sending on ch
+    bus     *EventBus
+    id      uint64
+}
+
+// Dropped returns how many updates this subscriber has missed
+func (s *Subscription) Dropped() uint64 {
+    return atomic.LoadUint64(&s.dropped)
+}
+
+// Close unsubscribes
+func (s *Subscription) Close() {
+    s.bus.mu.Lock()
+    delete(s.bus.subs, s.id)
+    s.bus.mu.Unlock()
+    s.close()
+}
+
+func (s *Subscription) close() {
+    s.once.Do(func() {
+        // Wake any publisher blocked on us before taking the send lock
+        close(s.done)
+        s.mu.Lock()
+        close(s.ch)
+        s.mu.Unlock()
+    })
+}
+
+func (s *Subscription) matches(update RouteUpdate) bool {
+    if len(s.topics) > 0 && !s.topics[update.UpdateType] {
+        return false
+    }
+    if len(s.routes) > 0 && !s.routes[update.RouteID] {
+        return false
+    }
+    return true
+}
+
+// deliver hands an update to the subscriber according to its policy
+func (s *Subscription) deliver(update RouteUpdate) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    select {
+    case <-s.done:
+        return
+    default:
+    }
+
+    select {
+    case s.ch <- update:
+        return
+    default:
+    }
+
+    switch s.policy {
+    case DropOldest:
+        select {
+        case <-s.ch:
+            atomic.AddUint64(&s.dropped, 1)
+        default:
+        }
+        select {
+        case s.ch <- update:
+        default:
+            atomic.AddUint64(&s.dropped, 1)
+        }
+    case Block:
+        var timeout <-chan time.Time
+        if s.timeout > 0 {
+            timer := time.NewTimer(s.timeout)
+            defer timer.Stop()
+            timeout = timer.C
+        }
+        select {
+        case s.ch <- update:
+        case <-s.done:
+        case <-timeout:
+            atomic.AddUint64(&s.dropped, 1)
+        }
+    default:
+        atomic.AddUint64(&s.dropped, 1)
+    }
+}
+
+// EventBus fans RouteUpdates out to subscribers. Publishing never holds
+// the subscriber lock while delivering, but does hold the publish lock, so
+// it is safe to call from anywhere that does not hold a lock a Block
+// subscriber needs to make progress and is not itself reading a Block
+// subscription.
+type EventBus struct {
+    subs     map[uint64]*Subscription
+    nextID   uint64
+    sequence uint64
+    closed   bool
+    mu       sync.RWMutex
+    publish  sync.Mutex // keeps delivery in sequence order
+}
+
+func NewEventBus() *EventBus {
+    return &EventBus{
+        subs: make(map[uint64]*Subscription),
+    }
+}
+
+// Subscribe registers a subscriber
+func (b *EventBus) Subscribe(opts SubscribeOptions) (*Subscription, error) {
+    topics := make(map[string]bool)
+    for _, topic := range opts.Topics {
+        if !isValidTopic(topic) {
+            return nil, fmt.Errorf("%w %q (valid topics: %s)", ErrUnknownTopic, topic, strings.Join(validTopics, ", "))
+        }
+        topics[topic] = true
+    }
+    routes := make(map[string]bool)
+    for _, routeID := range opts.RouteIDs {
+        routes[routeID] = true
+    }
+    if opts.Buffer <= 0 {
+        opts.Buffer = defaultSubscriberBuffer
+    }
+
+    ch := make(chan RouteUpdate, opts.Buffer)
+    sub := &Subscription{
+        C:       ch,
+        ch:      ch,
+        topics:  topics,
+        routes:  routes,
+        policy:  opts.Policy,
+        timeout: opts.BlockTimeout,
+        done:    make(chan struct{}),
+        bus:     b,
+    }
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if b.closed {
+        return nil, ErrBusClosed
+    }
+    b.nextID++
+    sub.id = b.nextID
+    b.subs[sub.id] = sub
+    return sub, nil
+}
+
+// Publish stamps an update with the next sequence number and delivers it
+// to every matching subscriber
+func (b *EventBus) Publish(update RouteUpdate) (uint64, error) {
+    if err := update.validate(); err != nil {
+        return 0, err
+    }
+    if update.Timestamp.IsZero() {
+        update.Timestamp = time.Now()
+    }
+
+    b.publish.Lock()
+    defer b.publish.Unlock()
+
+    b.mu.Lock()
+    if b.closed {
+        b.mu.Unlock()
+        return 0, ErrBusClosed
+    }
+    b.sequence++
+    update.Sequence = b.sequence
+    var targets []*Subscription
+    for _, sub := range b.subs {
+        if sub.matches(update) {
+            targets = append(targets, sub)
+        }
+    }
+    b.mu.Unlock()
+
+    for _, sub := range targets {
+        sub.deliver(update)
+    }
+    return update.Sequence, nil
+}
+
+// Sequence returns the sequence number of the last update published
+func (b *EventBus) Sequence() uint64 {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return b.sequence
+}
+
+// Close stops accepting updates and closes every subscription. Subscribers
+// can still read what was buffered before their channel closes.
+func (b *EventBus) Close() {
+    b.mu.Lock()
+    if b.closed {
+        b.mu.Unlock()
+        return
+    }
+    b.closed = true
+    subs := b.subs
+    b.subs = make(map[uint64]*Subscription)
+    b.mu.Unlock()
+
+    for _, sub := range subs {
+        sub.close()
+    }
+}
+
+// Relay publishes updates on a bus from a goroutine of its own. Readers
+// of Block subscriptions publish through one: publishing inline could wait
+// on a publisher that is waiting for them to read. Updates queue without
+// bound and are published in order.
+type Relay struct {
+    bus    *EventBus
+    queue  []RouteUpdate
+    wake   chan struct{}
+    done   chan struct{}
+    closed bool
+    mu     sync.Mutex
+}
+
+func NewRelay(bus *EventBus) *Relay {
+    r := &Relay{
+        bus:  bus,
+        wake: make(chan struct{}, 1),
+        done: make(chan struct{}),
+    }
+    go r.run()
+    return r
+}
+
+// Publish queues an update to be published. Updates that fail validation
+// are rejected here rather than lost later.
+func (r *Relay) Publish(update RouteUpdate) error {
+    if err := update.validate(); err != nil {
+        return err
+    }
+    if update.Timestamp.IsZero() {
+        update.Timestamp = time.Now()
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.closed {
+        return ErrBusClosed
+    }
+    r.queue = append(r.queue, update)
+    select {
+    case r.wake <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+func (r *Relay) run() {
+    defer close(r.done)
+    for range r.wake {
+        r.mu.Lock()
+        queue := r.queue
+        r.queue = nil
+        closed := r.closed
+        r.mu.Unlock()
+
+        for _, update := range queue {
+            // Publishing only fails once the bus is closed, and then the
+            // rest are as undeliverable
+            if _, err := r.bus.Publish(update); err != nil {
+                break
+            }
+        }
+        if closed {
+            return
+        }
+    }
+}
+
+// Close publishes what is still queued and stops the relay
+func (r *Relay) Close() {
+    r.mu.Lock()
+    if r.closed {
+        r.mu.Unlock()
+        <-r.done
+        return
+    }
+    r.closed = true
+    r.mu.Unlock()
+
+    select {
+    case r.wake <- struct{}{}:
+    default:
+    }
+    <-r.done
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const (
+    defaultSegmentBytes = 64 << 20
+    defaultSyncInterval = time.Second
+    segmentSuffix       = ".log"
+)
+
+// Kinds of record in the event log
+const (
+    RecordUpdate = "update"
+    RecordFix    = "fix"
+    RecordModel  = "model"
+)
+
+// LogRecord is one entry in the event log. Exactly one payload is set, the
+// one matching Kind.
+type LogRecord struct {
+    Sequence uint64           `json:"seq"`
+    At       time.Time        `json:"at"`
+    Kind     string           `json:"kind"`
+    Update   *RouteUpdate     `json:"update,omitempty"`
+    Fix      *VehicleFix      `json:"fix,omitempty"`
+    Model    *PredictiveModel `json:"model,omitempty"`
+}
+
+// EventLogOptions tunes segment rotation and retention
+type EventLogOptions struct {
+    SegmentBytes int64         // rotate once a segment reaches this size
+    Retention    time.Duration // drop segments entirely older than this; 0 keeps all
+    SyncInterval time.Duration // how often appended records are fsynced
+}
+
+// EventLog is an append-only log of JSON records split over numbered
+// segment files. Each segment is named after the first sequence number it
+// holds.
+type EventLog struct {
+    dir     string
+    opts    EventLogOptions
+    file    *os.File
+    size    int64
+    nextSeq uint64
+    dirty   bool
+    done    chan struct{}
+    closed  bool
+    mu      sync.Mutex
+}
+
+// OpenEventLog opens or creates the log in dir. A record torn by a crash at
+// the end of the last segment is cut off.
+func OpenEventLog(dir string, opts EventLogOptions) (*EventLog, error) {
+    if opts.SegmentBytes <= 0 {
+        opts.SegmentBytes = defaultSegmentBytes
+    }
+    if opts.SyncInterval <= 0 {
+        opts.SyncInterval = defaultSyncInterval
+    }
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+
+    el := &EventLog{
+        dir:     dir,
+        opts:    opts,
+        nextSeq: 1,
+        done:    make(chan struct{}),
+    }
+
+    segments, err := el.segments()
+    if err != nil {
+        return nil, err
+    }
+    if len(segments) == 0 {
+        if err := el.openSegment(el.nextSeq); err != nil {
+            return nil, err
+        }
+    } else if err := el.recoverSegment(segments[len(segments)-1]); err != nil {
+        return nil, err
+    }
+
+    go el.syncLoop()
+    return el, nil
+}
+
+// segments lists the segment files in sequence order
+func (el *EventLog) segments() ([]string, error) {
+    entries, err := os.ReadDir(el.dir)
+    if err != nil {
+        return nil, err
+    }
+
+    type segment struct {
+        path  string
+        start uint64
+    }
+    var found []segment
+    for _, entry := range entries {
+        if entry.IsDir() {
+            continue
+        }
+        start, ok := segmentStart(entry.Name())
+        if !ok {
+            continue
+        }
+        found = append(found, segment{filepath.Join(el.dir, entry.Name()), start})
+    }
+    sort.Slice(found, func(i, j int) bool { return found[i].start < found[j].start })
+
+    paths := make([]string, len(found))
+    for i, s := range found {
+        paths[i] = s.path
+    }
+    return paths, nil
+}
+
+// segmentStart is the first sequence number of the segment file name, if
+// it names one
+func segmentStart(name string) (uint64, bool) {
+    if !strings.HasSuffix(name, segmentSuffix) {
+        return 0, false
+    }
+    start, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+    return start, err == nil
+}
+
+// recoverSegment reopens the last segment for appending, truncating any
+// partial record and picking up the sequence where it left off. A segment
+// holding no records yet starts at the sequence it is named after.
+func (el *EventLog) recoverSegment(path string) error {
+    if start, ok := segmentStart(filepath.Base(path)); ok {
+        el.nextSeq = start
+    }
+    file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+    if err != nil {
+        return err
+    }
+
+    var good int64
+    reader := bufio.NewReader(file)
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            file.Close()
+            return err
+        }
+
+        var record LogRecord
+        if json.Unmarshal(line, &record) != nil {
+            break
+        }
+        good += int64(len(line))
+        el.nextSeq = record.Sequence + 1
+    }
+
+    if err := file.Truncate(good); err != nil {
+        file.Close()
+        return err
+    }
+    if _, err := file.Seek(good, io.SeekStart); err != nil {
+        file.Close()
+        return err
+    }
+
+    el.file = file
+    el.size = good
+    return nil
+}
+
+func (el *EventLog) openSegment(start uint64) error {
+    path := filepath.Join(el.dir, fmt.Sprintf("%020d%s", start, segmentSuffix))
+    file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return err
+    }
+    el.file = file
+    el.size = 0
+    return nil
+}
+
+// Append writes a record, assigning its sequence number
+func (el *EventLog) Append(record LogRecord) (uint64, error) {
+    if record.At.IsZero() {
+        record.At = time.Now()
+    }
+
+    el.mu.Lock()
+    defer el.mu.Unlock()
+
+    if el.closed {
+        return 0, errors.New("event log is closed")
+    }
+
+    if el.size >= el.opts.SegmentBytes {
+        if err := el.rotate(); err != nil {
+            return 0, err
+        }
+    }
+
+    record.Sequence = el.nextSeq
+    line, err := json.Marshal(record)
+    if err != nil {
+        return 0, err
+    }
+    line = append(line, '\n')
+
+    if _, err := el.file.Write(line); err != nil {
+        return 0, err
+    }
+
+    el.size += int64(len(line))
+    el.nextSeq++
+    el.dirty = true
+    return record.Sequence, nil
+}
+
+// rotate closes the current segment and starts the next. Callers must hold
+// el.mu.
+func (el *EventLog) rotate() error {
+    if err := el.file.Sync(); err != nil {
+        return err
+    }
+    if err := el.file.Close(); err != nil {
+        return err
+    }
+    if err := el.openSegment(el.nextSeq); err != nil {
+        return err
+    }
+    return el.prune()
+}
+
+// prune removes segments whose records are all older than the retention
+// period. Callers must hold el.mu.
+func (el *EventLog) prune() error {
+    if el.opts.Retention <= 0 {
+        return nil
+    }
+
+    segments, err := el.segments()
+    if err != nil {
+        return err
+    }
+
+    cutoff := time.Now().Add(-el.opts.Retention)
+    // A segment ends where the next one starts; never drop the active one
+    for i := 0; i+1 < len(segments); i++ {
+        next, err := firstRecord(segments[i+1])
+        if err != nil || next.At.After(cutoff) {
+            break
+        }
+        if err := os.Remove(segments[i]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (el *EventLog) syncLoop() {
+    ticker := time.NewTicker(el.opts.SyncInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-el.done:
+            return
+        case <-ticker.C:
+            el.mu.Lock()
+            if el.dirty && !el.closed {
+                if err := el.file.Sync(); err != nil {
+                    log.Printf("Syncing event log: %v", err)
+                }
+                el.dirty = false
+            }
+            el.mu.Unlock()
+        }
+    }
+}
+
+// Close flushes and closes the log
+func (el *EventLog) Close() error {
+    el.mu.Lock()
+    defer el.mu.Unlock()
+
+    if el.closed {
+        return nil
+    }
+    el.closed = true
+    close(el.done)
+
+    if err := el.file.Sync(); err != nil {
+        el.file.Close()
+        return err
+    }
+    return el.file.Close()
+}
+
+// Replay calls fn for every record in [from, until), oldest first. Zero
+// times leave that end open.
+func (el *EventLog) Replay(from, until time.Time, fn func(LogRecord) error) error {
+    return replayDir(el.dir, from, until, fn)
+}
+
+// replayDir replays the segments in a log directory without opening it
+// for writing
+func replayDir(dir string, from, until time.Time, fn func(LogRecord) error) error {
+    segments, err := (&EventLog{dir: dir}).segments()
+    if err != nil {
+        return err
+    }
+
+    for i, path := range segments {
+        // Skip segments that end before the window opens
+        if !from.IsZero() && i+1 < len(segments) {
+            next, err := firstRecord(segments[i+1])
+            if err == nil && !next.At.After(from) {
+                continue
+            }
+        }
+
+        if err := replaySegment(path, from, until, fn); err != nil {
+            return fmt.Errorf("replaying %s: %w", filepath.Base(path), err)
+        }
+    }
+    return nil
+}
+
+// replaySegment replays the records of one segment in [from, until).
+// Records are appended as they arrive but stamped with when they happened,
+// so one past until may be followed by more within the window.
+func replaySegment(path string, from, until time.Time, fn func(LogRecord) error) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    reader := bufio.NewReader(file)
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err == io.EOF {
+            // A trailing partial line is a record still being written
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+
+        var record LogRecord
+        if err := json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+            return err
+        }
+        if !until.IsZero() && !record.At.Before(until) {
+            continue
+        }
+        if !from.IsZero() && record.At.Before(from) {
+            continue
+        }
+        if err := fn(record); err != nil {
+            return err
+        }
+    }
+}
+
+func firstRecord(path string) (LogRecord, error) {
+    var record LogRecord
+    file, err := os.Open(path)
+    if err != nil {
+        return record, err
+    }
+    defer file.Close()
+
+    line, err := bufio.NewReader(file).ReadBytes('\n')
+    if err != nil {
+        return record, err
+    }
+    err = json.Unmarshal(line, &record)
+    return record, err
+}
+
+// Snapshot is what the real-time system knew at a moment
+type Snapshot struct {
+    At          time.Time                   `json:"at"`
+    Traffic     map[string]TrafficData      `json:"traffic"`
+    Predictions map[string]*PredictiveModel `json:"predictions"`
+    Vehicles    map[string]VehicleFix       `json:"vehicles"`
+    Alerts      map[string][]ServiceAlert   `json:"alerts"` // route -> alerts in force
+    Health      map[string]HealthIssue      `json:"health"` // route -> last issue reported
+    States      map[string]string           `json:"states"` // route -> health state
+    alerts      map[string]map[string]ServiceAlert
+}
+
+// StateAt rebuilds what the system thought at a moment in the past, e.g.
+// "what did traffic look like at 08:15 yesterday"
+func StateAt(dir string, at time.Time) (*Snapshot, error) {
+    snapshot := &Snapshot{
+        At:          at,
+        Traffic:     make(map[string]TrafficData),
+        Predictions: make(map[string]*PredictiveModel),
+        Vehicles:    make(map[string]VehicleFix),
+        Alerts:      make(map[string][]ServiceAlert),
+        Health:      make(map[string]HealthIssue),
+        States:      make(map[string]string),
+        alerts:      make(map[string]map[string]ServiceAlert),
+    }
+
+    err := replayDir(dir, time.Time{}, at, func(record LogRecord) error {
+        snapshot.apply(record)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    for routeID, alerts := range snapshot.alerts {
+        for _, alert := range alerts {
+            snapshot.Alerts[routeID] = append(snapshot.Alerts[routeID], alert)
+        }
+    }
+    snapshot.alerts = nil
+    return snapshot, nil
+}
+
+func (s *Snapshot) apply(record LogRecord) {
+    switch {
+    case record.Fix != nil:
+        s.Vehicles[record.Fix.VehicleID] = *record.Fix
+    case record.Model != nil:
+        s.Predictions[record.Model.RouteID] = record.Model
+    case record.Update != nil:
+        update := record.Update
+        switch {
+        case update.Traffic != nil:
+            s.Traffic[update.Traffic.H3Index] = *update.Traffic
+        case update.Health != nil:
+            s.Health[update.RouteID] = *update.Health
+        case update.Transition != nil:
+            s.States[update.RouteID] = update.Transition.To
+        case update.Alert != nil:
+            alert := *update.Alert
+            if alert.ClearedAt != nil {
+                delete(s.alerts[alert.RouteID], alert.IncidentID)
+                break
+            }
+            if s.alerts[alert.RouteID] == nil {
+                s.alerts[alert.RouteID] = make(map[string]ServiceAlert)
+            }
+            s.alerts[alert.RouteID][alert.IncidentID] = alert
+        }
+    }
+}
+
+// OpenEventLog starts journalling to a log in dir. What the log already
+// holds is replayed first to rebuild traffic, speed profiles, vehicle
+// positions and demand models. Call it before feeding in live data.
+func (rtm *RealTimeManager) OpenEventLog(dir string, opts EventLogOptions) error {
+    eventLog, err := OpenEventLog(dir, opts)
+    if err != nil {
+        return err
+    }
+
+    if err := eventLog.Replay(time.Time{}, time.Time{}, func(record LogRecord) error {
+        rtm.restore(record)
+        return nil
+    }); err != nil {
+        eventLog.Close()
+        return err
+    }
+
+    // Everything published from here on is journalled; the writer waits
+    // rather than losing updates. Positions are left out, as their fixes
+    // are journalled already.
+    var topics []string
+    for _, topic := range validTopics {
+        if topic != TopicPosition {
+            topics = append(topics, topic)
+        }
+    }
+    sub, err := rtm.bus.Subscribe(SubscribeOptions{Topics: topics, Buffer: 4096, Policy: Block, BlockTimeout: blockTimeout})
+    if err != nil {
+        eventLog.Close()
+        return err
+    }
+
+    rtm.mu.Lock()
+    rtm.eventLog = eventLog
+    rtm.mu.Unlock()
+
+    go func() {
+        defer close(rtm.journalled)
+        for update := range sub.C {
+            update := update
+            if _, err := eventLog.Append(LogRecord{At: update.Timestamp, Kind: RecordUpdate, Update: &update}); err != nil {
+                log.Printf("Journalling %s update: %v", update.UpdateType, err)
+            }
+        }
+        if err := eventLog.Close(); err != nil {
+            log.Printf("Closing event log: %v", err)
+        }
+    }()
+    return nil
+}
+
+// journal appends a record that doesn't travel over the bus
+func (rtm *RealTimeManager) journal(record LogRecord) {
+    rtm.mu.RLock()
+    eventLog := rtm.eventLog
+    rtm.mu.RUnlock()
+    if eventLog == nil {
+        return
+    }
+
+    if _, err := eventLog.Append(record); err != nil {
+        log.Printf("Journalling %s: %v", record.Kind, err)
+    }
+}
+
+// restore applies a replayed record to the live state
+func (rtm *RealTimeManager) restore(record LogRecord) {
+    switch {
+    case record.Fix != nil:
+        rtm.probes.restore(*record.Fix)
+    case record.Model != nil:
+        rtm.mu.Lock()
+        rtm.predictions[record.Model.RouteID] = record.Model
+        rtm.mu.Unlock()
+    case record.Update != nil && record.Update.Traffic != nil:
+        traffic := *record.Update.Traffic
+        rtm.profile.Observe(traffic.H3Index, traffic.LastUpdated, traffic.Speed)
+        rtm.mu.Lock()
+        rtm.trafficData[traffic.H3Index] = &traffic
+        rtm.mu.Unlock()
+    }
+}
+
+// StateAt rebuilds what the system thought at a moment from its event log
+func (rtm *RealTimeManager) StateAt(at time.Time) (*Snapshot, error) {
+    rtm.mu.RLock()
+    eventLog := rtm.eventLog
+    rtm.mu.RUnlock()
+    if eventLog == nil {
+        return nil, errors.New("no event log is open")
+    }
+    return StateAt(eventLog.dir, at)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestEventLogRecovery(t *testing.T) {
+    record := func(seq uint64) string {
+        return fmt.Sprintf(`{"seq":%d,"at":"2024-03-01T07:00:00Z","kind":"fix"}`+"\n", seq)
+    }
+    segment := func(start uint64) string {
+        return fmt.Sprintf("%020d%s", start, segmentSuffix)
+    }
+
+    tests := []struct {
+        name     string
+        segments map[string]string // file name -> contents
+        wantSeq  uint64            // of the next record appended
+    }{
+        {name: "new log", wantSeq: 1},
+        {
+            name:     "records in the last segment",
+            segments: map[string]string{segment(1): record(1) + record(2) + record(3)},
+            wantSeq:  4,
+        },
+        {
+            name: "empty last segment",
+            segments: map[string]string{
+                segment(1): record(1) + record(2) + record(3),
+                segment(4): "",
+            },
+            wantSeq: 4,
+        },
+        {
+            name:     "torn last record",
+            segments: map[string]string{segment(1): record(1) + record(2) + `{"seq":3,"at":"2024-03`},
+            wantSeq:  3,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := t.TempDir()
+            for name, contents := range tt.segments {
+                if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+                    t.Fatal(err)
+                }
+            }
+
+            el, err := OpenEventLog(dir, EventLogOptions{})
+            if err != nil {
+                t.Fatalf("OpenEventLog: %v", err)
+            }
+            defer el.Close()
+
+            seq, err := el.Append(LogRecord{At: time.Now(), Kind: RecordFix, Fix: &VehicleFix{VehicleID: "KBX 123A"}})
+            if err != nil {
+                t.Fatalf("Append: %v", err)
+            }
+            if seq != tt.wantSeq {
+                t.Errorf("Append assigned sequence %d, want %d", seq, tt.wantSeq)
+            }
+        })
+    }
+}
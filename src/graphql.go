@@ -0,0 +1,917 @@
+package main
+
+import (
+    "context"
+    _ "embed"
+    "errors"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    graphql "github.com/graph-gophers/graphql-go"
+    "github.com/graph-gophers/graphql-go/relay"
+    "github.com/graph-gophers/graphql-transport-ws/graphqlws"
+
+    "motown/auth"
+)
+
+const (
+    graphQLMaxDepth         = 10
+    graphQLMaxParallelism   = 10
+    graphQLSubscriberBuffer = 64
+)
+
+// graphQLSchema describes the route model for the GraphQL API
+//
+//go:embed schema.graphql
+var graphQLSchema string
+
+// GraphQLRequest is the body of a GraphQL query or mutation
+type GraphQLRequest struct {
+    Query         string                 `json:"query"`
+    OperationName string                 `json:"operationName,omitempty"`
+    Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// GraphQLResponse is what a GraphQL request answers with
+type GraphQLResponse struct {
+    Data   interface{} `json:"data,omitempty"`
+    Errors []struct {
+        Message string        `json:"message"`
+        Path    []interface{} `json:"path,omitempty"`
+    } `json:"errors,omitempty"`
+}
+
+// newGraphQLHandler serves queries and mutations over HTTP and
+// subscriptions over WebSocket, using the graphql-ws protocol. Resolvers
+// go through the same service layer as the REST API.
+func newGraphQLHandler(s *APIServer) http.Handler {
+    schema := graphql.MustParseSchema(graphQLSchema, &graphQLResolver{api: s},
+        graphql.MaxDepth(graphQLMaxDepth),
+        graphql.MaxParallelism(graphQLMaxParallelism),
+    )
+    return graphqlws.NewHandlerFunc(schema, &relay.Handler{Schema: schema})
+}
+
+// graphQLError hides errors that aren't the client's doing, as the REST
+// API does
+func graphQLError(err error) error {
+    if status, _ := errorResponse(err); status == http.StatusInternalServerError {
+        log.Printf("GraphQL: %v", err)
+        return errors.New("internal error")
+    }
+    return err
+}
+
+// pageBounds turns first and offset into slice bounds
+func pageBounds(total int, first, offset int32) (int, int, error) {
+    verr := &ValidationError{}
+    if first < 1 || first > maxPageLimit {
+        verr.Add("first", "must be between 1 and %d", maxPageLimit)
+    }
+    if offset < 0 {
+        verr.Add("offset", "can't be negative")
+    }
+    if err := verr.Err(); err != nil {
+        return 0, 0, err
+    }
+
+    start, end := int(offset), int(offset)+int(first)
+    if start > total {
+        start = total
+    }
+    if end > total {
+        end = total
+    }
+    return start, end, nil
+}
+
+func parseRouteID(id graphql.ID) (string, error) {
+    if !uidPattern.MatchString(string(id)) {
+        verr := &ValidationError{}
+        verr.Add("id", "%q is not a route ID; IDs look like 0x1a2b", id)
+        return "", verr
+    }
+    return string(id), nil
+}
+
+func parseMaxAge(value string) (time.Duration, error) {
+    maxAge, err := time.ParseDuration(value)
+    if err != nil || maxAge <= 0 {
+        verr := &ValidationError{}
+        verr.Add("maxAge", "must be a positive duration, e.g. 5m")
+        return 0, verr
+    }
+    return maxAge, nil
+}
+
+func derefString(s *string) string {
+    if s == nil {
+        return ""
+    }
+    return *s
+}
+
+func derefFloat(f *float64) float64 {
+    if f == nil {
+        return 0
+    }
+    return *f
+}
+
+// nonNil keeps lists GraphQL declares non-null from going out as null
+func nonNil(list []string) []string {
+    if list == nil {
+        return []string{}
+    }
+    return list
+}
+
+func optionalTime(t time.Time) *graphql.Time {
+    if t.IsZero() {
+        return nil
+    }
+    return &graphql.Time{Time: t}
+}
+
+func optionalString(value string) *string {
+    if value == "" {
+        return nil
+    }
+    return &value
+}
+
+// Stop is a pickup point or destination and the routes serving it
+type Stop struct {
+    Name   string
+    Routes []Route
+}
+
+// listStops groups the stored routes by the places they serve, going
+// through the route cache
+func (s *APIServer) listStops(ctx context.Context) ([]Stop, error) {
+    routes, err := s.planner.listRoutes(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    byName := make(map[string]*Stop)
+    add := func(name string, route Route) {
+        name = strings.TrimSpace(name)
+        if name == "" {
+            return
+        }
+        key := strings.ToLower(name)
+        stop, exists := byName[key]
+        if !exists {
+            stop = &Stop{Name: name}
+            byName[key] = stop
+        }
+        for _, served := range stop.Routes {
+            if served.Uid == route.Uid {
+                return
+            }
+        }
+        stop.Routes = append(stop.Routes, route)
+    }
+    for _, route := range routes {
+        add(route.PickupPoint, route)
+        for _, destination := range route.Destinations {
+            add(destination, route)
+        }
+    }
+
+    stops := make([]Stop, 0, len(byName))
+    for _, stop := range byName {
+        stops = append(stops, *stop)
+    }
+    sort.Slice(stops, func(i, j int) bool {
+        return strings.ToLower(stops[i].Name) < strings.ToLower(stops[j].Name)
+    })
+    return stops, nil
+}
+
+// graphQLResolver is the root of the GraphQL schema
+type graphQLResolver struct {
+    api *APIServer
+}
+
+type locationInput struct {
+    Lat float64
+    Lng float64
+}
+
+func (l locationInput) location() Location {
+    return Location{Lat: l.Lat, Lng: l.Lng}
+}
+
+type scheduleInput struct {
+    StartTime        string
+    EndTime          string
+    FrequencyMinutes int32
+}
+
+type fareInput struct {
+    Regular float64
+    Peak    *float64
+    OffPeak *float64
+}
+
+type routeInput struct {
+    RouteNumber  string
+    Sacco        *string
+    PickupPoint  string
+    Destinations *[]string
+    Pickup       locationInput
+    Destination  locationInput
+    Schedule     *[]scheduleInput
+    Fare         *fareInput
+    ActiveDays   *[]string
+}
+
+func (in routeInput) route() Route {
+    route := Route{
+        RouteNumber: in.RouteNumber,
+        PickupPoint: in.PickupPoint,
+        PickupLat:   in.Pickup.Lat,
+        PickupLng:   in.Pickup.Lng,
+        DestLat:     in.Destination.Lat,
+        DestLng:     in.Destination.Lng,
+    }
+    if in.Sacco != nil {
+        route.Sacco = *in.Sacco
+    }
+    if in.Destinations != nil {
+        route.Destinations = *in.Destinations
+    }
+    if in.ActiveDays != nil {
+        route.ActiveDays = *in.ActiveDays
+    }
+    if in.Schedule != nil {
+        for _, s := range *in.Schedule {
+            route.Schedule = append(route.Schedule, Schedule{
+                StartTime: s.StartTime,
+                EndTime:   s.EndTime,
+                Frequency: int(s.FrequencyMinutes),
+            })
+        }
+    }
+    if in.Fare != nil {
+        route.Fare = FareInfo{
+            Regular:      in.Fare.Regular,
+            PeakHours:    derefFloat(in.Fare.Peak),
+            OffPeakHours: derefFloat(in.Fare.OffPeak),
+        }
+    }
+    return route
+}
+
+func (r *graphQLResolver) Routes(ctx context.Context, args struct {
+    Near        *locationInput
+    MaxDistance *float64
+    Destination *string
+    DayOfWeek   *string
+    MaxFare     *float64
+    TimeOfDay   *string
+    First       int32
+    Offset      int32
+}) ([]*routeResolver, error) {
+    criteria := SearchCriteria{
+        Destination: derefString(args.Destination),
+        MaxDistance: derefFloat(args.MaxDistance),
+        DayOfWeek:   derefString(args.DayOfWeek),
+        MaxFare:     derefFloat(args.MaxFare),
+        TimeOfDay:   derefString(args.TimeOfDay),
+    }
+    if args.Near != nil {
+        near := args.Near.location()
+        criteria.NearLocation = &near
+    }
+
+    routes, err := r.api.findRoutes(ctx, criteria)
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+    start, end, err := pageBounds(len(routes), args.First, args.Offset)
+    if err != nil {
+        return nil, err
+    }
+    return r.api.routeResolvers(routes[start:end]), nil
+}
+
+func (r *graphQLResolver) Route(ctx context.Context, args struct{ ID graphql.ID }) (*routeResolver, error) {
+    id, err := parseRouteID(args.ID)
+    if err != nil {
+        return nil, err
+    }
+    return r.api.routeResolver(ctx, id)
+}
+
+func (r *graphQLResolver) Stops(ctx context.Context, args struct {
+    Search *string
+    First  int32
+    Offset int32
+}) ([]*stopResolver, error) {
+    stops, err := r.api.listStops(ctx)
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+
+    search := strings.ToLower(strings.TrimSpace(derefString(args.Search)))
+    matching := stops[:0]
+    for _, stop := range stops {
+        if strings.Contains(strings.ToLower(stop.Name), search) {
+            matching = append(matching, stop)
+        }
+    }
+
+    start, end, err := pageBounds(len(matching), args.First, args.Offset)
+    if err != nil {
+        return nil, err
+    }
+    resolvers := make([]*stopResolver, 0, end-start)
+    for _, stop := range matching[start:end] {
+        resolvers = append(resolvers, &stopResolver{api: r.api, stop: stop})
+    }
+    return resolvers, nil
+}
+
+func (r *graphQLResolver) Stop(ctx context.Context, args struct{ Name string }) (*stopResolver, error) {
+    stops, err := r.api.listStops(ctx)
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+    for _, stop := range stops {
+        if strings.EqualFold(stop.Name, strings.TrimSpace(args.Name)) {
+            return &stopResolver{api: r.api, stop: stop}, nil
+        }
+    }
+    return nil, nil
+}
+
+func (r *graphQLResolver) Vehicles(ctx context.Context, args struct {
+    RouteID *graphql.ID
+    MaxAge  string
+}) ([]*vehicleResolver, error) {
+    if err := r.api.authorize(ctx, ActionReadVehicles, auth.Resource{}); err != nil {
+        return nil, err
+    }
+    maxAge, err := parseMaxAge(args.MaxAge)
+    if err != nil {
+        return nil, err
+    }
+    routeID := ""
+    if args.RouteID != nil {
+        if routeID, err = parseRouteID(*args.RouteID); err != nil {
+            return nil, err
+        }
+    }
+    return r.api.vehicleResolvers(r.api.positions(routeID, maxAge)), nil
+}
+
+func (r *graphQLResolver) RouteSets(ctx context.Context, args struct {
+    First  int32
+    Offset int32
+}) ([]*routeSetResolver, error) {
+    if err := r.api.authorize(ctx, ActionReadRouteSets, auth.Resource{}); err != nil {
+        return nil, err
+    }
+    routeSets, err := r.api.planner.ListRouteSets(ctx)
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+    start, end, err := pageBounds(len(routeSets), args.First, args.Offset)
+    if err != nil {
+        return nil, err
+    }
+
+    resolvers := make([]*routeSetResolver, 0, end-start)
+    for _, routeSet := range routeSets[start:end] {
+        resolvers = append(resolvers, &routeSetResolver{api: r.api, set: routeSet})
+    }
+    return resolvers, nil
+}
+
+func (r *graphQLResolver) RouteSet(ctx context.Context, args struct{ ID graphql.ID }) (*routeSetResolver, error) {
+    if err := r.api.authorize(ctx, ActionReadRouteSets, auth.Resource{}); err != nil {
+        return nil, err
+    }
+    routeSet, err := r.api.planner.GetRouteSet(ctx, string(args.ID))
+    if errors.Is(err, ErrRouteSetNotFound) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+    return &routeSetResolver{api: r.api, set: routeSet}, nil
+}
+
+func (r *graphQLResolver) Journey(ctx context.Context, args struct {
+    From     locationInput
+    To       locationInput
+    DepartAt *graphql.Time
+}) (*journeyResolver, error) {
+    if err := r.api.authorize(ctx, ActionPlanJourney, auth.Resource{}); err != nil {
+        return nil, err
+    }
+    verr := &ValidationError{}
+    validateLocation("from", args.From.location(), verr)
+    validateLocation("to", args.To.location(), verr)
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+
+    departAt := time.Now()
+    if args.DepartAt != nil {
+        departAt = args.DepartAt.Time
+    }
+    plan, err := r.api.rtm.PlanJourney(ctx, args.From.location(), args.To.location(), departAt)
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+    return &journeyResolver{api: r.api, plan: plan}, nil
+}
+
+func (r *graphQLResolver) CreateRoute(ctx context.Context, args struct{ Input routeInput }) (*routeResolver, error) {
+    if err := r.api.authorize(ctx, ActionWriteRoutes, auth.Resource{}); err != nil {
+        return nil, err
+    }
+    route := args.Input.route()
+    if err := r.api.saveRoute(ctx, &route); err != nil {
+        return nil, graphQLError(err)
+    }
+    return &routeResolver{api: r.api, route: route}, nil
+}
+
+func (r *graphQLResolver) UpdateRoute(ctx context.Context, args struct {
+    ID    graphql.ID
+    Input routeInput
+}) (*routeResolver, error) {
+    if err := r.api.authorize(ctx, ActionWriteRoutes, auth.Resource{}); err != nil {
+        return nil, err
+    }
+    id, err := parseRouteID(args.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    route := args.Input.route()
+    route.Uid = id
+    if err := r.api.saveRoute(ctx, &route); err != nil {
+        return nil, graphQLError(err)
+    }
+    return &routeResolver{api: r.api, route: route}, nil
+}
+
+func (r *graphQLResolver) DeleteRoute(ctx context.Context, args struct{ ID graphql.ID }) (graphql.ID, error) {
+    if err := r.api.authorize(ctx, ActionWriteRoutes, auth.Resource{}); err != nil {
+        return "", err
+    }
+    id, err := parseRouteID(args.ID)
+    if err != nil {
+        return "", err
+    }
+    if err := r.api.removeRoute(ctx, id); err != nil {
+        return "", graphQLError(err)
+    }
+    return args.ID, nil
+}
+
+// subscribe relays updates from the real-time manager until the client
+// goes away. Slow clients lose their oldest updates rather than holding up
+// the bus.
+func (r *graphQLResolver) subscribe(ctx context.Context, opts SubscribeOptions, keep func(RouteUpdate) bool) (<-chan RouteUpdate, error) {
+    opts.Buffer = graphQLSubscriberBuffer
+    opts.Policy = DropOldest
+    sub, err := r.api.rtm.Subscribe(opts)
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+
+    updates := make(chan RouteUpdate)
+    go func() {
+        defer close(updates)
+        defer sub.Close()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case update, ok := <-sub.C:
+                if !ok {
+                    return
+                }
+                if !keep(update) {
+                    continue
+                }
+                select {
+                case updates <- update:
+                case <-ctx.Done():
+                    return
+                }
+            }
+        }
+    }()
+    return updates, nil
+}
+
+func (r *graphQLResolver) VehiclePositions(ctx context.Context, args struct {
+    RouteID   *graphql.ID
+    VehicleID *string
+}) (<-chan *vehicleResolver, error) {
+    if err := r.api.authorize(ctx, ActionReadVehicles, auth.Resource{}); err != nil {
+        return nil, err
+    }
+    opts := SubscribeOptions{Topics: []string{TopicPosition}}
+    if args.RouteID != nil {
+        routeID, err := parseRouteID(*args.RouteID)
+        if err != nil {
+            return nil, err
+        }
+        opts.RouteIDs = []string{routeID}
+    }
+
+    updates, err := r.subscribe(ctx, opts, func(update RouteUpdate) bool {
+        return args.VehicleID == nil || update.Position.VehicleID == *args.VehicleID
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    vehicles := make(chan *vehicleResolver)
+    go func() {
+        defer close(vehicles)
+        for update := range updates {
+            select {
+            case vehicles <- &vehicleResolver{api: r.api, fix: *update.Position}:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    return vehicles, nil
+}
+
+func (r *graphQLResolver) RouteUpdates(ctx context.Context, args struct {
+    RouteID *graphql.ID
+    Types   *[]string
+}) (<-chan *routeUpdateResolver, error) {
+    var opts SubscribeOptions
+    if args.RouteID != nil {
+        routeID, err := parseRouteID(*args.RouteID)
+        if err != nil {
+            return nil, err
+        }
+        opts.RouteIDs = []string{routeID}
+    }
+
+    if args.Types != nil {
+        verr := &ValidationError{}
+        for _, topic := range *args.Types {
+            if !isValidTopic(topic) {
+                verr.Add("types", "%q is not an update type (valid: %s)", topic, strings.Join(validTopics, ", "))
+            }
+        }
+        if err := verr.Err(); err != nil {
+            return nil, err
+        }
+        opts.Topics = *args.Types
+    } else {
+        // Positions come thick and fast; they have their own subscription
+        for _, topic := range validTopics {
+            if topic != TopicPosition {
+                opts.Topics = append(opts.Topics, topic)
+            }
+        }
+    }
+
+    updates, err := r.subscribe(ctx, opts, func(RouteUpdate) bool { return true })
+    if err != nil {
+        return nil, err
+    }
+
+    resolvers := make(chan *routeUpdateResolver)
+    go func() {
+        defer close(resolvers)
+        for update := range updates {
+            select {
+            case resolvers <- &routeUpdateResolver{api: r.api, update: update}:
+            case <-ctx.Done():
+                return
+            }
+        }
+    }()
+    return resolvers, nil
+}
+
+// routeResolver fetches a route through the planner's cache; a route that
+// doesn't exist resolves to null
+func (s *APIServer) routeResolver(ctx context.Context, id string) (*routeResolver, error) {
+    route, err := s.planner.getRoute(ctx, id)
+    if errors.Is(err, ErrRouteNotFound) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, graphQLError(err)
+    }
+    return &routeResolver{api: s, route: *route}, nil
+}
+
+func (s *APIServer) routeResolvers(routes []Route) []*routeResolver {
+    resolvers := make([]*routeResolver, len(routes))
+    for i, route := range routes {
+        resolvers[i] = &routeResolver{api: s, route: route}
+    }
+    return resolvers
+}
+
+func (s *APIServer) vehicleResolvers(positions []VehicleFix) []*vehicleResolver {
+    resolvers := make([]*vehicleResolver, len(positions))
+    for i, fix := range positions {
+        resolvers[i] = &vehicleResolver{api: s, fix: fix}
+    }
+    return resolvers
+}
+
+type locationResolver struct {
+    location Location
+}
+
+func (l *locationResolver) Lat() float64 { return l.location.Lat }
+func (l *locationResolver) Lng() float64 { return l.location.Lng }
+
+type routeResolver struct {
+    api   *APIServer
+    route Route
+}
+
+func (r *routeResolver) ID() graphql.ID             { return graphql.ID(r.route.Uid) }
+func (r *routeResolver) RouteNumber() string        { return r.route.RouteNumber }
+func (r *routeResolver) PickupPoint() string        { return r.route.PickupPoint }
+func (r *routeResolver) Sacco() *string             { return optionalString(r.route.Sacco) }
+func (r *routeResolver) Destinations() []string     { return nonNil(r.route.Destinations) }
+func (r *routeResolver) ActiveDays() []string       { return nonNil(r.route.ActiveDays) }
+func (r *routeResolver) LastUpdated() *graphql.Time { return optionalTime(r.route.LastUpdated) }
+
+func (r *routeResolver) Pickup() *locationResolver {
+    return &locationResolver{Location{Lat: r.route.PickupLat, Lng: r.route.PickupLng}}
+}
+
+func (r *routeResolver) Destination() *locationResolver {
+    return &locationResolver{Location{Lat: r.route.DestLat, Lng: r.route.DestLng}}
+}
+
+func (r *routeResolver) Schedule() []*scheduleResolver {
+    resolvers := make([]*scheduleResolver, len(r.route.Schedule))
+    for i, s := range r.route.Schedule {
+        resolvers[i] = &scheduleResolver{s}
+    }
+    return resolvers
+}
+
+func (r *routeResolver) Fare() *fareResolver {
+    return &fareResolver{r.route.Fare}
+}
+
+func (r *routeResolver) Vehicles(args struct{ MaxAge string }) ([]*vehicleResolver, error) {
+    maxAge, err := parseMaxAge(args.MaxAge)
+    if err != nil {
+        return nil, err
+    }
+    return r.api.vehicleResolvers(r.api.positions(r.route.Uid, maxAge)), nil
+}
+
+type scheduleResolver struct {
+    schedule Schedule
+}
+
+func (s *scheduleResolver) StartTime() string       { return s.schedule.StartTime }
+func (s *scheduleResolver) EndTime() string         { return s.schedule.EndTime }
+func (s *scheduleResolver) FrequencyMinutes() int32 { return int32(s.schedule.Frequency) }
+
+type fareResolver struct {
+    fare FareInfo
+}
+
+func (f *fareResolver) Regular() float64 { return f.fare.Regular }
+func (f *fareResolver) Peak() float64    { return f.fare.PeakHours }
+func (f *fareResolver) OffPeak() float64 { return f.fare.OffPeakHours }
+
+type stopResolver struct {
+    api  *APIServer
+    stop Stop
+}
+
+func (s *stopResolver) Name() string             { return s.stop.Name }
+func (s *stopResolver) Routes() []*routeResolver { return s.api.routeResolvers(s.stop.Routes) }
+
+type vehicleResolver struct {
+    api *APIServer
+    fix VehicleFix
+}
+
+func (v *vehicleResolver) ID() string { return v.fix.VehicleID }
+
+func (v *vehicleResolver) RouteID() *graphql.ID {
+    if v.fix.RouteID == "" {
+        return nil
+    }
+    id := graphql.ID(v.fix.RouteID)
+    return &id
+}
+
+func (v *vehicleResolver) Route(ctx context.Context) (*routeResolver, error) {
+    if v.fix.RouteID == "" {
+        return nil, nil
+    }
+    return v.api.routeResolver(ctx, v.fix.RouteID)
+}
+
+func (v *vehicleResolver) Location() *locationResolver {
+    return &locationResolver{Location{Lat: v.fix.Lat, Lng: v.fix.Lng}}
+}
+
+func (v *vehicleResolver) Timestamp() graphql.Time { return graphql.Time{Time: v.fix.Timestamp} }
+
+type routeSetResolver struct {
+    api *APIServer
+    set *RouteSet
+}
+
+func (r *routeSetResolver) ID() graphql.ID          { return graphql.ID(r.set.ID) }
+func (r *routeSetResolver) Name() string            { return r.set.Name }
+func (r *routeSetResolver) Version() int32          { return int32(r.set.Version) }
+func (r *routeSetResolver) Coverage() []string      { return nonNil(r.set.Coverage) }
+func (r *routeSetResolver) CreatedAt() graphql.Time { return graphql.Time{Time: r.set.Created} }
+func (r *routeSetResolver) UpdatedAt() graphql.Time { return graphql.Time{Time: r.set.Updated} }
+
+// Routes skips routes deleted since the set was saved
+func (r *routeSetResolver) Routes(ctx context.Context) ([]*routeResolver, error) {
+    resolvers := make([]*routeResolver, 0, len(r.set.Routes))
+    for _, id := range r.set.Routes {
+        route, err := r.api.routeResolver(ctx, id)
+        if err != nil {
+            return nil, err
+        }
+        if route != nil {
+            resolvers = append(resolvers, route)
+        }
+    }
+    return resolvers, nil
+}
+
+type journeyResolver struct {
+    api  *APIServer
+    plan *JourneyPlan
+}
+
+func (j *journeyResolver) From() *locationResolver { return &locationResolver{j.plan.From} }
+func (j *journeyResolver) To() *locationResolver   { return &locationResolver{j.plan.To} }
+func (j *journeyResolver) DepartAt() graphql.Time  { return graphql.Time{Time: j.plan.DepartAt} }
+
+func (j *journeyResolver) Options() []*journeyOptionResolver {
+    resolvers := make([]*journeyOptionResolver, len(j.plan.Options))
+    for i, option := range j.plan.Options {
+        resolvers[i] = &journeyOptionResolver{api: j.api, option: option}
+    }
+    return resolvers
+}
+
+type journeyOptionResolver struct {
+    api    *APIServer
+    option JourneyOption
+}
+
+func (j *journeyOptionResolver) Route(ctx context.Context) (*routeResolver, error) {
+    return j.api.routeResolver(ctx, j.option.RouteID)
+}
+
+func (j *journeyOptionResolver) RouteNumber() string        { return j.option.RouteNumber }
+func (j *journeyOptionResolver) WalkToPickupKm() float64    { return j.option.WalkToKm }
+func (j *journeyOptionResolver) WalkFromDropOffKm() float64 { return j.option.WalkFromKm }
+func (j *journeyOptionResolver) WaitMinutes() float64       { return j.option.Wait.Minutes() }
+func (j *journeyOptionResolver) TotalMinutes() float64      { return j.option.Total.Minutes() }
+func (j *journeyOptionResolver) TotalLowerMinutes() float64 { return j.option.Lower.Minutes() }
+func (j *journeyOptionResolver) TotalUpperMinutes() float64 { return j.option.Upper.Minutes() }
+
+type routeUpdateResolver struct {
+    api    *APIServer
+    update RouteUpdate
+}
+
+func (u *routeUpdateResolver) Sequence() string        { return strconv.FormatUint(u.update.Sequence, 10) }
+func (u *routeUpdateResolver) Type() string            { return u.update.UpdateType }
+func (u *routeUpdateResolver) Timestamp() graphql.Time { return graphql.Time{Time: u.update.Timestamp} }
+
+func (u *routeUpdateResolver) RouteID() *graphql.ID {
+    if u.update.RouteID == "" {
+        return nil
+    }
+    id := graphql.ID(u.update.RouteID)
+    return &id
+}
+
+func (u *routeUpdateResolver) Traffic() *trafficResolver {
+    if u.update.Traffic == nil {
+        return nil
+    }
+    return &trafficResolver{*u.update.Traffic}
+}
+
+func (u *routeUpdateResolver) Incident() *incidentResolver {
+    if u.update.Incident == nil {
+        return nil
+    }
+    return &incidentResolver{*u.update.Incident}
+}
+
+func (u *routeUpdateResolver) Alert() *alertResolver {
+    if u.update.Alert == nil {
+        return nil
+    }
+    return &alertResolver{*u.update.Alert}
+}
+
+func (u *routeUpdateResolver) Health() *healthIssueResolver {
+    if u.update.Health == nil {
+        return nil
+    }
+    return &healthIssueResolver{*u.update.Health}
+}
+
+func (u *routeUpdateResolver) Transition() *transitionResolver {
+    if u.update.Transition == nil {
+        return nil
+    }
+    return &transitionResolver{*u.update.Transition}
+}
+
+func (u *routeUpdateResolver) Position() *vehicleResolver {
+    if u.update.Position == nil {
+        return nil
+    }
+    return &vehicleResolver{api: u.api, fix: *u.update.Position}
+}
+
+type trafficResolver struct {
+    traffic TrafficData
+}
+
+func (t *trafficResolver) H3Index() string     { return t.traffic.H3Index }
+func (t *trafficResolver) SpeedKmh() float64   { return t.traffic.Speed }
+func (t *trafficResolver) Congestion() float64 { return t.traffic.Congestion }
+func (t *trafficResolver) Source() string      { return t.traffic.Source }
+
+type incidentResolver struct {
+    incident Incident
+}
+
+func (i *incidentResolver) ID() graphql.ID      { return graphql.ID(i.incident.ID) }
+func (i *incidentResolver) Type() string        { return i.incident.Type }
+func (i *incidentResolver) Description() string { return i.incident.Description }
+func (i *incidentResolver) Location() *locationResolver {
+    return &locationResolver{i.incident.Location}
+}
+func (i *incidentResolver) Severity() string { return i.incident.Severity }
+func (i *incidentResolver) Status() string   { return i.incident.Status }
+func (i *incidentResolver) ReportedAt() graphql.Time {
+    return graphql.Time{Time: i.incident.ReportedAt}
+}
+func (i *incidentResolver) ExpiresAt() graphql.Time { return graphql.Time{Time: i.incident.ExpiresAt} }
+
+func (i *incidentResolver) AffectedRoutes() []graphql.ID {
+    ids := make([]graphql.ID, len(i.incident.AffectedRoutes))
+    for n, id := range i.incident.AffectedRoutes {
+        ids[n] = graphql.ID(id)
+    }
+    return ids
+}
+
+type alertResolver struct {
+    alert ServiceAlert
+}
+
+func (a *alertResolver) ID() graphql.ID         { return graphql.ID(a.alert.ID) }
+func (a *alertResolver) IncidentID() graphql.ID { return graphql.ID(a.alert.IncidentID) }
+func (a *alertResolver) RouteID() graphql.ID    { return graphql.ID(a.alert.RouteID) }
+func (a *alertResolver) Severity() string       { return a.alert.Severity }
+func (a *alertResolver) Message() string        { return a.alert.Message }
+func (a *alertResolver) IssuedAt() graphql.Time { return graphql.Time{Time: a.alert.IssuedAt} }
+
+type healthIssueResolver struct {
+    issue HealthIssue
+}
+
+func (h *healthIssueResolver) Score() float64 { return h.issue.Score }
+func (h *healthIssueResolver) Issue() string  { return h.issue.Issue }
+
+type transitionResolver struct {
+    transition HealthTransition
+}
+
+func (t *transitionResolver) From() string     { return t.transition.From }
+func (t *transitionResolver) To() string       { return t.transition.To }
+func (t *transitionResolver) Score() float64   { return t.transition.Score }
+func (t *transitionResolver) Issues() []string { return nonNil(t.transition.Issues) }
@@ -0,0 +1,578 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "math"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210/protos/api"
+    "github.com/uber/h3-go/v4"
+)
+
+const (
+    healthCheckInterval = 5 * time.Minute
+    healthWorkers       = 8
+    healthCheckTimeout  = time.Minute
+    healthHistoryLimit  = 288 // a day of checks at the default interval
+
+    heavyCongestion     = 0.8
+    vehicleFixMaxAge    = 5 * time.Minute
+    headwayGapTolerance = 1.5 // gaps up to this many headways are normal
+)
+
+// Route health states, best to worst
+const (
+    HealthHealthy  = "healthy"
+    HealthDegraded = "degraded"
+    HealthDown     = "down"
+)
+
+const (
+    healthyScore = 0.7
+    downScore    = 0.4
+)
+
+// healthState maps a score onto a state
+func healthState(score float64) string {
+    switch {
+    case score >= healthyScore:
+        return HealthHealthy
+    case score >= downScore:
+        return HealthDegraded
+    default:
+        return HealthDown
+    }
+}
+
+// HealthTarget is what a check gets to look at
+type HealthTarget struct {
+    RouteID string
+    Route   *Route
+    Cells   []string
+    At      time.Time
+}
+
+// CheckResult is one check's verdict, scored 0 (broken) to 1 (fine)
+type CheckResult struct {
+    Check  string   `json:"check"`
+    Score  float64  `json:"score"`
+    Issues []string `json:"issues,omitempty"`
+}
+
+// HealthCheck is one aspect of route health
+type HealthCheck interface {
+    Name() string
+    Check(ctx context.Context, target HealthTarget) CheckResult
+}
+
+// HealthTransition is published when a route changes health state
+type HealthTransition struct {
+    RouteID string    `json:"route_id"`
+    From    string    `json:"from"`
+    To      string    `json:"to"`
+    Score   float64   `json:"health_score"`
+    Issues  []string  `json:"issues,omitempty"`
+    At      time.Time `json:"at"`
+}
+
+// TrafficCheck looks at congestion on the route's own cells
+type TrafficCheck struct {
+    rtm *RealTimeManager
+}
+
+func (c TrafficCheck) Name() string { return "traffic" }
+
+func (c TrafficCheck) Check(ctx context.Context, target HealthTarget) CheckResult {
+    result := CheckResult{Check: c.Name(), Score: 1}
+
+    c.rtm.mu.RLock()
+    var measured, heavy int
+    for _, cell := range target.Cells {
+        traffic, exists := c.rtm.trafficData[cell]
+        if !exists || target.At.Sub(traffic.LastUpdated) > trafficStaleAfter {
+            continue
+        }
+        measured++
+        if traffic.Congestion > heavyCongestion {
+            heavy++
+        }
+    }
+    c.rtm.mu.RUnlock()
+
+    if heavy > 0 {
+        result.Score = 1 - float64(heavy)/float64(measured)
+        result.Issues = append(result.Issues,
+            fmt.Sprintf("Heavy traffic on %d of %d measured cells", heavy, measured))
+    }
+    return result
+}
+
+// routeVehicles returns the recent fixes of the vehicles working a route
+func routeVehicles(rtm *RealTimeManager, routeID string) []VehicleFix {
+    var vehicles []VehicleFix
+    for _, fix := range rtm.probes.VehiclePositions(vehicleFixMaxAge) {
+        if fix.RouteID == routeID {
+            vehicles = append(vehicles, fix)
+        }
+    }
+    return vehicles
+}
+
+// scheduledHeadway is the time between vehicles the schedule calls for
+func scheduledHeadway(route Route, at time.Time) time.Duration {
+    return 2 * expectedWait(route, at)
+}
+
+// VehicleCountCheck compares the vehicles on a route with what its
+// schedule needs
+type VehicleCountCheck struct {
+    rtm *RealTimeManager
+}
+
+func (c VehicleCountCheck) Name() string { return "vehicle_count" }
+
+func (c VehicleCountCheck) Check(ctx context.Context, target HealthTarget) CheckResult {
+    result := CheckResult{Check: c.Name(), Score: 1}
+
+    route := *target.Route
+    lengthKm := calculateDistance(route.PickupLat, route.PickupLng, route.DestLat, route.DestLng) / 1000
+    roundTrip := 2*lengthKm/averageOperatingSpeedKmh*60 + terminalLayoverMinutes
+    required := int(math.Ceil(roundTrip / scheduledHeadway(route, target.At).Minutes()))
+    active := len(routeVehicles(c.rtm, target.RouteID))
+
+    if required > 0 && active < required {
+        result.Score = float64(active) / float64(required)
+        result.Issues = append(result.Issues,
+            fmt.Sprintf("%d of %d scheduled vehicles reporting", active, required))
+    }
+    return result
+}
+
+// HeadwayCheck looks for long gaps between consecutive vehicles
+type HeadwayCheck struct {
+    rtm *RealTimeManager
+}
+
+func (c HeadwayCheck) Name() string { return "headway" }
+
+func (c HeadwayCheck) Check(ctx context.Context, target HealthTarget) CheckResult {
+    result := CheckResult{Check: c.Name(), Score: 1}
+    if len(target.Cells) < 2 {
+        return result
+    }
+
+    position := make(map[string]int, len(target.Cells))
+    for i, cell := range target.Cells {
+        position[cell] = i
+    }
+
+    // Place each vehicle at its cell along the route; vehicles off the
+    // route are deadheading or lost and don't count
+    var stops []int
+    for _, fix := range routeVehicles(c.rtm, target.RouteID) {
+        cell := h3.LatLngToCell(h3.NewLatLng(fix.Lat, fix.Lng), probeResolution).String()
+        if i, on := position[cell]; on {
+            stops = append(stops, i)
+        }
+    }
+    if len(stops) == 0 {
+        return result
+    }
+    sort.Ints(stops)
+
+    // Vehicles run out and back, so the gap behind the last one wraps
+    // round to the first
+    last := len(target.Cells) - 1
+    maxGap := stops[0] + last - stops[len(stops)-1]
+    for i := 1; i < len(stops); i++ {
+        if gap := stops[i] - stops[i-1]; gap > maxGap {
+            maxGap = gap
+        }
+    }
+
+    route := *target.Route
+    lengthKm := calculateDistance(route.PickupLat, route.PickupLng, route.DestLat, route.DestLng) / 1000 * routeCircuity
+    gapMinutes := float64(maxGap) / float64(last) * lengthKm / averageOperatingSpeedKmh * 60
+    headway := scheduledHeadway(route, target.At).Minutes()
+
+    if allowed := headway * headwayGapTolerance; gapMinutes > allowed {
+        result.Score = allowed / gapMinutes
+        result.Issues = append(result.Issues,
+            fmt.Sprintf("Gap of %.0f minutes between vehicles against a %.0f minute headway", gapMinutes, headway))
+    }
+    return result
+}
+
+// IncidentCheck marks routes down by the incidents on them
+type IncidentCheck struct {
+    rtm *RealTimeManager
+}
+
+func (c IncidentCheck) Name() string { return "incidents" }
+
+var incidentHealthScores = map[string]float64{
+    SeverityLow:      0.9,
+    SeverityMedium:   0.7,
+    SeverityHigh:     0.4,
+    SeverityCritical: 0.1,
+}
+
+func (c IncidentCheck) Check(ctx context.Context, target HealthTarget) CheckResult {
+    result := CheckResult{Check: c.Name(), Score: 1}
+    for _, alert := range c.rtm.ServiceAlerts(target.RouteID) {
+        result.Score = math.Min(result.Score, incidentHealthScores[alert.Severity])
+        result.Issues = append(result.Issues, alert.Message)
+    }
+    return result
+}
+
+// HealthMonitor evaluates the health of every watched route on one
+// schedule, sharing a small pool of workers
+type HealthMonitor struct {
+    rtm       *RealTimeManager
+    checks    []HealthCheck
+    routes    map[string]string // route -> current state
+    history   map[string][]HealthMetrics
+    interval  time.Duration
+    now       func() time.Time
+    done      chan struct{}
+    closeOnce sync.Once
+    mu        sync.Mutex
+}
+
+// NewHealthMonitor creates a monitor running the given checks, or the
+// standard traffic, headway, vehicle count and incident checks if none
+func NewHealthMonitor(rtm *RealTimeManager, checks ...HealthCheck) *HealthMonitor {
+    if len(checks) == 0 {
+        checks = []HealthCheck{
+            TrafficCheck{rtm},
+            HeadwayCheck{rtm},
+            VehicleCountCheck{rtm},
+            IncidentCheck{rtm},
+        }
+    }
+    return &HealthMonitor{
+        rtm:      rtm,
+        checks:   checks,
+        routes:   make(map[string]string),
+        history:  make(map[string][]HealthMetrics),
+        interval: healthCheckInterval,
+        now:      time.Now,
+        done:     make(chan struct{}),
+    }
+}
+
+// AddCheck adds a check to every evaluation from now on
+func (hm *HealthMonitor) AddCheck(check HealthCheck) {
+    hm.mu.Lock()
+    defer hm.mu.Unlock()
+    hm.checks = append(hm.checks, check)
+}
+
+// Watch adds routes to the schedule
+func (hm *HealthMonitor) Watch(routeIDs ...string) {
+    hm.mu.Lock()
+    defer hm.mu.Unlock()
+    for _, routeID := range routeIDs {
+        if _, watched := hm.routes[routeID]; !watched {
+            hm.routes[routeID] = ""
+        }
+    }
+}
+
+// Unwatch removes routes from the schedule
+func (hm *HealthMonitor) Unwatch(routeIDs ...string) {
+    hm.mu.Lock()
+    defer hm.mu.Unlock()
+    for _, routeID := range routeIDs {
+        delete(hm.routes, routeID)
+    }
+}
+
+// run evaluates the watched routes every interval until closed
+func (hm *HealthMonitor) run() {
+    ticker := time.NewTicker(hm.interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-hm.done:
+            return
+        case <-ticker.C:
+            hm.EvaluateAll()
+        }
+    }
+}
+
+// EvaluateAll checks every watched route once
+func (hm *HealthMonitor) EvaluateAll() {
+    hm.mu.Lock()
+    routeIDs := make([]string, 0, len(hm.routes))
+    for routeID := range hm.routes {
+        routeIDs = append(routeIDs, routeID)
+    }
+    hm.mu.Unlock()
+
+    jobs := make(chan string)
+    var wg sync.WaitGroup
+    for i := 0; i < healthWorkers && i < len(routeIDs); i++ {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+            for routeID := range jobs {
+                ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+                if _, err := hm.Evaluate(ctx, routeID); err != nil {
+                    log.Printf("Checking health of route %s: %v", routeID, err)
+                }
+                cancel()
+            }
+        }()
+    }
+
+feed:
+    for _, routeID := range routeIDs {
+        select {
+        case jobs <- routeID:
+        case <-hm.done:
+            break feed
+        }
+    }
+    close(jobs)
+    wg.Wait()
+}
+
+// Evaluate runs every check against a route, records the result and
+// reports any change of state
+func (hm *HealthMonitor) Evaluate(ctx context.Context, routeID string) (HealthMetrics, error) {
+    route, err := hm.rtm.planner.getRoute(ctx, routeID)
+    if err != nil {
+        return HealthMetrics{}, err
+    }
+
+    target := HealthTarget{
+        RouteID: routeID,
+        Route:   route,
+        Cells:   routeCells(*route),
+        At:      hm.now(),
+    }
+
+    hm.mu.Lock()
+    checks := append([]HealthCheck(nil), hm.checks...)
+    hm.mu.Unlock()
+
+    health := HealthMetrics{
+        RouteID:     routeID,
+        Score:       1.0,
+        LastChecked: target.At,
+    }
+    for _, check := range checks {
+        result := check.Check(ctx, target)
+        result.Score = math.Max(0, math.Min(1, result.Score))
+        health.Score *= result.Score
+        health.Issues = append(health.Issues, result.Issues...)
+        health.Checks = append(health.Checks, result)
+    }
+    health.State = healthState(health.Score)
+
+    if err := saveHealth(ctx, hm.rtm, health); err != nil {
+        return health, err
+    }
+
+    hm.mu.Lock()
+    previous, watched := hm.routes[routeID]
+    if watched {
+        hm.routes[routeID] = health.State
+    } else if earlier := hm.history[routeID]; len(earlier) > 0 {
+        previous = earlier[len(earlier)-1].State
+    }
+    history := append(hm.history[routeID], health)
+    if len(history) > healthHistoryLimit {
+        history = history[len(history)-healthHistoryLimit:]
+    }
+    hm.history[routeID] = history
+    hm.mu.Unlock()
+
+    // The first evaluation of a route only counts as a transition if it
+    // isn't healthy
+    if previous == "" {
+        previous = HealthHealthy
+    }
+    if previous != health.State {
+        hm.rtm.Publish(RouteUpdate{
+            RouteID:    routeID,
+            UpdateType: TopicHealthState,
+            Transition: &HealthTransition{
+                RouteID: routeID,
+                From:    previous,
+                To:      health.State,
+                Score:   health.Score,
+                Issues:  health.Issues,
+                At:      health.LastChecked,
+            },
+            Timestamp: health.LastChecked,
+        })
+
+        // Reacting to a route going bad is done once, not every check
+        // while it stays bad
+        if health.State != HealthHealthy {
+            hm.rtm.handleUnhealthyRoute(ctx, routeID, health)
+        }
+    }
+
+    hm.rtm.alerts.Observe(ctx, health)
+    return health, nil
+}
+
+// Current returns the most recent health of a route
+func (hm *HealthMonitor) Current(routeID string) (HealthMetrics, bool) {
+    hm.mu.Lock()
+    defer hm.mu.Unlock()
+
+    history := hm.history[routeID]
+    if len(history) == 0 {
+        return HealthMetrics{}, false
+    }
+    return history[len(history)-1], true
+}
+
+// Close stops the schedule
+func (hm *HealthMonitor) Close() {
+    hm.closeOnce.Do(func() { close(hm.done) })
+}
+
+// healthNode is how a health check is stored in Dgraph
+type healthNode struct {
+    DType   []string  `json:"dgraph.type,omitempty"`
+    Route   *routeRef `json:"health_route,omitempty"`
+    Score   float64   `json:"health_score"`
+    State   string    `json:"health_state"`
+    Issues  []string  `json:"health_issues,omitempty"`
+    Checks  string    `json:"health_checks,omitempty"`
+    Checked time.Time `json:"checked_at"`
+}
+
+func saveHealth(ctx context.Context, rtm *RealTimeManager, health HealthMetrics) error {
+    checks, err := json.Marshal(health.Checks)
+    if err != nil {
+        return err
+    }
+
+    setJSON, err := json.Marshal(healthNode{
+        DType:   []string{"RouteHealth"},
+        Route:   &routeRef{Uid: health.RouteID},
+        Score:   health.Score,
+        State:   health.State,
+        Issues:  health.Issues,
+        Checks:  string(checks),
+        Checked: health.LastChecked,
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = rtm.dgraph.NewTxn().Mutate(ctx, &api.Mutation{
+        SetJson:   setJSON,
+        CommitNow: true,
+    })
+    return err
+}
+
+// HealthHistory returns a route's stored health checks since a time,
+// oldest first
+func (rtm *RealTimeManager) HealthHistory(ctx context.Context, routeID string, since time.Time) ([]HealthMetrics, error) {
+    resp, err := rtm.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query Health($route: string, $since: string) {
+            route(func: uid($route)) {
+                ~health_route(orderasc: checked_at) @filter(ge(checked_at, $since)) {
+                    health_score
+                    health_state
+                    health_issues
+                    health_checks
+                    checked_at
+                }
+            }
+        }`, map[string]string{
+        "$route": routeID,
+        "$since": since.Format(time.RFC3339),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Route []struct {
+            Checks []healthNode `json:"~health_route"`
+        } `json:"route"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Route) == 0 {
+        return nil, nil
+    }
+
+    history := make([]HealthMetrics, 0, len(result.Route[0].Checks))
+    for _, node := range result.Route[0].Checks {
+        health := HealthMetrics{
+            RouteID:     routeID,
+            Score:       node.Score,
+            State:       node.State,
+            Issues:      node.Issues,
+            LastChecked: node.Checked,
+        }
+        if node.Checks != "" {
+            if err := json.Unmarshal([]byte(node.Checks), &health.Checks); err != nil {
+                return nil, fmt.Errorf("decoding health of route %s: %w", routeID, err)
+            }
+        }
+        history = append(history, health)
+    }
+    return history, nil
+}
+
+// MonitorRouteHealth adds routes to the health schedule until ctx is done
+func (rtm *RealTimeManager) MonitorRouteHealth(ctx context.Context, routeIDs ...string) {
+    rtm.health.Watch(routeIDs...)
+    go func() {
+        <-ctx.Done()
+        rtm.health.Unwatch(routeIDs...)
+    }()
+}
+
+// MonitorAllRoutes adds every stored route to the health schedule
+func (rtm *RealTimeManager) MonitorAllRoutes(ctx context.Context) error {
+    routeIDs, err := rtm.planner.GetAllRouteIDs(ctx)
+    if err != nil {
+        return err
+    }
+    rtm.health.Watch(routeIDs...)
+    return nil
+}
+
+// RouteHealth returns the most recent health of a route, checking it now
+// if it hasn't been yet
+func (rtm *RealTimeManager) RouteHealth(ctx context.Context, routeID string) (HealthMetrics, error) {
+    if health, ok := rtm.health.Current(routeID); ok {
+        return health, nil
+    }
+    return rtm.health.Evaluate(ctx, routeID)
+}
+
+// Alerts returns the manager that turns route health into notifications
+func (rtm *RealTimeManager) Alerts() *AlertManager {
+    return rtm.alerts
+}
+
+// describeHealth summarises a route's health for logs
+func describeHealth(health HealthMetrics) string {
+    if len(health.Issues) == 0 {
+        return fmt.Sprintf("%s (%.2f)", health.State, health.Score)
+    }
+    return fmt.Sprintf("%s (%.2f): %s", health.State, health.Score, strings.Join(health.Issues, "; "))
+}
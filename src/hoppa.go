@@ -1,3 +1,5 @@
+//go:build ignore
+
 package main
 
 func createDoc(stub shim.ChaincodeStubInterface, args string) pb.Response {
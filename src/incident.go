@@ -0,0 +1,761 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+    "github.com/dgraph-io/dgo/v210/protos/api"
+    "github.com/uber/h3-go/v4"
+)
+
+const (
+    incidentResolution    = 9
+    incidentSweepInterval = time.Minute
+    incidentTimeout       = 30 * time.Second
+)
+
+var ErrIncidentNotFound = errors.New("incident not found")
+
+// Kinds of incident
+const (
+    IncidentAccident  = "accident"
+    IncidentBreakdown = "breakdown"
+    IncidentRoadworks = "roadworks"
+    IncidentFlooding  = "flooding"
+    IncidentProtest   = "protest"
+    IncidentClosure   = "road_closure"
+)
+
+var validIncidentTypes = []string{
+    IncidentAccident,
+    IncidentBreakdown,
+    IncidentRoadworks,
+    IncidentFlooding,
+    IncidentProtest,
+    IncidentClosure,
+}
+
+// Incident severities, least to most severe
+const (
+    SeverityLow      = "low"
+    SeverityMedium   = "medium"
+    SeverityHigh     = "high"
+    SeverityCritical = "critical"
+)
+
+// severityImpact is how far an incident of a severity reaches, in rings of
+// cells around its location, and how long it lasts unless told otherwise
+var severityImpact = map[string]struct {
+    rings    int
+    lifetime time.Duration
+}{
+    SeverityLow:      {0, 30 * time.Minute},
+    SeverityMedium:   {1, time.Hour},
+    SeverityHigh:     {2, 2 * time.Hour},
+    SeverityCritical: {3, 4 * time.Hour},
+}
+
+// Incident lifecycle states
+const (
+    IncidentActive   = "active"
+    IncidentResolved = "resolved"
+    IncidentExpired  = "expired"
+)
+
+// Incident is something on the road that disrupts service
+type Incident struct {
+    ID             string     `json:"id"`
+    Type           string     `json:"type"`
+    Description    string     `json:"description,omitempty"`
+    Location       Location   `json:"location"`
+    Severity       string     `json:"severity"`
+    AffectedCells  []string   `json:"affected_cells,omitempty"`
+    AffectedRoutes []string   `json:"affected_routes,omitempty"`
+    Status         string     `json:"status"`
+    ReportedAt     time.Time  `json:"reported_at"`
+    ExpiresAt      time.Time  `json:"expires_at"`
+    ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+}
+
+// IncidentEvent is one entry in an incident's audit history
+type IncidentEvent struct {
+    Action string    `json:"action"`
+    Status string    `json:"status"`
+    Note   string    `json:"note,omitempty"`
+    At     time.Time `json:"at"`
+}
+
+// ServiceAlert tells riders of a route about an incident affecting it
+type ServiceAlert struct {
+    ID         string     `json:"id"`
+    IncidentID string     `json:"incident_id"`
+    RouteID    string     `json:"route_id"`
+    Severity   string     `json:"severity"`
+    Message    string     `json:"message"`
+    IssuedAt   time.Time  `json:"issued_at"`
+    ClearedAt  *time.Time `json:"cleared_at,omitempty"`
+}
+
+// IncidentManager tracks active incidents, the routes they degrade and the
+// alerts raised for them
+type IncidentManager struct {
+    rtm       *RealTimeManager
+    incidents map[string]*Incident
+    alerts    map[string]map[string]*ServiceAlert // route -> incident -> alert
+    now       func() time.Time
+    done      chan struct{}
+    closeOnce sync.Once
+    mu        sync.RWMutex
+}
+
+func NewIncidentManager(rtm *RealTimeManager) *IncidentManager {
+    return &IncidentManager{
+        rtm:       rtm,
+        incidents: make(map[string]*Incident),
+        alerts:    make(map[string]map[string]*ServiceAlert),
+        now:       time.Now,
+        done:      make(chan struct{}),
+    }
+}
+
+// validateIncident fills in defaults and checks the incident makes sense
+func (im *IncidentManager) validateIncident(incident *Incident) error {
+    known := false
+    for _, t := range validIncidentTypes {
+        if incident.Type == t {
+            known = true
+            break
+        }
+    }
+    if !known {
+        return fmt.Errorf("%w: unknown incident type %q (valid types: %s)",
+            ErrInvalidRequest, incident.Type, strings.Join(validIncidentTypes, ", "))
+    }
+
+    if incident.Severity == "" {
+        incident.Severity = SeverityMedium
+    }
+    impact, ok := severityImpact[incident.Severity]
+    if !ok {
+        return fmt.Errorf("%w: unknown incident severity %q", ErrInvalidRequest, incident.Severity)
+    }
+
+    loc := incident.Location
+    if loc.Lat < -90 || loc.Lat > 90 || loc.Lng < -180 || loc.Lng > 180 {
+        return fmt.Errorf("%w: incident has invalid location %f,%f", ErrInvalidRequest, loc.Lat, loc.Lng)
+    }
+    if len(incident.AffectedCells) == 0 && loc.Lat == 0 && loc.Lng == 0 {
+        return fmt.Errorf("%w: incident needs a location or affected cells", ErrInvalidRequest)
+    }
+
+    if incident.ID == "" {
+        incident.ID = generateUUID()
+    }
+    if incident.ReportedAt.IsZero() {
+        incident.ReportedAt = im.now()
+    }
+    if incident.ExpiresAt.IsZero() {
+        incident.ExpiresAt = incident.ReportedAt.Add(impact.lifetime)
+    }
+
+    if len(incident.AffectedCells) == 0 {
+        center := h3.LatLngToCell(h3.NewLatLng(loc.Lat, loc.Lng), incidentResolution)
+        for _, cell := range h3.GridDisk(center, impact.rings) {
+            incident.AffectedCells = append(incident.AffectedCells, cell.String())
+        }
+    }
+    for _, cell := range incident.AffectedCells {
+        if !h3.Cell(h3.IndexFromString(cell)).IsValid() {
+            return fmt.Errorf("%w: incident has invalid cell %q", ErrInvalidRequest, cell)
+        }
+    }
+    return nil
+}
+
+// Report records a new incident, or updates an active one reported under
+// the same ID, and alerts the routes running through it
+func (im *IncidentManager) Report(ctx context.Context, incident Incident) (*Incident, error) {
+    return im.report(ctx, incident, im.rtm.Publish)
+}
+
+// report is Report publishing the alerts with publish, so the processor
+// can hand them to its relay rather than wait on the bus it reads from
+func (im *IncidentManager) report(ctx context.Context, incident Incident, publish func(RouteUpdate) error) (*Incident, error) {
+    if err := im.validateIncident(&incident); err != nil {
+        return nil, err
+    }
+
+    im.mu.RLock()
+    existing, exists := im.incidents[incident.ID]
+    im.mu.RUnlock()
+
+    action := "reported"
+    if exists {
+        action = "updated"
+        incident.ReportedAt = existing.ReportedAt
+    }
+
+    if im.rtm.planner != nil {
+        routes, err := im.rtm.planner.routesThroughCells(ctx, incident.AffectedCells)
+        if err != nil {
+            return nil, err
+        }
+        incident.AffectedRoutes = mergeIDs(incident.AffectedRoutes, routes)
+    }
+    incident.Status = IncidentActive
+    incident.ResolvedAt = nil
+
+    note := fmt.Sprintf("%s severity, %d cells, alerting %d routes",
+        incident.Severity, len(incident.AffectedCells), len(incident.AffectedRoutes))
+    if err := saveIncident(ctx, im.rtm.dgraph, &incident, action, note); err != nil {
+        return nil, err
+    }
+
+    im.mu.Lock()
+    im.incidents[incident.ID] = &incident
+    cleared := im.clearAlerts(incident.ID)
+    raised := im.raiseAlerts(&incident)
+    im.mu.Unlock()
+
+    im.publishAlerts(cleared, publish)
+    im.publishAlerts(raised, publish)
+    return &incident, nil
+}
+
+// Resolve closes an incident that has cleared
+func (im *IncidentManager) Resolve(ctx context.Context, incidentID, note string) error {
+    im.mu.RLock()
+    incident, exists := im.incidents[incidentID]
+    im.mu.RUnlock()
+    if !exists {
+        return fmt.Errorf("%w: no active incident %s", ErrIncidentNotFound, incidentID)
+    }
+    return im.close(ctx, incident, IncidentResolved, note)
+}
+
+// ExpireIncidents closes every incident past its expiry
+func (im *IncidentManager) ExpireIncidents(ctx context.Context) error {
+    now := im.now()
+
+    im.mu.RLock()
+    var expired []*Incident
+    for _, incident := range im.incidents {
+        if !incident.ExpiresAt.After(now) {
+            expired = append(expired, incident)
+        }
+    }
+    im.mu.RUnlock()
+
+    for _, incident := range expired {
+        if err := im.close(ctx, incident, IncidentExpired, "expired at "+incident.ExpiresAt.Format(time.RFC3339)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// close moves an incident out of the active set and clears its alerts
+func (im *IncidentManager) close(ctx context.Context, incident *Incident, status, note string) error {
+    closed := *incident
+    closedAt := im.now()
+    closed.Status = status
+    closed.ResolvedAt = &closedAt
+
+    if err := saveIncident(ctx, im.rtm.dgraph, &closed, status, note); err != nil {
+        return err
+    }
+
+    im.mu.Lock()
+    delete(im.incidents, closed.ID)
+    cleared := im.clearAlerts(closed.ID)
+    im.mu.Unlock()
+
+    im.publishAlerts(cleared, im.rtm.Publish)
+    return nil
+}
+
+// raiseAlerts issues an alert on every route an incident affects. Callers
+// must hold im.mu.
+func (im *IncidentManager) raiseAlerts(incident *Incident) []ServiceAlert {
+    kind := strings.ReplaceAll(incident.Type, "_", " ")
+    message := fmt.Sprintf("%s%s reported (%s severity): expect delays until %s",
+        strings.ToUpper(kind[:1]), kind[1:],
+        incident.Severity,
+        incident.ExpiresAt.Local().Format("15:04"))
+    if incident.Description != "" {
+        message += ". " + incident.Description
+    }
+
+    var raised []ServiceAlert
+    for _, routeID := range incident.AffectedRoutes {
+        alerts, exists := im.alerts[routeID]
+        if !exists {
+            alerts = make(map[string]*ServiceAlert)
+            im.alerts[routeID] = alerts
+        }
+        alert := &ServiceAlert{
+            ID:         generateUUID(),
+            IncidentID: incident.ID,
+            RouteID:    routeID,
+            Severity:   incident.Severity,
+            Message:    message,
+            IssuedAt:   im.now(),
+        }
+        alerts[incident.ID] = alert
+        raised = append(raised, *alert)
+    }
+    return raised
+}
+
+// clearAlerts withdraws the alerts raised for an incident. Callers must
+// hold im.mu.
+func (im *IncidentManager) clearAlerts(incidentID string) []ServiceAlert {
+    var cleared []ServiceAlert
+    clearedAt := im.now()
+    for routeID, alerts := range im.alerts {
+        if alert, exists := alerts[incidentID]; exists {
+            withdrawn := *alert
+            withdrawn.ClearedAt = &clearedAt
+            cleared = append(cleared, withdrawn)
+            delete(alerts, incidentID)
+        }
+        if len(alerts) == 0 {
+            delete(im.alerts, routeID)
+        }
+    }
+    return cleared
+}
+
+// publishAlerts tells subscribers about alerts raised or cleared. It must
+// be called without holding im.mu.
+func (im *IncidentManager) publishAlerts(alerts []ServiceAlert, publish func(RouteUpdate) error) {
+    for i := range alerts {
+        at := alerts[i].IssuedAt
+        if alerts[i].ClearedAt != nil {
+            at = *alerts[i].ClearedAt
+        }
+        if err := publish(RouteUpdate{
+            RouteID:    alerts[i].RouteID,
+            UpdateType: TopicAlert,
+            Alert:      &alerts[i],
+            Timestamp:  at,
+        }); err != nil && !errors.Is(err, ErrBusClosed) {
+            log.Printf("Publishing alert for route %s: %v", alerts[i].RouteID, err)
+        }
+    }
+}
+
+// Get returns an active incident
+func (im *IncidentManager) Get(incidentID string) (*Incident, bool) {
+    im.mu.RLock()
+    defer im.mu.RUnlock()
+
+    incident, exists := im.incidents[incidentID]
+    if !exists {
+        return nil, false
+    }
+    copied := *incident
+    return &copied, true
+}
+
+// Active lists the active incidents, most recent first
+func (im *IncidentManager) Active() []Incident {
+    im.mu.RLock()
+    defer im.mu.RUnlock()
+
+    incidents := make([]Incident, 0, len(im.incidents))
+    for _, incident := range im.incidents {
+        incidents = append(incidents, *incident)
+    }
+    sort.Slice(incidents, func(i, j int) bool {
+        return incidents[i].ReportedAt.After(incidents[j].ReportedAt)
+    })
+    return incidents
+}
+
+// Alerts returns the alerts in force on a route, most severe first
+func (im *IncidentManager) Alerts(routeID string) []ServiceAlert {
+    im.mu.RLock()
+    defer im.mu.RUnlock()
+
+    var alerts []ServiceAlert
+    for _, alert := range im.alerts[routeID] {
+        alerts = append(alerts, *alert)
+    }
+    sort.Slice(alerts, func(i, j int) bool {
+        a, b := severityImpact[alerts[i].Severity].rings, severityImpact[alerts[j].Severity].rings
+        if a != b {
+            return a > b
+        }
+        return alerts[i].IssuedAt.After(alerts[j].IssuedAt)
+    })
+    return alerts
+}
+
+// IsDegraded reports whether any active incident affects a route
+func (im *IncidentManager) IsDegraded(routeID string) bool {
+    im.mu.RLock()
+    defer im.mu.RUnlock()
+    return len(im.alerts[routeID]) > 0
+}
+
+// Restore reloads the incidents still active in Dgraph, e.g. after a restart
+func (im *IncidentManager) Restore(ctx context.Context) error {
+    incidents, err := loadActiveIncidents(ctx, im.rtm.dgraph)
+    if err != nil {
+        return err
+    }
+
+    var raised []ServiceAlert
+    im.mu.Lock()
+    for _, incident := range incidents {
+        im.incidents[incident.ID] = incident
+        im.clearAlerts(incident.ID)
+        raised = append(raised, im.raiseAlerts(incident)...)
+    }
+    im.mu.Unlock()
+
+    im.publishAlerts(raised, im.rtm.Publish)
+    return im.ExpireIncidents(ctx)
+}
+
+// run expires incidents until the manager is closed
+func (im *IncidentManager) run() {
+    ticker := time.NewTicker(incidentSweepInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-im.done:
+            return
+        case <-ticker.C:
+            ctx, cancel := context.WithTimeout(context.Background(), incidentTimeout)
+            if err := im.ExpireIncidents(ctx); err != nil {
+                log.Printf("Expiring incidents: %v", err)
+            }
+            cancel()
+        }
+    }
+}
+
+// Close stops the expiry loop
+func (im *IncidentManager) Close() {
+    im.closeOnce.Do(func() { close(im.done) })
+}
+
+// handleIncidentUpdate reports an incident pushed onto the update channel
+func (rtm *RealTimeManager) handleIncidentUpdate(update RouteUpdate) {
+    incident := *update.Incident
+    if update.RouteID != "" {
+        incident.AffectedRoutes = mergeIDs(incident.AffectedRoutes, []string{update.RouteID})
+    }
+    if incident.ReportedAt.IsZero() {
+        incident.ReportedAt = update.Timestamp
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), incidentTimeout)
+    defer cancel()
+    if _, err := rtm.incidents.report(ctx, incident, rtm.relay.Publish); err != nil {
+        log.Printf("Reporting %s incident: %v", incident.Type, err)
+    }
+}
+
+// ReportIncident records an incident and alerts the routes it affects
+func (rtm *RealTimeManager) ReportIncident(ctx context.Context, incident Incident) (*Incident, error) {
+    return rtm.incidents.Report(ctx, incident)
+}
+
+// ResolveIncident closes an incident that has cleared
+func (rtm *RealTimeManager) ResolveIncident(ctx context.Context, incidentID, note string) error {
+    return rtm.incidents.Resolve(ctx, incidentID, note)
+}
+
+// RestoreIncidents reloads the incidents still active in Dgraph and raises
+// their alerts again, e.g. after a restart
+func (rtm *RealTimeManager) RestoreIncidents(ctx context.Context) error {
+    return rtm.incidents.Restore(ctx)
+}
+
+// ActiveIncidents lists the active incidents, most recent first
+func (rtm *RealTimeManager) ActiveIncidents() []Incident {
+    return rtm.incidents.Active()
+}
+
+// IsDegraded reports whether a route is running through an active incident
+func (rtm *RealTimeManager) IsDegraded(routeID string) bool {
+    return rtm.incidents.IsDegraded(routeID)
+}
+
+// ServiceAlerts returns the alerts in force on a route
+func (rtm *RealTimeManager) ServiceAlerts(routeID string) []ServiceAlert {
+    return rtm.incidents.Alerts(routeID)
+}
+
+// mergeIDs appends the IDs in extra not already in ids
+func mergeIDs(ids, extra []string) []string {
+    seen := make(map[string]bool, len(ids))
+    for _, id := range ids {
+        seen[id] = true
+    }
+    for _, id := range extra {
+        if !seen[id] {
+            seen[id] = true
+            ids = append(ids, id)
+        }
+    }
+    return ids
+}
+
+// routesThroughCells returns the routes whose path crosses any of the cells.
+// Cells may be at any resolution; route paths are compared at the
+// resolution they are traced at.
+func (rp *RoutePlanner) routesThroughCells(ctx context.Context, cells []string) ([]string, error) {
+    targets := make(map[h3.Cell]bool)
+    resolutions := make(map[int]bool)
+    for _, index := range cells {
+        cell := h3.Cell(h3.IndexFromString(index))
+        if !cell.IsValid() {
+            continue
+        }
+        if cell.Resolution() > incidentResolution {
+            cell = cell.Parent(incidentResolution)
+        }
+        targets[cell] = true
+        resolutions[cell.Resolution()] = true
+    }
+    if len(targets) == 0 {
+        return nil, nil
+    }
+
+    routes, err := rp.listRoutes(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    var affected []string
+    for _, route := range routes {
+        if routeCrosses(route, targets, resolutions) {
+            affected = append(affected, route.Uid)
+        }
+    }
+    return affected, nil
+}
+
+// routeCrosses reports whether any cell of a route's path lies in or under
+// one of the target cells
+func routeCrosses(route Route, targets map[h3.Cell]bool, resolutions map[int]bool) bool {
+    for _, index := range routeCells(route) {
+        cell := h3.Cell(h3.IndexFromString(index))
+        if !cell.IsValid() {
+            continue
+        }
+        for res := range resolutions {
+            if res > cell.Resolution() {
+                continue
+            }
+            if targets[cell.Parent(res)] {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// incidentNode is how an Incident is stored in Dgraph
+type incidentNode struct {
+    Uid         string              `json:"uid,omitempty"`
+    DType       []string            `json:"dgraph.type,omitempty"`
+    IncidentID  string              `json:"incident_id,omitempty"`
+    Type        string              `json:"incident_type,omitempty"`
+    Description string              `json:"incident_description,omitempty"`
+    Severity    string              `json:"incident_severity,omitempty"`
+    Lat         float64             `json:"incident_lat"`
+    Lng         float64             `json:"incident_lng"`
+    Cells       []string            `json:"incident_cells,omitempty"`
+    Routes      []routeRef          `json:"incident_routes,omitempty"`
+    Status      string              `json:"incident_status,omitempty"`
+    Reported    time.Time           `json:"reported_at"`
+    Expires     time.Time           `json:"expires_at"`
+    Resolved    *time.Time          `json:"resolved_at,omitempty"`
+    History     []incidentEventNode `json:"incident_history,omitempty"`
+}
+
+type incidentEventNode struct {
+    DType   []string  `json:"dgraph.type,omitempty"`
+    Action  string    `json:"event_action"`
+    Status  string    `json:"incident_status"`
+    Note    string    `json:"event_note,omitempty"`
+    Created time.Time `json:"created_at"`
+}
+
+const incidentFields = `
+    incident_id
+    incident_type
+    incident_description
+    incident_severity
+    incident_lat
+    incident_lng
+    incident_cells
+    incident_routes { uid }
+    incident_status
+    reported_at
+    expires_at
+    resolved_at`
+
+func (n incidentNode) toIncident() *Incident {
+    return &Incident{
+        ID:             n.IncidentID,
+        Type:           n.Type,
+        Description:    n.Description,
+        Location:       Location{Lat: n.Lat, Lng: n.Lng},
+        Severity:       n.Severity,
+        AffectedCells:  n.Cells,
+        AffectedRoutes: fromRouteRefs(n.Routes),
+        Status:         n.Status,
+        ReportedAt:     n.Reported,
+        ExpiresAt:      n.Expires,
+        ResolvedAt:     n.Resolved,
+    }
+}
+
+// saveIncident stores an incident's current state and appends an entry to
+// its audit history
+func saveIncident(ctx context.Context, dgraphClient *dgo.Dgraph, incident *Incident, action, note string) error {
+    txn := dgraphClient.NewTxn()
+    defer txn.Discard(ctx)
+
+    resp, err := txn.QueryWithVars(ctx, `
+        query Current($id: string) {
+            incidents(func: eq(incident_id, $id)) @filter(type(Incident)) {
+                uid
+            }
+        }`, map[string]string{"$id": incident.ID})
+    if err != nil {
+        return err
+    }
+
+    var current struct {
+        Incidents []incidentNode `json:"incidents"`
+    }
+    if err := json.Unmarshal(resp.Json, &current); err != nil {
+        return err
+    }
+
+    uid := "_:incident"
+    if len(current.Incidents) > 0 {
+        uid = current.Incidents[0].Uid
+
+        // List predicates are replaced rather than appended to
+        del := &api.Mutation{}
+        dgo.DeleteEdges(del, uid, "incident_cells", "incident_routes")
+        if _, err := txn.Mutate(ctx, del); err != nil {
+            return err
+        }
+    }
+
+    node := incidentNode{
+        Uid:         uid,
+        DType:       []string{"Incident"},
+        IncidentID:  incident.ID,
+        Type:        incident.Type,
+        Description: incident.Description,
+        Severity:    incident.Severity,
+        Lat:         incident.Location.Lat,
+        Lng:         incident.Location.Lng,
+        Cells:       incident.AffectedCells,
+        Routes:      toRouteRefs(incident.AffectedRoutes),
+        Status:      incident.Status,
+        Reported:    incident.ReportedAt,
+        Expires:     incident.ExpiresAt,
+        Resolved:    incident.ResolvedAt,
+        History: []incidentEventNode{{
+            DType:   []string{"IncidentEvent"},
+            Action:  action,
+            Status:  incident.Status,
+            Note:    note,
+            Created: time.Now(),
+        }},
+    }
+
+    setJSON, err := json.Marshal(node)
+    if err != nil {
+        return err
+    }
+    if _, err := txn.Mutate(ctx, &api.Mutation{SetJson: setJSON}); err != nil {
+        return err
+    }
+    return txn.Commit(ctx)
+}
+
+// loadActiveIncidents reads every incident still marked active
+func loadActiveIncidents(ctx context.Context, dgraphClient *dgo.Dgraph) ([]*Incident, error) {
+    resp, err := dgraphClient.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query Active($status: string) {
+            incidents(func: eq(incident_status, $status)) @filter(type(Incident)) {`+incidentFields+`
+            }
+        }`, map[string]string{"$status": IncidentActive})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Incidents []incidentNode `json:"incidents"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+
+    incidents := make([]*Incident, 0, len(result.Incidents))
+    for _, node := range result.Incidents {
+        incidents = append(incidents, node.toIncident())
+    }
+    return incidents, nil
+}
+
+// IncidentHistory returns the audit history of an incident, oldest first
+func (rtm *RealTimeManager) IncidentHistory(ctx context.Context, incidentID string) (*Incident, []IncidentEvent, error) {
+    resp, err := rtm.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query History($id: string) {
+            incidents(func: eq(incident_id, $id)) @filter(type(Incident)) {`+incidentFields+`
+                incident_history(orderasc: created_at) {
+                    event_action
+                    incident_status
+                    event_note
+                    created_at
+                }
+            }
+        }`, map[string]string{"$id": incidentID})
+    if err != nil {
+        return nil, nil, err
+    }
+
+    var result struct {
+        Incidents []incidentNode `json:"incidents"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, nil, err
+    }
+    if len(result.Incidents) == 0 {
+        return nil, nil, fmt.Errorf("%w: %s", ErrIncidentNotFound, incidentID)
+    }
+
+    node := result.Incidents[0]
+    var history []IncidentEvent
+    for _, event := range node.History {
+        history = append(history, IncidentEvent{
+            Action: event.Action,
+            Status: event.Status,
+            Note:   event.Note,
+            At:     event.Created,
+        })
+    }
+    return node.toIncident(), history, nil
+}
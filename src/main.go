@@ -0,0 +1,30 @@
+package main
+
+import (
+    "flag"
+    "os"
+)
+
+// main serves the REST API, or sign in for riders, crew and SACCO admins
+// when the first argument is "login":
+//
+//	go run ./src [-addr host:port]
+//	go run ./src login [-addr host:port] [-mock-idp]
+//
+// Both reach Dgraph through the DGRAPH_* settings (see dgraph.LoadConfig)
+// and verify tokens with the AUTH_* settings (see auth.LoadConfig). The API
+// journals real-time updates to EVENT_LOG_DIR, if set, and replays them on
+// start. It alerts on unhealthy routes through the ALERT_* settings (see
+// LoadAlertConfig).
+func main() {
+    args := os.Args[1:]
+    if len(args) > 0 && args[0] == "login" {
+        loginServer(args[1:])
+        return
+    }
+
+    flags := flag.NewFlagSet("api", flag.ExitOnError)
+    addr := flags.String("addr", os.Getenv("LISTEN_ADDR"), "address to listen on (LISTEN_ADDR, default :8080)")
+    flags.Parse(args)
+    serveAPI(*addr)
+}
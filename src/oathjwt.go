@@ -1,101 +1,296 @@
 package main
 
 import (
+    "context"
     "encoding/json"
+    "flag"
     "fmt"
     "log"
+    "net"
     "net/http"
-    "github.com/dghubble/oauth1"
-    "github.com/golang-jwt/jwt"
-)
+    "os"
+    "os/signal"
+    "strings"
+    "syscall"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+    "github.com/dgraph-io/dgo/v210/protos/api"
 
-const (
-    requestTokenURL = "https://<OAuth-provider-URL>/request_token"
-    accessTokenURL  = "https://<OAuth-provider-URL>/access_token"
-    callbackURL     = "<callback-URL>"
-    consumerKey     = "<consumer-key>"
-    consumerSecret  = "<consumer-secret>"
-    jwtSecret       = "<jwt-secret>"
+    "motown/auth"
+    "motown/dgraph"
 )
 
-type AccessTokenResponse struct {
-    AccessToken       string `json:"access_token"`
-    AccessTokenSecret string `json:"access_token_secret"`
+const maxLinkedName = 100 // as for people added from the CLI
+
+// personLinker links external logins to Person nodes, by the identities
+// predicate in the person schema (apply it with `motown schema`). A login
+// seen for the first time becomes a new rider, or joins the person whose
+// phone number the provider has verified. Crew and SACCO admins sign in
+// scoped to the vehicle or SACCO stored with them.
+type personLinker struct {
+    dgraph *dgraph.Client
 }
 
-func main() {
-    // Create OAuth1.0a configuration
-    config := oauth1.Config{
-        ConsumerKey:    consumerKey,
-        ConsumerSecret: consumerSecret,
-        CallbackURL:    callbackURL,
-        Endpoint: oauth1.Endpoint{
-            RequestTokenURL: requestTokenURL,
-            AccessTokenURL:  accessTokenURL,
-        },
-    }
-
-    // Create HTTP client for OAuth requests
-    httpClient := config.Client(oauth1.NoContext, &oauth1.Token{
-        Token:  "<request-token>",
-        Secret: "<request-token-secret>",
-    })
+type linkedPerson struct {
+    Uid        string     `json:"uid,omitempty"`
+    DType      []string   `json:"dgraph.type,omitempty"`
+    Name       string     `json:"name,omitempty"`
+    Phone      string     `json:"phone,omitempty"`
+    Role       string     `json:"role,omitempty"`
+    Sacco      string     `json:"sacco,omitempty"`
+    Vehicle    string     `json:"crew_vehicle,omitempty"`
+    Identities []string   `json:"identities,omitempty"`
+    CreatedAt  *time.Time `json:"created_at,omitempty"`
+    UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+}
 
-    // Handler for the main endpoint
-    http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-        // Verify JWT from Authorization header
-        tokenString := r.Header.Get("Authorization")
-        if tokenString == "" {
-            http.Error(w, "Missing authorization header", http.StatusUnauthorized)
-            return
+func (pl *personLinker) Link(ctx context.Context, external *auth.ExternalIdentity) (auth.Identity, error) {
+    key := external.Key()
+    var person *linkedPerson
+    err := pl.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        var err error
+        person, err = findPerson(ctx, txn, "identities", key)
+        if err != nil || person != nil {
+            return err
         }
 
-        token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-            if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-                return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+        // Riders who first signed up by phone keep their account when the
+        // provider vouches for the same number
+        phone := ""
+        if external.PhoneVerified {
+            phone, _ = auth.NormalizePhone(external.Phone)
+        }
+        if phone != "" {
+            if person, err = findPerson(ctx, txn, "phone", phone); err != nil {
+                return err
             }
-            return []byte(jwtSecret), nil
-        })
+        }
 
-        if err != nil {
-            http.Error(w, "Invalid token", http.StatusUnauthorized)
-            return
+        now := time.Now()
+        if person != nil {
+            if person.Role == auth.RoleAdmin {
+                return nil // refused below, without linking
+            }
+            return mutateJSON(ctx, txn, linkedPerson{Uid: person.Uid, Identities: []string{key}, UpdatedAt: &now})
         }
 
-        if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-            json.NewEncoder(w).Encode(claims)
-        } else {
-            http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+        person = &linkedPerson{
+            Uid:        "_:person",
+            DType:      []string{"Person"},
+            Name:       linkedName(external),
+            Phone:      phone,
+            Role:       auth.RoleRider,
+            Identities: []string{key},
+            CreatedAt:  &now,
+            UpdatedAt:  &now,
+        }
+        setJSON, err := json.Marshal(person)
+        if err != nil {
+            return err
         }
+        resp, err := txn.Mutate(ctx, &api.Mutation{SetJson: setJSON})
+        if err != nil {
+            return err
+        }
+        person.Uid = resp.Uids["person"]
+        return nil
     })
+    if err != nil {
+        return auth.Identity{}, err
+    }
+
+    // Platform admins act on everything, so they sign in with tokens
+    // issued by `motown token issue` rather than a login anyone could link
+    if person.Role == auth.RoleAdmin {
+        return auth.Identity{}, fmt.Errorf("%w: %s accounts can't sign in with an external login; ask an admin for a token", auth.ErrForbidden, person.Role)
+    }
+    return auth.Identity{Subject: person.Uid, Role: person.Role, Vehicle: person.Vehicle, Sacco: person.Sacco}, nil
+}
+
+// findPerson looks a person up by an indexed predicate
+func findPerson(ctx context.Context, txn *dgo.Txn, predicate, value string) (*linkedPerson, error) {
+    resp, err := txn.QueryWithVars(ctx, fmt.Sprintf(`
+    query Person($value: string) {
+        people(func: eq(%s, $value), first: 1) @filter(type(Person)) { uid name role sacco crew_vehicle }
+    }`, predicate), map[string]string{"$value": value})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        People []linkedPerson `json:"people"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.People) == 0 {
+        return nil, nil
+    }
+    return &result.People[0], nil
+}
+
+// linkedName is what a new rider is called, from whatever the provider
+// told us
+func linkedName(external *auth.ExternalIdentity) string {
+    name := strings.TrimSpace(external.Name)
+    if name == "" && external.Email != "" {
+        name = strings.SplitN(external.Email, "@", 2)[0]
+    }
+    if name == "" {
+        name = "Rider"
+    }
+    if len(name) > maxLinkedName {
+        name = name[:maxLinkedName]
+    }
+    return name
+}
 
-    // Handler for OAuth callback
-    http.HandleFunc("/callback", func(w http.ResponseWriter, r *http.Request) {
-        // Make request to protected resource
-        resp, err := httpClient.Get("https://<API-URL>/protected_resource")
+// loginServer serves sign in for riders, crew and SACCO admins:
+//
+//	GET  /login/{provider}           sign in with a provider
+//	GET  /login/{provider}/callback  the provider's redirect back
+//	POST /login/phone                text a code to a phone
+//	POST /login/phone/verify         sign in with the code
+//	POST /token/refresh              a new session for a refresh token
+//	POST /logout                     end the bearer's session
+//	POST /logout/all                 end all the bearer's sessions
+//
+// Providers are configured by OIDC_* settings (see auth.LoadOIDCConfig),
+// registered under OIDC_PROVIDER ("oidc" if unset), and optionally OAUTH1_*
+// (see auth.LoadOAuth1Config). -mock-idp adds a local mock provider as
+// "mock", for trying the flow without a real one. Phone login is on when
+// SMS_SENDER names a way to send codes (see auth.LoadSMSSender).
+func loginServer(args []string) {
+    flags := flag.NewFlagSet("login", flag.ExitOnError)
+    addr := flags.String("addr", ":8080", "address to listen on")
+    mockIdP := flags.Bool("mock-idp", false, "sign in through a local mock OIDC provider at /login/mock")
+    flags.Parse(args)
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    // Tokens are signed with the keys in AUTH_KEYS (or JWT_SECRET), like
+    // every other motown service
+    authConfig, err := auth.LoadConfig(os.Getenv)
+    if err != nil {
+        log.Fatal(err)
+    }
+    client := createDgraphClient()
+    defer client.Close()
+    sessions := NewSessionStore(client)
+    authConfig.Refresh = sessions
+    authConfig.Revocations = auth.NewRevocationList(sessions)
+    if err := authConfig.Revocations.Sync(ctx); err != nil {
+        log.Fatal("Loading token revocations:", err)
+    }
+    go authConfig.Revocations.Run(ctx, revocationSyncInterval)
+    tokens, err := auth.NewService(authConfig)
+    if err != nil {
+        log.Fatal(err)
+    }
+    login := auth.NewLogin(tokens, &personLinker{dgraph: client})
+    providers := 0
+
+    oidcConfig, ok, err := auth.LoadOIDCConfig("OIDC", os.Getenv)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if ok {
+        provider, err := auth.NewOIDCProvider(ctx, oidcConfig)
         if err != nil {
-            http.Error(w, "Failed to access protected resource", http.StatusInternalServerError)
-            return
+            log.Fatal(err)
         }
-        defer resp.Body.Close()
-
-        // Create JWT token with access token
-        token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-            "access_token": "<access-token>", // Replace with actual access token
-        })
+        name := os.Getenv("OIDC_PROVIDER")
+        if name == "" {
+            name = "oidc"
+        }
+        login.AddProvider(name, provider)
+        providers++
+    }
 
-        tokenString, err := token.SignedString([]byte(jwtSecret))
+    oauth1Config, ok, err := auth.LoadOAuth1Config("OAUTH1", os.Getenv)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if ok {
+        provider, err := auth.NewOAuth1Provider(oauth1Config)
         if err != nil {
-            http.Error(w, "Failed to create JWT", http.StatusInternalServerError)
-            return
+            log.Fatal(err)
         }
+        login.AddProvider(oauth1Config.Name, provider)
+        providers++
+    }
 
-        // Return JWT token
-        w.Header().Set("Content-Type", "application/json")
-        json.NewEncoder(w).Encode(map[string]string{
-            "token": tokenString,
+    if *mockIdP {
+        idp, err := auth.NewMockIdP("motown-login", "")
+        if err != nil {
+            log.Fatal(err)
+        }
+        defer idp.Close()
+        base := "http://" + *addr
+        if host, _, err := net.SplitHostPort(*addr); err == nil && host == "" {
+            base = "http://localhost" + *addr
+        }
+        provider, err := auth.NewOIDCProvider(ctx, auth.OIDCConfig{
+            Issuer:      idp.Issuer(),
+            ClientID:    "motown-login",
+            RedirectURL: base + "/login/mock/callback",
         })
-    })
+        if err != nil {
+            log.Fatal(err)
+        }
+        login.AddProvider("mock", provider)
+        providers++
+        log.Printf("Mock IdP at %s; sign in at %s/login/mock", idp.Issuer(), base)
+    }
+    sender, ok, err := auth.LoadSMSSender(os.Getenv)
+    if err != nil {
+        log.Fatal(err)
+    }
+    if ok {
+        otp, err := auth.NewOTP(auth.OTPConfig{}, sender)
+        if err != nil {
+            log.Fatal(err)
+        }
+        login.EnablePhone(otp)
+        providers++
+    }
+    if providers == 0 {
+        log.Fatal("No login providers: set OIDC_ISSUER, OAUTH1_CONSUMER_KEY or SMS_SENDER, or pass -mock-idp")
+    }
 
-    log.Fatal(http.ListenAndServe(":8080", nil))
+    // Requests in flight get to finish on interrupt, before the connections
+    // to Dgraph close
+    server := &http.Server{Addr: *addr, Handler: loginMux(tokens, login), ReadHeaderTimeout: 10 * time.Second}
+    served := make(chan error, 1)
+    go func() {
+        served <- server.ListenAndServe()
+    }()
+    select {
+    case err := <-served:
+        log.Fatal(err)
+    case <-ctx.Done():
+    }
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), defaultShutdownWait)
+    defer cancel()
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        log.Println("Login server stopped:", err)
+    }
+}
+
+// loginMux routes the login server's endpoints to login, and anything else
+// to an endpoint that echoes the bearer's verified claims
+func loginMux(tokens *auth.Service, login *auth.Login) *http.ServeMux {
+    mux := http.NewServeMux()
+    mux.Handle("/", tokens.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        claims, _ := auth.ClaimsFrom(r.Context())
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(claims)
+    })))
+    mux.Handle(auth.JWKSPath, tokens.JWKSHandler())
+    mux.Handle("/login/", login)
+    mux.Handle("/token/refresh", login)
+    mux.Handle("/logout", login)
+    mux.Handle("/logout/all", login)
+    return mux
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+
+    "motown/auth"
+)
+
+// TestLoginMuxLogout signs out through the login server's routes
+func TestLoginMuxLogout(t *testing.T) {
+    key, err := auth.GenerateKey("test", auth.HS256)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tokens, err := auth.NewService(auth.Config{Keys: []*auth.Key{key}, Revocations: auth.NewRevocationList(nil)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    login := auth.NewLogin(tokens, auth.LinkerFunc(func(ctx context.Context, identity *auth.ExternalIdentity) (auth.Identity, error) {
+        t.Errorf("linked %+v", identity)
+        return auth.Identity{}, auth.ErrForbidden
+    }))
+    mux := loginMux(tokens, login)
+
+    signIn := func(subject string) string {
+        session, err := tokens.IssueSession(context.Background(), auth.Identity{Subject: subject, Role: auth.RoleRider})
+        if err != nil {
+            t.Fatal(err)
+        }
+        return session.AccessToken
+    }
+    request := func(method, path, token string) int {
+        r := httptest.NewRequest(method, path, nil)
+        if token != "" {
+            r.Header.Set("Authorization", "Bearer "+token)
+        }
+        w := httptest.NewRecorder()
+        mux.ServeHTTP(w, r)
+        return w.Code
+    }
+
+    first, second, other := signIn("rider-1"), signIn("rider-1"), signIn("rider-2")
+    tests := []struct {
+        name   string
+        method string
+        path   string
+        token  string
+        want   int
+    }{
+        {name: "signed in", method: http.MethodGet, path: "/", token: first, want: http.StatusOK},
+        {name: "logout without a token", method: http.MethodPost, path: "/logout", want: http.StatusUnauthorized},
+        {name: "logout by GET", method: http.MethodGet, path: "/logout", token: first, want: http.StatusMethodNotAllowed},
+        {name: "logout", method: http.MethodPost, path: "/logout", token: first, want: http.StatusNoContent},
+        {name: "session ended", method: http.MethodGet, path: "/", token: first, want: http.StatusUnauthorized},
+        {name: "other session still on", method: http.MethodGet, path: "/", token: second, want: http.StatusOK},
+        {name: "logout everywhere", method: http.MethodPost, path: "/logout/all", token: second, want: http.StatusNoContent},
+        {name: "every session ended", method: http.MethodGet, path: "/", token: second, want: http.StatusUnauthorized},
+        {name: "other subject still on", method: http.MethodGet, path: "/", token: other, want: http.StatusOK},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := request(tt.method, tt.path, tt.token); got != tt.want {
+                t.Errorf("%s %s answered %d, want %d", tt.method, tt.path, got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+    "net/http"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const apiVersion = "1.0.0"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaBuilder turns Go types into OpenAPI schemas, collecting named
+// structs as components so they're described once
+type schemaBuilder struct {
+    components map[string]interface{}
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+    switch t {
+    case timeType:
+        return map[string]interface{}{"type": "string", "format": "date-time"}
+    case reflect.TypeOf(time.Duration(0)):
+        return map[string]interface{}{"type": "integer", "format": "int64", "description": "nanoseconds"}
+    }
+
+    switch t.Kind() {
+    case reflect.Ptr:
+        return b.schema(t.Elem())
+    case reflect.Bool:
+        return map[string]interface{}{"type": "boolean"}
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return map[string]interface{}{"type": "integer"}
+    case reflect.Float32, reflect.Float64:
+        return map[string]interface{}{"type": "number"}
+    case reflect.String:
+        return map[string]interface{}{"type": "string"}
+    case reflect.Slice, reflect.Array:
+        return map[string]interface{}{"type": "array", "items": b.schema(t.Elem())}
+    case reflect.Map:
+        return map[string]interface{}{"type": "object", "additionalProperties": b.schema(t.Elem())}
+    case reflect.Struct:
+        if t.Name() == "" {
+            return b.object(t)
+        }
+        if _, seen := b.components[t.Name()]; !seen {
+            b.components[t.Name()] = nil // placeholder, in case the type refers to itself
+            b.components[t.Name()] = b.object(t)
+        }
+        return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+    default:
+        return map[string]interface{}{}
+    }
+}
+
+// object describes a struct's JSON fields, flattening embedded structs the
+// way encoding/json does
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+    properties := make(map[string]interface{})
+    b.fields(t, properties)
+    return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (b *schemaBuilder) fields(t reflect.Type, properties map[string]interface{}) {
+    for i := 0; i < t.NumField(); i++ {
+        field := t.Field(i)
+        tag := field.Tag.Get("json")
+        if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+            continue
+        }
+        name, _, _ := strings.Cut(tag, ",")
+
+        if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+            b.fields(field.Type, properties)
+            continue
+        }
+        if name == "" {
+            name = field.Name
+        }
+        if _, shadowed := properties[name]; shadowed {
+            continue
+        }
+
+        properties[name] = b.schema(field.Type)
+    }
+}
+
+// OpenAPI builds the OpenAPI 3 document for the server's endpoints
+func (s *APIServer) OpenAPI() map[string]interface{} {
+    b := &schemaBuilder{components: make(map[string]interface{})}
+    errorSchema := b.schema(reflect.TypeOf(errorEnvelope{}))
+    pageSchema := b.schema(reflect.TypeOf(Page{}))
+
+    paths := make(map[string]interface{})
+    for _, e := range s.endpoints {
+        operation := map[string]interface{}{
+            "summary":     e.Summary,
+            "operationId": operationID(e),
+            "tags":        []string{e.Tag},
+        }
+
+        var parameters []interface{}
+        for _, segment := range e.segments {
+            if strings.HasPrefix(segment, "{") {
+                parameters = append(parameters, map[string]interface{}{
+                    "name":     strings.Trim(segment, "{}"),
+                    "in":       "path",
+                    "required": true,
+                    "schema":   map[string]interface{}{"type": "string"},
+                })
+            }
+        }
+        query := e.Query
+        if e.Paged {
+            query = append(query[:len(query):len(query)],
+                queryParam{Name: "limit", Type: "integer", Description: "items per page, at most " + strconv.Itoa(maxPageLimit)},
+                queryParam{Name: "offset", Type: "integer", Description: "items to skip"},
+            )
+        }
+        for _, param := range query {
+            parameters = append(parameters, map[string]interface{}{
+                "name":        param.Name,
+                "in":          "query",
+                "description": param.Description,
+                "required":    param.Required,
+                "schema":      map[string]interface{}{"type": param.Type},
+            })
+        }
+        if len(parameters) > 0 {
+            operation["parameters"] = parameters
+        }
+
+        if e.Body != nil {
+            operation["requestBody"] = map[string]interface{}{
+                "required": true,
+                "content": map[string]interface{}{
+                    "application/json": map[string]interface{}{"schema": b.schema(reflect.TypeOf(e.Body))},
+                },
+            }
+        }
+
+        status := e.Status
+        if status == 0 {
+            status = http.StatusOK
+        }
+        success := map[string]interface{}{"description": http.StatusText(status)}
+        if e.Response != nil {
+            schema := b.schema(reflect.TypeOf(e.Response))
+            if e.serve == nil {
+                envelope := map[string]interface{}{"data": schema}
+                if e.Paged {
+                    envelope["page"] = pageSchema
+                }
+                schema = map[string]interface{}{"type": "object", "properties": envelope}
+            }
+            contentType := e.Produces
+            if contentType == "" {
+                contentType = "application/json"
+            }
+            success["content"] = map[string]interface{}{
+                contentType: map[string]interface{}{"schema": schema},
+            }
+        }
+        operation["responses"] = map[string]interface{}{
+            strconv.Itoa(status): success,
+            "default": map[string]interface{}{
+                "description": "An error",
+                "content": map[string]interface{}{
+                    "application/json": map[string]interface{}{"schema": errorSchema},
+                },
+            },
+        }
+
+        if s.config.Auth != nil && e.Public {
+            operation["security"] = []interface{}{}
+        }
+
+        item, _ := paths[e.Path].(map[string]interface{})
+        if item == nil {
+            item = make(map[string]interface{})
+            paths[e.Path] = item
+        }
+        item[strings.ToLower(e.Method)] = operation
+    }
+
+    document := map[string]interface{}{
+        "openapi": "3.0.3",
+        "info": map[string]interface{}{
+            "title":   "Motown routes API",
+            "version": apiVersion,
+        },
+        "paths":      paths,
+        "components": map[string]interface{}{"schemas": b.components},
+    }
+    if s.config.Auth != nil {
+        document["components"].(map[string]interface{})["securitySchemes"] = map[string]interface{}{
+            "bearer": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+        }
+        document["security"] = []interface{}{map[string]interface{}{"bearer": []string{}}}
+    }
+    return document
+}
+
+// operationID names an operation after its method and path, leaving out
+// the version, e.g. getRouteSetsIdHistory
+func operationID(e *endpoint) string {
+    var id strings.Builder
+    id.WriteString(strings.ToLower(e.Method))
+    for _, segment := range e.segments {
+        if segment == "v1" {
+            continue
+        }
+        for _, word := range strings.FieldsFunc(segment, func(r rune) bool {
+            return r == '-' || r == '{' || r == '}' || r == '.'
+        }) {
+            id.WriteString(strings.ToUpper(word[:1]) + word[1:])
+        }
+    }
+    return id.String()
+}
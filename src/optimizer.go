@@ -0,0 +1,471 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+    "time"
+
+    "github.com/uber/h3-go/v4"
+)
+
+// Criteria understood by the route set optimiser
+const (
+    CriterionCoverage    = "coverage"
+    CriterionReliability = "reliability"
+    CriterionDemand      = "demand"
+    CriterionCost        = "cost"
+    CriterionTraffic     = "traffic"
+)
+
+var validCriteria = []string{
+    CriterionCoverage,
+    CriterionReliability,
+    CriterionDemand,
+    CriterionCost,
+    CriterionTraffic,
+}
+
+// Assumptions used to size the fleet a route needs
+const (
+    averageOperatingSpeedKmh = 20.0
+    terminalLayoverMinutes   = 10.0
+    defaultHeadwayMinutes    = 15
+)
+
+// OptimizationConstraints limits what the optimiser may select. Zero means
+// no limit.
+type OptimizationConstraints struct {
+    MaxRoutes int `json:"max_routes,omitempty"`
+    FleetSize int `json:"fleet_size,omitempty"` // vehicles available to the set
+}
+
+// RouteScore explains how a route was scored and why it was or was not picked
+type RouteScore struct {
+    RouteID       string             `json:"route_id"`
+    Rank          int                `json:"rank"`
+    Score         float64            `json:"score"`
+    Components    map[string]float64 `json:"components"`    // criterion -> 0-1 value
+    Contributions map[string]float64 `json:"contributions"` // criterion -> weight * value
+    Vehicles      int                `json:"vehicles_required"`
+    Selected      bool               `json:"selected"`
+    Reason        string             `json:"reason"`
+}
+
+// OptimizationResult is the outcome of optimising a route set
+type OptimizationResult struct {
+    SetID        string                  `json:"set_id"`
+    Weights      map[string]float64      `json:"weights"`
+    Constraints  OptimizationConstraints `json:"constraints"`
+    Selected     []string                `json:"selected_route_ids"`
+    Ranking      []RouteScore            `json:"ranking"`
+    VehiclesUsed int                     `json:"vehicles_used"`
+    OptimizedAt  time.Time               `json:"optimized_at"`
+}
+
+// TrafficSource reports congestion (0-1) for an H3 cell
+type TrafficSource interface {
+    CongestionAt(h3Index string) (float64, bool)
+}
+
+// routeCandidate is a route with everything the optimiser scores it on
+type routeCandidate struct {
+    id        string
+    cells     []string
+    analytics *RouteAnalytics
+    vehicles  int
+    traffic   float64 // mean congestion on the route's cells, 0-1
+}
+
+// validateCriteria checks the criterion names and normalises the weights
+// to sum to one
+func validateCriteria(weights map[string]float64) (map[string]float64, error) {
+    if len(weights) == 0 {
+        return nil, fmt.Errorf("no optimisation criteria given")
+    }
+
+    known := make(map[string]bool, len(validCriteria))
+    for _, name := range validCriteria {
+        known[name] = true
+    }
+
+    var total float64
+    for name, weight := range weights {
+        if !known[name] {
+            return nil, fmt.Errorf("unknown optimisation criterion %q (valid: %s)", name, strings.Join(validCriteria, ", "))
+        }
+        if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+            return nil, fmt.Errorf("invalid weight %v for criterion %q", weight, name)
+        }
+        total += weight
+    }
+    if total == 0 {
+        return nil, fmt.Errorf("optimisation weights sum to zero")
+    }
+
+    normalized := make(map[string]float64, len(weights))
+    for name, weight := range weights {
+        normalized[name] = weight / total
+    }
+    return normalized, nil
+}
+
+// optimizeRoutes ranks candidate routes by their weighted score and greedily
+// selects them within the constraints. Coverage is scored on the cells a
+// route adds to those already selected, so overlapping routes lose out.
+func optimizeRoutes(candidates []routeCandidate, weights map[string]float64, constraints OptimizationConstraints) ([]string, []RouteScore) {
+    // Values used to bring demand and cost to a 0-1 scale
+    var maxUsage, maxVehicles int
+    allCells := make(map[string]bool)
+    for _, c := range candidates {
+        if c.analytics != nil && c.analytics.UsageCount > maxUsage {
+            maxUsage = c.analytics.UsageCount
+        }
+        if c.vehicles > maxVehicles {
+            maxVehicles = c.vehicles
+        }
+        for _, cell := range c.cells {
+            allCells[cell] = true
+        }
+    }
+
+    score := func(c routeCandidate, covered map[string]bool) RouteScore {
+        newCells := 0
+        for _, cell := range c.cells {
+            if !covered[cell] {
+                newCells++
+            }
+        }
+
+        components := map[string]float64{
+            CriterionReliability: 0.5,
+            CriterionDemand:      0,
+            CriterionCost:        1,
+            CriterionTraffic:     1 - c.traffic,
+        }
+        if len(allCells) > 0 {
+            components[CriterionCoverage] = float64(newCells) / float64(len(allCells))
+        }
+        if c.analytics != nil {
+            components[CriterionReliability] = c.analytics.Reliability
+            if maxUsage > 0 {
+                components[CriterionDemand] = float64(c.analytics.UsageCount) / float64(maxUsage)
+            }
+        }
+        if maxVehicles > 0 {
+            components[CriterionCost] = 1 - float64(c.vehicles)/float64(maxVehicles+1)
+        }
+
+        rs := RouteScore{
+            RouteID:       c.id,
+            Components:    make(map[string]float64, len(weights)),
+            Contributions: make(map[string]float64, len(weights)),
+            Vehicles:      c.vehicles,
+        }
+        for name, weight := range weights {
+            rs.Components[name] = components[name]
+            rs.Contributions[name] = weight * components[name]
+            rs.Score += rs.Contributions[name]
+        }
+        return rs
+    }
+
+    covered := make(map[string]bool)
+    remaining := append([]routeCandidate(nil), candidates...)
+    fleetLeft := constraints.FleetSize
+    var selected []string
+    var ranking []RouteScore
+
+    for len(remaining) > 0 {
+        // Re-score what's left against the current coverage
+        scores := make([]RouteScore, len(remaining))
+        for i, c := range remaining {
+            scores[i] = score(c, covered)
+        }
+        best := -1
+        for i := range scores {
+            if best == -1 || scores[i].Score > scores[best].Score ||
+                (scores[i].Score == scores[best].Score && scores[i].RouteID < scores[best].RouteID) {
+                best = i
+            }
+        }
+
+        rs := scores[best]
+        c := remaining[best]
+        remaining = append(remaining[:best], remaining[best+1:]...)
+
+        switch {
+        case constraints.MaxRoutes > 0 && len(selected) >= constraints.MaxRoutes:
+            rs.Reason = fmt.Sprintf("not selected: limit of %d routes reached", constraints.MaxRoutes)
+        case constraints.FleetSize > 0 && c.vehicles > fleetLeft:
+            rs.Reason = fmt.Sprintf("not selected: needs %d vehicles, %d left in fleet", c.vehicles, fleetLeft)
+        default:
+            rs.Selected = true
+            rs.Reason = "selected: " + describeContributions(rs.Contributions)
+            selected = append(selected, c.id)
+            fleetLeft -= c.vehicles
+            for _, cell := range c.cells {
+                covered[cell] = true
+            }
+        }
+
+        rs.Rank = len(ranking) + 1
+        ranking = append(ranking, rs)
+    }
+
+    return selected, ranking
+}
+
+// describeContributions lists the criteria that contributed most to a score
+func describeContributions(contributions map[string]float64) string {
+    names := make([]string, 0, len(contributions))
+    for name := range contributions {
+        names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool {
+        if contributions[names[i]] == contributions[names[j]] {
+            return names[i] < names[j]
+        }
+        return contributions[names[i]] > contributions[names[j]]
+    })
+
+    parts := make([]string, len(names))
+    for i, name := range names {
+        parts[i] = fmt.Sprintf("%s %.2f", name, contributions[name])
+    }
+    return strings.Join(parts, ", ")
+}
+
+// routeCells returns the H3 cells a route passes through, in order and
+// without consecutive repeats
+func routeCells(route Route) []string {
+    var cells []string
+    appendCell := func(cell string) {
+        if cell != "" && (len(cells) == 0 || cells[len(cells)-1] != cell) {
+            cells = append(cells, cell)
+        }
+    }
+
+    appendCell(route.PickupH3Index)
+    for _, cell := range calculateIntermediateH3Indexes(route.PickupLat, route.PickupLng, route.DestLat, route.DestLng, 9) {
+        appendCell(cell)
+    }
+    appendCell(route.DestH3Index)
+    return cells
+}
+
+// vehiclesRequired estimates how many vehicles keep a route at its most
+// frequent scheduled headway
+func vehiclesRequired(route Route) int {
+    headway := 0
+    for _, s := range route.Schedule {
+        if s.Frequency > 0 && (headway == 0 || s.Frequency < headway) {
+            headway = s.Frequency
+        }
+    }
+    if headway == 0 {
+        headway = defaultHeadwayMinutes
+    }
+
+    lengthKm := calculateDistance(route.PickupLat, route.PickupLng, route.DestLat, route.DestLng) / 1000
+    roundTripMinutes := 2*lengthKm/averageOperatingSpeedKmh*60 + terminalLayoverMinutes
+    return int(math.Ceil(roundTripMinutes / float64(headway)))
+}
+
+const routeFields = `
+    uid
+    route_number
+    sacco
+    pickup_point
+    destinations
+    pickup_h3_index
+    dest_h3_index
+    pickup_lat
+    pickup_lng
+    dest_lat
+    dest_lng
+    schedule {
+        start_time
+        end_time
+        frequency_minutes
+    }
+    fare {
+        regular_fare
+        peak_fare
+        off_peak_fare
+    }
+    active_days
+    last_updated`
+
+// getRoute fetches a single route by UID, going through the route cache
+func (rp *RoutePlanner) getRoute(ctx context.Context, routeID string) (*Route, error) {
+    cacheKey := "route:" + routeID
+    if routes, ok := rp.cache.Get(cacheKey); ok && len(routes) == 1 {
+        return &routes[0], nil
+    }
+
+    query := `
+        query Route($id: string) {
+            route(func: uid($id)) @filter(type(Route)) {` + routeFields + `
+            }
+        }`
+
+    resp, err := rp.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, query, map[string]string{"$id": routeID})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Route []Route `json:"route"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Route) == 0 {
+        return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, routeID)
+    }
+
+    rp.cache.Set(cacheKey, result.Route[:1])
+    return &result.Route[0], nil
+}
+
+// listRoutes returns every stored route
+func (rp *RoutePlanner) listRoutes(ctx context.Context) ([]Route, error) {
+    cacheKey := "routes:all"
+    if routes, ok := rp.cache.Get(cacheKey); ok {
+        return routes, nil
+    }
+
+    resp, err := rp.dgraph.NewReadOnlyTxn().Query(ctx, `
+        {
+            routes(func: type(Route)) {`+routeFields+`
+            }
+        }`)
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Routes []Route `json:"routes"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+
+    rp.cache.Set(cacheKey, result.Routes)
+    return result.Routes, nil
+}
+
+// GetAllRouteIDs returns the IDs of every stored route
+func (rp *RoutePlanner) GetAllRouteIDs(ctx context.Context) ([]string, error) {
+    resp, err := rp.dgraph.NewReadOnlyTxn().Query(ctx, `
+        {
+            routes(func: type(Route)) {
+                uid
+            }
+        }`)
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Routes []routeRef `json:"routes"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    return fromRouteRefs(result.Routes), nil
+}
+
+// getRouteAnalytics returns the recorded analytics for a route, or nil if
+// none have been recorded yet
+func (rp *RoutePlanner) getRouteAnalytics(ctx context.Context, routeID string) (*RouteAnalytics, error) {
+    rp.mu.RLock()
+    defer rp.mu.RUnlock()
+    return rp.analytics[routeID], nil
+}
+
+// RecordRouteAnalytics stores analytics used when scoring routes
+func (rp *RoutePlanner) RecordRouteAnalytics(analytics *RouteAnalytics) {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+    analytics.LastAnalyzed = time.Now()
+    rp.analytics[analytics.RouteID] = analytics
+}
+
+// SetTrafficSource sets where the optimiser reads congestion from
+func (rp *RoutePlanner) SetTrafficSource(source TrafficSource) {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+    rp.traffic = source
+}
+
+// buildCandidates loads the data the optimiser needs for each route
+func (rp *RoutePlanner) buildCandidates(ctx context.Context, routeIDs []string) ([]routeCandidate, error) {
+    rp.mu.RLock()
+    traffic := rp.traffic
+    rp.mu.RUnlock()
+
+    candidates := make([]routeCandidate, 0, len(routeIDs))
+    for _, routeID := range routeIDs {
+        route, err := rp.getRoute(ctx, routeID)
+        if err != nil {
+            return nil, err
+        }
+        analytics, err := rp.getRouteAnalytics(ctx, routeID)
+        if err != nil {
+            return nil, err
+        }
+
+        c := routeCandidate{
+            id:        routeID,
+            cells:     routeCells(*route),
+            analytics: analytics,
+            vehicles:  vehiclesRequired(*route),
+        }
+
+        if traffic != nil {
+            var total float64
+            var n int
+            for _, cell := range c.cells {
+                if congestion, ok := traffic.CongestionAt(cell); ok {
+                    total += congestion
+                    n++
+                }
+            }
+            if n > 0 {
+                c.traffic = total / float64(n)
+            }
+        }
+
+        candidates = append(candidates, c)
+    }
+
+    return candidates, nil
+}
+
+// setCoverage returns the union of the cells of the given candidates
+func setCoverage(candidates []routeCandidate, routeIDs []string) []string {
+    wanted := make(map[string]bool, len(routeIDs))
+    for _, id := range routeIDs {
+        wanted[id] = true
+    }
+
+    seen := make(map[string]bool)
+    var coverage []string
+    for _, c := range candidates {
+        if !wanted[c.id] {
+            continue
+        }
+        for _, cell := range c.cells {
+            if !seen[cell] && h3.Cell(h3.IndexFromString(cell)).IsValid() {
+                seen[cell] = true
+                coverage = append(coverage, cell)
+            }
+        }
+    }
+    return coverage
+}
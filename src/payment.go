@@ -0,0 +1,771 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sync"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+
+    "motown/dgraph"
+)
+
+const (
+    defaultCurrency        = "KES"
+    reconcileInterval      = 2 * time.Minute
+    reconcileAfter         = 2 * time.Minute // leave callbacks time to arrive first
+    providerRequestTimeout = 30 * time.Second
+)
+
+// Payment intent states
+const (
+    PaymentPending   = "pending"
+    PaymentSucceeded = "succeeded"
+    PaymentFailed    = "failed"
+    PaymentRefunded  = "refunded"
+)
+
+// Refund states
+const (
+    RefundPending   = "pending"
+    RefundSucceeded = "succeeded"
+    RefundFailed    = "failed"
+)
+
+var (
+    ErrPaymentNotFound      = errors.New("payment not found")
+    ErrRefundNotFound       = errors.New("refund not found")
+    ErrIdempotencyReuse     = errors.New("idempotency key was used for a different payment")
+    ErrPaymentNotRefundable = errors.New("payment can't be refunded")
+    ErrBadCallback          = errors.New("callback failed validation")
+    ErrUnknownProvider      = errors.New("unknown payment provider")
+)
+
+// PaymentRequest asks for a fare to be paid. Requests with the same
+// idempotency key get the same intent back and the payer is only asked to
+// pay once.
+type PaymentRequest struct {
+    IdempotencyKey string  `json:"idempotency_key"`
+    Provider       string  `json:"provider"`
+    BookingID      string  `json:"booking_id,omitempty"`
+    TripID         string  `json:"trip_id,omitempty"`
+    Phone          string  `json:"phone"`
+    Amount         float64 `json:"amount"`
+    Currency       string  `json:"currency,omitempty"`
+    Description    string  `json:"description,omitempty"`
+}
+
+// PaymentIntent tracks one payment from request to settlement
+type PaymentIntent struct {
+    ID             string    `json:"id"`
+    IdempotencyKey string    `json:"idempotency_key"`
+    Provider       string    `json:"provider"`
+    BookingID      string    `json:"booking_id,omitempty"`
+    TripID         string    `json:"trip_id,omitempty"`
+    Phone          string    `json:"phone"`
+    Amount         float64   `json:"amount"`
+    Currency       string    `json:"currency"`
+    Description    string    `json:"description,omitempty"`
+    Status         string    `json:"status"`
+    Reference      string    `json:"reference,omitempty"` // the provider's id for the charge
+    Receipt        string    `json:"receipt,omitempty"`   // what the payer sees, e.g. an M-Pesa code
+    FailureReason  string    `json:"failure_reason,omitempty"`
+    RefundedAmount float64   `json:"refunded_amount"`
+    Refunds        []Refund  `json:"refunds,omitempty"`
+    CreatedAt      time.Time `json:"created_at"`
+    UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Refund returns some or all of a payment
+type Refund struct {
+    ID        string    `json:"id"`
+    Amount    float64   `json:"amount"`
+    Reason    string    `json:"reason,omitempty"`
+    Status    string    `json:"status"`
+    Reference string    `json:"reference,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Provider events
+const (
+    EventPayment = "payment"
+    EventRefund  = "refund"
+)
+
+// ProviderEvent is a provider's word on how a charge or refund ended, from
+// a callback or a status query
+type ProviderEvent struct {
+    Kind      string  `json:"kind"`
+    PaymentID string  `json:"payment_id"`
+    RefundID  string  `json:"refund_id,omitempty"`
+    Reference string  `json:"reference,omitempty"`
+    Status    string  `json:"status"` // a payment or refund state; pending if not settled yet
+    Receipt   string  `json:"receipt,omitempty"`
+    Amount    float64 `json:"amount,omitempty"`
+    Reason    string  `json:"reason,omitempty"`
+}
+
+// PaymentProvider is a way of collecting money, such as M-Pesa
+type PaymentProvider interface {
+    Name() string
+    // Charge asks the payer to pay and returns the provider's reference.
+    // The outcome arrives later through a callback.
+    Charge(ctx context.Context, intent PaymentIntent) (string, error)
+    // Status asks the provider how a charge went
+    Status(ctx context.Context, intent PaymentIntent) (ProviderEvent, error)
+    // Refund starts returning money to the payer and returns the
+    // provider's reference for it
+    Refund(ctx context.Context, intent PaymentIntent, refund Refund) (string, error)
+    // ParseCallback checks a callback really came from the provider and
+    // reads it
+    ParseCallback(r *http.Request) (ProviderEvent, error)
+}
+
+// PaymentService takes fare payments through its providers and keeps the
+// intents in Dgraph. Paying for a held booking confirms it.
+type PaymentService struct {
+    dgraph    *dgraph.Client
+    bookings  *BookingService
+    providers map[string]PaymentProvider
+    mu        sync.RWMutex
+    now       func() time.Time
+    done      chan struct{}
+    closeOnce sync.Once
+}
+
+func NewPaymentService(client *dgraph.Client, bookings *BookingService) *PaymentService {
+    ps := &PaymentService{
+        dgraph:    client,
+        bookings:  bookings,
+        providers: make(map[string]PaymentProvider),
+        now:       time.Now,
+        done:      make(chan struct{}),
+    }
+    go ps.run()
+    return ps
+}
+
+// AddProvider makes a provider available for payments
+func (ps *PaymentService) AddProvider(provider PaymentProvider) {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    ps.providers[provider.Name()] = provider
+}
+
+func (ps *PaymentService) provider(name string) (PaymentProvider, error) {
+    ps.mu.RLock()
+    defer ps.mu.RUnlock()
+
+    provider, exists := ps.providers[name]
+    if !exists {
+        return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, name)
+    }
+    return provider, nil
+}
+
+// paymentNode and refundNode are how intents are stored in Dgraph
+type paymentNode struct {
+    Uid            string       `json:"uid,omitempty"`
+    DType          []string     `json:"dgraph.type,omitempty"`
+    PaymentID      string       `json:"payment_id,omitempty"`
+    IdempotencyKey string       `json:"idempotency_key,omitempty"`
+    Provider       string       `json:"payment_provider,omitempty"`
+    Booking        *bookingNode `json:"payment_booking,omitempty"`
+    Trip           *tripNode    `json:"payment_trip,omitempty"`
+    Phone          string       `json:"payment_phone,omitempty"`
+    Amount         float64      `json:"payment_amount"`
+    Currency       string       `json:"payment_currency,omitempty"`
+    Description    string       `json:"payment_description,omitempty"`
+    Status         string       `json:"payment_status,omitempty"`
+    Reference      string       `json:"payment_reference,omitempty"`
+    Receipt        string       `json:"payment_receipt,omitempty"`
+    FailureReason  string       `json:"failure_reason,omitempty"`
+    RefundedAmount float64      `json:"refunded_amount"`
+    Refunds        []refundNode `json:"payment_refunds,omitempty"`
+    CreatedAt      time.Time    `json:"created_at"`
+    UpdatedAt      time.Time    `json:"updated_at"`
+}
+
+type refundNode struct {
+    Uid       string    `json:"uid,omitempty"`
+    DType     []string  `json:"dgraph.type,omitempty"`
+    RefundID  string    `json:"refund_id,omitempty"`
+    Amount    float64   `json:"refund_amount"`
+    Reason    string    `json:"refund_reason,omitempty"`
+    Status    string    `json:"refund_status,omitempty"`
+    Reference string    `json:"refund_reference,omitempty"`
+    CreatedAt time.Time `json:"created_at"`
+    UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (n paymentNode) toIntent() *PaymentIntent {
+    intent := &PaymentIntent{
+        ID:             n.PaymentID,
+        IdempotencyKey: n.IdempotencyKey,
+        Provider:       n.Provider,
+        Phone:          n.Phone,
+        Amount:         n.Amount,
+        Currency:       n.Currency,
+        Description:    n.Description,
+        Status:         n.Status,
+        Reference:      n.Reference,
+        Receipt:        n.Receipt,
+        FailureReason:  n.FailureReason,
+        RefundedAmount: n.RefundedAmount,
+        CreatedAt:      n.CreatedAt,
+        UpdatedAt:      n.UpdatedAt,
+    }
+    if n.Booking != nil {
+        intent.BookingID = n.Booking.BookingID
+    }
+    if n.Trip != nil {
+        intent.TripID = n.Trip.TripID
+    }
+    for _, refund := range n.Refunds {
+        intent.Refunds = append(intent.Refunds, Refund{
+            ID:        refund.RefundID,
+            Amount:    refund.Amount,
+            Reason:    refund.Reason,
+            Status:    refund.Status,
+            Reference: refund.Reference,
+            CreatedAt: refund.CreatedAt,
+            UpdatedAt: refund.UpdatedAt,
+        })
+    }
+    return intent
+}
+
+const paymentFields = `
+    uid
+    payment_id
+    idempotency_key
+    payment_provider
+    payment_booking { booking_id }
+    payment_trip { trip_id }
+    payment_phone
+    payment_amount
+    payment_currency
+    payment_description
+    payment_status
+    payment_reference
+    payment_receipt
+    failure_reason
+    refunded_amount
+    payment_refunds {
+        uid
+        refund_id
+        refund_amount
+        refund_reason
+        refund_status
+        refund_reference
+        created_at
+        updated_at
+    }
+    created_at
+    updated_at`
+
+// findPayment reads the intent whose predicate has the given value
+func findPayment(ctx context.Context, txn *dgo.Txn, predicate, value string) (*paymentNode, error) {
+    resp, err := txn.QueryWithVars(ctx, `
+        query Payment($value: string) {
+            payments(func: eq(`+predicate+`, $value)) @filter(type(PaymentIntent)) {`+paymentFields+`
+            }
+        }`, map[string]string{"$value": value})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Payments []paymentNode `json:"payments"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Payments) == 0 {
+        return nil, nil
+    }
+    return &result.Payments[0], nil
+}
+
+// lookupUid finds the node with the given value for an indexed predicate
+func lookupUid(ctx context.Context, txn *dgo.Txn, predicate, value string) (string, error) {
+    resp, err := txn.QueryWithVars(ctx, `
+        query Lookup($value: string) {
+            nodes(func: eq(`+predicate+`, $value)) { uid }
+        }`, map[string]string{"$value": value})
+    if err != nil {
+        return "", err
+    }
+
+    var result struct {
+        Nodes []struct {
+            Uid string `json:"uid"`
+        } `json:"nodes"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return "", err
+    }
+    if len(result.Nodes) == 0 {
+        return "", nil
+    }
+    return result.Nodes[0].Uid, nil
+}
+
+// Pay creates a payment intent and asks the payer to pay it. Repeating a
+// request with the same idempotency key returns the first intent without
+// charging again; reusing a key for a different payment is an error.
+func (ps *PaymentService) Pay(ctx context.Context, req PaymentRequest) (*PaymentIntent, error) {
+    if req.IdempotencyKey == "" {
+        return nil, fmt.Errorf("a payment needs an idempotency key")
+    }
+    if req.Amount <= 0 {
+        return nil, fmt.Errorf("payment amount must be positive")
+    }
+    if req.BookingID == "" && req.TripID == "" {
+        return nil, fmt.Errorf("a payment must be for a booking or a trip")
+    }
+    if req.Currency == "" {
+        req.Currency = defaultCurrency
+    }
+    provider, err := ps.provider(req.Provider)
+    if err != nil {
+        return nil, err
+    }
+
+    var intent *PaymentIntent
+    created := false
+    err = ps.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        created = false
+        existing, err := findPayment(ctx, txn, "idempotency_key", req.IdempotencyKey)
+        if err != nil {
+            return err
+        }
+        if existing != nil {
+            intent = existing.toIntent()
+            if intent.Provider != req.Provider || intent.Amount != req.Amount || intent.Phone != req.Phone ||
+                intent.BookingID != req.BookingID || intent.TripID != req.TripID {
+                return ErrIdempotencyReuse
+            }
+            return nil
+        }
+
+        now := ps.now()
+        node := paymentNode{
+            Uid:            "_:payment",
+            DType:          []string{"PaymentIntent"},
+            PaymentID:      generateUUID(),
+            IdempotencyKey: req.IdempotencyKey,
+            Provider:       req.Provider,
+            Phone:          req.Phone,
+            Amount:         req.Amount,
+            Currency:       req.Currency,
+            Description:    req.Description,
+            Status:         PaymentPending,
+            CreatedAt:      now,
+            UpdatedAt:      now,
+        }
+        if req.BookingID != "" {
+            uid, err := lookupUid(ctx, txn, "booking_id", req.BookingID)
+            if err != nil {
+                return err
+            }
+            if uid == "" {
+                return fmt.Errorf("%w: %s", ErrBookingNotFound, req.BookingID)
+            }
+            node.Booking = &bookingNode{Uid: uid}
+        }
+        if req.TripID != "" {
+            uid, err := lookupUid(ctx, txn, "trip_id", req.TripID)
+            if err != nil {
+                return err
+            }
+            if uid == "" {
+                return fmt.Errorf("%w: %s", ErrTripNotFound, req.TripID)
+            }
+            node.Trip = &tripNode{Uid: uid}
+        }
+
+        if err := mutateJSON(ctx, txn, node); err != nil {
+            return err
+        }
+        intent = node.toIntent()
+        intent.BookingID = req.BookingID
+        intent.TripID = req.TripID
+        created = true
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if !created {
+        return intent, nil
+    }
+
+    // Only the request that created the intent charges the payer
+    chargeCtx, cancel := context.WithTimeout(ctx, providerRequestTimeout)
+    defer cancel()
+
+    reference, err := provider.Charge(chargeCtx, *intent)
+    if err != nil {
+        log.Printf("Charging payment %s through %s: %v", intent.ID, intent.Provider, err)
+        return ps.apply(ctx, ProviderEvent{
+            Kind:      EventPayment,
+            PaymentID: intent.ID,
+            Status:    PaymentFailed,
+            Reason:    err.Error(),
+        })
+    }
+    return ps.apply(ctx, ProviderEvent{
+        Kind:      EventPayment,
+        PaymentID: intent.ID,
+        Reference: reference,
+        Status:    PaymentPending,
+    })
+}
+
+// GetPayment returns a payment intent with its refunds
+func (ps *PaymentService) GetPayment(ctx context.Context, paymentID string) (*PaymentIntent, error) {
+    txn := ps.dgraph.NewReadOnlyTxn()
+    defer txn.Discard(ctx)
+
+    node, err := findPayment(ctx, txn, "payment_id", paymentID)
+    if err != nil {
+        return nil, err
+    }
+    if node == nil {
+        return nil, fmt.Errorf("%w: %s", ErrPaymentNotFound, paymentID)
+    }
+    return node.toIntent(), nil
+}
+
+// apply records what a provider said about a charge or refund. Events for
+// intents that have already settled are ignored, so duplicate and late
+// callbacks are harmless, except that a receipt is still taken for a
+// payment settled without one, as by a status query.
+func (ps *PaymentService) apply(ctx context.Context, event ProviderEvent) (*PaymentIntent, error) {
+    confirmBooking := ""
+    err := ps.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        confirmBooking = ""
+        node, err := findPayment(ctx, txn, "payment_id", event.PaymentID)
+        if err != nil {
+            return err
+        }
+        if node == nil {
+            return fmt.Errorf("%w: %s", ErrPaymentNotFound, event.PaymentID)
+        }
+        now := ps.now()
+
+        if event.Kind == EventRefund {
+            return ps.applyRefund(ctx, txn, node, event, now)
+        }
+
+        if node.Reference != "" && event.Reference != "" && node.Reference != event.Reference {
+            return fmt.Errorf("%w: reference %s doesn't match payment %s", ErrBadCallback, event.Reference, node.PaymentID)
+        }
+        if node.Status != PaymentPending {
+            if node.Status == PaymentFailed || node.Receipt != "" || event.Status != PaymentSucceeded || event.Receipt == "" {
+                return nil
+            }
+            return mutateJSON(ctx, txn, map[string]interface{}{
+                "uid":             node.Uid,
+                "payment_receipt": event.Receipt,
+                "updated_at":      now,
+            })
+        }
+        update := map[string]interface{}{
+            "uid":        node.Uid,
+            "updated_at": now,
+        }
+        if event.Reference != "" {
+            update["payment_reference"] = event.Reference
+        }
+        switch event.Status {
+        case PaymentSucceeded:
+            if event.Amount > 0 && event.Amount < node.Amount {
+                update["payment_status"] = PaymentFailed
+                update["failure_reason"] = fmt.Sprintf("paid %.2f of %.2f", event.Amount, node.Amount)
+                break
+            }
+            update["payment_status"] = PaymentSucceeded
+            update["payment_receipt"] = event.Receipt
+            if node.Booking != nil {
+                confirmBooking = node.Booking.BookingID
+            }
+        case PaymentFailed:
+            update["payment_status"] = PaymentFailed
+            update["failure_reason"] = event.Reason
+        }
+        return mutateJSON(ctx, txn, update)
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    if confirmBooking != "" && ps.bookings != nil {
+        if _, err := ps.bookings.Confirm(ctx, confirmBooking); err != nil && !errors.Is(err, ErrBookingTransition) {
+            log.Printf("Confirming paid booking %s: %v", confirmBooking, err)
+        }
+    }
+    return ps.GetPayment(ctx, event.PaymentID)
+}
+
+func (ps *PaymentService) applyRefund(ctx context.Context, txn *dgo.Txn, node *paymentNode, event ProviderEvent, now time.Time) error {
+    for _, refund := range node.Refunds {
+        if refund.RefundID != event.RefundID {
+            continue
+        }
+        if refund.Status != RefundPending || event.Status == RefundPending {
+            return nil
+        }
+
+        update := map[string]interface{}{
+            "uid":           refund.Uid,
+            "refund_status": event.Status,
+            "updated_at":    now,
+        }
+        if event.Reference != "" {
+            update["refund_reference"] = event.Reference
+        }
+        if err := mutateJSON(ctx, txn, update); err != nil {
+            return err
+        }
+
+        // The amount was set aside when the refund started, so a failed
+        // refund gives it back
+        refunded := node.RefundedAmount
+        if event.Status == RefundFailed {
+            refunded -= refund.Amount
+        }
+        status := PaymentSucceeded
+        if refunded >= node.Amount {
+            status = PaymentRefunded
+        }
+        return mutateJSON(ctx, txn, map[string]interface{}{
+            "uid":             node.Uid,
+            "payment_status":  status,
+            "refunded_amount": refunded,
+            "updated_at":      now,
+        })
+    }
+    return fmt.Errorf("%w: %s", ErrRefundNotFound, event.RefundID)
+}
+
+// Refund returns some of a settled payment, or all of it if amount is zero
+func (ps *PaymentService) Refund(ctx context.Context, paymentID string, amount float64, reason string) (*Refund, error) {
+    var intent *PaymentIntent
+    var refund Refund
+    err := ps.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        node, err := findPayment(ctx, txn, "payment_id", paymentID)
+        if err != nil {
+            return err
+        }
+        if node == nil {
+            return fmt.Errorf("%w: %s", ErrPaymentNotFound, paymentID)
+        }
+        if node.Status != PaymentSucceeded {
+            return fmt.Errorf("%w: it is %s", ErrPaymentNotRefundable, node.Status)
+        }
+
+        remaining := node.Amount - node.RefundedAmount
+        if amount == 0 {
+            amount = remaining
+        }
+        if amount <= 0 || amount > remaining {
+            return fmt.Errorf("%w: %.2f of %.2f left to refund", ErrPaymentNotRefundable, remaining, node.Amount)
+        }
+
+        now := ps.now()
+        refund = Refund{
+            ID:        generateUUID(),
+            Amount:    amount,
+            Reason:    reason,
+            Status:    RefundPending,
+            CreatedAt: now,
+            UpdatedAt: now,
+        }
+        intent = node.toIntent()
+
+        // Set the amount aside now so concurrent refunds can't return more
+        // than was paid
+        return mutateJSON(ctx, txn, map[string]interface{}{
+            "uid":             node.Uid,
+            "refunded_amount": node.RefundedAmount + amount,
+            "updated_at":      now,
+            "payment_refunds": []refundNode{{
+                Uid:       "_:refund",
+                DType:     []string{"Refund"},
+                RefundID:  refund.ID,
+                Amount:    refund.Amount,
+                Reason:    refund.Reason,
+                Status:    refund.Status,
+                CreatedAt: now,
+                UpdatedAt: now,
+            }},
+        })
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    provider, err := ps.provider(intent.Provider)
+    if err != nil {
+        return nil, err
+    }
+    refundCtx, cancel := context.WithTimeout(ctx, providerRequestTimeout)
+    defer cancel()
+
+    event := ProviderEvent{Kind: EventRefund, PaymentID: paymentID, RefundID: refund.ID, Status: RefundPending}
+    reference, err := provider.Refund(refundCtx, *intent, refund)
+    if err != nil {
+        log.Printf("Refunding payment %s through %s: %v", paymentID, intent.Provider, err)
+        event.Status = RefundFailed
+    }
+    event.Reference = reference
+    updated, err := ps.apply(ctx, event)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, r := range updated.Refunds {
+        if r.ID == refund.ID {
+            return &r, nil
+        }
+    }
+    return &refund, nil
+}
+
+// CallbackHandler takes a provider's callbacks. It answers 200 even for
+// events that change nothing, so the provider stops retrying.
+func (ps *PaymentService) CallbackHandler(providerName string) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        provider, err := ps.provider(providerName)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusNotFound)
+            return
+        }
+
+        event, err := provider.ParseCallback(r)
+        if err != nil {
+            log.Printf("Rejected %s callback from %s: %v", providerName, r.RemoteAddr, err)
+            http.Error(w, "invalid callback", http.StatusUnauthorized)
+            return
+        }
+
+        if _, err := ps.apply(r.Context(), event); err != nil {
+            log.Printf("Applying %s callback for payment %s: %v", providerName, event.PaymentID, err)
+            if errors.Is(err, ErrBadCallback) {
+                http.Error(w, "invalid callback", http.StatusUnauthorized)
+                return
+            }
+            if !errors.Is(err, ErrPaymentNotFound) && !errors.Is(err, ErrRefundNotFound) {
+                http.Error(w, "callback not applied", http.StatusInternalServerError)
+                return
+            }
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.Write([]byte(`{"ResultCode":0,"ResultDesc":"Accepted"}`))
+    })
+}
+
+// Reconcile asks providers about payments still pending after their
+// callbacks should have arrived, and settles them
+func (ps *PaymentService) Reconcile(ctx context.Context) (int, error) {
+    resp, err := ps.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query Pending($status: string, $before: string) {
+            payments(func: eq(payment_status, $status)) @filter(type(PaymentIntent) AND le(updated_at, $before)) {`+paymentFields+`
+            }
+        }`, map[string]string{
+        "$status": PaymentPending,
+        "$before": ps.now().Add(-reconcileAfter).Format(time.RFC3339),
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    var result struct {
+        Payments []paymentNode `json:"payments"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return 0, err
+    }
+
+    settled := 0
+    for _, node := range result.Payments {
+        intent := node.toIntent()
+        provider, err := ps.provider(intent.Provider)
+        if err != nil {
+            log.Printf("Reconciling payment %s: %v", intent.ID, err)
+            continue
+        }
+
+        // A charge that never reached the provider has nothing to ask about
+        if intent.Reference == "" {
+            if _, err := ps.apply(ctx, ProviderEvent{
+                Kind:      EventPayment,
+                PaymentID: intent.ID,
+                Status:    PaymentFailed,
+                Reason:    "charge was never accepted by the provider",
+            }); err != nil {
+                return settled, err
+            }
+            settled++
+            continue
+        }
+
+        queryCtx, cancel := context.WithTimeout(ctx, providerRequestTimeout)
+        event, err := provider.Status(queryCtx, *intent)
+        cancel()
+        if err != nil {
+            log.Printf("Querying %s for payment %s: %v", intent.Provider, intent.ID, err)
+            continue
+        }
+        if event.Status == PaymentPending {
+            continue
+        }
+
+        event.Kind = EventPayment
+        event.PaymentID = intent.ID
+        if _, err := ps.apply(ctx, event); err != nil {
+            return settled, err
+        }
+        settled++
+    }
+    return settled, nil
+}
+
+func (ps *PaymentService) run() {
+    ticker := time.NewTicker(reconcileInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ps.done:
+            return
+        case <-ticker.C:
+            ctx, cancel := context.WithTimeout(context.Background(), reconcileInterval)
+            if settled, err := ps.Reconcile(ctx); err != nil {
+                log.Printf("Reconciling payments: %v", err)
+            } else if settled > 0 {
+                log.Printf("Reconciled %d payments", settled)
+            }
+            cancel()
+        }
+    }
+}
+
+// Close stops reconciling
+func (ps *PaymentService) Close() {
+    ps.closeOnce.Do(func() { close(ps.done) })
+}
+
+// Payments returns the fare payment service
+func (rtm *RealTimeManager) Payments() *PaymentService {
+    return rtm.payments
+}
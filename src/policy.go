@@ -0,0 +1,73 @@
+package main
+
+import (
+    "context"
+
+    "motown/auth"
+)
+
+// Actions the API's endpoints and GraphQL fields take. The policy grants
+// them to roles.
+const (
+    ActionReadRoutes      = "routes:read"
+    ActionWriteRoutes     = "routes:write"
+    ActionEditTimetable   = "routes:timetable"
+    ActionRouteAnalytics  = "routes:analytics"
+    ActionReadRouteSets   = "route-sets:read"
+    ActionWriteRouteSets  = "route-sets:write"
+    ActionReadVehicles    = "vehicles:read"
+    ActionReportPosition  = "vehicles:report"
+    ActionPlanJourney     = "journeys:plan"
+    ActionCreateTrip      = "trips:create"
+    ActionBook            = "bookings:create"
+    ActionCancelBooking   = "bookings:cancel"
+    ActionBoard           = "bookings:board"
+    ActionReadBookings    = "bookings:read"
+    ActionPay             = "payments:create"
+    ActionReadPayments    = "payments:read"
+    ActionRefund          = "payments:refund"
+    ActionRequestRide     = "rides:request"
+    ActionAnswerSeats     = "seat-requests:answer"
+    ActionReadIncidents   = "incidents:read"
+    ActionReportIncident  = "incidents:report"
+    ActionResolveIncident = "incidents:resolve"
+)
+
+// PolicyRules is who may do what. Riders request rides and hold seats, and
+// book, pay for, cancel and see their own bookings and payments. Conductors
+// report for, open trips on, answer the seat requests of and board the
+// riders of the vehicle they work, and report incidents on the road. SACCO admins keep the
+// timetables and fares of their SACCO's routes and resolve incidents, and
+// platform admins do everything.
+var PolicyRules = []auth.Rule{
+    {Role: auth.RoleRider, Actions: []string{ActionReadRoutes, ActionReadVehicles, ActionPlanJourney, ActionReadIncidents}},
+    {Role: auth.RoleRider, Actions: []string{ActionRequestRide, ActionBook, ActionCancelBooking, ActionReadBookings, ActionPay, ActionReadPayments}, When: auth.OwnResource},
+
+    {Role: auth.RoleConductor, Actions: []string{ActionReadRoutes, ActionReadVehicles, ActionPlanJourney, ActionReadIncidents, ActionReportIncident}},
+    {Role: auth.RoleConductor, Actions: []string{ActionReportPosition, ActionCreateTrip, ActionAnswerSeats, ActionBoard, ActionReadBookings}, When: auth.OwnVehicle},
+
+    {Role: auth.RoleSaccoAdmin, Actions: []string{ActionReadRoutes, ActionReadVehicles, ActionPlanJourney, ActionReadRouteSets,
+        ActionReadIncidents, ActionReportIncident, ActionResolveIncident}},
+    {Role: auth.RoleSaccoAdmin, Actions: []string{ActionEditTimetable, ActionRouteAnalytics}, When: auth.OwnSacco},
+
+    {Role: auth.RoleAdmin, Actions: []string{auth.AnyAction}},
+}
+
+// authorize checks the caller may take an action on a resource. Endpoints
+// whose rules look at the resource call it once they have loaded it; the
+// middleware has only checked the caller's role. An API run without
+// authentication allows everything.
+func (s *APIServer) authorize(ctx context.Context, action string, resource auth.Resource) error {
+    if s.config.Auth == nil {
+        return nil
+    }
+    return s.config.Policy.Authorize(ctx, action, resource)
+}
+
+// caller is the subject of the request's token, if it has one
+func caller(ctx context.Context) string {
+    if claims, ok := auth.ClaimsFrom(ctx); ok {
+        return claims.Subject
+    }
+    return ""
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/golang-jwt/jwt"
+
+    "motown/auth"
+)
+
+func TestPolicyRules(t *testing.T) {
+    policy := auth.NewPolicy(PolicyRules)
+    rider := &auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "rider-1"}, Role: auth.RoleRider}
+    conductor := &auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "crew-1"}, Role: auth.RoleConductor, Vehicle: "KBX 123A"}
+    saccoAdmin := &auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "sacco-admin"}, Role: auth.RoleSaccoAdmin, Sacco: "sacco-1"}
+    admin := &auth.Claims{StandardClaims: jwt.StandardClaims{Subject: "root"}, Role: auth.RoleAdmin}
+
+    ownBooking := auth.Resource{Owner: "rider-1", Vehicle: "KBX 123A", Sacco: "sacco-1"}
+    otherBooking := auth.Resource{Owner: "rider-2", Vehicle: "KCA 999Z", Sacco: "sacco-2"}
+    ownRoute := auth.Resource{Sacco: "sacco-1"}
+    otherRoute := auth.Resource{Sacco: "sacco-2"}
+
+    tests := []struct {
+        name     string
+        claims   *auth.Claims
+        action   string
+        resource auth.Resource
+        want     bool
+    }{
+        {name: "rider plans a journey", claims: rider, action: ActionPlanJourney, want: true},
+        {name: "rider reads vehicles", claims: rider, action: ActionReadVehicles, want: true},
+        {name: "rider books for self", claims: rider, action: ActionBook, resource: ownBooking, want: true},
+        {name: "rider books for another", claims: rider, action: ActionBook, resource: otherBooking},
+        {name: "rider reads own booking", claims: rider, action: ActionReadBookings, resource: ownBooking, want: true},
+        {name: "rider reads another's booking", claims: rider, action: ActionReadBookings, resource: otherBooking},
+        {name: "rider pays for own booking", claims: rider, action: ActionPay, resource: ownBooking, want: true},
+        {name: "rider pays for another's booking", claims: rider, action: ActionPay, resource: otherBooking},
+        {name: "rider reads own payment", claims: rider, action: ActionReadPayments, resource: ownBooking, want: true},
+        {name: "rider refunds own payment", claims: rider, action: ActionRefund, resource: ownBooking},
+        {name: "rider reports a position", claims: rider, action: ActionReportPosition, resource: ownBooking},
+        {name: "rider edits a timetable", claims: rider, action: ActionEditTimetable, resource: ownRoute},
+        {name: "rider requests a ride for self", claims: rider, action: ActionRequestRide, resource: ownBooking, want: true},
+        {name: "rider holds seats on another's ride", claims: rider, action: ActionRequestRide, resource: otherBooking},
+        {name: "rider cancels own booking", claims: rider, action: ActionCancelBooking, resource: ownBooking, want: true},
+        {name: "rider cancels another's booking", claims: rider, action: ActionCancelBooking, resource: otherBooking},
+        {name: "rider boards self", claims: rider, action: ActionBoard, resource: ownBooking},
+        {name: "rider opens a trip", claims: rider, action: ActionCreateTrip, resource: ownBooking},
+        {name: "rider answers seat requests", claims: rider, action: ActionAnswerSeats, resource: ownBooking},
+        {name: "rider reads incidents", claims: rider, action: ActionReadIncidents, want: true},
+        {name: "rider reports an incident", claims: rider, action: ActionReportIncident},
+
+        {name: "conductor reports for own vehicle", claims: conductor, action: ActionReportPosition, resource: auth.Resource{Vehicle: "KBX 123A"}, want: true},
+        {name: "conductor reports for another vehicle", claims: conductor, action: ActionReportPosition, resource: auth.Resource{Vehicle: "KCA 999Z"}},
+        {name: "conductor reads own vehicle's bookings", claims: conductor, action: ActionReadBookings, resource: ownBooking, want: true},
+        {name: "conductor reads another vehicle's bookings", claims: conductor, action: ActionReadBookings, resource: otherBooking},
+        {name: "conductor answers own vehicle's seat requests", claims: conductor, action: ActionAnswerSeats, resource: auth.Resource{Vehicle: "KBX 123A"}, want: true},
+        {name: "conductor answers another vehicle's seat requests", claims: conductor, action: ActionAnswerSeats, resource: auth.Resource{Vehicle: "KCA 999Z"}},
+        {name: "conductor opens a trip on own vehicle", claims: conductor, action: ActionCreateTrip, resource: auth.Resource{Vehicle: "KBX 123A"}, want: true},
+        {name: "conductor opens a trip on another vehicle", claims: conductor, action: ActionCreateTrip, resource: auth.Resource{Vehicle: "KCA 999Z"}},
+        {name: "conductor boards own vehicle's rider", claims: conductor, action: ActionBoard, resource: ownBooking, want: true},
+        {name: "conductor boards another vehicle's rider", claims: conductor, action: ActionBoard, resource: otherBooking},
+        {name: "conductor cancels a booking", claims: conductor, action: ActionCancelBooking, resource: ownBooking},
+        {name: "conductor books", claims: conductor, action: ActionBook, resource: ownBooking},
+        {name: "conductor writes routes", claims: conductor, action: ActionWriteRoutes},
+        {name: "conductor reports an incident", claims: conductor, action: ActionReportIncident, want: true},
+        {name: "conductor resolves an incident", claims: conductor, action: ActionResolveIncident},
+
+        {name: "sacco admin edits own timetable", claims: saccoAdmin, action: ActionEditTimetable, resource: ownRoute, want: true},
+        {name: "sacco admin edits another sacco's timetable", claims: saccoAdmin, action: ActionEditTimetable, resource: otherRoute},
+        {name: "sacco admin reads own analytics", claims: saccoAdmin, action: ActionRouteAnalytics, resource: ownRoute, want: true},
+        {name: "sacco admin reads another sacco's analytics", claims: saccoAdmin, action: ActionRouteAnalytics, resource: otherRoute},
+        {name: "sacco admin reads route sets", claims: saccoAdmin, action: ActionReadRouteSets, want: true},
+        {name: "sacco admin writes route sets", claims: saccoAdmin, action: ActionWriteRouteSets},
+        {name: "sacco admin creates routes", claims: saccoAdmin, action: ActionWriteRoutes},
+        {name: "sacco admin refunds", claims: saccoAdmin, action: ActionRefund, resource: ownBooking},
+        {name: "sacco admin resolves an incident", claims: saccoAdmin, action: ActionResolveIncident, want: true},
+
+        {name: "admin writes routes", claims: admin, action: ActionWriteRoutes, want: true},
+        {name: "admin edits any timetable", claims: admin, action: ActionEditTimetable, resource: otherRoute, want: true},
+        {name: "admin refunds", claims: admin, action: ActionRefund, resource: otherBooking, want: true},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := policy.Allowed(tt.claims, tt.action, tt.resource); got != tt.want {
+                t.Errorf("Allowed(%s, %s) = %v, want %v", tt.claims.Role, tt.action, got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/uber/h3-go/v4"
+)
+
+const (
+    probeSource     = "gps-probe"
+    probeResolution = 9
+    probeWindow     = 5 * time.Minute // how long samples are pooled before publishing
+
+    // A vehicle faster than this between fixes is a GPS jump; slower than
+    // the minimum it is dwelling at a stage or stuck at a light
+    maxProbeSpeedKmh = 120.0
+    minProbeSpeedKmh = 3.0
+
+    minFixInterval   = 2 * time.Second
+    maxFixInterval   = 2 * time.Minute
+    maxProbePathHops = 20
+
+    minCellSamples     = 3
+    freeFlowPercentile = 0.85
+    freeFlowMinSamples = 20
+    freeFlowHistory    = 500
+    outlierMADs        = 3.0
+)
+
+// VehicleFix is a GPS position reported by a vehicle
+type VehicleFix struct {
+    VehicleID string    `json:"vehicle_id"`
+    RouteID   string    `json:"route_id,omitempty"`
+    Lat       float64   `json:"lat"`
+    Lng       float64   `json:"lng"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// ProbeIngestor derives per-cell traffic from consecutive fleet GPS fixes
+// and publishes it to the RealTimeManager
+type ProbeIngestor struct {
+    rtm         *RealTimeManager
+    lastFix     map[string]VehicleFix
+    prevFix     map[string]VehicleFix
+    samples     map[string][]float64 // h3 index -> speeds in the current window
+    observed    map[string][]float64 // h3 index -> recent speeds, for free flow
+    windowStart time.Time
+    now         func() time.Time
+    mu          sync.Mutex
+}
+
+func NewProbeIngestor(rtm *RealTimeManager) *ProbeIngestor {
+    return &ProbeIngestor{
+        rtm:      rtm,
+        lastFix:  make(map[string]VehicleFix),
+        prevFix:  make(map[string]VehicleFix),
+        samples:  make(map[string][]float64),
+        observed: make(map[string][]float64),
+        now:      time.Now,
+    }
+}
+
+// Ingest takes a fix, matches the hop from the vehicle's previous fix onto
+// H3 cells and records its speed in each. Hops that look like GPS jumps or
+// dwelling at a stage are dropped. Pooled samples are published to the
+// RealTimeManager once the current window has run its course.
+func (pi *ProbeIngestor) Ingest(fix VehicleFix) error {
+    if fix.VehicleID == "" {
+        return fmt.Errorf("fix has no vehicle id")
+    }
+    if fix.Lat < -90 || fix.Lat > 90 || fix.Lng < -180 || fix.Lng > 180 {
+        return fmt.Errorf("fix for %s has invalid position %f,%f", fix.VehicleID, fix.Lat, fix.Lng)
+    }
+    if fix.Timestamp.IsZero() {
+        fix.Timestamp = pi.now()
+    }
+
+    pi.mu.Lock()
+    previous, seen := pi.lastFix[fix.VehicleID]
+    if seen && !fix.Timestamp.After(previous.Timestamp) {
+        pi.mu.Unlock()
+        return nil // duplicate or out of order
+    }
+    pi.lastFix[fix.VehicleID] = fix
+    if seen {
+        pi.prevFix[fix.VehicleID] = previous
+        pi.recordHop(previous, fix)
+    }
+
+    var ready map[string][]float64
+    if pi.windowStart.IsZero() {
+        pi.windowStart = pi.now()
+    } else if pi.now().Sub(pi.windowStart) >= probeWindow {
+        ready = pi.takeWindow()
+    }
+    pi.mu.Unlock()
+
+    // Publish outside our lock; the RealTimeManager takes its own
+    pi.publish(ready)
+    return nil
+}
+
+// recordHop adds the speed of the hop between two fixes to every cell on
+// its path. Callers must hold pi.mu.
+func (pi *ProbeIngestor) recordHop(from, to VehicleFix) {
+    elapsed := to.Timestamp.Sub(from.Timestamp)
+    if elapsed < minFixInterval || elapsed > maxFixInterval {
+        return
+    }
+
+    km := calculateDistance(from.Lat, from.Lng, to.Lat, to.Lng) / 1000
+    speed := km / elapsed.Hours()
+    if speed > maxProbeSpeedKmh || speed < minProbeSpeedKmh {
+        return
+    }
+
+    for _, cell := range probePath(from, to) {
+        pi.samples[cell] = append(pi.samples[cell], speed)
+    }
+}
+
+// probePath returns the cells a straight hop between two fixes crosses
+func probePath(from, to VehicleFix) []string {
+    a := h3.LatLngToCell(h3.NewLatLng(from.Lat, from.Lng), probeResolution)
+    b := h3.LatLngToCell(h3.NewLatLng(to.Lat, to.Lng), probeResolution)
+    if a == b {
+        return []string{a.String()}
+    }
+
+    // GridPath can't cross pentagon distortion; fall back to the end cells
+    hops := h3.GridDistance(a, b)
+    if hops <= 0 || hops > maxProbePathHops {
+        return []string{a.String(), b.String()}
+    }
+
+    path := h3.GridPath(a, b)
+    cells := make([]string, len(path))
+    for i, cell := range path {
+        cells[i] = cell.String()
+    }
+    return cells
+}
+
+// takeWindow hands over the samples pooled so far and starts a new window.
+// Callers must hold pi.mu.
+func (pi *ProbeIngestor) takeWindow() map[string][]float64 {
+    ready := pi.samples
+    pi.samples = make(map[string][]float64)
+    pi.windowStart = pi.now()
+    return ready
+}
+
+// Flush publishes whatever has been pooled without waiting for the window
+func (pi *ProbeIngestor) Flush() {
+    pi.mu.Lock()
+    ready := pi.takeWindow()
+    pi.mu.Unlock()
+
+    pi.publish(ready)
+}
+
+// publish turns pooled samples into traffic updates
+func (pi *ProbeIngestor) publish(ready map[string][]float64) {
+    for cell, speeds := range ready {
+        speeds = removeOutliers(speeds)
+        if len(speeds) < minCellSamples {
+            continue
+        }
+
+        var total float64
+        for _, speed := range speeds {
+            total += speed
+        }
+        speed := total / float64(len(speeds))
+
+        freeFlow := pi.freeFlowSpeed(cell, speeds)
+        congestion := math.Min(1, math.Max(0, 1-speed/freeFlow))
+
+        pi.rtm.UpdateTrafficFrom(cell, speed, congestion, probeSource)
+    }
+}
+
+// freeFlowSpeed records a cell's speeds and returns its free-flow speed,
+// taken as a high percentile of what vehicles manage there
+func (pi *ProbeIngestor) freeFlowSpeed(cell string, speeds []float64) float64 {
+    pi.mu.Lock()
+    defer pi.mu.Unlock()
+
+    history := append(pi.observed[cell], speeds...)
+    if len(history) > freeFlowHistory {
+        history = history[len(history)-freeFlowHistory:]
+    }
+    pi.observed[cell] = history
+
+    if len(history) < freeFlowMinSamples {
+        return freeFlowSpeedKmh
+    }
+
+    sorted := append([]float64(nil), history...)
+    sort.Float64s(sorted)
+    return math.Max(sorted[int(freeFlowPercentile*float64(len(sorted)-1))], minProbeSpeedKmh)
+}
+
+// removeOutliers drops samples further than a few median absolute
+// deviations from the median
+func removeOutliers(speeds []float64) []float64 {
+    if len(speeds) < 3 {
+        return speeds
+    }
+
+    median := medianOf(speeds)
+    deviations := make([]float64, len(speeds))
+    for i, speed := range speeds {
+        deviations[i] = math.Abs(speed - median)
+    }
+    mad := medianOf(deviations)
+    if mad == 0 {
+        return speeds
+    }
+
+    kept := speeds[:0:0]
+    for _, speed := range speeds {
+        if math.Abs(speed-median) <= outlierMADs*mad {
+            kept = append(kept, speed)
+        }
+    }
+    return kept
+}
+
+func medianOf(values []float64) float64 {
+    sorted := append([]float64(nil), values...)
+    sort.Float64s(sorted)
+    mid := len(sorted) / 2
+    if len(sorted)%2 == 0 {
+        return (sorted[mid-1] + sorted[mid]) / 2
+    }
+    return sorted[mid]
+}
+
+// restore brings back a vehicle's last fix from the event log without
+// deriving traffic from it again
+func (pi *ProbeIngestor) restore(fix VehicleFix) {
+    pi.mu.Lock()
+    defer pi.mu.Unlock()
+
+    previous, seen := pi.lastFix[fix.VehicleID]
+    if !seen || fix.Timestamp.After(previous.Timestamp) {
+        if seen {
+            pi.prevFix[fix.VehicleID] = previous
+        }
+        pi.lastFix[fix.VehicleID] = fix
+    }
+}
+
+// VehicleTrack returns a vehicle's last two fixes, for working out which
+// way it is heading. hasPrevious is false until a second fix arrives.
+func (pi *ProbeIngestor) VehicleTrack(vehicleID string) (previous, latest VehicleFix, hasPrevious bool) {
+    pi.mu.Lock()
+    defer pi.mu.Unlock()
+
+    latest = pi.lastFix[vehicleID]
+    previous, hasPrevious = pi.prevFix[vehicleID]
+    return previous, latest, hasPrevious
+}
+
+// VehiclePositions returns the latest fix of every vehicle seen within maxAge
+func (pi *ProbeIngestor) VehiclePositions(maxAge time.Duration) []VehicleFix {
+    pi.mu.Lock()
+    defer pi.mu.Unlock()
+
+    now := pi.now()
+    var positions []VehicleFix
+    for _, fix := range pi.lastFix {
+        if now.Sub(fix.Timestamp) <= maxAge {
+            positions = append(positions, fix)
+        }
+    }
+    sort.Slice(positions, func(i, j int) bool {
+        return positions[i].VehicleID < positions[j].VehicleID
+    })
+    return positions
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+
+    "motown/dgraph"
+)
+
+// TrafficData represents real-time traffic information
+type TrafficData struct {
+    H3Index      string    `json:"h3_index"`
+    Speed        float64   `json:"speed_kmh"`
+    Congestion   float64   `json:"congestion_level"` // 0-1
+    LastUpdated  time.Time `json:"last_updated"`
+    Source       string    `json:"source"`
+}
+
+// PredictiveModel represents route demand and performance predictions
+type PredictiveModel struct {
+    RouteID      string                `json:"route_id"`
+    Predictions  map[string]Prediction `json:"predictions"` // hour of week ("Mon 08:00") -> prediction
+    Accuracy     float64               `json:"accuracy_score"`
+    LastTrained  time.Time             `json:"last_trained"`
+}
+
+type Prediction struct {
+    Demand       float64 `json:"expected_demand"`
+    TravelTime   float64 `json:"expected_travel_time"` // minutes
+    Reliability  float64 `json:"reliability_score"`
+}
+
+// RealTimeManager handles real-time updates and predictions
+type RealTimeManager struct {
+    trafficData    map[string]*TrafficData
+    predictions    map[string]*PredictiveModel
+    bus            *EventBus
+    processor      *Subscription
+    relay          *Relay
+    processed      chan struct{}
+    eventLog       *EventLog
+    journalled     chan struct{}
+    profile        *SpeedProfile
+    estimator      *TravelTimeEstimator
+    probes         *ProbeIngestor
+    incidents      *IncidentManager
+    health         *HealthMonitor
+    alerts         *AlertManager
+    rides          *RideDispatcher
+    bookings       *BookingService
+    payments       *PaymentService
+    streams        *StreamHub
+    mu            sync.RWMutex
+    dgraph        *dgo.Dgraph
+    planner       *RoutePlanner
+}
+
+func NewRealTimeManager(client *dgraph.Client, planner *RoutePlanner) *RealTimeManager {
+    rtm := &RealTimeManager{
+        trafficData: make(map[string]*TrafficData),
+        predictions: make(map[string]*PredictiveModel),
+        bus:         NewEventBus(),
+        processed:   make(chan struct{}),
+        journalled:  make(chan struct{}),
+        profile:     NewSpeedProfile(),
+        dgraph:      client.Dgraph,
+        planner:     planner,
+    }
+    rtm.estimator = NewTravelTimeEstimator(rtm, rtm.profile)
+    rtm.probes = NewProbeIngestor(rtm)
+    rtm.incidents = NewIncidentManager(rtm)
+    rtm.health = NewHealthMonitor(rtm)
+    rtm.alerts = NewAlertManager(rtm)
+    rtm.rides = NewRideDispatcher(rtm)
+    rtm.bookings = NewBookingService(client)
+    rtm.payments = NewPaymentService(client, rtm.bookings)
+
+    if planner != nil {
+        planner.SetTrafficSource(rtm)
+    }
+
+    // Reports coming in over the bus must not be lost, so publishers wait
+    // for the processor rather than dropping them. It publishes the alerts
+    // they raise through the relay, as a publisher may be waiting on it.
+    rtm.processor, _ = rtm.bus.Subscribe(SubscribeOptions{
+        Topics:       []string{TopicDemand, TopicIncident},
+        Buffer:       1000,
+        Policy:       Block,
+        BlockTimeout: blockTimeout,
+    })
+    rtm.relay = NewRelay(rtm.bus)
+
+    rtm.streams = NewStreamHub(rtm)
+
+    // Start update processing
+    go rtm.processUpdates()
+    go rtm.streams.run()
+    go rtm.incidents.run()
+    go rtm.health.run()
+    return rtm
+}
+
+// ProcessUpdates handles real-time updates
+func (rtm *RealTimeManager) processUpdates() {
+    defer close(rtm.processed)
+
+    for update := range rtm.processor.C {
+        switch update.UpdateType {
+        case TopicDemand:
+            rtm.handleDemandUpdate(update)
+        case TopicIncident:
+            rtm.handleIncidentUpdate(update)
+        }
+    }
+}
+
+// Subscribe registers a subscriber for live updates
+func (rtm *RealTimeManager) Subscribe(opts SubscribeOptions) (*Subscription, error) {
+    return rtm.bus.Subscribe(opts)
+}
+
+// Publish puts an update on the bus. It must not be called while holding
+// rtm.mu, since Block subscribers may need it to drain their buffers.
+func (rtm *RealTimeManager) Publish(update RouteUpdate) error {
+    _, err := rtm.bus.Publish(update)
+    return err
+}
+
+// Close stops background work, closes the bus and waits for updates
+// already queued to be processed
+func (rtm *RealTimeManager) Close() {
+    rtm.health.Close()
+    rtm.alerts.Close()
+    rtm.payments.Close()
+    rtm.bookings.Close()
+    rtm.incidents.Close()
+    rtm.probes.Flush()
+    rtm.bus.Close()
+    <-rtm.processed
+    rtm.relay.Close()
+
+    rtm.mu.RLock()
+    journalling := rtm.eventLog != nil
+    rtm.mu.RUnlock()
+    if journalling {
+        <-rtm.journalled
+    }
+}
+
+// UpdateTraffic updates traffic data for a specific area
+func (rtm *RealTimeManager) UpdateTraffic(h3Index string, speed float64, congestion float64) {
+    rtm.UpdateTrafficFrom(h3Index, speed, congestion, "real-time-sensors")
+}
+
+// IngestFix feeds a vehicle GPS fix into the traffic derived from the fleet
+// and publishes it as a position update
+func (rtm *RealTimeManager) IngestFix(fix VehicleFix) error {
+    if fix.Timestamp.IsZero() {
+        fix.Timestamp = time.Now()
+    }
+    if err := rtm.probes.Ingest(fix); err != nil {
+        return err
+    }
+    rtm.journal(LogRecord{At: fix.Timestamp, Kind: RecordFix, Fix: &fix})
+
+    rtm.Publish(RouteUpdate{
+        UpdateType: TopicPosition,
+        RouteID:    fix.RouteID,
+        Position:   &fix,
+        Timestamp:  fix.Timestamp,
+    })
+    return nil
+}
+
+// UpdateTrafficFrom updates traffic data for an area, noting where it came from
+func (rtm *RealTimeManager) UpdateTrafficFrom(h3Index string, speed float64, congestion float64, source string) {
+    // Every live sample also builds up the historical speed profile
+    rtm.profile.Observe(h3Index, time.Now(), speed)
+
+    traffic := TrafficData{
+        H3Index:     h3Index,
+        Speed:       speed,
+        Congestion:  congestion,
+        LastUpdated: time.Now(),
+        Source:      source,
+    }
+
+    rtm.mu.Lock()
+    rtm.trafficData[h3Index] = &traffic
+    rtm.mu.Unlock()
+
+    // Publish outside the lock so slow subscribers can't stall readers
+    if err := rtm.Publish(RouteUpdate{
+        UpdateType: TopicTraffic,
+        Traffic:    &traffic,
+        Timestamp:  traffic.LastUpdated,
+    }); err != nil && !errors.Is(err, ErrBusClosed) {
+        log.Printf("Publishing traffic for %s: %v", h3Index, err)
+    }
+}
+
+// CongestionAt returns the last known congestion level for a cell
+func (rtm *RealTimeManager) CongestionAt(h3Index string) (float64, bool) {
+    rtm.mu.RLock()
+    defer rtm.mu.RUnlock()
+
+    traffic, exists := rtm.trafficData[h3Index]
+    if !exists {
+        return 0, false
+    }
+    return traffic.Congestion, true
+}
+
+// PredictDemand predicts route demand for the next 24 hours, keyed "15:00"
+func (rtm *RealTimeManager) PredictDemand(ctx context.Context, routeID string) (map[string]Prediction, error) {
+    rtm.mu.RLock()
+    model, exists := rtm.predictions[routeID]
+    rtm.mu.RUnlock()
+
+    if !exists {
+        // Fall back to the last model stored for the route
+        stored, err := loadModel(ctx, rtm.dgraph, routeID)
+        if err != nil {
+            return nil, err
+        }
+        if stored != nil {
+            model, exists = stored, true
+            rtm.mu.Lock()
+            rtm.predictions[routeID] = model
+            rtm.mu.Unlock()
+        }
+    }
+
+    if !exists || time.Since(model.LastTrained) > 24*time.Hour {
+        // Train new model if doesn't exist or is outdated
+        if err := rtm.trainModel(ctx, routeID); err != nil {
+            return nil, err
+        }
+        rtm.mu.RLock()
+        model = rtm.predictions[routeID]
+        rtm.mu.RUnlock()
+    }
+
+    // Get predictions for next 24 hours
+    predictions := make(map[string]Prediction)
+    now := time.Now()
+    for i := 0; i < 24; i++ {
+        hour := now.Add(time.Duration(i) * time.Hour)
+        hourKey := fmt.Sprintf("%02d:00", hour.Hour())
+        predictions[hourKey] = model.Predictions[hourOfWeekKey(hourOfWeek(hour))]
+    }
+
+    return predictions, nil
+}
+
+// TrainModel trains the predictive model for a route from hour-of-week
+// baselines over its stored ridership
+func (rtm *RealTimeManager) trainModel(ctx context.Context, routeID string) error {
+    // Fetch historical data
+    historicalData, err := rtm.getHistoricalData(ctx, routeID)
+    if err != nil {
+        return err
+    }
+    series := hourlySeries(historicalData)
+
+    // Train model using historical data
+    model := &PredictiveModel{
+        RouteID:     routeID,
+        Predictions: make(map[string]Prediction),
+        LastTrained: time.Now(),
+    }
+
+    // Travel times not observed in ridership come from the traffic profile
+    var route *Route
+    if rtm.planner != nil {
+        route, err = rtm.planner.getRoute(ctx, routeID)
+        if err != nil {
+            return err
+        }
+    }
+
+    // Process historical data and generate predictions
+    now := time.Now()
+    for slot := 0; slot < hoursPerWeek; slot++ {
+        prediction := rtm.calculatePrediction(series, slot)
+        if prediction.TravelTime == 0 && route != nil {
+            departAt := now.Add(time.Duration((slot-hourOfWeek(now)+hoursPerWeek)%hoursPerWeek) * time.Hour)
+            prediction.TravelTime = rtm.estimator.EstimateRoute(*route, departAt).Duration.Minutes()
+        }
+        model.Predictions[hourOfWeekKey(slot)] = prediction
+    }
+
+    // Calculate model accuracy
+    model.Accuracy = rtm.calculateModelAccuracy(series)
+
+    // Store the model
+    if err := saveModel(ctx, rtm.dgraph, model); err != nil {
+        return err
+    }
+
+    rtm.mu.Lock()
+    rtm.predictions[routeID] = model
+    rtm.mu.Unlock()
+
+    rtm.journal(LogRecord{At: model.LastTrained, Kind: RecordModel, Model: model})
+    return nil
+}
+
+// OptimizeRealTime performs real-time route optimization
+func (rtm *RealTimeManager) OptimizeRealTime(ctx context.Context, routeSetID string) error {
+    // Current traffic reaches the planner through CongestionAt
+    optimizationCriteria := map[string]float64{
+        CriterionTraffic:     0.4,
+        CriterionDemand:      0.3,
+        CriterionReliability: 0.3,
+    }
+
+    _, err := rtm.planner.OptimizeRouteSet(ctx, routeSetID, optimizationCriteria, OptimizationConstraints{})
+    return err
+}
+
+// Example usage
+func realTimeExample() {
+    ctx := context.Background()
+    dgraphClient := createDgraphClient()
+    defer dgraphClient.Close()
+    cache := NewRouteCache(15 * time.Minute)
+    planner := NewRoutePlanner(dgraphClient.Dgraph, cache)
+    rtm := NewRealTimeManager(dgraphClient, planner)
+
+    // Start route monitoring
+    if err := rtm.MonitorAllRoutes(ctx); err != nil {
+        log.Fatal(err)
+    }
+
+    // Update traffic data
+    rtm.UpdateTraffic("8928308281fffff", 45.5, 0.3)
+
+    // Get demand predictions
+    predictions, err := rtm.PredictDemand(ctx, "route-123")
+    if err != nil {
+        log.Fatal(err)
+    }
+    fmt.Printf("Demand predictions: %v\n", predictions)
+
+    // Optimize routes in real-time
+    err = rtm.OptimizeRealTime(ctx, "set-456")
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    // Example of handling real-time updates
+    update := RouteUpdate{
+        RouteID:    "route-123",
+        UpdateType: TopicIncident,
+        Incident: &Incident{
+            Type:     IncidentAccident,
+            Location: Location{Lat: -1.2865, Lng: 36.815},
+            Severity: SeverityHigh,
+        },
+        Timestamp: time.Now(),
+    }
+    if err := rtm.Publish(update); err != nil {
+        log.Fatal(err)
+    }
+}
+
+// HealthMetrics represents route health information
+type HealthMetrics struct {
+    RouteID      string        `json:"route_id"`
+    Score        float64       `json:"health_score"`
+    State        string        `json:"state"`
+    Issues       []string      `json:"issues"`
+    Checks       []CheckResult `json:"checks"`
+    LastChecked  time.Time     `json:"last_checked"`
+}
+
+func (rtm *RealTimeManager) handleUnhealthyRoute(ctx context.Context, routeID string, health HealthMetrics) {
+    // Log the issue
+    log.Printf("Unhealthy route detected: %s %s", routeID, describeHealth(health))
+
+    // Notify relevant systems
+    for _, issue := range health.Issues {
+        rtm.Publish(RouteUpdate{
+            RouteID:    routeID,
+            UpdateType: TopicHealth,
+            Health:     &HealthIssue{Score: health.Score, Issue: issue},
+            Timestamp:  health.LastChecked,
+        })
+    }
+
+    // Re-optimise the route sets a route that is down belongs to
+    if health.State == HealthDown {
+        route, err := rtm.planner.getRoute(ctx, routeID)
+        if err != nil {
+            log.Printf("Re-optimising around route %s: %v", routeID, err)
+            return
+        }
+        sets, err := rtm.planner.RouteSetsContainingRoute(ctx, route.RouteNumber)
+        if err != nil {
+            log.Printf("Re-optimising around route %s: %v", routeID, err)
+            return
+        }
+        for _, set := range sets {
+            if err := rtm.OptimizeRealTime(ctx, set.ID); err != nil {
+                log.Printf("Re-optimising route set %s: %v", set.ID, err)
+            }
+        }
+    }
+}
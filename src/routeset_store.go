@@ -0,0 +1,458 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+    "github.com/dgraph-io/dgo/v210/protos/api"
+    "github.com/uber/h3-go/v4"
+)
+
+// ErrRouteSetConflict is returned when a route set was changed by someone
+// else since it was read
+var ErrRouteSetConflict = errors.New("route set was modified concurrently")
+
+// RouteSetVersion is a snapshot of a route set taken on every update
+type RouteSetVersion struct {
+    Version int       `json:"version"`
+    Routes  []string  `json:"route_ids"`
+    Reason  string    `json:"reason"`
+    Created time.Time `json:"created_at"`
+}
+
+// routeSetNode is how a RouteSet is stored in Dgraph
+type routeSetNode struct {
+    Uid        string            `json:"uid,omitempty"`
+    DType      []string          `json:"dgraph.type,omitempty"`
+    SetID      string            `json:"set_id,omitempty"`
+    Name       string            `json:"set_name,omitempty"`
+    Routes     []routeRef        `json:"set_routes,omitempty"`
+    Candidates []routeRef        `json:"set_candidates,omitempty"`
+    Coverage   []string          `json:"h3_coverage,omitempty"`
+    Properties string            `json:"set_properties,omitempty"`
+    Version    int               `json:"set_version"`
+    History    []routeSetVersion `json:"set_history,omitempty"`
+    Created    time.Time         `json:"created_at"`
+    Updated    time.Time         `json:"updated_at"`
+}
+
+type routeRef struct {
+    Uid string `json:"uid"`
+}
+
+type routeSetVersion struct {
+    Uid     string     `json:"uid,omitempty"`
+    DType   []string   `json:"dgraph.type,omitempty"`
+    Version int        `json:"version_number"`
+    Routes  []routeRef `json:"version_routes,omitempty"`
+    Reason  string     `json:"version_reason,omitempty"`
+    Created time.Time  `json:"created_at"`
+}
+
+// Fields fetched whenever a route set is read
+const routeSetFields = `
+            uid
+            set_id
+            set_name
+            set_routes { uid }
+            set_candidates { uid }
+            h3_coverage
+            set_properties
+            set_version
+            created_at
+            updated_at`
+
+// generateUUID returns a random (version 4) UUID
+func generateUUID() string {
+    var b [16]byte
+    if _, err := rand.Read(b[:]); err != nil {
+        panic(err)
+    }
+    b[6] = (b[6] & 0x0f) | 0x40
+    b[8] = (b[8] & 0x3f) | 0x80
+    return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+func toRouteRefs(uids []string) []routeRef {
+    refs := make([]routeRef, len(uids))
+    for i, uid := range uids {
+        refs[i] = routeRef{Uid: uid}
+    }
+    return refs
+}
+
+func fromRouteRefs(refs []routeRef) []string {
+    uids := make([]string, len(refs))
+    for i, ref := range refs {
+        uids[i] = ref.Uid
+    }
+    return uids
+}
+
+func (n routeSetNode) toRouteSet() (*RouteSet, error) {
+    routeSet := &RouteSet{
+        ID:         n.SetID,
+        Name:       n.Name,
+        Routes:     fromRouteRefs(n.Routes),
+        Candidates: fromRouteRefs(n.Candidates),
+        Coverage:   n.Coverage,
+        Properties: make(map[string]interface{}),
+        Version:    n.Version,
+        Created:    n.Created,
+        Updated:    n.Updated,
+    }
+    if n.Properties != "" {
+        if err := json.Unmarshal([]byte(n.Properties), &routeSet.Properties); err != nil {
+            return nil, fmt.Errorf("decoding properties of route set %s: %w", n.SetID, err)
+        }
+    }
+    return routeSet, nil
+}
+
+// saveRouteSet writes a route set as the next version after expectedVersion
+// and records a history entry. A version of 0 creates the set.
+func saveRouteSet(ctx context.Context, dgraphClient *dgo.Dgraph, routeSet *RouteSet, expectedVersion int, reason string) error {
+    txn := dgraphClient.NewTxn()
+    defer txn.Discard(ctx)
+
+    resp, err := txn.QueryWithVars(ctx, `
+        query Current($id: string) {
+            sets(func: eq(set_id, $id)) @filter(type(RouteSet)) {
+                uid
+                set_version
+            }
+        }`, map[string]string{"$id": routeSet.ID})
+    if err != nil {
+        return err
+    }
+
+    var current struct {
+        Sets []routeSetNode `json:"sets"`
+    }
+    if err := json.Unmarshal(resp.Json, &current); err != nil {
+        return err
+    }
+
+    uid := "_:set"
+    switch {
+    case len(current.Sets) == 0 && expectedVersion != 0:
+        return fmt.Errorf("%w: %s", ErrRouteSetNotFound, routeSet.ID)
+    case len(current.Sets) > 0 && current.Sets[0].Version != expectedVersion:
+        return fmt.Errorf("%w: %s is at version %d, expected %d",
+            ErrRouteSetConflict, routeSet.ID, current.Sets[0].Version, expectedVersion)
+    case len(current.Sets) > 0:
+        uid = current.Sets[0].Uid
+
+        // List predicates are replaced rather than appended to
+        del := &api.Mutation{}
+        dgo.DeleteEdges(del, uid, "set_routes", "set_candidates", "h3_coverage")
+        if _, err := txn.Mutate(ctx, del); err != nil {
+            return err
+        }
+    }
+
+    properties, err := json.Marshal(routeSet.Properties)
+    if err != nil {
+        return err
+    }
+
+    now := time.Now()
+    node := routeSetNode{
+        Uid:        uid,
+        DType:      []string{"RouteSet"},
+        SetID:      routeSet.ID,
+        Name:       routeSet.Name,
+        Routes:     toRouteRefs(routeSet.Routes),
+        Candidates: toRouteRefs(routeSet.Candidates),
+        Coverage:   routeSet.Coverage,
+        Properties: string(properties),
+        Version:    expectedVersion + 1,
+        History: []routeSetVersion{{
+            DType:   []string{"RouteSetVersion"},
+            Version: expectedVersion + 1,
+            Routes:  toRouteRefs(routeSet.Routes),
+            Reason:  reason,
+            Created: now,
+        }},
+        Created: routeSet.Created,
+        Updated: now,
+    }
+
+    setJSON, err := json.Marshal(node)
+    if err != nil {
+        return err
+    }
+    if _, err := txn.Mutate(ctx, &api.Mutation{SetJson: setJSON}); err != nil {
+        return err
+    }
+
+    if err := txn.Commit(ctx); err != nil {
+        if errors.Is(err, dgo.ErrAborted) {
+            return fmt.Errorf("%w: %s", ErrRouteSetConflict, routeSet.ID)
+        }
+        return err
+    }
+
+    routeSet.Version = node.Version
+    routeSet.Updated = now
+    return nil
+}
+
+// queryRouteSets runs a query whose "sets" block returns route set nodes
+func queryRouteSets(ctx context.Context, dgraphClient *dgo.Dgraph, query string, vars map[string]string) ([]*RouteSet, error) {
+    resp, err := dgraphClient.NewReadOnlyTxn().QueryWithVars(ctx, query, vars)
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Sets []routeSetNode `json:"sets"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+
+    routeSets := make([]*RouteSet, 0, len(result.Sets))
+    for _, node := range result.Sets {
+        routeSet, err := node.toRouteSet()
+        if err != nil {
+            return nil, err
+        }
+        routeSets = append(routeSets, routeSet)
+    }
+    return routeSets, nil
+}
+
+// loadRouteSet reads a route set by its ID
+func loadRouteSet(ctx context.Context, dgraphClient *dgo.Dgraph, setID string) (*RouteSet, error) {
+    routeSets, err := queryRouteSets(ctx, dgraphClient, `
+        query RouteSet($id: string) {
+            sets(func: eq(set_id, $id)) @filter(type(RouteSet)) {`+routeSetFields+`
+            }
+        }`, map[string]string{"$id": setID})
+    if err != nil {
+        return nil, err
+    }
+    if len(routeSets) == 0 {
+        return nil, fmt.Errorf("%w: %s", ErrRouteSetNotFound, setID)
+    }
+    return routeSets[0], nil
+}
+
+// getRouteSet returns a route set from memory, loading it from Dgraph if it
+// isn't there yet
+func (rp *RoutePlanner) getRouteSet(ctx context.Context, setID string) (*RouteSet, error) {
+    rp.mu.RLock()
+    routeSet, exists := rp.routeSets[setID]
+    rp.mu.RUnlock()
+    if exists {
+        return routeSet, nil
+    }
+
+    routeSet, err := loadRouteSet(ctx, rp.dgraph, setID)
+    if err != nil {
+        return nil, err
+    }
+
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+    if cached, exists := rp.routeSets[setID]; exists {
+        return cached, nil
+    }
+    rp.routeSets[setID] = routeSet
+    return routeSet, nil
+}
+
+// saveRouteSet persists a changed copy of a route set and, once stored,
+// makes it the copy the planner works with
+func (rp *RoutePlanner) saveRouteSet(ctx context.Context, routeSet *RouteSet, expectedVersion int, reason string) error {
+    if err := saveRouteSet(ctx, rp.dgraph, routeSet, expectedVersion, reason); err != nil {
+        if errors.Is(err, ErrRouteSetConflict) {
+            // Our copy is stale; reload it on next access
+            rp.mu.Lock()
+            delete(rp.routeSets, routeSet.ID)
+            rp.mu.Unlock()
+        }
+        return err
+    }
+
+    rp.mu.Lock()
+    rp.routeSets[routeSet.ID] = routeSet
+    rp.mu.Unlock()
+    return nil
+}
+
+// GetRouteSet returns a route set by ID
+func (rp *RoutePlanner) GetRouteSet(ctx context.Context, setID string) (*RouteSet, error) {
+    routeSet, err := rp.getRouteSet(ctx, setID)
+    if err != nil {
+        return nil, err
+    }
+    copied := *routeSet
+    return &copied, nil
+}
+
+// ListRouteSets returns all stored route sets, most recently updated first
+func (rp *RoutePlanner) ListRouteSets(ctx context.Context) ([]*RouteSet, error) {
+    return queryRouteSets(ctx, rp.dgraph, `
+        {
+            sets(func: type(RouteSet), orderdesc: updated_at) {`+routeSetFields+`
+            }
+        }`, nil)
+}
+
+// UpdateRouteSet renames a route set and replaces its properties. The
+// update fails with ErrRouteSetConflict if the set is no longer at version.
+func (rp *RoutePlanner) UpdateRouteSet(ctx context.Context, setID string, version int, name string, properties map[string]interface{}) (*RouteSet, error) {
+    routeSet, err := rp.getRouteSet(ctx, setID)
+    if err != nil {
+        return nil, err
+    }
+
+    rp.mu.RLock()
+    updated := *routeSet
+    rp.mu.RUnlock()
+
+    if name != "" {
+        updated.Name = name
+    }
+    if properties != nil {
+        updated.Properties = properties
+    }
+
+    if err := rp.saveRouteSet(ctx, &updated, version, "updated"); err != nil {
+        return nil, err
+    }
+    return &updated, nil
+}
+
+// DeleteRouteSet removes a route set and its history
+func (rp *RoutePlanner) DeleteRouteSet(ctx context.Context, setID string) error {
+    txn := rp.dgraph.NewTxn()
+    defer txn.Discard(ctx)
+
+    resp, err := txn.QueryWithVars(ctx, `
+        query Delete($id: string) {
+            sets(func: eq(set_id, $id)) @filter(type(RouteSet)) {
+                uid
+                set_history { uid }
+            }
+        }`, map[string]string{"$id": setID})
+    if err != nil {
+        return err
+    }
+
+    var result struct {
+        Sets []routeSetNode `json:"sets"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return err
+    }
+    if len(result.Sets) == 0 {
+        return fmt.Errorf("%w: %s", ErrRouteSetNotFound, setID)
+    }
+
+    var nodes []map[string]string
+    for _, set := range result.Sets {
+        nodes = append(nodes, map[string]string{"uid": set.Uid})
+        for _, version := range set.History {
+            nodes = append(nodes, map[string]string{"uid": version.Uid})
+        }
+    }
+    deleteJSON, err := json.Marshal(nodes)
+    if err != nil {
+        return err
+    }
+
+    if _, err := txn.Mutate(ctx, &api.Mutation{DeleteJson: deleteJSON}); err != nil {
+        return err
+    }
+    if err := txn.Commit(ctx); err != nil {
+        return err
+    }
+
+    rp.mu.Lock()
+    delete(rp.routeSets, setID)
+    rp.mu.Unlock()
+    return nil
+}
+
+// RouteSetHistory returns the stored versions of a route set, newest first
+func (rp *RoutePlanner) RouteSetHistory(ctx context.Context, setID string) ([]RouteSetVersion, error) {
+    resp, err := rp.dgraph.NewReadOnlyTxn().QueryWithVars(ctx, `
+        query History($id: string) {
+            sets(func: eq(set_id, $id)) @filter(type(RouteSet)) {
+                set_history(orderdesc: version_number) {
+                    version_number
+                    version_routes { uid }
+                    version_reason
+                    created_at
+                }
+            }
+        }`, map[string]string{"$id": setID})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Sets []routeSetNode `json:"sets"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    if len(result.Sets) == 0 {
+        return nil, fmt.Errorf("%w: %s", ErrRouteSetNotFound, setID)
+    }
+
+    var history []RouteSetVersion
+    for _, version := range result.Sets[0].History {
+        history = append(history, RouteSetVersion{
+            Version: version.Version,
+            Routes:  fromRouteRefs(version.Routes),
+            Reason:  version.Reason,
+            Created: version.Created,
+        })
+    }
+    return history, nil
+}
+
+// RouteSetsContainingRoute returns the sets a route (by route number) is part of
+func (rp *RoutePlanner) RouteSetsContainingRoute(ctx context.Context, routeNumber string) ([]*RouteSet, error) {
+    return queryRouteSets(ctx, rp.dgraph, `
+        query Containing($number: string) {
+            var(func: eq(route_number, $number)) @filter(type(Route)) {
+                s as ~set_routes
+            }
+            sets(func: uid(s), orderdesc: updated_at) {`+routeSetFields+`
+            }
+        }`, map[string]string{"$number": routeNumber})
+}
+
+// RouteSetsCoveringCell returns the sets whose coverage includes an H3 cell,
+// either directly or through a coarser cell containing it
+func (rp *RoutePlanner) RouteSetsCoveringCell(ctx context.Context, h3Index string) ([]*RouteSet, error) {
+    cell := h3.Cell(h3.IndexFromString(h3Index))
+    if !cell.IsValid() {
+        return nil, fmt.Errorf("invalid h3 index: %s", h3Index)
+    }
+
+    cells := []string{cell.String()}
+    for res := cell.Resolution() - 1; res >= 0; res-- {
+        cells = append(cells, cell.Parent(res).String())
+    }
+    cellsJSON, err := json.Marshal(cells)
+    if err != nil {
+        return nil, err
+    }
+
+    return queryRouteSets(ctx, rp.dgraph, `
+        query Covering($cells: string) {
+            sets(func: eq(h3_coverage, $cells), orderdesc: updated_at) @filter(type(RouteSet)) {`+routeSetFields+`
+            }
+        }`, map[string]string{"$cells": string(cellsJSON)})
+}
@@ -2,16 +2,35 @@ package main
 
 import (
     "context"
+    _ "embed"
     "time"
     "encoding/json"
-    "github.com/dgraph-io/dgo/v200"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "strings"
+    "sync"
+    "github.com/dgraph-io/dgo/v210"
+    "github.com/dgraph-io/dgo/v210/protos/api"
     "github.com/uber/h3-go/v4"
 )
 
+const (
+    searchCellSpacingM = 300 // roughly between neighbouring resolution 9 cells
+    maxSearchRings     = 20
+)
+
+var (
+    ErrRouteNotFound    = errors.New("route not found")
+    ErrRouteSetNotFound = errors.New("route set not found")
+)
+
 // Extended Route structure with additional fields
 type Route struct {
     Uid            string      `json:"uid,omitempty"`
     RouteNumber    string      `json:"route_number"`
+    Sacco          string      `json:"sacco,omitempty"` // the SACCO that runs it
     PickupPoint    string      `json:"pickup_point"`
     Destinations   []string    `json:"destinations"`
     PickupH3Index  string      `json:"pickup_h3_index"`
@@ -38,50 +57,9 @@ type FareInfo struct {
     OffPeakHours float64 `json:"off_peak_fare"`
 }
 
-// Extended schema for Dgraph
-const extendedSchema = `
-    route_number: string @index(exact) .
-    pickup_point: string @index(term) .
-    destinations: [string] @index(term) .
-    pickup_h3_index: string @index(exact) .
-    dest_h3_index: string @index(exact) .
-    pickup_lat: float .
-    pickup_lng: float .
-    dest_lat: float .
-    dest_lng: float .
-    schedule: [uid] @reverse .
-    fare: uid @reverse .
-    active_days: [string] @index(term) .
-    last_updated: datetime @index(hour) .
-
-    type Route {
-        route_number
-        pickup_point
-        destinations
-        pickup_h3_index
-        dest_h3_index
-        pickup_lat
-        pickup_lng
-        dest_lat
-        dest_lng
-        schedule
-        fare
-        active_days
-        last_updated
-    }
-
-    type Schedule {
-        start_time
-        end_time
-        frequency_minutes
-    }
-
-    type FareInfo {
-        regular_fare
-        peak_fare
-        off_peak_fare
-    }
-`
+// Extended schema for Dgraph, shared with the CLI's schema apply
+//go:embed schema.dql
+var extendedSchema string
 
 // Advanced search function with multiple criteria
 type SearchCriteria struct {
@@ -98,67 +76,44 @@ type Location struct {
     Lng float64 `json:"lng"`
 }
 
+// SearchRoutes finds the routes meeting every criterion given. Pickups
+// near a location are matched on H3 cells first and then by distance.
 func SearchRoutes(ctx context.Context, dgraphClient *dgo.Dgraph, criteria SearchCriteria) ([]Route, error) {
-    var queryBuilder strings.Builder
-    queryBuilder.WriteString(`
-        query SearchRoutes($location: string, $maxDistance: float, $day: string, $maxFare: float) {
-            routes(func: type(Route)) @filter(`)
-
-    // Build dynamic filter conditions
-    var conditions []string
-    variables := make(map[string]interface{})
+    // Dgraph rejects declared variables a query doesn't use, so both are
+    // built up together
+    var declarations, conditions []string
+    variables := make(map[string]string)
 
     if criteria.NearLocation != nil {
-        h3Index := h3.LatLngToCell(h3.LatLng{
-            Lat: criteria.NearLocation.Lat,
-            Lng: criteria.NearLocation.Lng,
-        }, 9)
-        neighbors := h3.GridDisk(h3Index, 1)
-        h3Indexes := make([]string, len(neighbors))
-        for i, n := range neighbors {
-            h3Indexes[i] = n.String()
+        cells, err := json.Marshal(searchCells(*criteria.NearLocation, criteria.MaxDistance))
+        if err != nil {
+            return nil, err
         }
-        conditions = append(conditions, "eq(pickup_h3_index, val(h3Indexes))")
-        variables["h3Indexes"] = h3Indexes
+        declarations = append(declarations, "$cells: string")
+        conditions = append(conditions, "eq(pickup_h3_index, $cells)")
+        variables["$cells"] = string(cells)
     }
 
     if criteria.Destination != "" {
+        declarations = append(declarations, "$destination: string")
         conditions = append(conditions, "anyofterms(destinations, $destination)")
-        variables["destination"] = criteria.Destination
+        variables["$destination"] = criteria.Destination
     }
 
     if criteria.DayOfWeek != "" {
+        declarations = append(declarations, "$day: string")
         conditions = append(conditions, "anyofterms(active_days, $day)")
-        variables["day"] = criteria.DayOfWeek
-    }
-
-    // Combine conditions and complete the query
-    queryBuilder.WriteString(strings.Join(conditions, " AND "))
-    queryBuilder.WriteString(`) {
-        uid
-        route_number
-        pickup_point
-        destinations
-        pickup_lat
-        pickup_lng
-        dest_lat
-        dest_lng
-        schedule {
-            start_time
-            end_time
-            frequency_minutes
-        }
-        fare {
-            regular_fare
-            peak_fare
-            off_peak_fare
-        }
-        active_days
-        last_updated
+        variables["$day"] = criteria.DayOfWeek
     }
-}`)
 
-    resp, err := dgraphClient.NewTxn().QueryWithVars(ctx, queryBuilder.String(), variables)
+    filter := append([]string{"type(Route)"}, conditions...)
+    query := `
+        query SearchRoutes(` + strings.Join(declarations, ", ") + `) {
+            routes(func: type(Route)) @filter(` + strings.Join(filter, " AND ") + `) {` + routeFields + `
+            }
+        }`
+
+    resp, err := dgraphClient.NewReadOnlyTxn().QueryWithVars(ctx, query, variables)
     if err != nil {
         return nil, err
     }
@@ -175,6 +130,88 @@ func SearchRoutes(ctx context.Context, dgraphClient *dgo.Dgraph, criteria Search
     return filteredRoutes, nil
 }
 
+// searchCells are the cells within maxDistance meters of a location, or its
+// immediate neighbours when no distance is given
+func searchCells(near Location, maxDistance float64) []string {
+    rings := int(math.Ceil(maxDistance / searchCellSpacingM))
+    if rings < 1 {
+        rings = 1
+    }
+    if rings > maxSearchRings {
+        rings = maxSearchRings
+    }
+
+    center := h3.LatLngToCell(h3.LatLng{Lat: near.Lat, Lng: near.Lng}, 9)
+    neighbors := h3.GridDisk(center, rings)
+    cells := make([]string, len(neighbors))
+    for i, n := range neighbors {
+        cells[i] = n.String()
+    }
+    return cells
+}
+
+// filterRoutes applies the criteria Dgraph can't: the exact pickup
+// distance, the time of day and the fare at that time
+func filterRoutes(routes []Route, criteria SearchCriteria) []Route {
+    at, timed := criteriaTime(criteria)
+    clock := at.Format("15:04")
+
+    filtered := make([]Route, 0, len(routes))
+    for _, route := range routes {
+        if criteria.NearLocation != nil && criteria.MaxDistance > 0 {
+            distance := calculateDistance(criteria.NearLocation.Lat, criteria.NearLocation.Lng, route.PickupLat, route.PickupLng)
+            if distance > criteria.MaxDistance {
+                continue
+            }
+        }
+
+        if timed && len(route.Schedule) > 0 {
+            running := false
+            for _, s := range route.Schedule {
+                if s.StartTime <= clock && clock < s.EndTime {
+                    running = true
+                    break
+                }
+            }
+            if !running {
+                continue
+            }
+        }
+
+        if criteria.MaxFare > 0 {
+            fare := route.Fare.Regular
+            if timed {
+                fare = fareAt(route, at)
+            }
+            if fare > criteria.MaxFare {
+                continue
+            }
+        }
+
+        filtered = append(filtered, route)
+    }
+    return filtered
+}
+
+// criteriaTime is the next time matching the criteria's time of day and
+// day of the week; ok is false when no time of day is given
+func criteriaTime(criteria SearchCriteria) (at time.Time, ok bool) {
+    clock, err := time.ParseInLocation("15:04", criteria.TimeOfDay, time.Local)
+    if err != nil {
+        return time.Time{}, false
+    }
+
+    now := time.Now()
+    at = time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+    for i := 0; i < 7 && criteria.DayOfWeek != ""; i++ {
+        if strings.EqualFold(at.Weekday().String(), criteria.DayOfWeek) {
+            break
+        }
+        at = at.AddDate(0, 0, 1)
+    }
+    return at, true
+}
+
 // Example usage of advanced search
 func searchExample() {
     criteria := SearchCriteria{
@@ -189,7 +226,9 @@ func searchExample() {
         TimeOfDay: "08:00",
     }
 
-    routes, err := SearchRoutes(context.Background(), dgraphClient, criteria)
+    dgraphClient := createDgraphClient()
+    defer dgraphClient.Close()
+    routes, err := SearchRoutes(context.Background(), dgraphClient.Dgraph, criteria)
     if err != nil {
         log.Fatal(err)
     }
@@ -203,8 +242,11 @@ func searchExample() {
     }
 }
 
-// Helper function to update route information
-func UpdateRoute(ctx context.Context, dgraphClient *dgo.Dgraph, route Route) error {
+// UpdateRoute stores a route, creating it when it has no UID. Its lists,
+// schedule and fare replace the stored ones, and route.Uid, the H3 indexes
+// and LastUpdated are filled in. Updating a UID that isn't a route fails
+// with ErrRouteNotFound.
+func UpdateRoute(ctx context.Context, dgraphClient *dgo.Dgraph, route *Route) error {
     // Update H3 indexes
     resolution := 9
     route.PickupH3Index = h3.LatLngToCell(h3.LatLng{
@@ -219,41 +261,188 @@ func UpdateRoute(ctx context.Context, dgraphClient *dgo.Dgraph, route Route) err
 
     route.LastUpdated = time.Now()
 
+    txn := dgraphClient.NewTxn()
+    defer txn.Discard(ctx)
+
+    if route.Uid != "" {
+        if err := clearRoute(ctx, txn, route.Uid); err != nil {
+            return err
+        }
+    }
+
+    setJSON, err := getMutationJSON(*route)
+    if err != nil {
+        return err
+    }
+
     // Prepare mutation
     mutation := &api.Mutation{
-        SetJson: getMutationJSON(route),
+        SetJson: setJSON,
         CommitNow: true,
     }
 
-    _, err := dgraphClient.NewTxn().Mutate(ctx, mutation)
+    resp, err := txn.Mutate(ctx, mutation)
+    if err != nil {
+        return err
+    }
+    if route.Uid == "" {
+        route.Uid = resp.Uids["route"]
+    }
+    return nil
+}
+
+// DeleteRoute removes a route along with its schedule and fare
+func DeleteRoute(ctx context.Context, dgraphClient *dgo.Dgraph, routeID string) error {
+    txn := dgraphClient.NewTxn()
+    defer txn.Discard(ctx)
+
+    if err := clearRoute(ctx, txn, routeID); err != nil {
+        return err
+    }
+    deleteJSON, err := json.Marshal(map[string]string{"uid": routeID})
+    if err != nil {
+        return err
+    }
+    _, err = txn.Mutate(ctx, &api.Mutation{DeleteJson: deleteJSON, CommitNow: true})
     return err
 }
 
-// Cache implementation for frequently accessed routes
+// clearRoute deletes a route's schedule and fare nodes and empties its
+// lists, ready for them to be replaced
+func clearRoute(ctx context.Context, txn *dgo.Txn, routeID string) error {
+    resp, err := txn.QueryWithVars(ctx, `
+        query Route($id: string) {
+            route(func: uid($id)) @filter(type(Route)) {
+                uid
+                schedule { uid }
+                fare { uid }
+            }
+        }`, map[string]string{"$id": routeID})
+    if err != nil {
+        return err
+    }
+
+    var result struct {
+        Route []struct {
+            Uid      string     `json:"uid"`
+            Schedule []routeRef `json:"schedule"`
+            Fare     *routeRef  `json:"fare"`
+        } `json:"route"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return err
+    }
+    if len(result.Route) == 0 {
+        return fmt.Errorf("%w: %s", ErrRouteNotFound, routeID)
+    }
+
+    children := result.Route[0].Schedule
+    if fare := result.Route[0].Fare; fare != nil {
+        children = append(children, *fare)
+    }
+    mutation := &api.Mutation{
+        DelNquads: []byte(fmt.Sprintf("<%[1]s> <sacco> * .\n<%[1]s> <destinations> * .\n<%[1]s> <active_days> * .\n<%[1]s> <schedule> * .\n<%[1]s> <fare> * .", routeID)),
+    }
+    if len(children) > 0 {
+        if mutation.DeleteJson, err = json.Marshal(children); err != nil {
+            return err
+        }
+    }
+    _, err = txn.Mutate(ctx, mutation)
+    return err
+}
+
+// routeNode is a route as stored, with its schedule and fare as typed nodes
+type routeNode struct {
+    Route
+    DgraphType string         `json:"dgraph.type"`
+    Schedule   []scheduleNode `json:"schedule,omitempty"`
+    Fare       fareNode       `json:"fare"`
+}
+
+type scheduleNode struct {
+    Schedule
+    DgraphType string `json:"dgraph.type"`
+}
+
+type fareNode struct {
+    FareInfo
+    DgraphType string `json:"dgraph.type"`
+}
+
+// getMutationJSON is the JSON that stores a route. New routes are the
+// blank node "route", so their UID can be read from the response.
+func getMutationJSON(route Route) ([]byte, error) {
+    if route.Uid == "" {
+        route.Uid = "_:route"
+    }
+
+    node := routeNode{
+        Route:      route,
+        DgraphType: "Route",
+        Fare:       fareNode{FareInfo: route.Fare, DgraphType: "FareInfo"},
+    }
+    for _, s := range route.Schedule {
+        node.Schedule = append(node.Schedule, scheduleNode{Schedule: s, DgraphType: "Schedule"})
+    }
+    return json.Marshal(node)
+}
+
+// Cache implementation for frequently accessed routes. Entries older than
+// maxAge are misses, and are dropped as new ones are stored.
 type RouteCache struct {
-    cache    map[string][]Route
-    mu       sync.RWMutex
-    maxAge   time.Duration
+    cache  map[string]cachedRoutes
+    mu     sync.RWMutex
+    maxAge time.Duration
+    now    func() time.Time
+}
+
+type cachedRoutes struct {
+    routes   []Route
+    storedAt time.Time
 }
 
 func NewRouteCache(maxAge time.Duration) *RouteCache {
     return &RouteCache{
-        cache:  make(map[string][]Route),
+        cache:  make(map[string]cachedRoutes),
         maxAge: maxAge,
+        now:    time.Now,
     }
 }
 
 func (rc *RouteCache) Get(key string) ([]Route, bool) {
     rc.mu.RLock()
     defer rc.mu.RUnlock()
-    routes, exists := rc.cache[key]
-    return routes, exists
+    entry, exists := rc.cache[key]
+    if !exists || rc.expired(entry, rc.now()) {
+        return nil, false
+    }
+    return entry.routes, true
 }
 
 func (rc *RouteCache) Set(key string, routes []Route) {
     rc.mu.Lock()
     defer rc.mu.Unlock()
-    rc.cache[key] = routes
+    now := rc.now()
+    for k, entry := range rc.cache {
+        if rc.expired(entry, now) {
+            delete(rc.cache, k)
+        }
+    }
+    rc.cache[key] = cachedRoutes{routes: routes, storedAt: now}
+}
+
+// expired reports whether an entry is past maxAge; entries never expire if
+// maxAge isn't positive
+func (rc *RouteCache) expired(entry cachedRoutes, now time.Time) bool {
+    return rc.maxAge > 0 && now.Sub(entry.storedAt) >= rc.maxAge
+}
+
+// Clear empties the cache, for when stored routes change
+func (rc *RouteCache) Clear() {
+    rc.mu.Lock()
+    defer rc.mu.Unlock()
+    rc.cache = make(map[string]cachedRoutes)
 }
 
 // RouteAnalytics tracks usage and performance metrics
@@ -271,8 +460,10 @@ type RouteSet struct {
     ID          string    `json:"id"`
     Name        string    `json:"name"`
     Routes      []string  `json:"route_ids"` // Route UIDs
+    Candidates  []string  `json:"candidate_route_ids"` // Route UIDs the set may select from
     Coverage    []string  `json:"h3_coverage"` // H3 indexes covered
     Properties  map[string]interface{} `json:"properties"`
+    Version     int       `json:"version"`
     Created     time.Time `json:"created_at"`
     Updated     time.Time `json:"updated_at"`
 }
@@ -282,6 +473,8 @@ type RoutePlanner struct {
     cache       *RouteCache
     analytics   map[string]*RouteAnalytics
     routeSets   map[string]*RouteSet
+    population  *PopulationGrid
+    traffic     TrafficSource
     mu          sync.RWMutex
     dgraph      *dgo.Dgraph
 }
@@ -307,6 +500,7 @@ func (rp *RoutePlanner) CreateRouteSet(ctx context.Context, name string, criteri
         ID:         generateUUID(),
         Name:       name,
         Routes:     make([]string, len(routes)),
+        Candidates: make([]string, len(routes)),
         Coverage:   make([]string, 0),
         Properties: make(map[string]interface{}),
         Created:    time.Now(),
@@ -317,6 +511,7 @@ func (rp *RoutePlanner) CreateRouteSet(ctx context.Context, name string, criteri
     coverageMap := make(map[string]bool)
     for i, route := range routes {
         routeSet.Routes[i] = route.Uid
+        routeSet.Candidates[i] = route.Uid
 
         // Add pickup and destination H3 indexes to coverage
         coverageMap[route.PickupH3Index] = true
@@ -339,53 +534,74 @@ func (rp *RoutePlanner) CreateRouteSet(ctx context.Context, name string, criteri
     }
 
     // Store route set
-    rp.mu.Lock()
-    rp.routeSets[routeSet.ID] = routeSet
-    rp.mu.Unlock()
+    if err := rp.saveRouteSet(ctx, routeSet, 0, "created"); err != nil {
+        return nil, err
+    }
 
     return routeSet, nil
 }
 
-// OptimizeRouteSet optimizes routes within a set based on various metrics
-func (rp *RoutePlanner) OptimizeRouteSet(ctx context.Context, setID string, optimizationCriteria map[string]float64) error {
+// OptimizeRouteSet selects the routes of a set that best meet the weighted
+// criteria within the constraints, and explains the score of every candidate
+func (rp *RoutePlanner) OptimizeRouteSet(ctx context.Context, setID string, optimizationCriteria map[string]float64, constraints OptimizationConstraints) (*OptimizationResult, error) {
+    weights, err := validateCriteria(optimizationCriteria)
+    if err != nil {
+        return nil, err
+    }
+
+    routeSet, err := rp.getRouteSet(ctx, setID)
+    if err != nil {
+        return nil, err
+    }
+
     rp.mu.RLock()
-    routeSet, exists := rp.routeSets[setID]
+    updated := *routeSet
     rp.mu.RUnlock()
 
-    if !exists {
-        return fmt.Errorf("route set not found: %s", setID)
+    candidateIDs := updated.Candidates
+    if len(candidateIDs) == 0 {
+        candidateIDs = updated.Routes
     }
 
-    // Gather analytics for all routes in the set
-    routeAnalytics := make(map[string]*RouteAnalytics)
-    for _, routeID := range routeSet.Routes {
-        analytics, err := rp.getRouteAnalytics(ctx, routeID)
-        if err != nil {
-            continue
-        }
-        routeAnalytics[routeID] = analytics
+    // Gather routes and analytics for every candidate in the set
+    candidates, err := rp.buildCandidates(ctx, candidateIDs)
+    if err != nil {
+        return nil, err
     }
 
     // Optimize based on criteria
-    optimizedRoutes := optimizeRoutes(routeSet.Routes, routeAnalytics, optimizationCriteria)
+    optimizedRoutes, ranking := optimizeRoutes(candidates, weights, constraints)
+
+    result := &OptimizationResult{
+        SetID:       setID,
+        Weights:     weights,
+        Constraints: constraints,
+        Selected:    optimizedRoutes,
+        Ranking:     ranking,
+        OptimizedAt: time.Now(),
+    }
+    for _, score := range ranking {
+        if score.Selected {
+            result.VehiclesUsed += score.Vehicles
+        }
+    }
 
-    // Update route set with optimized routes
-    rp.mu.Lock()
-    routeSet.Routes = optimizedRoutes
-    routeSet.Updated = time.Now()
-    rp.mu.Unlock()
+    // Store the optimized routes as a new version of the set
+    updated.Routes = optimizedRoutes
+    updated.Coverage = setCoverage(candidates, optimizedRoutes)
+    reason := "optimized: " + describeContributions(weights)
+    if err := rp.saveRouteSet(ctx, &updated, routeSet.Version, reason); err != nil {
+        return nil, err
+    }
 
-    return nil
+    return result, nil
 }
 
 // AnalyzeRouteSet performs analysis on a set of routes
 func (rp *RoutePlanner) AnalyzeRouteSet(ctx context.Context, setID string) (*RouteSetAnalysis, error) {
-    rp.mu.RLock()
-    routeSet, exists := rp.routeSets[setID]
-    rp.mu.RUnlock()
-
-    if !exists {
-        return nil, fmt.Errorf("route set not found: %s", setID)
+    routeSet, err := rp.getRouteSet(ctx, setID)
+    if err != nil {
+        return nil, err
     }
 
     analysis := &RouteSetAnalysis{
@@ -398,9 +614,48 @@ func (rp *RoutePlanner) AnalyzeRouteSet(ctx context.Context, setID string) (*Rou
         AnalyzedAt:      time.Now(),
     }
 
+    rp.mu.RLock()
+    population := rp.population
+    rp.mu.RUnlock()
+    if population != nil {
+        coverage := population.Coverage(routeSet.Coverage)
+        analysis.Population = &coverage
+    }
+
     return analysis, nil
 }
 
+// SetPopulationGrid sets the population used for weighted coverage
+func (rp *RoutePlanner) SetPopulationGrid(grid *PopulationGrid) {
+    rp.mu.Lock()
+    defer rp.mu.Unlock()
+    rp.population = grid
+}
+
+// RouteSetCoverageGeoJSON returns the coverage of a set as a GeoJSON MultiPolygon
+func (rp *RoutePlanner) RouteSetCoverageGeoJSON(ctx context.Context, setID string) (*GeoJSONMultiPolygon, error) {
+    routeSet, err := rp.getRouteSet(ctx, setID)
+    if err != nil {
+        return nil, err
+    }
+
+    return CoverageGeoJSON(routeSet.Coverage)
+}
+
+// CompareRouteSets measures the coverage overlap between two sets
+func (rp *RoutePlanner) CompareRouteSets(ctx context.Context, setA, setB string) (*CoverageOverlap, error) {
+    routeSetA, err := rp.getRouteSet(ctx, setA)
+    if err != nil {
+        return nil, err
+    }
+    routeSetB, err := rp.getRouteSet(ctx, setB)
+    if err != nil {
+        return nil, err
+    }
+
+    return CompareCoverage(routeSetA, routeSetB)
+}
+
 // Helper function to calculate intermediate H3 indexes between two points
 func calculateIntermediateH3Indexes(startLat, startLng, endLat, endLng float64, resolution int) []string {
     var indexes []string
@@ -408,6 +663,9 @@ func calculateIntermediateH3Indexes(startLat, startLng, endLat, endLng float64,
     // Calculate number of points based on distance
     distance := calculateDistance(startLat, startLng, endLat, endLng)
     pointCount := int(distance / 100) // One point every 100 meters
+    if pointCount < 1 {
+        pointCount = 1
+    }
 
     for i := 0; i <= pointCount; i++ {
         fraction := float64(i) / float64(pointCount)
@@ -424,35 +682,33 @@ func calculateIntermediateH3Indexes(startLat, startLng, endLat, endLng float64,
     return indexes
 }
 
+// Great-circle distance between two points in meters
+func calculateDistance(startLat, startLng, endLat, endLng float64) float64 {
+    return h3.GreatCircleDistanceM(
+        h3.LatLng{Lat: startLat, Lng: startLng},
+        h3.LatLng{Lat: endLat, Lng: endLng},
+    )
+}
+
 // RouteSetAnalysis contains analytical data for a route set
 type RouteSetAnalysis struct {
     SetID            string             `json:"set_id"`
     RouteCount       int                `json:"route_count"`
     CoverageArea     float64            `json:"coverage_area_km2"`
+    Population       *PopulationCoverage `json:"population_coverage,omitempty"`
     AverageMetrics   map[string]float64 `json:"average_metrics"`
     PeakHours        []string           `json:"peak_hours"`
     ReliabilityScore float64            `json:"reliability_score"`
     AnalyzedAt       time.Time          `json:"analyzed_at"`
 }
 
-// Calculate coverage area from H3 indexes
-func calculateCoverageArea(h3Indexes []string) float64 {
-    uniqueCells := make(map[string]bool)
-    for _, idx := range h3Indexes {
-        uniqueCells[idx] = true
-    }
-
-    // H3 resolution 9 has an average hexagon area of about 0.1 km²
-    return float64(len(uniqueCells)) * 0.1
-}
-
 // Identify peak hours for a route set
 func identifySetPeakHours(routeSet *RouteSet) []string {
     hourCounts := make(map[string]int)
     peakThreshold := len(routeSet.Routes) / 2
 
     // Count usage per hour
-    for _, routeID := range routeSet.Routes {
+    for range routeSet.Routes {
         // Aggregate schedule information
         // This is a simplified example - you'd typically get this from your analytics data
     }
@@ -473,7 +729,7 @@ func calculateSetReliability(routeSet *RouteSet) float64 {
     var totalScore float64
     var count int
 
-    for _, routeID := range routeSet.Routes {
+    for range routeSet.Routes {
         // Aggregate reliability scores
         // This is a simplified example - you'd typically get this from your analytics data
         totalScore += 0.9 // placeholder
@@ -489,8 +745,10 @@ func calculateSetReliability(routeSet *RouteSet) float64 {
 // Example usage of the route planner
 func routePlannerExample() {
     ctx := context.Background()
+    dgraphClient := createDgraphClient()
+    defer dgraphClient.Close()
     cache := NewRouteCache(15 * time.Minute)
-    planner := NewRoutePlanner(dgraphClient, cache)
+    planner := NewRoutePlanner(dgraphClient.Dgraph, cache)
 
     // Create a new route set
     criteria := SearchCriteria{
@@ -511,10 +769,16 @@ func routePlannerExample() {
         "reliability": 0.7,
         "coverage": 0.3,
     }
-    err = planner.OptimizeRouteSet(ctx, routeSet.ID, optimizationCriteria)
+    result, err := planner.OptimizeRouteSet(ctx, routeSet.ID, optimizationCriteria, OptimizationConstraints{
+        MaxRoutes: 10,
+        FleetSize: 60,
+    })
     if err != nil {
         log.Fatal(err)
     }
+    for _, score := range result.Ranking {
+        fmt.Printf("#%d %s %.2f %s\n", score.Rank, score.RouteID, score.Score, score.Reason)
+    }
 
     // Analyze the route set
     analysis, err := planner.AnalyzeRouteSet(ctx, routeSet.ID)
@@ -527,303 +791,3 @@ func routePlannerExample() {
     fmt.Printf("Reliability Score: %.2f\n", analysis.ReliabilityScore)
     fmt.Printf("Peak Hours: %v\n", analysis.PeakHours)
 }
-
-package main
-
-import (
-    "context"
-    "time"
-    "sync"
-    "math"
-    "github.com/dgraph-io/dgo/v200"
-    "github.com/uber/h3-go/v4"
-)
-
-// TrafficData represents real-time traffic information
-type TrafficData struct {
-    H3Index      string    `json:"h3_index"`
-    Speed        float64   `json:"speed_kmh"`
-    Congestion   float64   `json:"congestion_level"` // 0-1
-    LastUpdated  time.Time `json:"last_updated"`
-    Source       string    `json:"source"`
-}
-
-// PredictiveModel represents route demand and performance predictions
-type PredictiveModel struct {
-    RouteID      string                `json:"route_id"`
-    Predictions  map[string]Prediction `json:"predictions"` // hour -> prediction
-    Accuracy     float64               `json:"accuracy_score"`
-    LastTrained  time.Time             `json:"last_trained"`
-}
-
-type Prediction struct {
-    Demand       float64 `json:"expected_demand"`
-    TravelTime   float64 `json:"expected_travel_time"`
-    Reliability  float64 `json:"reliability_score"`
-}
-
-// RealTimeManager handles real-time updates and predictions
-type RealTimeManager struct {
-    trafficData    map[string]*TrafficData
-    predictions    map[string]*PredictiveModel
-    updates        chan RouteUpdate
-    mu            sync.RWMutex
-    dgraph        *dgo.Dgraph
-    planner       *RoutePlanner
-}
-
-type RouteUpdate struct {
-    RouteID     string
-    UpdateType  string
-    Data        interface{}
-    Timestamp   time.Time
-}
-
-func NewRealTimeManager(dgraph *dgo.Dgraph, planner *RoutePlanner) *RealTimeManager {
-    rtm := &RealTimeManager{
-        trafficData: make(map[string]*TrafficData),
-        predictions: make(map[string]*PredictiveModel),
-        updates:     make(chan RouteUpdate, 1000),
-        dgraph:      dgraph,
-        planner:     planner,
-    }
-
-    // Start update processing
-    go rtm.processUpdates()
-    return rtm
-}
-
-// ProcessUpdates handles real-time updates
-func (rtm *RealTimeManager) processUpdates() {
-    for update := range rtm.updates {
-        switch update.UpdateType {
-        case "traffic":
-            rtm.handleTrafficUpdate(update)
-        case "demand":
-            rtm.handleDemandUpdate(update)
-        case "incident":
-            rtm.handleIncidentUpdate(update)
-        }
-    }
-}
-
-// UpdateTraffic updates traffic data for a specific area
-func (rtm *RealTimeManager) UpdateTraffic(h3Index string, speed float64, congestion float64) {
-    rtm.mu.Lock()
-    defer rtm.mu.Unlock()
-
-    rtm.trafficData[h3Index] = &TrafficData{
-        H3Index:     h3Index,
-        Speed:       speed,
-        Congestion:  congestion,
-        LastUpdated: time.Now(),
-        Source:      "real-time-sensors",
-    }
-
-    // Send update to processing channel
-    rtm.updates <- RouteUpdate{
-        UpdateType: "traffic",
-        Data:      rtm.trafficData[h3Index],
-        Timestamp: time.Now(),
-    }
-}
-
-// PredictDemand predicts route demand for the next 24 hours
-func (rtm *RealTimeManager) PredictDemand(ctx context.Context, routeID string) (map[string]Prediction, error) {
-    rtm.mu.RLock()
-    model, exists := rtm.predictions[routeID]
-    rtm.mu.RUnlock()
-
-    if !exists || time.Since(model.LastTrained) > 24*time.Hour {
-        // Train new model if doesn't exist or is outdated
-        if err := rtm.trainModel(ctx, routeID); err != nil {
-            return nil, err
-        }
-        model = rtm.predictions[routeID]
-    }
-
-    // Get predictions for next 24 hours
-    predictions := make(map[string]Prediction)
-    now := time.Now()
-    for i := 0; i < 24; i++ {
-        hour := now.Add(time.Duration(i) * time.Hour)
-        hourKey := hour.Format("15:00")
-        predictions[hourKey] = model.Predictions[hourKey]
-    }
-
-    return predictions, nil
-}
-
-// TrainModel trains the predictive model for a route
-func (rtm *RealTimeManager) trainModel(ctx context.Context, routeID string) error {
-    // Fetch historical data
-    historicalData, err := rtm.getHistoricalData(ctx, routeID)
-    if err != nil {
-        return err
-    }
-
-    // Train model using historical data
-    model := &PredictiveModel{
-        RouteID:     routeID,
-        Predictions: make(map[string]Prediction),
-        LastTrained: time.Now(),
-    }
-
-    // Process historical data and generate predictions
-    for hour := 0; hour < 24; hour++ {
-        hourStr := fmt.Sprintf("%02d:00", hour)
-        prediction := rtm.calculatePrediction(historicalData, hour)
-        model.Predictions[hourStr] = prediction
-    }
-
-    // Calculate model accuracy
-    model.Accuracy = rtm.calculateModelAccuracy(historicalData, model.Predictions)
-
-    // Store the model
-    rtm.mu.Lock()
-    rtm.predictions[routeID] = model
-    rtm.mu.Unlock()
-
-    return nil
-}
-
-// OptimizeRealTime performs real-time route optimization
-func (rtm *RealTimeManager) OptimizeRealTime(ctx context.Context, routeSetID string) error {
-    // Get current traffic conditions
-    trafficConditions := rtm.getCurrentTrafficConditions()
-    
-    // Get demand predictions
-    predictions, err := rtm.getPredictionsForRouteSet(ctx, routeSetID)
-    if err != nil {
-        return err
-    }
-
-    // Optimize based on current conditions and predictions
-    optimizationCriteria := map[string]float64{
-        "current_traffic": 0.4,
-        "predicted_demand": 0.3,
-        "reliability": 0.3,
-    }
-
-    return rtm.planner.OptimizeRouteSet(ctx, routeSetID, optimizationCriteria)
-}
-
-// MonitorRouteHealth continuously monitors route health
-func (rtm *RealTimeManager) MonitorRouteHealth(ctx context.Context, routeID string) {
-    ticker := time.NewTicker(5 * time.Minute)
-    defer ticker.Stop()
-
-    for {
-        select {
-        case <-ctx.Done():
-            return
-        case <-ticker.C:
-            health := rtm.calculateRouteHealth(routeID)
-            if health.Score < 0.7 {
-                rtm.handleUnhealthyRoute(routeID, health)
-            }
-        }
-    }
-}
-
-// Example usage
-func realTimeExample() {
-    ctx := context.Background()
-    cache := NewRouteCache(15 * time.Minute)
-    planner := NewRoutePlanner(dgraphClient, cache)
-    rtm := NewRealTimeManager(dgraphClient, planner)
-
-    // Start route monitoring
-    go func() {
-        for _, routeID := range planner.GetAllRouteIDs() {
-            go rtm.MonitorRouteHealth(ctx, routeID)
-        }
-    }()
-
-    // Update traffic data
-    rtm.UpdateTraffic("8928308281fffff", 45.5, 0.3)
-
-    // Get demand predictions
-    predictions, err := rtm.PredictDemand(ctx, "route-123")
-    if err != nil {
-        log.Fatal(err)
-    }
-
-    // Optimize routes in real-time
-    err = rtm.OptimizeRealTime(ctx, "set-456")
-    if err != nil {
-        log.Fatal(err)
-    }
-
-    // Example of handling real-time updates
-    update := RouteUpdate{
-        RouteID:    "route-123",
-        UpdateType: "incident",
-        Data: map[string]interface{}{
-            "type": "accident",
-            "location": map[string]float64{
-                "lat": -1.2865,
-                "lng": 36.815,
-            },
-            "severity": "high",
-        },
-        Timestamp: time.Now(),
-    }
-    rtm.updates <- update
-}
-
-// HealthMetrics represents route health information
-type HealthMetrics struct {
-    Score        float64   `json:"health_score"`
-    Issues       []string  `json:"issues"`
-    LastChecked  time.Time `json:"last_checked"`
-}
-
-func (rtm *RealTimeManager) calculateRouteHealth(routeID string) HealthMetrics {
-    rtm.mu.RLock()
-    defer rtm.mu.RUnlock()
-
-    health := HealthMetrics{
-        Score:       1.0,
-        LastChecked: time.Now(),
-    }
-
-    // Check traffic conditions
-    for _, traffic := range rtm.trafficData {
-        if traffic.Congestion > 0.8 {
-            health.Score *= 0.8
-            health.Issues = append(health.Issues, "Heavy traffic detected")
-        }
-    }
-
-    // Check reliability
-    if model, exists := rtm.predictions[routeID]; exists {
-        if model.Accuracy < 0.7 {
-            health.Score *= 0.9
-            health.Issues = append(health.Issues, "Low prediction accuracy")
-        }
-    }
-
-    return health
-}
-
-func (rtm *RealTimeManager) handleUnhealthyRoute(routeID string, health HealthMetrics) {
-    // Log the issue
-    log.Printf("Unhealthy route detected: %s (Score: %.2f)", routeID, health.Score)
-
-    // Notify relevant systems
-    for _, issue := range health.Issues {
-        rtm.updates <- RouteUpdate{
-            RouteID:    routeID,
-            UpdateType: "health_issue",
-            Data:       issue,
-            Timestamp:  time.Now(),
-        }
-    }
-
-    // Trigger re-optimization if necessary
-    if health.Score < 0.5 {
-        ctx := context.Background()
-        rtm.OptimizeRealTime(ctx, routeID)
-    }
-}
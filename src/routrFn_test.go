@@ -0,0 +1,56 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestRouteCache(t *testing.T) {
+    start := time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+    routes := []Route{{Uid: "0x1", RouteNumber: "46"}}
+
+    tests := []struct {
+        name    string
+        maxAge  time.Duration
+        after   time.Duration // between Set and Get
+        wantHit bool
+    }{
+        {name: "fresh", maxAge: 15 * time.Minute, after: 14 * time.Minute, wantHit: true},
+        {name: "at max age", maxAge: 15 * time.Minute, after: 15 * time.Minute},
+        {name: "stale", maxAge: 15 * time.Minute, after: time.Hour},
+        {name: "no max age", after: 24 * time.Hour, wantHit: true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            cache := NewRouteCache(tt.maxAge)
+            now := start
+            cache.now = func() time.Time { return now }
+
+            cache.Set("route:0x1", routes)
+            now = now.Add(tt.after)
+            got, hit := cache.Get("route:0x1")
+            if hit != tt.wantHit {
+                t.Fatalf("Get hit = %v, want %v", hit, tt.wantHit)
+            }
+            if hit && (len(got) != 1 || got[0].Uid != "0x1") {
+                t.Errorf("Get = %+v, want the stored route", got)
+            }
+        })
+    }
+}
+
+func TestRouteCacheEvicts(t *testing.T) {
+    cache := NewRouteCache(15 * time.Minute)
+    now := time.Date(2024, 3, 1, 7, 0, 0, 0, time.UTC)
+    cache.now = func() time.Time { return now }
+
+    cache.Set("route:0x1", []Route{{Uid: "0x1"}})
+    cache.Set("routes:all", []Route{{Uid: "0x1"}, {Uid: "0x2"}})
+    now = now.Add(20 * time.Minute)
+    cache.Set("route:0x2", []Route{{Uid: "0x2"}})
+
+    if len(cache.cache) != 1 {
+        t.Errorf("cache holds %d entries after the others expired, want 1", len(cache.cache))
+    }
+}
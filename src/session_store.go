@@ -0,0 +1,222 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "time"
+
+    "github.com/dgraph-io/dgo/v210"
+
+    "motown/auth"
+    "motown/dgraph"
+)
+
+// revocationSyncInterval is how long a revocation made on one instance can
+// take to reach the others
+const revocationSyncInterval = 30 * time.Second
+
+// SessionStore keeps refresh tokens and token revocations in Dgraph, so
+// every instance of the login and API servers sees the same sessions
+type SessionStore struct {
+    dgraph *dgraph.Client
+}
+
+func NewSessionStore(client *dgraph.Client) *SessionStore {
+    return &SessionStore{dgraph: client}
+}
+
+// refreshNode and revocationNode are how sessions are stored in Dgraph
+type refreshNode struct {
+    Uid       string     `json:"uid,omitempty"`
+    DType     []string   `json:"dgraph.type,omitempty"`
+    Hash      string     `json:"refresh_hash,omitempty"`
+    Family    string     `json:"refresh_family,omitempty"`
+    Subject   string     `json:"refresh_subject,omitempty"`
+    Role      string     `json:"refresh_role,omitempty"`
+    Vehicle   string     `json:"refresh_vehicle,omitempty"`
+    Sacco     string     `json:"refresh_sacco,omitempty"`
+    Used      bool       `json:"refresh_used,omitempty"`
+    Revoked   bool       `json:"refresh_revoked,omitempty"`
+    CreatedAt *time.Time `json:"created_at,omitempty"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type revocationNode struct {
+    Uid     string    `json:"uid,omitempty"`
+    DType   []string  `json:"dgraph.type,omitempty"`
+    TokenID string    `json:"revoked_token,omitempty"`
+    Session string    `json:"revoked_session,omitempty"`
+    Subject string    `json:"revoked_subject,omitempty"`
+    At      time.Time `json:"revoked_at"`
+    Until   time.Time `json:"revoked_until"`
+}
+
+const refreshFields = `
+            uid
+            refresh_hash
+            refresh_family
+            refresh_subject
+            refresh_role
+            refresh_vehicle
+            refresh_sacco
+            refresh_used
+            refresh_revoked
+            created_at
+            expires_at`
+
+func (n refreshNode) toToken() *auth.RefreshToken {
+    token := &auth.RefreshToken{
+        Hash:     n.Hash,
+        Family:   n.Family,
+        Identity: auth.Identity{Subject: n.Subject, Role: n.Role, Vehicle: n.Vehicle, Sacco: n.Sacco},
+        Used:     n.Used,
+        Revoked:  n.Revoked,
+    }
+    if n.CreatedAt != nil {
+        token.IssuedAt = *n.CreatedAt
+    }
+    if n.ExpiresAt != nil {
+        token.ExpiresAt = *n.ExpiresAt
+    }
+    return token
+}
+
+func (ss *SessionStore) Save(ctx context.Context, token *auth.RefreshToken) error {
+    return ss.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        return mutateJSON(ctx, txn, refreshNode{
+            Uid:       "_:refresh",
+            DType:     []string{"RefreshToken"},
+            Hash:      token.Hash,
+            Family:    token.Family,
+            Subject:   token.Identity.Subject,
+            Role:      token.Identity.Role,
+            Vehicle:   token.Identity.Vehicle,
+            Sacco:     token.Identity.Sacco,
+            CreatedAt: &token.IssuedAt,
+            ExpiresAt: &token.ExpiresAt,
+        })
+    })
+}
+
+// Use marks a token used in the same transaction it is read in, so of two
+// racing refreshes only one sees a first use
+func (ss *SessionStore) Use(ctx context.Context, hash string) (*auth.RefreshToken, bool, error) {
+    var token *auth.RefreshToken
+    err := ss.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        nodes, err := queryRefreshTokens(ctx, txn, "refresh_hash", hash)
+        if err != nil || len(nodes) == 0 {
+            token = nil
+            return err
+        }
+        token = nodes[0].toToken()
+        if token.Used {
+            return nil
+        }
+        return mutateJSON(ctx, txn, refreshNode{Uid: nodes[0].Uid, Used: true})
+    })
+    if err != nil || token == nil {
+        return nil, false, err
+    }
+    return token, !token.Used, nil
+}
+
+func (ss *SessionStore) RevokeFamily(ctx context.Context, family string) error {
+    return ss.revoke(ctx, "refresh_family", family)
+}
+
+func (ss *SessionStore) RevokeSubject(ctx context.Context, subject string) error {
+    return ss.revoke(ctx, "refresh_subject", subject)
+}
+
+// revoke marks every live refresh token with a predicate's value revoked
+func (ss *SessionStore) revoke(ctx context.Context, predicate, value string) error {
+    return ss.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        nodes, err := queryRefreshTokens(ctx, txn, predicate, value)
+        if err != nil {
+            return err
+        }
+        var revoked []refreshNode
+        for _, node := range nodes {
+            if !node.Revoked {
+                revoked = append(revoked, refreshNode{Uid: node.Uid, Revoked: true})
+            }
+        }
+        if len(revoked) == 0 {
+            return nil
+        }
+        return mutateJSON(ctx, txn, revoked)
+    })
+}
+
+func queryRefreshTokens(ctx context.Context, txn *dgo.Txn, predicate, value string) ([]refreshNode, error) {
+    resp, err := txn.QueryWithVars(ctx, `
+    query Tokens($value: string, $now: string) {
+        tokens(func: eq(`+predicate+`, $value)) @filter(type(RefreshToken) AND ge(expires_at, $now)) {`+refreshFields+`
+        }
+    }`, map[string]string{"$value": value, "$now": time.Now().UTC().Format(time.RFC3339)})
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Tokens []refreshNode `json:"tokens"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    return result.Tokens, nil
+}
+
+func (ss *SessionStore) AddRevocation(ctx context.Context, revocation auth.Revocation) error {
+    return ss.dgraph.RetryTxn(ctx, func(txn *dgo.Txn) error {
+        return mutateJSON(ctx, txn, revocationNode{
+            Uid:     "_:revocation",
+            DType:   []string{"Revocation"},
+            TokenID: revocation.TokenID,
+            Session: revocation.Session,
+            Subject: revocation.Subject,
+            At:      revocation.At,
+            Until:   revocation.Until,
+        })
+    })
+}
+
+func (ss *SessionStore) Revocations(ctx context.Context, since time.Time) ([]auth.Revocation, error) {
+    txn := ss.dgraph.NewReadOnlyTxn()
+    defer txn.Discard(ctx)
+
+    resp, err := txn.QueryWithVars(ctx, `
+    query Revocations($since: string, $now: string) {
+        revocations(func: ge(revoked_at, $since)) @filter(type(Revocation) AND gt(revoked_until, $now)) {
+            revoked_token
+            revoked_session
+            revoked_subject
+            revoked_at
+            revoked_until
+        }
+    }`, map[string]string{
+        "$since": since.UTC().Format(time.RFC3339),
+        "$now":   time.Now().UTC().Format(time.RFC3339),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        Revocations []revocationNode `json:"revocations"`
+    }
+    if err := json.Unmarshal(resp.Json, &result); err != nil {
+        return nil, err
+    }
+    revocations := make([]auth.Revocation, 0, len(result.Revocations))
+    for _, n := range result.Revocations {
+        revocations = append(revocations, auth.Revocation{
+            TokenID: n.TokenID,
+            Session: n.Session,
+            Subject: n.Subject,
+            At:      n.At,
+            Until:   n.Until,
+        })
+    }
+    return revocations, nil
+}
@@ -0,0 +1,862 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/uber/h3-go/v4"
+    "golang.org/x/net/websocket"
+)
+
+const (
+    streamHistory         = 4096 // updates kept for clients resuming after a reconnect
+    streamInboxBuffer     = 256  // updates waiting for a client before it is cut off
+    maxStreamQueue        = 512  // events held back by a client's rate limit before it is cut off
+    maxStreamFilters      = 50   // routes, vehicles or areas in one filter
+    maxStreamMessageBytes = 4096
+    streamWriteTimeout    = 10 * time.Second
+    streamRetry           = 3 * time.Second // how soon EventSource clients reconnect
+    etaChangeThreshold    = 30 * time.Second
+
+    defaultStreamHeartbeat    = 15 * time.Second
+    defaultStreamRate         = 10 // events a second
+    defaultStreamBurst        = 50
+    defaultStreamMessageRate  = 1 // client messages a second
+    defaultStreamMessageBurst = 5
+)
+
+// Stream events that aren't bus topics
+const (
+    StreamETA       = "eta"
+    StreamHeartbeat = "heartbeat"
+    StreamReset     = "reset"
+    StreamError     = "error"
+)
+
+// streamTypes are the events a client can ask for
+var streamTypes = []string{TopicPosition, StreamETA, TopicAlert}
+
+var ErrStreamOverrun = errors.New("stream client fell too far behind")
+
+// StreamConfig sets the limits on each live stream connection
+type StreamConfig struct {
+    Heartbeat time.Duration // between heartbeats
+    Rate      float64       // events a second sent to a client, on average
+    Burst     int           // events sent back to back before Rate applies
+    // MessageRate and MessageBurst limit the subscription changes a
+    // WebSocket client sends
+    MessageRate  float64
+    MessageBurst int
+}
+
+// StreamEvent is what stream clients receive. Positions and alerts carry
+// the sequence of the update they came from, which a client resumes from
+// after reconnecting; an ETA shares the sequence of the position it was
+// estimated from. Heartbeats carry the sequence a client is caught up to.
+type StreamEvent struct {
+    Sequence  uint64        `json:"sequence"`
+    Type      string        `json:"type"`
+    Timestamp time.Time     `json:"timestamp"`
+    RouteID   string        `json:"route_id,omitempty"`
+    Position  *VehicleFix   `json:"position,omitempty"`
+    ETA       *VehicleETA   `json:"eta,omitempty"`
+    Alert     *ServiceAlert `json:"alert,omitempty"`
+    Incident  *Incident     `json:"incident,omitempty"`
+    Error     *APIError     `json:"error,omitempty"`
+}
+
+func (e StreamEvent) vehicleID() string {
+    switch {
+    case e.Position != nil:
+        return e.Position.VehicleID
+    case e.ETA != nil:
+        return e.ETA.VehicleID
+    }
+    return ""
+}
+
+// StreamFilter picks what a stream client receives: updates for any of the
+// routes, vehicles or areas given, or for every vehicle if none are.
+// WebSocket clients send one as a message to change their subscription.
+type StreamFilter struct {
+    Routes   []string  `json:"routes,omitempty"` // route numbers
+    RouteIDs []string  `json:"route_ids,omitempty"`
+    Vehicles []string  `json:"vehicles,omitempty"`
+    Areas    []string  `json:"areas,omitempty"` // H3 cells at any resolution
+    Types    []string  `json:"types,omitempty"`
+    Stop     *Location `json:"stop,omitempty"` // where ETAs are estimated to
+}
+
+// streamMatcher is a StreamFilter checked and with route numbers resolved
+type streamMatcher struct {
+    routes      map[string]bool
+    vehicles    map[string]bool
+    areas       map[h3.Cell]bool
+    resolutions map[int]bool
+    types       map[string]bool
+    stop        *Location
+}
+
+func isStreamType(t string) bool {
+    for _, valid := range streamTypes {
+        if t == valid {
+            return true
+        }
+    }
+    return false
+}
+
+// compileFilter checks a filter and resolves its route numbers through the
+// route cache
+func (s *APIServer) compileFilter(ctx context.Context, filter StreamFilter) (*streamMatcher, error) {
+    m := &streamMatcher{
+        routes:      make(map[string]bool),
+        vehicles:    make(map[string]bool),
+        areas:       make(map[h3.Cell]bool),
+        resolutions: make(map[int]bool),
+        types:       make(map[string]bool),
+        stop:        filter.Stop,
+    }
+    verr := &ValidationError{}
+    for _, list := range []struct {
+        field  string
+        values []string
+    }{
+        {"routes", filter.Routes},
+        {"route_ids", filter.RouteIDs},
+        {"vehicles", filter.Vehicles},
+        {"areas", filter.Areas},
+    } {
+        if len(list.values) > maxStreamFilters {
+            verr.Add(list.field, "at most %d allowed", maxStreamFilters)
+        }
+    }
+
+    if len(filter.Routes) > 0 {
+        routes, err := s.planner.listRoutes(ctx)
+        if err != nil {
+            return nil, err
+        }
+        for _, number := range filter.Routes {
+            found := false
+            for _, route := range routes {
+                if strings.EqualFold(route.RouteNumber, strings.TrimSpace(number)) {
+                    m.routes[route.Uid] = true
+                    found = true
+                }
+            }
+            if !found {
+                verr.Add("routes", "no route is numbered %q", number)
+            }
+        }
+    }
+    for _, id := range filter.RouteIDs {
+        if !uidPattern.MatchString(id) {
+            verr.Add("route_ids", "%q is not a route ID; IDs look like 0x1a2b", id)
+        }
+        m.routes[id] = true
+    }
+    for _, vehicle := range filter.Vehicles {
+        if strings.TrimSpace(vehicle) == "" {
+            verr.Add("vehicles", "can't be blank")
+            continue
+        }
+        m.vehicles[strings.TrimSpace(vehicle)] = true
+    }
+    for _, area := range filter.Areas {
+        cell := h3.Cell(h3.IndexFromString(area))
+        if !cell.IsValid() {
+            verr.Add("areas", "%q is not an H3 cell", area)
+            continue
+        }
+        m.areas[cell] = true
+        m.resolutions[cell.Resolution()] = true
+    }
+    if filter.Stop != nil {
+        validateLocation("stop", *filter.Stop, verr)
+    }
+
+    types := filter.Types
+    if len(types) == 0 {
+        types = []string{TopicPosition, TopicAlert}
+        if filter.Stop != nil {
+            types = append(types, StreamETA)
+        }
+    }
+    for _, t := range types {
+        switch {
+        case !isStreamType(t):
+            verr.Add("types", "%q is not a stream event type (valid: %s)", t, strings.Join(streamTypes, ", "))
+        case t == StreamETA && filter.Stop == nil:
+            verr.Add("types", "eta needs a stop to estimate arrivals at")
+        }
+        m.types[t] = true
+    }
+
+    if err := verr.Err(); err != nil {
+        return nil, err
+    }
+    return m, nil
+}
+
+func (m *streamMatcher) everything() bool {
+    return len(m.routes) == 0 && len(m.vehicles) == 0 && len(m.areas) == 0
+}
+
+// matches reports whether a client wants an event, given the route each
+// vehicle was last seen on. Positions are wanted for estimating ETAs even
+// by clients not asking for positions themselves.
+func (m *streamMatcher) matches(event StreamEvent, vehicleRoutes map[string]string) bool {
+    switch event.Type {
+    case TopicPosition:
+        if !m.types[TopicPosition] && !m.types[StreamETA] {
+            return false
+        }
+        fix := event.Position
+        return m.everything() || m.routes[fix.RouteID] || m.vehicles[fix.VehicleID] ||
+            m.covers(h3.NewLatLng(fix.Lat, fix.Lng))
+    case TopicAlert:
+        if !m.types[TopicAlert] {
+            return false
+        }
+        if m.everything() || m.routes[event.RouteID] {
+            return true
+        }
+        for vehicle := range m.vehicles {
+            if vehicleRoutes[vehicle] == event.RouteID {
+                return true
+            }
+        }
+        return event.Incident != nil && m.coversIncident(*event.Incident)
+    }
+    return false
+}
+
+// covers reports whether a point lies in one of the areas
+func (m *streamMatcher) covers(point h3.LatLng) bool {
+    for res := range m.resolutions {
+        if m.areas[h3.LatLngToCell(point, res)] {
+            return true
+        }
+    }
+    return false
+}
+
+// coversIncident reports whether an incident is in, or spreads over, one
+// of the areas
+func (m *streamMatcher) coversIncident(incident Incident) bool {
+    if m.covers(h3.NewLatLng(incident.Location.Lat, incident.Location.Lng)) {
+        return true
+    }
+    for _, index := range incident.AffectedCells {
+        cell := h3.Cell(h3.IndexFromString(index))
+        if !cell.IsValid() {
+            continue
+        }
+        for area := range m.areas {
+            switch {
+            case area.Resolution() <= cell.Resolution() && cell.Parent(area.Resolution()) == area:
+                return true
+            case area.Resolution() > cell.Resolution() && area.Parent(cell.Resolution()) == cell:
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// streamClient is a connection's place on the hub. The hub closes events
+// when it shuts down, or when the client can't keep up, setting overrun
+// first.
+type streamClient struct {
+    matcher *streamMatcher
+    events  chan StreamEvent
+    overrun bool
+    start   uint64 // sequence the client was caught up to on attaching
+}
+
+// StreamHub keeps recent position and alert updates for stream clients to
+// resume from, and fans new ones out to the clients connected
+type StreamHub struct {
+    rtm       *RealTimeManager
+    sub       *Subscription
+    history   []StreamEvent
+    floor     uint64              // sequence of the newest update dropped from history
+    latest    uint64              // sequence of the newest update recorded
+    vehicles  map[string]string   // route each vehicle was last seen on
+    incidents map[string]Incident // incidents alerts have been raised for
+    clients   map[*streamClient]bool
+    closed    bool
+    mu        sync.Mutex
+}
+
+func NewStreamHub(rtm *RealTimeManager) *StreamHub {
+    h := &StreamHub{
+        rtm:       rtm,
+        vehicles:  make(map[string]string),
+        incidents: make(map[string]Incident),
+        clients:   make(map[*streamClient]bool),
+    }
+    // History must be complete for resuming to be safe, so publishers wait
+    // for the hub rather than updates being dropped
+    h.sub, _ = rtm.bus.Subscribe(SubscribeOptions{
+        Topics:       []string{TopicPosition, TopicAlert},
+        Buffer:       streamHistory,
+        Policy:       Block,
+        BlockTimeout: blockTimeout,
+    })
+    // Clients resuming from before the hub started have missed updates
+    h.floor = rtm.bus.Sequence()
+    h.latest = h.floor
+    return h
+}
+
+func (h *StreamHub) run() {
+    for update := range h.sub.C {
+        h.record(update)
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    h.closed = true
+    for client := range h.clients {
+        close(client.events)
+        delete(h.clients, client)
+    }
+}
+
+// record adds an update to the history and passes it to the clients
+// wanting it. A client whose inbox is full is cut off, to resume once it
+// reconnects.
+func (h *StreamHub) record(update RouteUpdate) {
+    event := StreamEvent{
+        Sequence:  update.Sequence,
+        Type:      update.UpdateType,
+        Timestamp: update.Timestamp,
+        RouteID:   update.RouteID,
+        Position:  update.Position,
+        Alert:     update.Alert,
+    }
+    if update.Alert != nil {
+        if incident, ok := h.rtm.incidents.Get(update.Alert.IncidentID); ok {
+            event.Incident = incident
+        }
+    }
+
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    switch {
+    case update.Position != nil:
+        h.vehicles[update.Position.VehicleID] = update.Position.RouteID
+    case event.Incident != nil:
+        h.incidents[event.Incident.ID] = *event.Incident
+    case update.Alert != nil:
+        // Alerts are cleared once their incident has closed
+        if incident, ok := h.incidents[update.Alert.IncidentID]; ok {
+            event.Incident = &incident
+        }
+    }
+    if len(h.incidents) > streamHistory {
+        for id := range h.incidents {
+            if _, active := h.rtm.incidents.Get(id); !active {
+                delete(h.incidents, id)
+            }
+        }
+    }
+
+    h.history = append(h.history, event)
+    if len(h.history) > streamHistory {
+        h.floor = h.history[0].Sequence
+        h.history = h.history[1:]
+    }
+    h.latest = event.Sequence
+
+    for client := range h.clients {
+        if !client.matcher.matches(event, h.vehicles) {
+            continue
+        }
+        select {
+        case client.events <- event:
+        default:
+            client.overrun = true
+            close(client.events)
+            delete(h.clients, client)
+        }
+    }
+}
+
+// attach connects a client, returning the events it missed since the
+// sequence it resumes from, if any. reset is true when the history no
+// longer reaches back that far.
+func (h *StreamHub) attach(matcher *streamMatcher, since uint64) (client *streamClient, backlog []StreamEvent, reset bool, err error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    if h.closed {
+        return nil, nil, false, ErrBusClosed
+    }
+
+    client = &streamClient{
+        matcher: matcher,
+        events:  make(chan StreamEvent, streamInboxBuffer),
+        start:   h.latest,
+    }
+    if since > 0 {
+        reset = since < h.floor || since > h.latest
+    }
+    if since > 0 && !reset {
+        client.start = since
+        for _, event := range h.history {
+            if event.Sequence > since && matcher.matches(event, h.vehicles) {
+                backlog = append(backlog, event)
+            }
+        }
+    }
+    h.clients[client] = true
+    return client, backlog, reset, nil
+}
+
+func (h *StreamHub) detach(client *streamClient) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    delete(h.clients, client)
+}
+
+func (h *StreamHub) setMatcher(client *streamClient, matcher *streamMatcher) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    client.matcher = matcher
+}
+
+// latestSequence is the newest update the hub has passed to its clients
+func (h *StreamHub) latestSequence() uint64 {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return h.latest
+}
+
+// tokenBucket allows rate events a second on average, up to burst at once
+type tokenBucket struct {
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+    return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+    b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+    b.last = now
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+    b.refill(now)
+    if b.tokens < 1 {
+        return false
+    }
+    b.tokens--
+    return true
+}
+
+// wait is how long until the next event is allowed
+func (b *tokenBucket) wait(now time.Time) time.Duration {
+    b.refill(now)
+    if b.tokens >= 1 {
+        return 0
+    }
+    return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// streamControl is a subscription change from a WebSocket client, or why
+// it was refused
+type streamControl struct {
+    matcher *streamMatcher
+    err     *APIError
+    fatal   bool
+}
+
+// streamSession delivers a client's events over its connection, holding
+// them back to the client's rate limit
+type streamSession struct {
+    api     *APIServer
+    client  *streamClient
+    matcher *streamMatcher
+    send    func(StreamEvent) error
+    limiter *tokenBucket
+    queue   []StreamEvent
+    etas    map[string]time.Time // arrival last sent for each vehicle
+    sent    uint64               // sequence of the last event sent
+}
+
+func (s *APIServer) newStreamSession(client *streamClient, send func(StreamEvent) error) *streamSession {
+    return &streamSession{
+        api:     s,
+        client:  client,
+        matcher: client.matcher,
+        send:    send,
+        limiter: newTokenBucket(s.config.Stream.Rate, s.config.Stream.Burst),
+        etas:    make(map[string]time.Time),
+        sent:    client.start,
+    }
+}
+
+// run streams until the client goes away, the server shuts down or the
+// client falls too far behind
+func (ss *streamSession) run(ctx context.Context, backlog []StreamEvent, reset bool, controls <-chan streamControl) {
+    defer ss.api.rtm.streams.detach(ss.client)
+    heartbeat := time.NewTicker(ss.api.config.Stream.Heartbeat)
+    defer heartbeat.Stop()
+
+    if reset {
+        if err := ss.send(StreamEvent{Sequence: ss.client.start, Type: StreamReset, Timestamp: time.Now()}); err != nil {
+            return
+        }
+    }
+    for _, event := range backlog {
+        ss.accept(ctx, event)
+    }
+
+    var wake <-chan time.Time
+    for {
+        if err := ss.flush(); err != nil {
+            return
+        }
+        if len(ss.queue) > maxStreamQueue {
+            ss.overrun()
+            return
+        }
+        if len(ss.queue) > 0 && wake == nil {
+            wake = time.After(ss.limiter.wait(time.Now()))
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ss.api.stopping:
+            return
+        case event, ok := <-ss.client.events:
+            if !ok {
+                if ss.client.overrun {
+                    ss.overrun()
+                }
+                return
+            }
+            ss.accept(ctx, event)
+        case control := <-controls:
+            if control.err != nil {
+                if err := ss.send(StreamEvent{Type: StreamError, Timestamp: time.Now(), Error: control.err}); err != nil || control.fatal {
+                    return
+                }
+                continue
+            }
+            ss.matcher = control.matcher
+            ss.etas = make(map[string]time.Time)
+            ss.api.rtm.streams.setMatcher(ss.client, control.matcher)
+        case <-heartbeat.C:
+            if err := ss.send(StreamEvent{Sequence: ss.caughtUp(), Type: StreamHeartbeat, Timestamp: time.Now()}); err != nil {
+                return
+            }
+        case <-wake:
+            wake = nil
+        }
+    }
+}
+
+// caughtUp is the sequence the client has every event it wants up to. When
+// nothing is waiting to be sent, that is the newest update on the hub.
+func (ss *streamSession) caughtUp() uint64 {
+    latest := ss.api.rtm.streams.latestSequence()
+    if len(ss.client.events) == 0 && len(ss.queue) == 0 {
+        return latest
+    }
+    return ss.sent
+}
+
+func (ss *streamSession) overrun() {
+    ss.send(StreamEvent{Type: StreamError, Timestamp: time.Now(), Error: &APIError{
+        Code:    "overrun",
+        Message: fmt.Sprintf("%v; reconnect and resume from sequence %d", ErrStreamOverrun, ss.sent),
+    }})
+}
+
+func (ss *streamSession) accept(ctx context.Context, event StreamEvent) {
+    switch event.Type {
+    case TopicPosition:
+        if ss.matcher.types[TopicPosition] {
+            ss.enqueue(event)
+        }
+        if ss.matcher.types[StreamETA] {
+            ss.estimate(ctx, event)
+        }
+    case TopicAlert:
+        ss.enqueue(event)
+    }
+}
+
+// estimate queues an ETA for a vehicle heading for the client's stop when
+// it is new or has moved by etaChangeThreshold
+func (ss *streamSession) estimate(ctx context.Context, event StreamEvent) {
+    fix := *event.Position
+    if fix.RouteID == "" {
+        return
+    }
+    route, err := ss.api.planner.getRoute(ctx, fix.RouteID)
+    if err != nil {
+        if !errors.Is(err, ErrRouteNotFound) && ctx.Err() == nil {
+            log.Printf("Stream ETA for vehicle %s: %v", fix.VehicleID, err)
+        }
+        return
+    }
+
+    eta, ok := ss.api.rtm.EstimateArrival(*route, fix, *ss.matcher.stop, time.Now())
+    if !ok {
+        delete(ss.etas, fix.VehicleID) // gone past the stop, or turned off the route
+        return
+    }
+    last, sent := ss.etas[fix.VehicleID]
+    if sent && math.Abs(float64(eta.ArriveAt.Sub(last))) < float64(etaChangeThreshold) {
+        return
+    }
+    ss.etas[fix.VehicleID] = eta.ArriveAt
+    ss.enqueue(StreamEvent{
+        Sequence:  event.Sequence,
+        Type:      StreamETA,
+        Timestamp: time.Now(),
+        RouteID:   fix.RouteID,
+        ETA:       eta,
+    })
+}
+
+// enqueue queues an event to send. A queued position or ETA gives way to a
+// newer one for the same vehicle, so a client held back by its rate limit
+// gets the latest of each rather than falling further behind.
+func (ss *streamSession) enqueue(event StreamEvent) {
+    if vehicle := event.vehicleID(); vehicle != "" {
+        for i, queued := range ss.queue {
+            if queued.Type == event.Type && queued.vehicleID() == vehicle {
+                ss.queue = append(ss.queue[:i], ss.queue[i+1:]...)
+                break
+            }
+        }
+    }
+    ss.queue = append(ss.queue, event)
+}
+
+// flush sends what the rate limit allows
+func (ss *streamSession) flush() error {
+    now := time.Now()
+    for len(ss.queue) > 0 && ss.limiter.take(now) {
+        event := ss.queue[0]
+        ss.queue = ss.queue[1:]
+        if err := ss.send(event); err != nil {
+            return err
+        }
+        ss.sent = event.Sequence
+    }
+    return nil
+}
+
+// queryList reads a comma separated query parameter
+func queryList(query url.Values, name string) []string {
+    var values []string
+    for _, value := range strings.Split(query.Get(name), ",") {
+        if value = strings.TrimSpace(value); value != "" {
+            values = append(values, value)
+        }
+    }
+    return values
+}
+
+// streamRequest reads the filter and resume point of a stream request.
+// Clients resume from the Last-Event-ID header EventSource sends when it
+// reconnects, or from the since parameter.
+func (s *APIServer) streamRequest(r *http.Request) (*streamMatcher, uint64, error) {
+    query := r.URL.Query()
+    verr := &ValidationError{}
+    filter := StreamFilter{
+        Routes:   queryList(query, "routes"),
+        RouteIDs: queryList(query, "route_ids"),
+        Vehicles: queryList(query, "vehicles"),
+        Areas:    queryList(query, "areas"),
+        Types:    queryList(query, "types"),
+        Stop:     queryLocation(query, "stop", verr),
+    }
+
+    since := query.Get("since")
+    if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+        since = lastEventID
+    }
+    var sequence uint64
+    if since != "" {
+        var err error
+        if sequence, err = strconv.ParseUint(since, 10, 64); err != nil {
+            verr.Add("since", "must be a sequence number")
+        }
+    }
+    if err := verr.Err(); err != nil {
+        return nil, 0, err
+    }
+
+    matcher, err := s.compileFilter(r.Context(), filter)
+    return matcher, sequence, err
+}
+
+// streamError answers a stream request that can't start
+func streamError(w http.ResponseWriter, r *http.Request, err error) {
+    if errors.Is(err, ErrBusClosed) {
+        writeError(w, http.StatusServiceUnavailable, APIError{Code: "unavailable", Message: "the live stream is shutting down"})
+        return
+    }
+    status, apiErr := errorResponse(err)
+    if status == http.StatusInternalServerError {
+        log.Printf("API %s %s: %v", r.Method, r.URL.Path, err)
+    }
+    writeError(w, status, apiErr)
+}
+
+// streamEvents serves the live stream as Server-Sent Events
+func (s *APIServer) streamEvents(w http.ResponseWriter, r *http.Request) {
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        streamError(w, r, errors.New("response writer can't flush"))
+        return
+    }
+    matcher, since, err := s.streamRequest(r)
+    if err != nil {
+        streamError(w, r, err)
+        return
+    }
+    client, backlog, reset, err := s.rtm.streams.attach(matcher, since)
+    if err != nil {
+        streamError(w, r, err)
+        return
+    }
+
+    header := w.Header()
+    header.Set("Content-Type", "text/event-stream")
+    header.Set("Cache-Control", "no-cache")
+    header.Set("X-Accel-Buffering", "no") // or proxies hold events back
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+    flusher.Flush()
+
+    session := s.newStreamSession(client, func(event StreamEvent) error {
+        data, err := json.Marshal(event)
+        if err != nil {
+            return err
+        }
+        if event.Type != StreamError {
+            fmt.Fprintf(w, "id: %d\n", event.Sequence)
+        }
+        if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+            return err
+        }
+        flusher.Flush()
+        return nil
+    })
+    session.run(r.Context(), backlog, reset, nil)
+}
+
+// streamWebSocket serves the live stream over a WebSocket. Clients change
+// their subscription by sending a StreamFilter.
+func (s *APIServer) streamWebSocket(w http.ResponseWriter, r *http.Request) {
+    matcher, since, err := s.streamRequest(r)
+    if err != nil {
+        streamError(w, r, err)
+        return
+    }
+
+    server := websocket.Server{
+        // Only browsers send an Origin, so its absence isn't refused
+        Handshake: func(*websocket.Config, *http.Request) error { return nil },
+        Handler: func(ws *websocket.Conn) {
+            ws.MaxPayloadBytes = maxStreamMessageBytes
+            send := func(event StreamEvent) error {
+                ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+                return websocket.JSON.Send(ws, event)
+            }
+
+            client, backlog, reset, err := s.rtm.streams.attach(matcher, since)
+            if err != nil {
+                send(StreamEvent{Type: StreamError, Timestamp: time.Now(), Error: &APIError{
+                    Code: "unavailable", Message: "the live stream is shutting down",
+                }})
+                return
+            }
+
+            ctx, cancel := context.WithCancel(r.Context())
+            defer cancel()
+            controls := make(chan streamControl)
+            go s.readStreamControls(ctx, cancel, ws, controls)
+            s.newStreamSession(client, send).run(ctx, backlog, reset, controls)
+        },
+    }
+    server.ServeHTTP(w, r)
+}
+
+// readStreamControls reads subscription changes from a WebSocket client,
+// ending the stream once the client goes away
+func (s *APIServer) readStreamControls(ctx context.Context, cancel context.CancelFunc, ws *websocket.Conn, controls chan<- streamControl) {
+    defer cancel()
+    limiter := newTokenBucket(s.config.Stream.MessageRate, s.config.Stream.MessageBurst)
+
+    for {
+        var message []byte
+        err := websocket.Message.Receive(ws, &message)
+        if err != nil && !errors.Is(err, websocket.ErrFrameTooLarge) {
+            return
+        }
+
+        var control streamControl
+        var filter StreamFilter
+        switch {
+        case !limiter.take(time.Now()):
+            control.err = &APIError{
+                Code:    "rate_limited",
+                Message: fmt.Sprintf("sent more than %v messages a second", s.config.Stream.MessageRate),
+            }
+            control.fatal = true
+        case err != nil:
+            control.err = &APIError{Code: "invalid_request", Message: fmt.Sprintf("messages are limited to %d bytes", maxStreamMessageBytes)}
+        default:
+            decoder := json.NewDecoder(strings.NewReader(string(message)))
+            decoder.DisallowUnknownFields()
+            if err := decoder.Decode(&filter); err != nil {
+                control.err = &APIError{Code: "invalid_request", Message: "messages must be a stream filter: " + err.Error()}
+                break
+            }
+            matcher, err := s.compileFilter(ctx, filter)
+            if err != nil {
+                status, apiErr := errorResponse(err)
+                if status == http.StatusInternalServerError {
+                    log.Printf("API stream filter: %v", err)
+                }
+                control.err = &apiErr
+                break
+            }
+            control.matcher = matcher
+        }
+
+        select {
+        case controls <- control:
+        case <-ctx.Done():
+            return
+        }
+        if control.fatal {
+            return
+        }
+    }
+}
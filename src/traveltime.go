@@ -0,0 +1,319 @@
+package main
+
+import (
+    "context"
+    "math"
+    "sort"
+    "sync"
+    "time"
+
+    "github.com/uber/h3-go/v4"
+)
+
+const (
+    trafficStaleAfter  = 10 * time.Minute
+    freeFlowSpeedKmh   = 40.0
+    minSegmentSpeedKmh = 3.0
+    walkingSpeedKmh    = 5.0
+    maxWalkKm          = 1.0
+    routeCircuity      = 1.3 // road distance over straight-line distance
+    etaBandSigmas      = 1.28
+)
+
+// Relative speed uncertainty for each kind of speed source
+const (
+    liveSpeedSigma    = 0.10
+    minProfileSigma   = 0.10
+    defaultSpeedSigma = 0.35
+)
+
+// Where a segment's speed came from
+const (
+    SpeedSourceLive       = "live"
+    SpeedSourceBlended    = "blended"
+    SpeedSourceHistorical = "historical"
+    SpeedSourceDefault    = "default"
+)
+
+// SegmentEstimate is the travel time through one H3 cell of a route
+type SegmentEstimate struct {
+    H3Index    string        `json:"h3_index"`
+    DistanceKm float64       `json:"distance_km"`
+    SpeedKmh   float64       `json:"speed_kmh"`
+    Source     string        `json:"speed_source"`
+    Duration   time.Duration `json:"duration"`
+}
+
+// TravelTimeEstimate is an ETA with an uncertainty band
+type TravelTimeEstimate struct {
+    DepartAt   time.Time         `json:"depart_at"`
+    Duration   time.Duration     `json:"duration"`
+    Lower      time.Duration     `json:"lower"`
+    Upper      time.Duration     `json:"upper"`
+    DistanceKm float64           `json:"distance_km"`
+    Segments   []SegmentEstimate `json:"segments"`
+}
+
+// Arrival returns the expected arrival time
+func (e TravelTimeEstimate) Arrival() time.Time {
+    return e.DepartAt.Add(e.Duration)
+}
+
+// speedStat accumulates a running mean and variance (Welford)
+type speedStat struct {
+    n    int
+    mean float64
+    m2   float64
+}
+
+func (s *speedStat) add(speed float64) {
+    s.n++
+    delta := speed - s.mean
+    s.mean += delta / float64(s.n)
+    s.m2 += delta * (speed - s.mean)
+}
+
+func (s *speedStat) stddev() float64 {
+    if s.n < 2 {
+        return 0
+    }
+    return math.Sqrt(s.m2 / float64(s.n-1))
+}
+
+// SpeedProfile holds historical speeds per H3 cell and hour of week
+type SpeedProfile struct {
+    speeds map[string]*[hoursPerWeek]speedStat
+    mu     sync.RWMutex
+}
+
+func NewSpeedProfile() *SpeedProfile {
+    return &SpeedProfile{
+        speeds: make(map[string]*[hoursPerWeek]speedStat),
+    }
+}
+
+// Observe adds a speed measured in a cell at a time
+func (sp *SpeedProfile) Observe(h3Index string, at time.Time, speed float64) {
+    if speed <= 0 {
+        return
+    }
+
+    sp.mu.Lock()
+    defer sp.mu.Unlock()
+
+    stats, exists := sp.speeds[h3Index]
+    if !exists {
+        stats = new([hoursPerWeek]speedStat)
+        sp.speeds[h3Index] = stats
+    }
+    stats[hourOfWeek(at)].add(speed)
+}
+
+// Lookup returns the usual speed and its standard deviation for a cell at
+// a time
+func (sp *SpeedProfile) Lookup(h3Index string, at time.Time) (mean, stddev float64, ok bool) {
+    sp.mu.RLock()
+    defer sp.mu.RUnlock()
+
+    stats, exists := sp.speeds[h3Index]
+    if !exists {
+        return 0, 0, false
+    }
+    stat := stats[hourOfWeek(at)]
+    if stat.n == 0 {
+        return 0, 0, false
+    }
+    return stat.mean, stat.stddev(), true
+}
+
+// TravelTimeEstimator turns per-cell traffic into ETAs
+type TravelTimeEstimator struct {
+    rtm     *RealTimeManager
+    profile *SpeedProfile
+    now     func() time.Time
+}
+
+func NewTravelTimeEstimator(rtm *RealTimeManager, profile *SpeedProfile) *TravelTimeEstimator {
+    return &TravelTimeEstimator{
+        rtm:     rtm,
+        profile: profile,
+        now:     time.Now,
+    }
+}
+
+// cellSpeed picks the speed expected in a cell at a time and its relative
+// uncertainty. Live data is trusted while fresh; as it ages, or the cell is
+// reached further in the future, it is blended into the historical profile.
+func (e *TravelTimeEstimator) cellSpeed(h3Index string, at time.Time) (speed, sigma float64, source string) {
+    histSpeed, histStd, hasHist := e.profile.Lookup(h3Index, at)
+    histSigma := minProfileSigma
+    if hasHist && histSpeed > 0 {
+        histSigma = math.Max(minProfileSigma, histStd/histSpeed)
+    }
+
+    e.rtm.mu.RLock()
+    live, hasLive := e.rtm.trafficData[h3Index]
+    var liveSpeed float64
+    var liveAge time.Duration
+    if hasLive {
+        liveSpeed = live.Speed
+        liveAge = e.now().Sub(live.LastUpdated)
+    }
+    e.rtm.mu.RUnlock()
+
+    if ahead := at.Sub(e.now()); ahead > 0 {
+        liveAge += ahead
+    }
+    hasLive = hasLive && liveSpeed > 0
+
+    switch {
+    case hasLive && liveAge <= trafficStaleAfter:
+        return liveSpeed, liveSpeedSigma, SpeedSourceLive
+    case hasLive && hasHist:
+        weight := math.Exp(-float64(liveAge-trafficStaleAfter) / float64(trafficStaleAfter))
+        speed = weight*liveSpeed + (1-weight)*histSpeed
+        sigma = weight*liveSpeedSigma + (1-weight)*histSigma
+        return speed, sigma, SpeedSourceBlended
+    case hasHist:
+        return histSpeed, histSigma, SpeedSourceHistorical
+    case hasLive:
+        // Old live data with nothing to compare it against is still better
+        // than a guess, but not by much
+        return liveSpeed, defaultSpeedSigma, SpeedSourceBlended
+    default:
+        return freeFlowSpeedKmh, defaultSpeedSigma, SpeedSourceDefault
+    }
+}
+
+// EstimateCells estimates the time to travel through a sequence of cells.
+// Each hop between cell centres is split evenly between the two cells.
+func (e *TravelTimeEstimator) EstimateCells(cells []string, departAt time.Time) TravelTimeEstimate {
+    estimate := TravelTimeEstimate{DepartAt: departAt}
+    if len(cells) == 0 {
+        return estimate
+    }
+
+    distances := make([]float64, len(cells))
+    for i := 1; i < len(cells); i++ {
+        a := h3.Cell(h3.IndexFromString(cells[i-1]))
+        b := h3.Cell(h3.IndexFromString(cells[i]))
+        if !a.IsValid() || !b.IsValid() {
+            continue
+        }
+        hop := h3.GreatCircleDistanceKm(a.LatLng(), b.LatLng()) * routeCircuity
+        distances[i-1] += hop / 2
+        distances[i] += hop / 2
+    }
+
+    // Uncertainty is combined half as independent and half as fully
+    // correlated between cells, since congestion tends to spread
+    var variance, correlated float64
+    elapsed := time.Duration(0)
+    for i, cell := range cells {
+        speed, sigma, source := e.cellSpeed(cell, departAt.Add(elapsed))
+        speed = math.Max(speed, minSegmentSpeedKmh)
+
+        hours := distances[i] / speed
+        duration := time.Duration(hours * float64(time.Hour))
+        estimate.Segments = append(estimate.Segments, SegmentEstimate{
+            H3Index:    cell,
+            DistanceKm: distances[i],
+            SpeedKmh:   speed,
+            Source:     source,
+            Duration:   duration,
+        })
+
+        elapsed += duration
+        estimate.DistanceKm += distances[i]
+        spread := float64(duration) * sigma
+        variance += spread * spread
+        correlated += spread
+    }
+
+    spread := etaBandSigmas * (math.Sqrt(variance) + correlated) / 2
+    estimate.Duration = elapsed
+    estimate.Lower = time.Duration(math.Max(0, float64(elapsed)-spread))
+    estimate.Upper = time.Duration(float64(elapsed) + spread)
+    return estimate
+}
+
+// EstimateRoute estimates the end-to-end travel time of a route
+func (e *TravelTimeEstimator) EstimateRoute(route Route, departAt time.Time) TravelTimeEstimate {
+    return e.EstimateCells(routeCells(route), departAt)
+}
+
+// JourneyOption is one way to make a journey on a single route
+type JourneyOption struct {
+    RouteID     string             `json:"route_id"`
+    RouteNumber string             `json:"route_number"`
+    WalkToKm    float64            `json:"walk_to_pickup_km"`
+    WalkFromKm  float64            `json:"walk_from_drop_off_km"`
+    Wait        time.Duration      `json:"expected_wait"`
+    InVehicle   TravelTimeEstimate `json:"in_vehicle"`
+    Total       time.Duration      `json:"total"`
+    Lower       time.Duration      `json:"total_lower"`
+    Upper       time.Duration      `json:"total_upper"`
+}
+
+// JourneyPlan lists the options for getting between two points, fastest first
+type JourneyPlan struct {
+    From     Location        `json:"from"`
+    To       Location        `json:"to"`
+    DepartAt time.Time       `json:"depart_at"`
+    Options  []JourneyOption `json:"options"`
+}
+
+// PlanJourney finds routes picking up near from and dropping off near to,
+// and estimates the door-to-door time on each
+func (rtm *RealTimeManager) PlanJourney(ctx context.Context, from, to Location, departAt time.Time) (*JourneyPlan, error) {
+    routes, err := SearchRoutes(ctx, rtm.dgraph, SearchCriteria{
+        NearLocation: &from,
+        MaxDistance:  maxWalkKm * 1000,
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    plan := &JourneyPlan{From: from, To: to, DepartAt: departAt}
+    for _, route := range routes {
+        walkTo := calculateDistance(from.Lat, from.Lng, route.PickupLat, route.PickupLng) / 1000
+        walkFrom := calculateDistance(route.DestLat, route.DestLng, to.Lat, to.Lng) / 1000
+        if walkTo > maxWalkKm || walkFrom > maxWalkKm {
+            continue
+        }
+
+        walkToTime := time.Duration(walkTo / walkingSpeedKmh * float64(time.Hour))
+        walkFromTime := time.Duration(walkFrom / walkingSpeedKmh * float64(time.Hour))
+        wait := expectedWait(route, departAt.Add(walkToTime))
+        ride := rtm.estimator.EstimateRoute(route, departAt.Add(walkToTime+wait))
+
+        fixed := walkToTime + wait + walkFromTime
+        plan.Options = append(plan.Options, JourneyOption{
+            RouteID:     route.Uid,
+            RouteNumber: route.RouteNumber,
+            WalkToKm:    walkTo,
+            WalkFromKm:  walkFrom,
+            Wait:        wait,
+            InVehicle:   ride,
+            Total:       fixed + ride.Duration,
+            Lower:       fixed + ride.Lower,
+            Upper:       fixed + ride.Upper,
+        })
+    }
+
+    sort.Slice(plan.Options, func(i, j int) bool {
+        return plan.Options[i].Total < plan.Options[j].Total
+    })
+    return plan, nil
+}
+
+// expectedWait is half the scheduled headway in force at a time
+func expectedWait(route Route, at time.Time) time.Duration {
+    clock := at.Local().Format("15:04")
+    for _, s := range route.Schedule {
+        if s.Frequency > 0 && s.StartTime <= clock && clock < s.EndTime {
+            return time.Duration(s.Frequency) * time.Minute / 2
+        }
+    }
+    return defaultHeadwayMinutes * time.Minute / 2
+}
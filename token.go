@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"motown/auth"
+)
+
+var ErrInvalidToken = auth.ErrInvalidToken
+
+// TokenInfo describes an issued or verified token
+type TokenInfo struct {
+	Token     string    `json:"token,omitempty"`
+	ID        string    `json:"id,omitempty"`
+	Subject   string    `json:"subject"`
+	Role      string    `json:"role,omitempty"`
+	Vehicle   string    `json:"vehicle,omitempty"`
+	Sacco     string    `json:"sacco,omitempty"`
+	Issuer    string    `json:"issuer"`
+	Audience  string    `json:"audience"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Valid     bool      `json:"valid"`
+}
+
+// KeyInfo describes a generated signing key
+type KeyInfo struct {
+	ID        string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Path      string `json:"path,omitempty"`
+	Public    string `json:"public_path,omitempty"`
+}
+
+// authService is the token service configured by the AUTH_* settings, or
+// JWT_SECRET
+func authService() (*auth.Service, error) {
+	config, err := auth.LoadConfig(viper.GetString)
+	if errors.Is(err, auth.ErrNoKeys) {
+		return nil, fmt.Errorf("%w: %v", ErrNotConfigured, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return auth.NewService(config)
+}
+
+func newTokenInfo(token string, claims *auth.Claims) *TokenInfo {
+	return &TokenInfo{
+		Token:     token,
+		ID:        claims.Id,
+		Subject:   claims.Subject,
+		Role:      claims.Role,
+		Vehicle:   claims.Vehicle,
+		Sacco:     claims.Sacco,
+		Issuer:    claims.Issuer,
+		Audience:  claims.Audience,
+		IssuedAt:  time.Unix(claims.IssuedAt, 0),
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		Valid:     true,
+	}
+}
+
+func (t *TokenInfo) String() string {
+	var b strings.Builder
+	if t.Token != "" {
+		fmt.Fprintln(&b, t.Token)
+		return b.String()
+	}
+	fmt.Fprintln(&b, "Token is valid")
+	fmt.Fprintf(&b, "  Subject:  %s\n", t.Subject)
+	fmt.Fprintf(&b, "  Role:     %s\n", t.Role)
+	if t.Vehicle != "" {
+		fmt.Fprintf(&b, "  Vehicle:  %s\n", t.Vehicle)
+	}
+	if t.Sacco != "" {
+		fmt.Fprintf(&b, "  SACCO:    %s\n", t.Sacco)
+	}
+	fmt.Fprintf(&b, "  Issuer:   %s\n", t.Issuer)
+	fmt.Fprintf(&b, "  Audience: %s\n", t.Audience)
+	fmt.Fprintf(&b, "  Expires:  %s\n", t.ExpiresAt.Format(time.RFC1123))
+	return b.String()
+}
+
+func (k *KeyInfo) String() string {
+	if k.Path == "" {
+		return ""
+	}
+	text := fmt.Sprintf("Wrote %s key %s to %s\n", k.Algorithm, k.ID, k.Path)
+	if k.Public != "" {
+		text += fmt.Sprintf("Wrote its public key to %s\n", k.Public)
+	}
+	return text
+}
+
+// runTokenCommand issues and verifies JWTs, and makes signing keys:
+//
+//	motown token issue --subject id [--role rider] [--vehicle id] [--sacco id] [--ttl 15m]
+//	motown token verify <token>   (or the token on stdin)
+//	motown token keygen --kid id [--alg RS256] [--out path]
+//
+// To rotate keys, generate a key, add it to AUTH_KEYS and point
+// AUTH_SIGNING_KEY at it. Keep the old key listed, by its public key if it
+// has one, until the tokens it signed have expired.
+func runTokenCommand(ctx context.Context, out *output, args []string) error {
+	if len(args) == 0 {
+		return usagef("token needs issue, verify or keygen")
+	}
+
+	flags := newFlagSet("token "+args[0], out)
+	subject := flags.String("subject", "", "who the token is for")
+	role := flags.String("role", auth.RoleRider, "the role the subject acts in: rider, conductor, sacco_admin or admin")
+	vehicle := flags.String("vehicle", "", "the vehicle a conductor works")
+	sacco := flags.String("sacco", "", "the SACCO a SACCO admin runs")
+	ttl := flags.Duration("ttl", 0, "how long the token lasts (AUTH_TOKEN_TTL, or 15m)")
+	kid := flags.String("kid", "", "id of the key to generate")
+	algorithm := flags.String("alg", auth.RS256, "algorithm of the key to generate: RS256, ES256 or HS256")
+	path := flags.String("out", "", "file to write the generated key to (stdout if unset)")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+
+	if args[0] == "keygen" {
+		return generateKey(out, *kid, *algorithm, *path)
+	}
+
+	service, err := authService()
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "issue":
+		if *ttl < 0 {
+			return usagef("--ttl must be positive")
+		}
+		who := auth.Identity{Subject: *subject, Role: *role, Vehicle: *vehicle, Sacco: *sacco}
+		token, claims, err := service.Issue(who, *ttl)
+		if err != nil {
+			return usagef("%v", err)
+		}
+		return out.emit(newTokenInfo(token, claims), token+"\n")
+
+	case "verify":
+		tokenString := flags.Arg(0)
+		if tokenString == "" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return usagef("verify needs a token as an argument or on stdin")
+			}
+			tokenString = strings.TrimSpace(line)
+		}
+		claims, err := service.Verify(tokenString)
+		if err != nil {
+			return err
+		}
+		info := newTokenInfo("", claims)
+		return out.emit(info, info.String())
+
+	default:
+		return usagef("unknown token command %q; use issue, verify or keygen", args[0])
+	}
+}
+
+// generateKey writes a new signing key, and the public key beside it for
+// RS256 and ES256
+func generateKey(out *output, kid, algorithm, path string) error {
+	if kid == "" {
+		return usagef("keygen needs --kid")
+	}
+	key, err := auth.GenerateKey(kid, algorithm)
+	if err != nil {
+		return usagef("%v", err)
+	}
+	private, err := key.PrivatePEM()
+	if err != nil {
+		return err
+	}
+
+	info := &KeyInfo{ID: key.ID, Algorithm: key.Algorithm}
+	if path == "" {
+		if out.json {
+			return usagef("keygen --json needs --out")
+		}
+		_, err := out.stdout.Write(private)
+		return err
+	}
+	if err := os.WriteFile(path, private, 0600); err != nil {
+		return err
+	}
+	info.Path = path
+	if public, err := key.PublicPEM(); err == nil {
+		info.Public = strings.TrimSuffix(path, ".pem") + ".pub.pem"
+		if err := os.WriteFile(info.Public, public, 0644); err != nil {
+			return err
+		}
+	}
+	return out.emit(info, info.String())
+}